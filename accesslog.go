@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+var accessLog io.Writer
+
+// StatusWriter records the status code and body size of a response
+type StatusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+//
+func (sw *StatusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+//
+func (sw *StatusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+//
+func (sw *StatusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//
+func (sw *StatusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	sw.status = http.StatusSwitchingProtocols
+	return hijackThrough(sw.ResponseWriter)
+}
+
+//
+//
+
+// RotatingFile is an append-only file that is renamed to NAME.1, NAME.2, etc once it grows past maxSize
+type RotatingFile struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+//
+func NewRotatingFile(path string, maxSizeMB int, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxSize: int64(maxSizeMB) * 1024 * 1024, maxBackups: maxBackups}
+	return rf, rf.open()
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, _ := f.Stat()
+	rf.file = f
+	rf.size = info.Size()
+	return nil
+}
+
+//
+func (rf *RotatingFile) Write(b []byte) (int, error) {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.maxSize > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		rf.rotate()
+	}
+	n, err := rf.file.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) rotate() {
+	rf.file.Close()
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		os.Rename(rf.path+"."+strconv.Itoa(i), rf.path+"."+strconv.Itoa(i+1))
+	}
+	if rf.maxBackups > 0 {
+		os.Rename(rf.path, rf.path+".1")
+	} else {
+		os.Remove(rf.path)
+	}
+	rf.open()
+}
+
+// rewrite passes every line of the file and of its backups through edit, which returns the line
+// to keep in its place
+func (rf *RotatingFile) rewrite(edit func(string) string) error {
+	rf.Lock()
+	defer rf.Unlock()
+	rf.file.Close()
+	defer rf.open()
+	for i := 0; i <= rf.maxBackups; i++ {
+		name := rf.path
+		if i > 0 {
+			name += "." + strconv.Itoa(i)
+		}
+		bys, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		lines := strings.SplitAfter(string(bys), "\n")
+		for j, item := range lines {
+			if len(item) > 0 {
+				lines[j] = edit(strings.TrimSuffix(item, "\n")) + "\n"
+			}
+		}
+		if err := ioutil.WriteFile(name+".tmp", []byte(strings.Join(lines, "")), 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(name+".tmp", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+//
+
+func initAccessLog(cfg *ConfigAccessLog) error {
+	if cfg == nil {
+		return nil
+	}
+	switch cfg.Format {
+	case "":
+		cfg.Format = AccessLogCombined
+	case AccessLogCombined, AccessLogJSON:
+	default:
+		return E(F("Invalid access_log format '%s', must be one of '%s', '%s'", cfg.Format, AccessLogCombined, AccessLogJSON))
+	}
+	if len(cfg.Path) == 0 || cfg.Path == "-" {
+		accessLog = os.Stdout
+		return nil
+	}
+	rf, err := NewRotatingFile(cfg.Path, cfg.MaxSize, cfg.MaxBackups)
+	if err != nil {
+		return err
+	}
+	accessLog = rf
+	return nil
+}
+
+// scrubAccessLog replaces snowflake and the IP of their requests in the access log file and its
+// backups. A log sent to stdout is out of reach.
+func scrubAccessLog(snowflake string) {
+	rf, ok := accessLog.(*RotatingFile)
+	if !ok {
+		return
+	}
+	err := rf.rewrite(func(line string) string {
+		if config.AccessLog.Format == AccessLogJSON {
+			v := map[string]interface{}{}
+			if json.Unmarshal([]byte(line), &v) != nil || v["user"] != snowflake {
+				return line
+			}
+			v["user"] = erasedSnowflake
+			v["ip"] = ""
+			bytes, _ := json.Marshal(v)
+			return string(bytes)
+		}
+		parts := strings.SplitN(line, " ", 4)
+		if len(parts) < 4 || parts[2] != snowflake {
+			return line
+		}
+		return "- - " + erasedSnowflake + " " + parts[3]
+	})
+	if err != nil {
+		LogError("[access-log]", "scrubbing:", err.Error())
+	}
+}
+
+func mwAccessLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if accessLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &StatusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		user := "-"
+		if u, ok := getSession(r).Values["user"].(string); ok {
+			user = u
+		}
+		if config.AccessLog.Format == AccessLogJSON {
+			bytes, _ := json.Marshal(map[string]interface{}{
+				"time":     start.UTC().Format(time.RFC3339),
+				"ip":       clientIPForStorage(r),
+				"user":     user,
+				"method":   r.Method,
+				"path":     r.URL.RequestURI(),
+				"status":   sw.status,
+				"bytes":    sw.bytes,
+				"duration": time.Since(start).Seconds(),
+				"referer":  r.Referer(),
+				"agent":    r.UserAgent(),
+			})
+			accessLog.Write(append(bytes, '\n'))
+			return
+		}
+		accessLog.Write([]byte(F("%s - %s [%s] \"%s %s %s\" %d %d %q %q\n",
+			clientIPForStorage(r), user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, r.URL.RequestURI(), r.Proto, sw.status, sw.bytes, r.Referer(), r.UserAgent())))
+	}
+}
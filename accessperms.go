@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// what an access grant allows besides reading, grants from before these were added only read
+const (
+	AccessWrite  = "write"
+	AccessDelete = "delete"
+)
+
+var allAccessPerms = []string{AccessWrite, AccessDelete}
+
+// parseAccessPerms normalizes a comma separated list of access permissions. Empty is read only.
+func parseAccessPerms(v string) (string, error) {
+	found := map[string]bool{}
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(strings.ToLower(item))
+		if len(item) == 0 || item == "read" {
+			continue
+		}
+		if !Contains(allAccessPerms, item) {
+			return "", E(F("'%s' is not one of read, write, delete", item))
+		}
+		found[item] = true
+	}
+	result := []string{}
+	for k := range found {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return strings.Join(result, ","), nil
+}
+
+// hasPathPerm returns true if one of the grants covering fpath allows perm. Admins may change
+// anything they can read.
+func hasPathPerm(user UserRow, grants []UserAccessRow, fpath string, perm string) bool {
+	if isHiddenPath(fpath) {
+		return false
+	}
+	for _, item := range grants {
+		if !pathHasPrefix(fpath, item.path) {
+			continue
+		}
+		if user.admin || Contains(strings.Split(item.perms, ","), perm) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// states of an access request
+const (
+	RequestPending  = "pending"
+	RequestApproved = "approved"
+	RequestDenied   = "denied"
+)
+
+// a user may only have this many requests waiting at once
+const maxPendingRequests = 20
+
+// AccessRequestRow is a request by a user for access to a path
+type AccessRequestRow struct {
+	id      int
+	user    int
+	path    string
+	reason  string
+	created string
+	status  string
+	decided string
+	decider string
+	note    string
+	seen    bool
+}
+
+const accessRequestColumns = "id, user, path, reason, created, status, coalesce(decided, ''), coalesce(decider, ''), coalesce(note, ''), seen"
+
+func scanAccessRequest(rows *sql.Rows) AccessRequestRow {
+	var v AccessRequestRow
+	rows.Scan(&v.id, &v.user, &v.path, &v.reason, &v.created, &v.status, &v.decided, &v.decider, &v.note, &v.seen)
+	return v
+}
+
+// queryAccessRequests reads the requests matching clause, which is fixed text from our own code
+func queryAccessRequests(clause string, args ...interface{}) []AccessRequestRow {
+	result := []AccessRequestRow{}
+	rows, err := database.QueryPrepared(false, "select "+accessRequestColumns+" from access_requests "+clause, args...)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		result = append(result, scanAccessRequest(rows))
+	}
+	rows.Close()
+	return result
+}
+
+func queryAccessRequestByID(id int) (AccessRequestRow, bool) {
+	list := queryAccessRequests("where id = ?", id)
+	if len(list) == 0 {
+		return AccessRequestRow{}, false
+	}
+	return list[0], true
+}
+
+func accessRequestList(rows []AccessRequestRow) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	users := map[int]UserRow{}
+	for _, item := range rows {
+		if _, ok := users[item.user]; !ok {
+			users[item.user], _ = queryUserByID(item.user)
+		}
+		result = append(result, map[string]interface{}{
+			"id":        item.id,
+			"snowflake": users[item.user].snowflake,
+			"name":      users[item.user].name,
+			"path":      item.path,
+			"reason":    item.reason,
+			"created":   item.created,
+			"status":    item.status,
+			"decided":   item.decided,
+			"decider":   item.decider,
+			"note":      item.note,
+		})
+	}
+	return result
+}
+
+// accessRequestNotices returns a message for each decision the user has not dismissed yet
+func accessRequestNotices(user UserRow) []string {
+	result := []string{}
+	for _, item := range queryAccessRequests("where user = ? and status != ? and seen = 0", user.id, RequestPending) {
+		msg := F("Your request for access to %s was %s.", item.path, item.status)
+		if len(item.note) > 0 {
+			msg += " " + item.note
+		}
+		result = append(result, msg)
+	}
+	return result
+}
+
+// requestableFolders are the folders of the root offered on the request page, when the config
+// allows showing them
+func requestableFolders(uAccess []string) []string {
+	result := []string{}
+	if !config.AccessRequests.ListFolders {
+		return result
+	}
+	files, err := rootDir.ReadDir("/")
+	if err != nil {
+		return result
+	}
+	for _, item := range files {
+		p := "/" + item.Name() + "/"
+		if !item.IsDir() || strings.HasPrefix(item.Name(), ".") || hasPathAccess(uAccess, p) {
+			continue
+		}
+		result = append(result, p)
+	}
+	sort.Strings(result)
+	return result
+}
+
+//
+//
+
+// handler for http://andesite/requests
+func handleAccessRequests(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		return
+	}
+	list := accessRequestList(queryAccessRequests("where user = ? order by id desc", user.id))
+	if wantsJSON(r) {
+		writeJSON(w, map[string]interface{}{
+			"response": "good",
+			"requests": list,
+		})
+		return
+	}
+	writeHandlebarsFile(r, w, "/requests.hbs", map[string]interface{}{
+		"user":     user.snowflake,
+		"base":     httpBase,
+		"name":     displayName(user.snowflake, user.name),
+		"admin":    user.admin,
+		"requests": list,
+		"path":     r.URL.Query().Get("path"),
+		"folders":  requestableFolders(queryAccess(user)),
+	})
+}
+
+// handler for http://andesite/api/requests/seen
+func handleAccessRequestSeen(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	database.QueryPrepared(true, "update access_requests set seen = 1 where user = ? and status != ?", user.id, RequestPending)
+	writeAPIResponse(r, w, true, "Dismissed the decisions on your access requests.")
+}
+
+// handler for http://andesite/api/requests/create
+func handleAccessRequestCreate(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "path", Kind: FieldPath},
+		FormField{Name: "reason", Kind: FieldString, MaxLen: 512, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	fpath := vf.Get("path")
+	if !strings.HasSuffix(fpath, "/") {
+		fpath += "/"
+	}
+	if hasPathAccess(queryAccess(user), fpath) {
+		writeAPIResponse(r, w, false, F("You already have access to %s", fpath))
+		return
+	}
+	pending := queryAccessRequests("where user = ? and status = ?", user.id, RequestPending)
+	if len(pending) >= maxPendingRequests {
+		writeAPIResponse(r, w, false, "You have too many requests waiting for an admin already")
+		return
+	}
+	for _, item := range pending {
+		if item.path == fpath {
+			writeAPIResponse(r, w, false, F("You already requested access to %s", fpath))
+			return
+		}
+	}
+	id, err := database.QueryNextID("access_requests")
+	if err != nil {
+		writeAPIResponse(r, w, false, F("Your request could not be saved: %s", err.Error()))
+		return
+	}
+	database.QueryPrepared(true, "insert into access_requests (id, user, path, reason, created, status, seen) values (?, ?, ?, ?, ?, ?, 0)", id, user.id, fpath, vf.Get("reason"), timeNow(), RequestPending)
+	auditLog(r, user.snowflake, "request.create", user.snowflake, fpath)
+	fields := []DiscordField{discordUserField("User", user), {"Path", fpath, true}}
+	if len(vf.Get("reason")) > 0 {
+		fields = append(fields, DiscordField{"Reason", vf.Get("reason"), false})
+	}
+	postDiscord(r, DiscordEventRequest, "Access requested", fields)
+	writeAPIResponse(r, w, true, F("Requested access to %s, an admin will review it.", fpath))
+}
+
+// handler for http://andesite/api/admin/requests
+func handleAdminAccessRequests(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if len(status) == 0 {
+		status = RequestPending
+	}
+	limit, offset := pageParams(r, 200)
+	rows := queryAccessRequests("where status = ? order by id desc limit ? offset ?", status, limit, offset)
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"requests": accessRequestList(rows),
+	})
+}
+
+// handler for http://andesite/api/admin/requests/approve
+func handleAccessRequestApprove(w http.ResponseWriter, r *http.Request) {
+	decideAccessRequest(w, r, RequestApproved, "request.approve")
+}
+
+// handler for http://andesite/api/admin/requests/deny
+func handleAccessRequestDeny(w http.ResponseWriter, r *http.Request) {
+	decideAccessRequest(w, r, RequestDenied, "request.deny")
+}
+
+func decideAccessRequest(w http.ResponseWriter, r *http.Request, status string, action string) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "id", Kind: FieldInt},
+		FormField{Name: "note", Kind: FieldString, MaxLen: 512, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	req, ok := queryAccessRequestByID(vf.Int("id"))
+	if !ok || req.status != RequestPending {
+		writeAPIResponse(r, w, false, "Request does not exist or was already decided")
+		return
+	}
+	user, ok := queryUserByID(req.user)
+	if !ok {
+		writeAPIResponse(r, w, false, "User does not exist")
+		return
+	}
+	if status == RequestApproved && !hasPathAccess(queryAccess(user), req.path) {
+		aid, err := database.QueryNextID("access")
+		if err != nil {
+			writeAPIResponse(r, w, false, F("Access to %s could not be given: %s", req.path, err.Error()))
+			return
+		}
+		database.QueryPrepared(true, "insert into access (id, user, path) values (?, ?, ?)", aid, user.id, req.path)
+		auditLog(r, admin.snowflake, "access.create", user.snowflake, req.path)
+	}
+	database.QueryPrepared(true, "update access_requests set status = ?, decided = ?, decider = ?, note = ?, seen = 0 where id = ?", status, timeNow(), admin.snowflake, vf.Get("note"), req.id)
+	auditLog(r, admin.snowflake, action, user.snowflake, req.path)
+	mailUser(user, "request_decided", map[string]interface{}{
+		"path":     req.path,
+		"status":   status,
+		"approved": status == RequestApproved,
+		"note":     vf.Get("note"),
+	})
+	writeAPIResponse(r, w, true, F("The request of %s for %s was %s.", user.snowflake, req.path, status))
+}
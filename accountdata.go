@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// erasedSnowflake replaces the snowflake of an erased user wherever a record of them is kept
+const erasedSnowflake = "[erased]"
+
+// userDataExport is everything Andesite keeps about user
+func userDataExport(user UserRow) (map[string]interface{}, error) {
+	passkeys := []map[string]interface{}{}
+	for _, item := range queryPasskeysOf(user.id) {
+		passkeys = append(passkeys, map[string]interface{}{
+			"name":    item.name,
+			"created": item.created,
+			"used":    item.used,
+		})
+	}
+	downloads := []DownloadRow{}
+	rows, err := database.QueryPrepared(false, "select time, path, bytes, coalesce(ip, '') from downloads where user = ? order by id", user.id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		v := DownloadRow{User: user.snowflake}
+		rows.Scan(&v.Time, &v.Path, &v.Bytes, &v.IP)
+		downloads = append(downloads, v)
+	}
+	rows.Close()
+	audit := []AuditEvent{}
+	rows, err = database.QueryPrepared(false, "select time, actor, action, coalesce(target, ''), coalesce(ip, ''), coalesce(detail, ''), failed from audit where actor = ? or target = ? order by id", user.snowflake, user.snowflake)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ev AuditEvent
+		rows.Scan(&ev.Time, &ev.Actor, &ev.Action, &ev.Target, &ev.IP, &ev.Detail, &ev.Failed)
+		audit = append(audit, ev)
+	}
+	rows.Close()
+	shares := []map[string]interface{}{}
+	rows, err = database.QueryPrepared(false, "select "+shareColumns+" from shares where creator = ? order by id", user.snowflake)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		item := scanShare(rows)
+		shares = append(shares, map[string]interface{}{
+			"hash":    item.hash,
+			"path":    item.path,
+			"perms":   item.perms,
+			"expires": item.expires,
+		})
+	}
+	rows.Close()
+	storage, bandwidth := userQuotas(user)
+	return map[string]interface{}{
+		"user": map[string]interface{}{
+			"snowflake":       user.snowflake,
+			"name":            user.name,
+			"provider":        user.provider,
+			"admin":           user.admin,
+			"last_login":      user.lastLogin,
+			"email":           user.email,
+			"enabled":         user.enabled,
+			"suspend_reason":  user.suspendReason,
+			"quota_storage":   storage,
+			"quota_bandwidth": bandwidth,
+			"quota_speed":     userSpeedLimit(user),
+			"stored":          user.stored,
+		},
+		"access":          queryAccess(user),
+		"shares":          shares,
+		"sessions":        sessionList(querySessionsOf(user.id), ""),
+		"passkeys":        passkeys,
+		"access_requests": accessRequestList(queryAccessRequests("where user = ? order by id", user.id)),
+		"downloads":       downloads,
+		"audit":           audit,
+		"exported":        timeNow(),
+	}, nil
+}
+
+// eraseUser deletes user and replaces their snowflake and IP in the records that are kept about
+// others, such as the audit log. Copies already sent to audit sinks are not touched.
+func eraseUser(user UserRow) {
+	queryDeleteUser(user)
+	scrubSnowflake(user.snowflake)
+}
+
+func scrubSnowflake(snowflake string) {
+	// the IP and detail of events the user is only the target of belong to whoever acted on them
+	database.QueryPrepared(true, "update audit set actor = ?, ip = '', detail = '' where actor = ?", erasedSnowflake, snowflake)
+	database.QueryPrepared(true, "update audit set target = ? where target = ?", erasedSnowflake, snowflake)
+	database.QueryPrepared(true, "update access_requests set decider = ? where decider = ?", erasedSnowflake, snowflake)
+	database.QueryPrepared(true, "update invites set creator = ? where creator = ?", erasedSnowflake, snowflake)
+	database.QueryPrepared(true, "update trash set deleter = ? where deleter = ?", erasedSnowflake, snowflake)
+	database.QueryPrepared(true, "update shares set creator = ? where creator = ?", erasedSnowflake, snowflake)
+	scrubAccessLog(snowflake)
+}
+
+//
+//
+
+// handler for http://andesite/api/account/export
+func handleAccountExport(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		return
+	}
+	data, err := userDataExport(user)
+	if err != nil {
+		writeAPIResponse(r, w, false, "Could not read your data, try again later")
+		return
+	}
+	auditLog(r, user.snowflake, "user.export", user.snowflake, "")
+	name := strings.NewReplacer("/", "_", ":", "_", "\"", "_").Replace(user.snowflake)
+	w.Header().Set("Content-Disposition", F(`attachment; filename="andesite-%s.json"`, name))
+	data["response"] = "good"
+	writeJSON(w, data)
+}
+
+// handler for http://andesite/api/account/delete
+func handleAccountDelete(w http.ResponseWriter, r *http.Request) {
+	sess, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	if user.admin && queryAdminCount() <= 1 {
+		writeAPIResponse(r, w, false, "The last administrator can not delete their account")
+		return
+	}
+	changes := []string{
+		F("Delete your account %s (%s)", user.name, user.snowflake),
+		"Remove all of your access, passwords, passkeys, sessions, basket, unfinished uploads, downloads, access requests, and share links",
+		"Erase your name and IP from the audit log and access log",
+		"Log you out",
+	}
+	if !requireConfirmation(r, w, user, changes) {
+		return
+	}
+	eraseUser(user)
+	auditLog(r, erasedSnowflake, "user.erase", erasedSnowflake, "")
+	sess.Values = map[interface{}]interface{}{}
+	sess.Options.MaxAge = -1
+	sess.Save(r, w)
+	writeAPIResponse(r, w, true, "Your account and everything about it has been deleted.")
+}
+
+// handler for http://andesite/api/admin/users/purge
+func handleUserPurge(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128})
+	if !ok {
+		return
+	}
+	snowflake := vf.Get("snowflake")
+	if snowflake == admin.snowflake || snowflake == erasedSnowflake {
+		writeAPIResponse(r, w, false, "You can not purge yourself")
+		return
+	}
+	// users that were already deleted still have activity to scrub
+	user, exists := queryUserBySnowflake(snowflake)
+	changes := []string{}
+	if exists {
+		if user.admin && user.enabled && queryAdminCount() <= 1 {
+			writeAPIResponse(r, w, false, "Can not purge the last administrator")
+			return
+		}
+		changes = append(changes, F("Delete user %s (%s) with their access, passkeys, sessions, basket, unfinished uploads, downloads, access requests, and share links", user.name, snowflake))
+	}
+	changes = append(changes, F("Erase %s and their IPs from the audit log, access log, access requests, invites, share links, and trash", snowflake))
+	if !requireConfirmation(r, w, admin, changes) {
+		return
+	}
+	if exists {
+		queryDeleteUser(user)
+	}
+	scrubSnowflake(snowflake)
+	auditLog(r, admin.snowflake, "user.purge", erasedSnowflake, "")
+	writeAPIResponse(r, w, true, F("Purged %s.", snowflake))
+}
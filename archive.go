@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// ArchiveWriter streams the files of a directory download in one format
+type ArchiveWriter interface {
+	Add(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+// ArchiveFormat is a value of ?archive= on a directory
+type ArchiveFormat struct {
+	Ext         string
+	ContentType string
+	New         func(w io.Writer) (ArchiveWriter, error)
+}
+
+var archiveFormats = map[string]ArchiveFormat{
+	"zip":     {".zip", "application/zip", newZipArchive},
+	"tar.zst": {".tar.zst", "application/zstd", newTarZstArchive},
+}
+
+// handleArchive writes the files below qpath that uAccess allows as an archive. Errors after the
+// first byte can only be logged, the client sees a truncated download.
+func handleArchive(w http.ResponseWriter, r *http.Request, qpath string, uAccess []string, uID string, format string) {
+	af, ok := archiveFormats[format]
+	if !ok {
+		writeResponse(r, w, "Unknown Format", F("'%s' is not an archive format, use 'zip' or 'tar.zst'.", format), "")
+		return
+	}
+	user, isUser := downloadUser(r, uID)
+	if isUser && !checkBandwidthQuota(r, w, user) {
+		return
+	}
+	release, ok := acquireDownload(r, w)
+	if !ok {
+		return
+	}
+	defer release()
+	sw := &StatusWriter{ResponseWriter: w}
+	w = throttleWriter(sw, downloadSpeed(user, isUser))
+	if isUser {
+		defer logDownload(r, user, qpath, sw)
+	}
+	name := path.Base(strings.TrimSuffix(qpath, "/"))
+	if name == "/" || name == "." {
+		name = "root"
+	}
+	w.Header().Set("Content-Type", af.ContentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+strings.Replace(name, "\"", "", -1)+af.Ext+"\"")
+	aw, err := af.New(w)
+	if err != nil {
+		LogError("[archive]", qpath, err.Error())
+		return
+	}
+	if err := archiveDir(aw, qpath, name+"/", uAccess); err != nil {
+		LogError("[archive]", qpath, err.Error())
+		return
+	}
+	if err := aw.Close(); err != nil {
+		LogError("[archive]", qpath, err.Error())
+	}
+}
+
+// archiveDir adds the contents of fpath under prefix, skipping hidden and ignored files and
+// anything the user may not read. Symlinked directories are not followed.
+func archiveDir(aw ArchiveWriter, fpath string, prefix string, uAccess []string) error {
+	files, err := rootDir.ReadDir(fpath)
+	if err != nil {
+		return err
+	}
+	rules := ignoreRulesFor(fpath)
+	for _, item := range files {
+		p := fpath + item.Name()
+		if isHiddenEntry(rules, p, item.IsDir()) {
+			continue
+		}
+		if item.IsDir() {
+			if !hasPathAccess(uAccess, p+"/") && !archiveHasAccessBelow(uAccess, p+"/") {
+				continue
+			}
+			if err := archiveDir(aw, p+"/", prefix+item.Name()+"/", uAccess); err != nil {
+				return err
+			}
+			continue
+		}
+		if !hasPathAccess(uAccess, p) {
+			continue
+		}
+		info, err := rootDir.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		f, err := rootDir.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		err = aw.Add(prefix+item.Name(), info, f)
+		if c, ok := f.(io.Closer); ok {
+			c.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveHasAccessBelow returns true if the user was given access to a folder inside dir
+func archiveHasAccessBelow(uAccess []string, dir string) bool {
+	for _, item := range uAccess {
+		if strings.HasPrefix(item, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+//
+
+// ZipArchive stores files uncompressed, as most of a file server is already compressed media.
+// archive/zip switches to ZIP64 by itself for members over 4 GB and more than 65535 entries.
+type ZipArchive struct {
+	zw *zip.Writer
+}
+
+func newZipArchive(w io.Writer) (ArchiveWriter, error) {
+	return ZipArchive{zip.NewWriter(w)}, nil
+}
+
+//
+func (za ZipArchive) Add(name string, info os.FileInfo, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Store
+	fw, err := za.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+//
+func (za ZipArchive) Close() error {
+	return za.zw.Close()
+}
+
+//
+//
+
+// TarZstArchive is a tar stream compressed with zstd, which has no limits on size or entries
+type TarZstArchive struct {
+	zw *zstd.Encoder
+	tw *tar.Writer
+}
+
+func newTarZstArchive(w io.Writer) (ArchiveWriter, error) {
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		return nil, err
+	}
+	return TarZstArchive{zw, tar.NewWriter(zw)}, nil
+}
+
+//
+func (ta TarZstArchive) Add(name string, info os.FileInfo, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Uname, hdr.Gname, hdr.Uid, hdr.Gid = "", "", 0, 0
+	if err := ta.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(ta.tw, r)
+	return err
+}
+
+//
+func (ta TarZstArchive) Close() error {
+	if err := ta.tw.Close(); err != nil {
+		return err
+	}
+	return ta.zw.Close()
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/klauspost/compress/zstd"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// at most this many archives have their list of members kept in memory
+const archiveCacheSize = 64
+
+// archiveMember is a file or folder inside an archive
+type archiveMember struct {
+	name  string // its path in the archive with no leading slash, folders end in one
+	size  int64
+	mtime time.Time
+}
+
+// ArchiveBrowser reads the members of one kind of archive, without unpacking it to disk
+type ArchiveBrowser struct {
+	Suffix string
+	List   func(full string) ([]archiveMember, error)
+	Open   func(full string, name string) (io.ReadCloser, error)
+}
+
+// archiveBrowsers are the archives that can be browsed like a folder, longest suffix first
+var archiveBrowsers = []ArchiveBrowser{
+	{".tar.gz", listTar, openTar},
+	{".tar.zst", listTar, openTar},
+	{".tgz", listTar, openTar},
+	{".tar", listTar, openTar},
+	{".zip", listZip, openZip},
+	{".7z", list7z, open7z},
+}
+
+type archiveCacheEntry struct {
+	mod     time.Time
+	size    int64
+	members []archiveMember
+}
+
+var archiveCache = struct {
+	sync.Mutex
+	entries map[string]archiveCacheEntry
+}{entries: map[string]archiveCacheEntry{}}
+
+// archiveBrowserFor returns how to read the archive named name, if it is one
+func archiveBrowserFor(name string) (ArchiveBrowser, bool) {
+	lower := strings.ToLower(name)
+	for _, item := range archiveBrowsers {
+		if strings.HasSuffix(lower, item.Suffix) {
+			return item, true
+		}
+	}
+	return ArchiveBrowser{}, false
+}
+
+// memberName cleans a name from an archive, it returns false for names that try to leave it
+func memberName(name string, dir bool) (string, bool) {
+	name = strings.TrimLeft(strings.Replace(name, "\\", "/", -1), "/")
+	name = strings.TrimPrefix(name, "./")
+	clean := path.Clean(name)
+	if len(name) == 0 || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	if dir || strings.HasSuffix(name, "/") {
+		clean += "/"
+	}
+	return clean, true
+}
+
+// readCloser closes every one of closers, the member and then the archive it is in
+type readCloser struct {
+	io.Reader
+	closers []func() error
+}
+
+//
+func (rc readCloser) Close() error {
+	for _, item := range rc.closers {
+		item()
+	}
+	return nil
+}
+
+func listZip(full string) ([]archiveMember, error) {
+	zr, err := zip.OpenReader(full)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	result := []archiveMember{}
+	for _, item := range zr.File {
+		info := item.FileInfo()
+		if name, ok := memberName(item.Name, info.IsDir()); ok {
+			result = append(result, archiveMember{name, info.Size(), info.ModTime()})
+		}
+	}
+	return result, nil
+}
+
+func openZip(full string, name string) (io.ReadCloser, error) {
+	zr, err := zip.OpenReader(full)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range zr.File {
+		if n, ok := memberName(item.Name, false); ok && n == name {
+			f, err := item.Open()
+			if err != nil {
+				zr.Close()
+				return nil, err
+			}
+			return readCloser{f, []func() error{f.Close, zr.Close}}, nil
+		}
+	}
+	zr.Close()
+	return nil, os.ErrNotExist
+}
+
+// tarStream opens a tar file, decompressing it if its name says it is compressed
+func tarStream(full string) (*tar.Reader, func() error, error) {
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, nil, err
+	}
+	lower := strings.ToLower(full)
+	switch {
+	case strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz"):
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(gr), f.Close, nil
+	case strings.HasSuffix(lower, ".zst"):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(zr), func() error { zr.Close(); return f.Close() }, nil
+	}
+	return tar.NewReader(f), f.Close, nil
+}
+
+func listTar(full string) ([]archiveMember, error) {
+	tr, closer, err := tarStream(full)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+	result := []archiveMember{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeDir {
+			continue
+		}
+		if name, ok := memberName(h.Name, h.Typeflag == tar.TypeDir); ok {
+			result = append(result, archiveMember{name, h.Size, h.ModTime})
+		}
+	}
+}
+
+// openTar reads through the archive up to name, a tar can only be read from the start
+func openTar(full string, name string) (io.ReadCloser, error) {
+	tr, closer, err := tarStream(full)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			closer()
+			if err == io.EOF {
+				return nil, os.ErrNotExist
+			}
+			return nil, err
+		}
+		if n, ok := memberName(h.Name, false); ok && n == name && h.Typeflag == tar.TypeReg {
+			return readCloser{tr, []func() error{closer}}, nil
+		}
+	}
+}
+
+func list7z(full string) ([]archiveMember, error) {
+	sr, err := sevenzip.OpenReader(full)
+	if err != nil {
+		return nil, err
+	}
+	defer sr.Close()
+	result := []archiveMember{}
+	for _, item := range sr.File {
+		info := item.FileInfo()
+		if name, ok := memberName(item.Name, info.IsDir()); ok {
+			result = append(result, archiveMember{name, info.Size(), info.ModTime()})
+		}
+	}
+	return result, nil
+}
+
+func open7z(full string, name string) (io.ReadCloser, error) {
+	sr, err := sevenzip.OpenReader(full)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range sr.File {
+		if n, ok := memberName(item.Name, false); ok && n == name {
+			f, err := item.Open()
+			if err != nil {
+				sr.Close()
+				return nil, err
+			}
+			return readCloser{f, []func() error{f.Close, sr.Close}}, nil
+		}
+	}
+	sr.Close()
+	return nil, os.ErrNotExist
+}
+
+// archiveMembers returns the members of the archive at fpath, listing it again only when it changed
+func archiveMembers(fpath string, ab ArchiveBrowser) ([]archiveMember, error) {
+	info, err := rootDir.Stat(fpath)
+	if err != nil {
+		return nil, err
+	}
+	full, err := resolvePath(rootDir.Base(), fpath)
+	if err != nil {
+		return nil, err
+	}
+	archiveCache.Lock()
+	c, ok := archiveCache.entries[full]
+	archiveCache.Unlock()
+	if ok && c.mod.Equal(info.ModTime()) && c.size == info.Size() {
+		return c.members, nil
+	}
+	members, err := ab.List(full)
+	if err != nil {
+		return nil, err
+	}
+	archiveCache.Lock()
+	if len(archiveCache.entries) >= archiveCacheSize {
+		for k := range archiveCache.entries {
+			delete(archiveCache.entries, k)
+			break
+		}
+	}
+	archiveCache.entries[full] = archiveCacheEntry{info.ModTime(), info.Size(), members}
+	archiveCache.Unlock()
+	return members, nil
+}
+
+// splitArchivePath finds the archive in qpath, a path that does not exist on disk, and returns it
+// and the path inside of it, which is "" for its top
+func splitArchivePath(qpath string) (string, string, ArchiveBrowser, bool) {
+	segs := strings.Split(strings.Trim(qpath, "/"), "/")
+	p := ""
+	for i, seg := range segs {
+		p += "/" + seg
+		ab, ok := archiveBrowserFor(seg)
+		if !ok {
+			continue
+		}
+		if info, err := rootDir.Stat(p); err == nil && info.Mode().IsRegular() {
+			if i == len(segs)-1 && !strings.HasSuffix(qpath, "/") {
+				return "", "", ArchiveBrowser{}, false
+			}
+			return p, strings.TrimPrefix(qpath, p+"/"), ab, true
+		}
+	}
+	return "", "", ArchiveBrowser{}, false
+}
+
+// ArchiveMemberInfo is a member of an archive as an entry of a listing
+type ArchiveMemberInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+//
+func (v ArchiveMemberInfo) Name() string { return v.name }
+
+//
+func (v ArchiveMemberInfo) Size() int64 { return v.size }
+
+//
+func (v ArchiveMemberInfo) ModTime() time.Time { return v.mtime }
+
+//
+func (v ArchiveMemberInfo) IsDir() bool { return v.dir }
+
+//
+func (v ArchiveMemberInfo) Sys() interface{} { return nil }
+
+//
+func (v ArchiveMemberInfo) Mode() os.FileMode {
+	if v.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// archiveChildren returns the entries directly in dir of the archive. Folders that the archive
+// does not list on their own are made up from the paths of their files.
+func archiveChildren(members []archiveMember, dir string) []os.FileInfo {
+	found := map[string]*ArchiveMemberInfo{}
+	order := []string{}
+	for _, item := range members {
+		if !strings.HasPrefix(item.name, dir) || item.name == dir {
+			continue
+		}
+		rest := item.name[len(dir):]
+		name, isDir := rest, false
+		if i := strings.Index(rest, "/"); i >= 0 {
+			name, isDir = rest[:i], true
+		}
+		v, ok := found[name]
+		if !ok {
+			v = &ArchiveMemberInfo{name: name, dir: isDir}
+			found[name] = v
+			order = append(order, name)
+		}
+		if isDir {
+			v.size += item.size
+		} else {
+			v.size = item.size
+		}
+		if item.mtime.After(v.mtime) {
+			v.mtime = item.mtime
+		}
+	}
+	result := make([]os.FileInfo, len(order))
+	for i, item := range order {
+		result[i] = *found[item]
+	}
+	return result
+}
+
+// handleArchiveBrowse lists a folder inside the archive arc with listing, or sends one of its files
+func handleArchiveBrowse(w http.ResponseWriter, r *http.Request, arc string, inner string, ab ArchiveBrowser, uAccess []string, uID string, perms []string, listing func([]os.FileInfo)) {
+	can := false
+	for _, item := range uAccess {
+		if pathHasPrefix(arc, item) {
+			can = true
+		}
+	}
+	if !can {
+		writeUserDenied(r, w, true, false)
+		return
+	}
+	members, err := archiveMembers(arc, ab)
+	if err != nil {
+		LogError("[archive]", arc, err.Error())
+		writeResponse(r, w, "Unreadable Archive", F("%s could not be read as an archive.", path.Base(arc)), "")
+		return
+	}
+	if len(inner) == 0 || strings.HasSuffix(inner, "/") {
+		files := archiveChildren(members, inner)
+		if len(files) == 0 && len(inner) > 0 {
+			writeUserDenied(r, w, true, false)
+			return
+		}
+		if !Contains(perms, ShareBrowse) {
+			writeShareForbidden(r, w, "This share link does not allow browsing, use a link to a file in it.")
+			return
+		}
+		listing(files)
+		return
+	}
+	for _, item := range members {
+		if item.name == inner+"/" || strings.HasPrefix(item.name, inner+"/") {
+			http.Redirect(w, r, path.Base(inner)+"/", http.StatusMovedPermanently)
+			return
+		}
+		if item.name == inner {
+			handleArchiveMember(w, r, arc, item, ab, uID, perms)
+			return
+		}
+	}
+	writeUserDenied(r, w, true, false)
+}
+
+// handleArchiveMember sends the file m from the archive arc. It is read from the archive as it is
+// sent, so unlike files on disk it can not be resumed.
+func handleArchiveMember(w http.ResponseWriter, r *http.Request, arc string, m archiveMember, ab ArchiveBrowser, uID string, perms []string) {
+	if !checkHotlink(r, w, arc+"/"+m.name, false) {
+		return
+	}
+	if !shareAllowsFile(perms, r) {
+		writeShareForbidden(r, w, "This share link only allows playing files in the browser.")
+		return
+	}
+	ctype, disposition, allowed := contentHeaders(arc+"/"+m.name, !Contains(perms, ShareDownload))
+	if !allowed {
+		writeShareForbidden(r, w, "This file may only be downloaded, which this share link does not allow.")
+		return
+	}
+	// only downloads of users count against their quota, not those of share links
+	user, ok := downloadUser(r, uID)
+	if ok && !checkBandwidthQuota(r, w, user) {
+		return
+	}
+	release, can := acquireDownload(r, w)
+	if !can {
+		return
+	}
+	defer release()
+	full, err := resolvePath(rootDir.Base(), arc)
+	if err != nil {
+		writeUserDenied(r, w, true, false)
+		return
+	}
+	rc, err := ab.Open(full, m.name)
+	if err != nil {
+		LogError("[archive]", arc, m.name, err.Error())
+		writeResponse(r, w, "Unreadable Archive", F("%s could not be read from %s.", m.name, path.Base(arc)), "")
+		return
+	}
+	defer rc.Close()
+	setContentHeaders(w, path.Base(m.name), findFirstNonEmpty(ctype, "application/octet-stream"), disposition)
+	w.Header().Set("Content-Length", strconv.FormatInt(m.size, 10))
+	w.Header().Set("Last-Modified", m.mtime.UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	sw := &StatusWriter{ResponseWriter: w}
+	io.Copy(throttleWriter(sw, downloadSpeed(user, ok)), rc)
+	if ok {
+		logDownload(r, user, arc+"/"+m.name, sw)
+	}
+}
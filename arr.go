@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+var (
+	arrTitleRegex = regexp.MustCompile(`^(.+?)\s*\((\d{4})\)`)
+	arrIDRegex    = regexp.MustCompile(`[{\[](tmdb|imdb|tvdb)(?:id)?[-=]([a-z0-9]+)[}\]]`)
+)
+
+// ArrItem is one entry of a Sonarr/Radarr "Custom List"
+type ArrItem struct {
+	Title  string `json:"title"`
+	Year   int    `json:"year,omitempty"`
+	TmdbID int    `json:"tmdbId,omitempty"`
+	ImdbID string `json:"imdbId,omitempty"`
+	TvdbID int    `json:"tvdbId,omitempty"`
+}
+
+//
+type RSSFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel RSSChannel `xml:"channel"`
+}
+
+//
+type RSSChannel struct {
+	Title string    `xml:"title"`
+	Link  string    `xml:"link"`
+	Items []RSSItem `xml:"item"`
+}
+
+//
+type RSSItem struct {
+	Title     string       `xml:"title"`
+	GUID      string       `xml:"guid"`
+	Link      string       `xml:"link"`
+	PubDate   string       `xml:"pubDate"`
+	Size      int64        `xml:"size"`
+	Enclosure RSSEnclosure `xml:"enclosure"`
+}
+
+//
+type RSSEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+func validateArrConfig(cfg *Config) error {
+	names := map[string]bool{}
+	for i, item := range cfg.Arr {
+		if len(item.Name) == 0 || strings.ContainsAny(item.Name, "/?#") || names[item.Name] {
+			return E(F("arr list %d must have a unique name without '/'", i))
+		}
+		if len(item.Token) < 16 {
+			return E(F("arr list '%s' must have a token of at least 16 characters", item.Name))
+		}
+		p, err := sanitizePath(item.Path)
+		if err != nil || !strings.HasSuffix(p, "/") {
+			return E(F("arr list '%s' must have a directory path ending in '/'", item.Name))
+		}
+		cfg.Arr[i].Path = p
+		names[item.Name] = true
+	}
+	return nil
+}
+
+// parseArrItem reads the title, year, and ids from a folder named like
+// "Movie Title (2019) {tmdb-12345}" or "Show Title (2008) [tvdbid-81189]"
+func parseArrItem(name string) ArrItem {
+	item := ArrItem{Title: name}
+	if m := arrTitleRegex.FindStringSubmatch(name); m != nil {
+		item.Title = m[1]
+		item.Year, _ = strconv.Atoi(m[2])
+	}
+	for _, m := range arrIDRegex.FindAllStringSubmatch(strings.ToLower(name), -1) {
+		switch m[1] {
+		case "tmdb":
+			item.TmdbID, _ = strconv.Atoi(m[2])
+		case "imdb":
+			item.ImdbID = m[2]
+		case "tvdb":
+			item.TvdbID, _ = strconv.Atoi(m[2])
+		}
+	}
+	return item
+}
+
+// arrFileToken signs fpath for the enclosures of list, so that download clients can fetch them
+// without a session or the list's token. Changing the token invalidates them.
+func arrFileToken(list *ConfigArr, fpath string) string {
+	mac := hmac.New(sha256.New, []byte(list.Token))
+	mac.Write([]byte("arr:" + list.Name + ":" + fpath))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// handler for http://andesite/arr/{name}/list.json, http://andesite/arr/{name}/rss.xml, and
+// http://andesite/arr/{name}/file/{path}
+func handleArr(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(r.URL.Path[len("/arr/"):], "/", 3)
+	if len(parts) < 2 || (len(parts) == 3 && parts[1] != "file") {
+		writeUserDenied(r, w, true, false)
+		return
+	}
+	var list *ConfigArr
+	for i, item := range config.Arr {
+		if item.Name == parts[0] {
+			list = &config.Arr[i]
+		}
+	}
+	token := findFirstNonEmpty(r.Header.Get("X-Api-Key"), r.URL.Query().Get("token"))
+	if !checkLockout(r, w, AuthArrToken, parts[0]) {
+		return
+	}
+	if len(parts) == 3 {
+		handleArrFile(w, r, list, parts[0], "/"+parts[2])
+		return
+	}
+	if list == nil || !hmac.Equal([]byte(token), []byte(list.Token)) {
+		recordAuthFailure(r, AuthArrToken, parts[0])
+		writeStatus(r, w, http.StatusForbidden)
+		writeResponse(r, w, "Forbidden", "Unknown list or invalid token.", "")
+		return
+	}
+	clearAuthFailures(AuthArrToken, parts[0])
+	switch parts[1] {
+	case "list.json":
+		files, err := rootDir.ReadDir(list.Path)
+		if err != nil {
+			writeUserDenied(r, w, true, false)
+			return
+		}
+		items := []ArrItem{}
+		for _, item := range files {
+			if item.IsDir() && !strings.HasPrefix(item.Name(), ".") {
+				items = append(items, parseArrItem(item.Name()))
+			}
+		}
+		w.Header().Add("content-type", "application/json")
+		bytes, _ := json.Marshal(items)
+		w.Write(bytes)
+	case "rss.xml":
+		writeArrRSS(w, r, list)
+	default:
+		writeUserDenied(r, w, true, false)
+	}
+}
+
+// handleArrFile serves the file fpath of an enclosure of list's feed, if its signature matches
+func handleArrFile(w http.ResponseWriter, r *http.Request, list *ConfigArr, name string, fpath string) {
+	fpath, err := sanitizePath(fpath)
+	if list == nil || err != nil || !pathHasPrefix(fpath, list.Path) || !hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(arrFileToken(list, fpath))) {
+		recordAuthFailure(r, AuthArrToken, name)
+		writeStatus(r, w, http.StatusForbidden)
+		writeResponse(r, w, "Forbidden", "Unknown list or invalid signature.", "")
+		return
+	}
+	clearAuthFailures(AuthArrToken, name)
+	info, err := rootDir.Stat(fpath)
+	if err != nil || info.IsDir() || isHiddenPath(fpath) {
+		writeUserDenied(r, w, true, false)
+		return
+	}
+	release, ok := acquireDownload(r, w)
+	if !ok {
+		return
+	}
+	defer release()
+	file, err := rootDir.ReadFile(fpath)
+	if err != nil {
+		writeUserDenied(r, w, true, false)
+		return
+	}
+	defer file.(io.Closer).Close()
+	ctype, disposition, _ := contentHeaders(fpath, false)
+	setContentHeaders(w, info.Name(), ctype, disposition)
+	setETag(w, info)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// writeArrRSS lists the newest files under the list's path as an RSS feed in the shape that
+// *arr tools expect from indexers
+func writeArrRSS(w http.ResponseWriter, r *http.Request, list *ConfigArr) {
+	entries, err := newestFiles(list.Path, func(WatchedFile) bool { return true })
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	base := fullHost(r) + httpBase
+	feed := RSSFeed{Version: "2.0", Channel: RSSChannel{
+		Title: "Andesite: " + list.Name,
+		Link:  base + "files" + list.Path,
+	}}
+	for _, item := range entries {
+		escaped := (&url.URL{Path: item.Path}).EscapedPath()
+		u := base + "files" + escaped
+		// download clients fetch the enclosure on their own, without a session
+		enclosure := base + "arr/" + url.PathEscape(list.Name) + "/file" + escaped + "?sig=" + arrFileToken(list, item.Path)
+		feed.Channel.Items = append(feed.Channel.Items, RSSItem{
+			Title:     strings.TrimSuffix(item.Name, path.Ext(item.Name)),
+			GUID:      u,
+			Link:      u,
+			PubDate:   item.info.ModTime().UTC().Format(time.RFC1123Z),
+			Size:      item.info.Size(),
+			Enclosure: RSSEnclosure{enclosure, item.info.Size(), "application/octet-stream"},
+		})
+	}
+	w.Header().Add("Content-Type", "application/rss+xml")
+	bytes, _ := xml.Marshal(feed)
+	w.Write([]byte(xml.Header))
+	w.Write(bytes)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// kinds of audit sinks
+const (
+	AuditSyslog = "syslog"
+	AuditFile   = "file"
+	AuditHTTP   = "http"
+)
+
+const (
+	// events are dropped rather than holding up requests once a sink falls this far behind
+	auditQueueSize = 1024
+	auditMaxPage   = 200
+)
+
+// AuditEvent is one security relevant action, saved to the audit table and sent to every sink
+type AuditEvent struct {
+	Time   string `json:"time"`
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	Target string `json:"target"`
+	IP     string `json:"ip"`
+	Detail string `json:"detail,omitempty"`
+	Failed bool   `json:"failed,omitempty"`
+}
+
+// AuditSink is somewhere outside the database that audit events are copied to
+type AuditSink interface {
+	Send(ev AuditEvent) error
+}
+
+var auditQueues []chan AuditEvent
+
+func initAuditSinks() error {
+	for i, item := range config.AuditSinks {
+		var sink AuditSink
+		switch item.Type {
+		case AuditSyslog:
+			network, address, err := parseSyslogAddress(item.Address)
+			if err != nil {
+				return E(F("Invalid audit_sinks[%d].address: %s", i, err.Error()))
+			}
+			host, _ := os.Hostname()
+			sink = &SyslogSink{network: network, address: address, hostname: host}
+		case AuditFile:
+			if len(item.Path) == 0 {
+				return E(F("audit_sinks[%d].path is required", i))
+			}
+			rf, err := NewRotatingFile(item.Path, item.MaxSize, item.MaxBackups)
+			if err != nil {
+				return err
+			}
+			sink = &FileSink{rf}
+		case AuditHTTP:
+			if !strings.HasPrefix(item.URL, "http://") && !strings.HasPrefix(item.URL, "https://") {
+				return E(F("Invalid audit_sinks[%d].url '%s'", i, item.URL))
+			}
+			sink = &HTTPSink{url: item.URL, secret: item.Secret}
+		default:
+			return E(F("Invalid audit_sinks[%d].type '%s', must be one of '%s', '%s', '%s'", i, item.Type, AuditSyslog, AuditFile, AuditHTTP))
+		}
+		q := make(chan AuditEvent, auditQueueSize)
+		auditQueues = append(auditQueues, q)
+		go runAuditSink(item.Type, sink, q)
+	}
+	return nil
+}
+
+func runAuditSink(kind string, sink AuditSink, q <-chan AuditEvent) {
+	for ev := range q {
+		if err := sink.Send(ev); err != nil {
+			LogError("[audit]", kind, err.Error())
+		}
+	}
+}
+
+// auditLog records an action by actor on target. r may be nil for actions that do not come from
+// a request.
+func auditLog(r *http.Request, actor string, action string, target string, detail string) {
+	writeAudit(r, AuditEvent{Actor: actor, Action: action, Target: target, Detail: detail})
+}
+
+// auditFailure records an attempt that was refused
+func auditFailure(r *http.Request, actor string, action string, target string, detail string) {
+	writeAudit(r, AuditEvent{Actor: actor, Action: action, Target: target, Detail: detail, Failed: true})
+}
+
+func writeAudit(r *http.Request, ev AuditEvent) {
+	ev.Time = timeNow()
+	if r != nil {
+		ev.IP = clientIPForStorage(r)
+	}
+	if len(ev.Actor) == 0 {
+		ev.Actor = "-"
+	}
+	id, err := database.QueryNextID("audit")
+	if err != nil {
+		return
+	}
+	database.QueryPrepared(true, "insert into audit (id, time, actor, action, target, ip, detail, failed) values (?, ?, ?, ?, ?, ?, ?, ?)", id, ev.Time, ev.Actor, ev.Action, ev.Target, ev.IP, ev.Detail, boolToString(ev.Failed))
+	for _, q := range auditQueues {
+		select {
+		case q <- ev:
+		default:
+			LogError("[audit]", "sink queue is full, dropped", ev.Action, ev.Target)
+		}
+	}
+}
+
+// queryAudit returns the newest events matching the filters, empty filters match everything.
+// action matches a whole action or everything under it, "access" matches "access.create".
+func queryAudit(actor string, action string, target string, since string, until string, limit int, offset int) []AuditEvent {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if len(actor) > 0 {
+		where = append(where, "actor = ?")
+		args = append(args, actor)
+	}
+	if len(action) > 0 {
+		where = append(where, "(action = ? or substr(action, 1, length(?) + 1) = ? || '.')")
+		args = append(args, action, action, action)
+	}
+	if len(target) > 0 {
+		where = append(where, "target = ?")
+		args = append(args, target)
+	}
+	if len(since) > 0 {
+		where = append(where, "time >= ?")
+		args = append(args, since)
+	}
+	if len(until) > 0 {
+		where = append(where, "time < ?")
+		args = append(args, until)
+	}
+	args = append(args, limit, offset)
+	result := []AuditEvent{}
+	rows, err := database.QueryPrepared(false, "select time, actor, action, coalesce(target, ''), coalesce(ip, ''), coalesce(detail, ''), failed from audit where "+strings.Join(where, " and ")+" order by id desc limit ? offset ?", args...)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		var ev AuditEvent
+		rows.Scan(&ev.Time, &ev.Actor, &ev.Action, &ev.Target, &ev.IP, &ev.Detail, &ev.Failed)
+		result = append(result, ev)
+	}
+	rows.Close()
+	return result
+}
+
+// handler for http://andesite/api/admin/audit
+func handleAuditList(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	q := r.URL.Query()
+	limit, offset := pageParams(r, auditMaxPage)
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"events":   queryAudit(q.Get("actor"), q.Get("action"), q.Get("target"), q.Get("since"), q.Get("until"), limit, offset),
+	})
+}
+
+//
+//
+
+// SyslogSink sends RFC 5424 messages over UDP, TCP, or a Unix socket, reconnecting as needed
+type SyslogSink struct {
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn
+}
+
+// parseSyslogAddress splits "udp://host:514", "tcp://host:6514", or "unix:///dev/log"
+func parseSyslogAddress(v string) (string, string, error) {
+	i := strings.Index(v, "://")
+	if i == -1 {
+		return "", "", E("must look like 'udp://host:514', 'tcp://host:514', or 'unix:///dev/log'")
+	}
+	network, address := v[:i], v[i+3:]
+	switch network {
+	case "udp", "tcp", "unix", "unixgram":
+	default:
+		return "", "", E(F("unknown network '%s'", network))
+	}
+	if len(address) == 0 {
+		return "", "", E("missing address")
+	}
+	return network, address, nil
+}
+
+//
+func (s *SyslogSink) Send(ev AuditEvent) error {
+	// facility authpriv, with failures as warnings and everything else as notices
+	pri := 10*8 + 5
+	if ev.Failed {
+		pri = 10*8 + 4
+	}
+	body, _ := json.Marshal(ev)
+	msg := F("<%d>1 %s %s andesite %d %s - %s", pri, ev.Time, syslogField(s.hostname), os.Getpid(), syslogField(ev.Action), body)
+	if s.network == "tcp" {
+		// octet counting framing from RFC 6587, since the message may hold newlines
+		msg = F("%d %s", len(msg), msg)
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			conn, err := net.DialTimeout(s.network, s.address, time.Second*5)
+			if err != nil {
+				return err
+			}
+			s.conn = conn
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+		if _, err := io.WriteString(s.conn, msg); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return E("unable to write to " + s.address)
+}
+
+// syslogField makes v a valid header field, printable ASCII without spaces
+func syslogField(v string) string {
+	if len(v) == 0 {
+		return "-"
+	}
+	return strings.Map(func(c rune) rune {
+		if c <= ' ' || c > '~' {
+			return '_'
+		}
+		return c
+	}, v)
+}
+
+// FileSink writes one JSON event per line
+type FileSink struct {
+	file *RotatingFile
+}
+
+//
+func (s *FileSink) Send(ev AuditEvent) error {
+	body, _ := json.Marshal(ev)
+	_, err := s.file.Write(append(body, '\n'))
+	return err
+}
+
+// HTTPSink posts each event as JSON, signed the same way as webhooks
+type HTTPSink struct {
+	url    string
+	secret string
+}
+
+//
+func (s *HTTPSink) Send(ev AuditEvent) error {
+	body, _ := json.Marshal(ev)
+	wait := time.Second
+	var err error
+	for i := 1; i <= webhookMaxAttempts; i++ {
+		req, _ := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "nektro/andesite")
+		if len(s.secret) > 0 {
+			mac := hmac.New(sha256.New, []byte(s.secret))
+			mac.Write(body)
+			req.Header.Set("X-Andesite-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		var resp *http.Response
+		resp, err = webhookClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = E(resp.Status)
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+const maxAuthorizeChecks = 256
+
+// operations understood by userCan
+const (
+	OpRead         = "read"
+	OpList         = "list"
+	OpShare        = "share"
+	OpManageAccess = "manage_access"
+	OpWrite        = "write"
+	OpDelete       = "delete"
+)
+
+// hasPathAccess returns true if one of the user's access rules is a parent of fpath
+func hasPathAccess(uAccess []string, fpath string) bool {
+	if isHiddenPath(fpath) {
+		return false
+	}
+	for _, item := range uAccess {
+		if pathHasPrefix(fpath, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// userCan decides whether user may perform op on fpath, the same way the handlers for each
+// operation do
+func userCan(user UserRow, uAccess []string, op string, fpath string) (bool, error) {
+	switch op {
+	case OpRead:
+		return hasPathAccess(uAccess, fpath), nil
+	case OpList:
+		if hasPathAccess(uAccess, fpath) {
+			return true, nil
+		}
+		// directories leading to a rule are listed partially
+		for _, item := range uAccess {
+			if strings.HasSuffix(fpath, "/") && strings.HasPrefix(item, fpath) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case OpShare, OpManageAccess:
+		return user.admin && !isReadOnly(), nil
+	case OpWrite, OpDelete:
+		if isReadOnly() {
+			return false, nil
+		}
+		return hasPathPerm(user, queryAccessGrants(user), fpath, op), nil
+	}
+	return false, E(F("unknown operation '%s'", op))
+}
+
+// handler for http://andesite/api/authorize/check
+func handleAuthorizeCheck(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	checks := r.PostForm["check"]
+	if len(checks) == 0 {
+		writeAPIResponse(r, w, false, "Missing POST value 'check'")
+		return
+	}
+	if len(checks) > maxAuthorizeChecks {
+		writeAPIResponse(r, w, false, F("At most %d checks may be sent at once", maxAuthorizeChecks))
+		return
+	}
+	uAccess := queryAccess(user)
+	results := []map[string]interface{}{}
+	for _, item := range checks {
+		op, fpath := item, ""
+		if i := strings.Index(item, ":"); i > 0 {
+			op, fpath = item[:i], item[i+1:]
+		}
+		res := map[string]interface{}{"check": item, "op": op, "path": fpath, "allowed": false}
+		fpath, err := sanitizePath(fpath)
+		if err == nil {
+			res["path"] = fpath
+			res["allowed"], err = userCan(user, uAccess, op, fpath)
+		}
+		if err != nil {
+			res["error"] = err.Error()
+		}
+		results = append(results, res)
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"results":  results,
+	})
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// names inside a backup bundle
+const (
+	bundleDatabase = "andesite.db"
+	bundleThemes   = "themes/"
+)
+
+// sqliteCopy copies every page of src into dst with SQLite's online backup API. The copy is a
+// consistent snapshot, even while the server is writing to src.
+func sqliteCopy(dst *sql.DB, src *sql.DB) error {
+	ctx := context.Background()
+	sc, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	dc, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+	return dc.Raw(func(d interface{}) error {
+		return sc.Raw(func(s interface{}) error {
+			b, err := d.(*sqlite3.SQLiteConn).Backup("main", s.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// sqliteHandle returns the connection pool of the SQLite database, which backups need
+func sqliteHandle() (*sql.DB, error) {
+	db, ok := database.(SQLiteDB)
+	if !ok {
+		return nil, E("Backups are only made of SQLite databases, use pg_dump for PostgreSQL")
+	}
+	return db.DB.DB, nil
+}
+
+// backupDatabase writes a snapshot of the database to the file out
+func backupDatabase(out string) error {
+	src, err := sqliteHandle()
+	if err != nil {
+		return err
+	}
+	dst, err := sql.Open("sqlite3", out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	return sqliteCopy(dst, src)
+}
+
+// restoreDatabase replaces the contents of the database with the snapshot in the file in
+func restoreDatabase(in string) error {
+	dst, err := sqliteHandle()
+	if err != nil {
+		return err
+	}
+	src, err := sql.Open("sqlite3", "file:"+in+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := src.Ping(); err != nil {
+		return E(F("%s is not a SQLite database: %s", in, err.Error()))
+	}
+	return sqliteCopy(dst, src)
+}
+
+// writeBundle writes the database snapshot in dbFile, the config, and the themes folder of the
+// meta directory as a .tar.gz
+func writeBundle(out string, dbFile string) error {
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	add := func(name string, fpath string) error {
+		info, err := os.Stat(fpath)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		file, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	}
+	if err := add(bundleDatabase, dbFile); err != nil {
+		return err
+	}
+	if err := add(filepath.Base(configFile), configFile); err != nil {
+		return err
+	}
+	themes := filepath.Join(metaDir, "themes")
+	if DoesDirectoryExist(themes) {
+		err := filepath.Walk(themes, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, _ := filepath.Rel(themes, p)
+			return add(bundleThemes+filepath.ToSlash(rel), p)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readBundle extracts a bundle into dir, and returns the name of its config file
+func readBundle(in string, dir string) (string, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	tr := tar.NewReader(gr)
+	cfg := ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if hdr.Typeflag != tar.TypeReg || filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return "", E(F("Backup contains an unexpected entry '%s'", hdr.Name))
+		}
+		if !strings.HasPrefix(hdr.Name, bundleThemes) && hdr.Name != bundleDatabase {
+			if strings.Contains(hdr.Name, "/") || !Contains(configNames, hdr.Name) {
+				return "", E(F("Backup contains an unexpected entry '%s'", hdr.Name))
+			}
+			cfg = hdr.Name
+		}
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return "", err
+		}
+		file, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	if !DoesFileExist(filepath.Join(dir, bundleDatabase)) {
+		return "", E("Backup does not contain a database")
+	}
+	return cfg, nil
+}
+
+// isBundle returns true if the file at fpath starts like a gzip stream
+func isBundle(fpath string) (bool, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic, _ := bufio.NewReader(f).Peek(2)
+	return len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// copyFile writes the file at src to dst, which must not exist unless overwrite is true
+func copyFile(dst string, src string, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, flags, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+//
+//
+
+// runBackup implements `andesite backup`
+func runBackup(args []string) error {
+	fs, flagDataDir := cliFlags("backup", "[options]")
+	flagOutput := fs.String("output", "", "File to write, defaults to andesite-DATE.db, or andesite-DATE.tar.gz with --bundle")
+	flagBundle := fs.Bool("bundle", false, "Also include the config file and themes, as a .tar.gz")
+	if err := cliArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if err := cliSetup(*flagDataDir); err != nil {
+		return err
+	}
+	connectDatabase()
+	out := *flagOutput
+	if len(out) == 0 {
+		out = "andesite-" + time.Now().UTC().Format("20060102-150405") + ".db"
+		if *flagBundle {
+			out = strings.TrimSuffix(out, ".db") + ".tar.gz"
+		}
+	}
+	if DoesFileExist(out) {
+		return E(F("%s already exists", out))
+	}
+	if !*flagBundle {
+		if err := backupDatabase(out); err != nil {
+			return err
+		}
+		fmt.Println("Wrote", out)
+		return nil
+	}
+	tmp, err := ioutil.TempDir("", "andesite-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	dbFile := filepath.Join(tmp, bundleDatabase)
+	if err := backupDatabase(dbFile); err != nil {
+		return err
+	}
+	if err := writeBundle(out, dbFile); err != nil {
+		os.Remove(out)
+		return err
+	}
+	fmt.Println("Wrote", out)
+	return nil
+}
+
+// runRestore implements `andesite restore`. The server may keep running, but sessions and
+// caches it holds are of the old data, so restart it afterwards.
+func runRestore(args []string) error {
+	fs, flagDataDir := cliFlags("restore", "[options] FILE")
+	flagForce := fs.Bool("force", false, "Overwrite the config file and themes with the ones in a bundle")
+	if err := cliArgs(fs, args, 1); err != nil {
+		return err
+	}
+	in := fs.Arg(0)
+	bundle, err := isBundle(in)
+	if err != nil {
+		return err
+	}
+	if err := cliSetup(*flagDataDir); err != nil {
+		return err
+	}
+	connectDatabase()
+	if !bundle {
+		if err := restoreDatabase(in); err != nil {
+			return err
+		}
+		// backups from older versions are brought up to date
+		if err := migrateUp(0); err != nil {
+			return err
+		}
+		auditLog(nil, "cli", "backup.restore", in, "")
+		fmt.Println("Restored the database from", in)
+		return nil
+	}
+	tmp, err := ioutil.TempDir("", "andesite-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	cfg, err := readBundle(in, tmp)
+	if err != nil {
+		return err
+	}
+	// check the files are in place before changing the database, so that a failure leaves
+	// everything as it was
+	themes := filepath.Join(tmp, filepath.FromSlash(bundleThemes))
+	files := map[string]string{}
+	if len(cfg) > 0 {
+		files[filepath.Join(metaDir, cfg)] = filepath.Join(tmp, cfg)
+	}
+	filepath.Walk(themes, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(themes, p)
+			files[filepath.Join(metaDir, "themes", rel)] = p
+		}
+		return nil
+	})
+	if !*flagForce {
+		for dst := range files {
+			if DoesFileExist(dst) {
+				return E(F("%s already exists, use --force to overwrite it", dst))
+			}
+		}
+	}
+	if err := restoreDatabase(filepath.Join(tmp, bundleDatabase)); err != nil {
+		return err
+	}
+	if err := migrateUp(0); err != nil {
+		return err
+	}
+	for dst, src := range files {
+		if err := copyFile(dst, src, *flagForce); err != nil {
+			return err
+		}
+	}
+	auditLog(nil, "cli", "backup.restore", in, F("files=%d", len(files)))
+	fmt.Println("Restored the database and", len(files), "files from", in)
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// a basket may hold at most this many files and folders
+const basketMaxItems = 1000
+
+// basketSID returns the session the basket of r belongs to, only logged in sessions have one
+func basketSID(r *http.Request) string {
+	sid, _ := getSession(r).Values["sid"].(string)
+	return sid
+}
+
+// queryBasket returns the paths in the basket of the session sid, in the order they were added
+func queryBasket(sid string) []string {
+	result := []string{}
+	rows, err := database.QueryPrepared(false, "select path from basket where sid = ? order by id", sid)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		var p string
+		rows.Scan(&p)
+		result = append(result, p)
+	}
+	rows.Close()
+	return result
+}
+
+// basketItems drops the paths that are inside a folder that is also in the basket, so that
+// nothing is downloaded twice
+func basketItems(paths []string) []string {
+	result := []string{}
+	for _, x := range paths {
+		inside := false
+		for _, item := range paths {
+			if item != x && strings.HasSuffix(item, "/") && strings.HasPrefix(x, item) {
+				inside = true
+			}
+		}
+		if !inside {
+			result = append(result, x)
+		}
+	}
+	return result
+}
+
+// basketPath checks that user may download fpath and returns it as it is kept in the basket, with
+// a trailing slash for folders
+func basketPath(user UserRow, fpath string) (string, error) {
+	p, err := sanitizePath(fpath)
+	if err != nil {
+		return "", err
+	}
+	info, err := rootDir.Stat(p)
+	if err != nil || isIgnoredPath(p) {
+		return "", E(F("%s does not exist", fpath))
+	}
+	if info.IsDir() && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	if !info.IsDir() {
+		p = strings.TrimSuffix(p, "/")
+	}
+	if !hasPathAccess(queryAccess(user), p) {
+		return "", E(F("You do not have access to %s", fpath))
+	}
+	return p, nil
+}
+
+//
+//
+
+// handler for http://andesite/basket
+func handleBasket(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		return
+	}
+	uAccess := queryAccess(user)
+	list := []map[string]interface{}{}
+	var total int64
+	for _, item := range queryBasket(basketSID(r)) {
+		info, err := rootDir.Stat(item)
+		if err != nil || !hasPathAccess(uAccess, item) {
+			continue
+		}
+		size := info.Size()
+		if info.IsDir() {
+			size = withDirSizes(dirParent(item), []os.FileInfo{info})[0].Size()
+		}
+		total += size
+		list = append(list, map[string]interface{}{
+			"path":      item,
+			"is_dir":    info.IsDir(),
+			"size":      size,
+			"size_text": byteCountIEC(size),
+		})
+	}
+	if wantsJSON(r) {
+		writeJSON(w, map[string]interface{}{
+			"response": "good",
+			"items":    list,
+			"size":     total,
+		})
+		return
+	}
+	writeHandlebarsFile(r, w, "/basket.hbs", map[string]interface{}{
+		"user":  user.snowflake,
+		"base":  httpBase,
+		"name":  displayName(user.snowflake, user.name),
+		"admin": user.admin,
+		"items": list,
+		"size":  byteCountIEC(total),
+	})
+}
+
+// handler for http://andesite/api/basket/add
+func handleBasketAdd(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "path", Kind: FieldString, MaxLen: 4096})
+	if !ok {
+		return
+	}
+	sid := basketSID(r)
+	if len(sid) == 0 {
+		writeAPIResponse(r, w, false, "Log in again to use the basket")
+		return
+	}
+	p, err := basketPath(user, vf.Get("path"))
+	if err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	items := queryBasket(sid)
+	if Contains(items, p) {
+		writeAPIResponse(r, w, true, F("%s is already in your basket.", p))
+		return
+	}
+	if len(items) >= basketMaxItems {
+		writeAPIResponse(r, w, false, F("Your basket is full, it holds at most %d items", basketMaxItems))
+		return
+	}
+	id, err := database.QueryNextID("basket")
+	if err != nil {
+		writeAPIResponse(r, w, false, F("%s could not be added to your basket: %s", p, err.Error()))
+		return
+	}
+	database.QueryPrepared(true, "insert into basket (id, sid, path, added) values (?, ?, ?, ?)", id, sid, p, timeNow())
+	writeAPIResponse(r, w, true, F("Added %s to your basket.", p))
+}
+
+// handler for http://andesite/api/basket/remove
+func handleBasketRemove(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "path", Kind: FieldString, MaxLen: 4096})
+	if !ok {
+		return
+	}
+	database.QueryPrepared(true, "delete from basket where sid = ? and path = ?", basketSID(r), vf.Get("path"))
+	writeAPIResponse(r, w, true, F("Removed %s from your basket.", vf.Get("path")))
+}
+
+// handler for http://andesite/api/basket/clear
+func handleBasketClear(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	database.QueryPrepared(true, "delete from basket where sid = ?", basketSID(r))
+	writeAPIResponse(r, w, true, "Emptied your basket.")
+}
+
+// handler for http://andesite/api/basket/download
+func handleBasketDownload(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		return
+	}
+	items := basketItems(queryBasket(basketSID(r)))
+	if len(items) == 0 {
+		writeResponse(r, w, "Empty Basket", "Add files to your basket while browsing, then download them all at once here.", "")
+		return
+	}
+	if !checkBandwidthQuota(r, w, user) {
+		return
+	}
+	release, ok := acquireDownload(r, w)
+	if !ok {
+		return
+	}
+	defer release()
+	uAccess := queryAccess(user)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"basket.zip\"")
+	sw := &StatusWriter{ResponseWriter: w}
+	aw, err := newZipArchive(throttleWriter(sw, userSpeedLimit(user)))
+	if err != nil {
+		LogError("[basket]", err.Error())
+		return
+	}
+	// members keep their whole path, so that files from different folders can not collide
+	for _, item := range items {
+		if !hasPathAccess(uAccess, item) || isIgnoredPath(item) {
+			continue
+		}
+		name := strings.TrimPrefix(item, "/")
+		before := sw.bytes
+		if strings.HasSuffix(item, "/") {
+			err = archiveDir(aw, item, name, uAccess)
+		} else {
+			err = basketAddFile(aw, item, name)
+		}
+		// each item is logged as a download of its own, with what was sent while it was added
+		logDownload(r, user, item, &StatusWriter{status: sw.status, bytes: sw.bytes - before})
+		if err != nil {
+			LogError("[basket]", item, err.Error())
+			return
+		}
+	}
+	if err := aw.Close(); err != nil {
+		LogError("[basket]", err.Error())
+	}
+}
+
+func basketAddFile(aw ArchiveWriter, fpath string, name string) error {
+	info, err := rootDir.Stat(fpath)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := rootDir.ReadFile(fpath)
+	if err != nil {
+		return err
+	}
+	if c, ok := f.(io.Closer); ok {
+		defer c.Close()
+	}
+	return aw.Add(name, info, f)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+
+	flag "github.com/spf13/pflag"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+const benchListRuns = 20
+
+// runBench implements `andesite bench`, measuring the storage behind --root
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	flagRoot := fs.String("root", "", "Root directory to test, defaults to the one in config.json")
+	flagPath := fs.String("path", "/", "Directory within the root to test")
+	flagSize := fs.Int64("max-read", 256, "Maximum MiB to read from each file")
+	flagConc := fs.IntSlice("concurrency", []int{1, 2, 4, 8}, "Numbers of simultaneous downloads to test")
+	flagConfig := fs.String("config", "", "Path of the config file the server uses")
+	flagMeta := fs.String("meta-dir", "", "The --meta-dir of the server")
+	fs.Parse(args)
+
+	home, _ := homedir.Dir()
+	if len(*flagRoot) == 0 {
+		if _, err := loadConfig(home, *flagMeta, *flagConfig); err != nil {
+			return err
+		}
+		*flagRoot = config.Root
+	}
+	if len(*flagRoot) == 0 {
+		return E("bench requires --root or \"root\" in config.json")
+	}
+	base, _ := filepath.Abs(strings.Replace(*flagRoot, "~", home, 1))
+	root := FsRoot{base}
+	fpath, err := sanitizePath(*flagPath)
+	if err != nil {
+		return E("Invalid --path: " + err.Error())
+	}
+	if !strings.HasSuffix(fpath, "/") {
+		fpath += "/"
+	}
+	maxRead := *flagSize * 1024 * 1024
+	fmt.Printf("Benchmarking %s%s\n\n", base, fpath)
+
+	// listing latency
+	times := []time.Duration{}
+	entries := 0
+	for i := 0; i < benchListRuns; i++ {
+		start := time.Now()
+		files, err := root.ReadDir(fpath)
+		if err != nil {
+			return err
+		}
+		times = append(times, time.Since(start))
+		entries = len(files)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	fmt.Printf("Listing (%d entries, %d runs)\n", entries, benchListRuns)
+	fmt.Printf("  min %v  median %v  p95 %v\n\n", times[0], times[len(times)/2], times[len(times)*95/100])
+
+	// sequential read of the largest files
+	files := benchFiles(root, fpath, 64)
+	if len(files) == 0 {
+		fmt.Println("No files found to read.")
+		return nil
+	}
+	n, d, err := benchRead(root, files[0], maxRead)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sequential read (%s)\n", files[0])
+	fmt.Printf("  %s in %v, %s/s\n\n", byteCountIEC(n), d.Round(time.Millisecond), byteCountIEC(int64(float64(n)/d.Seconds())))
+
+	// concurrent downloads
+	fmt.Println("Concurrent reads")
+	for _, c := range *flagConc {
+		if c < 1 {
+			continue
+		}
+		var total int64
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		var ferr error
+		start := time.Now()
+		for i := 0; i < c; i++ {
+			wg.Add(1)
+			go func(f string) {
+				defer wg.Done()
+				n, _, err := benchRead(root, f, maxRead)
+				lock.Lock()
+				total += n
+				if err != nil {
+					ferr = err
+				}
+				lock.Unlock()
+			}(files[i%len(files)])
+		}
+		wg.Wait()
+		if ferr != nil {
+			return ferr
+		}
+		d := time.Since(start)
+		fmt.Printf("  %2d at once: %s in %v, %s/s total\n", c, byteCountIEC(total), d.Round(time.Millisecond), byteCountIEC(int64(float64(total)/d.Seconds())))
+	}
+	if atomic.LoadInt32(&benchCached) == 1 {
+		fmt.Println("\nThe page cache could not be dropped on this system, so reads of files that were read")
+		fmt.Println("before may have come from memory. Drop it by hand between runs for results of the disk.")
+	}
+	return nil
+}
+
+// benchFiles returns up to max of the largest files below fpath
+func benchFiles(root RootDir, fpath string, max int) []string {
+	type file struct {
+		path string
+		size int64
+	}
+	found := []file{}
+	queue := []string{fpath}
+	for len(queue) > 0 && len(found) < max*16 {
+		dir := queue[0]
+		queue = queue[1:]
+		infos, err := root.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, item := range infos {
+			if strings.HasPrefix(item.Name(), ".") {
+				continue
+			}
+			if item.IsDir() {
+				queue = append(queue, dir+item.Name()+"/")
+			} else if item.Mode().IsRegular() {
+				found = append(found, file{dir + item.Name(), item.Size()})
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].size > found[j].size })
+	result := []string{}
+	for i := 0; i < len(found) && i < max; i++ {
+		result = append(result, found[i].path)
+	}
+	return result
+}
+
+// 1 once the cached pages of a file read could not be dropped
+var benchCached int32
+
+// benchRead reads up to max bytes of fpath, first dropping what the page cache holds of it so
+// that earlier runs don't make it look faster than the disk is
+func benchRead(root RootDir, fpath string, max int64) (int64, time.Duration, error) {
+	f, err := root.ReadFile(fpath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if c, ok := f.(io.Closer); ok {
+		defer c.Close()
+	}
+	if file, ok := f.(*os.File); !ok || !dropFileCache(file) {
+		atomic.StoreInt32(&benchCached, 1)
+	}
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(f, max))
+	return n, time.Since(start), err
+}
@@ -0,0 +1,20 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// POSIX_FADV_DONTNEED
+const fadvDontNeed = 4
+
+// dropFileCache asks the kernel to forget the pages of f it has cached, so that reading it
+// measures the disk rather than memory
+func dropFileCache(f *os.File) bool {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+	return errno == 0
+}
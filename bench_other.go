@@ -0,0 +1,11 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import "os"
+
+// dropFileCache can not drop the cached pages of f here, bench says its results may be from memory
+func dropFileCache(f *os.File) bool {
+	return false
+}
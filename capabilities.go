@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// capabilities describes the optional subsystems of this instance, so that clients and themes
+// can adapt to it. Add new subsystems here as they are added, and keep existing keys stable.
+func capabilities() map[string]interface{} {
+	providers := []map[string]string{}
+	for _, item := range loginProviders() {
+		providers = append(providers, map[string]string{
+			"key":   item.key,
+			"name":  item.Name(),
+			"login": httpBase + "login?with=" + item.key,
+		})
+	}
+	archives := []string{}
+	for k := range archiveFormats {
+		archives = append(archives, k)
+	}
+	sort.Strings(archives)
+	return map[string]interface{}{
+		"version":   version,
+		"read_only": isReadOnly(),
+		"auth": map[string]interface{}{
+			"providers": providers,
+			"passkeys":  loginProviderEnabled("passkey"),
+		},
+		"uploads":     uploadsEnabled() && !isReadOnly(),
+		"webdav":      false,
+		"transcoding": false,
+		"search": map[string]interface{}{
+			"modes": []string{"substring"},
+			"index": getIndexStatus().State,
+		},
+		"archives":    archives,
+		"share_perms": allSharePerms,
+		"feeds":       true,
+		"og_images":   true,
+		"spec":        httpBase + "api/spec",
+	}
+}
+
+// handler for http://andesite/api/capabilities
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	c := capabilities()
+	c["response"] = "good"
+	writeJSON(w, c)
+}
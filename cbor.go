@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// nesting deeper than this is refused, WebAuthn data is never more than a few levels deep
+const cborMaxDepth = 16
+
+// cborDecode reads one CBOR item from the front of b and returns it with the rest of b. Maps
+// become map[interface{}]interface{} with int64 or string keys. Only what WebAuthn attestation
+// objects and COSE keys use is supported, so indefinite lengths are refused and floats are
+// returned as nil.
+func cborDecode(b []byte) (interface{}, []byte, error) {
+	return cborDecodeDepth(b, 0)
+}
+
+func cborDecodeDepth(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, E("cbor: nested too deeply")
+	}
+	if len(b) == 0 {
+		return nil, nil, E("cbor: unexpected end of data")
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(b) < size {
+			return nil, nil, E("cbor: unexpected end of data")
+		}
+		switch size {
+		case 1:
+			n = uint64(b[0])
+		case 2:
+			n = uint64(binary.BigEndian.Uint16(b))
+		case 4:
+			n = uint64(binary.BigEndian.Uint32(b))
+		case 8:
+			n = binary.BigEndian.Uint64(b)
+		}
+		b = b[size:]
+	default:
+		return nil, nil, E("cbor: indefinite lengths are not supported")
+	}
+
+	switch major {
+	case 0, 1:
+		if n > math.MaxInt64 {
+			return nil, nil, E("cbor: integer out of range")
+		}
+		if major == 1 {
+			return -1 - int64(n), b, nil
+		}
+		return int64(n), b, nil
+	case 2, 3:
+		if n > uint64(len(b)) {
+			return nil, nil, E("cbor: unexpected end of data")
+		}
+		if major == 2 {
+			return b[:n], b[n:], nil
+		}
+		return string(b[:n]), b[n:], nil
+	case 4:
+		if n > uint64(len(b)) {
+			return nil, nil, E("cbor: unexpected end of data")
+		}
+		result := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var v interface{}
+			var err error
+			v, b, err = cborDecodeDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			result = append(result, v)
+		}
+		return result, b, nil
+	case 5:
+		if n > uint64(len(b)) {
+			return nil, nil, E("cbor: unexpected end of data")
+		}
+		result := map[interface{}]interface{}{}
+		for i := uint64(0); i < n; i++ {
+			var k, v interface{}
+			var err error
+			k, b, err = cborDecodeDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, E("cbor: map keys must be integers or strings")
+			}
+			v, b, err = cborDecodeDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			result[k] = v
+		}
+		return result, b, nil
+	case 6:
+		// tags only describe the item that follows
+		return cborDecodeDepth(b, depth+1)
+	}
+	switch info {
+	case 20:
+		return false, b, nil
+	case 21:
+		return true, b, nil
+	}
+	return nil, b, nil
+}
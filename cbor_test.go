@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// cborHead is the first bytes of an item of major type major with argument n
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		return b
+	case n <= 0xffffffff:
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return b
+	}
+	b := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], n)
+	return b
+}
+
+// cborEncode encodes the types cborDecode returns, for building test input
+func cborEncode(v interface{}) []byte {
+	switch x := v.(type) {
+	case int:
+		return cborEncode(int64(x))
+	case int64:
+		if x < 0 {
+			return cborHead(1, uint64(-1-x))
+		}
+		return cborHead(0, uint64(x))
+	case []byte:
+		return append(cborHead(2, uint64(len(x))), x...)
+	case string:
+		return append(cborHead(3, uint64(len(x))), x...)
+	case []interface{}:
+		b := cborHead(4, uint64(len(x)))
+		for _, item := range x {
+			b = append(b, cborEncode(item)...)
+		}
+		return b
+	case map[interface{}]interface{}:
+		b := cborHead(5, uint64(len(x)))
+		for k, item := range x {
+			b = append(b, cborEncode(k)...)
+			b = append(b, cborEncode(item)...)
+		}
+		return b
+	case bool:
+		if x {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	}
+	return []byte{0xf6}
+}
+
+func TestCBORDecode(t *testing.T) {
+	cases := []struct {
+		name  string
+		value interface{}
+	}{
+		{"small int", int64(10)},
+		{"int", int64(500)},
+		{"large int", int64(1) << 40},
+		{"negative int", int64(-257)},
+		{"bytes", []byte{1, 2, 3}},
+		{"text", "none"},
+		{"array", []interface{}{int64(1), "a", []byte{2}}},
+		{"map", map[interface{}]interface{}{"fmt": "none", int64(-1): int64(1), "attStmt": map[interface{}]interface{}{}}},
+		{"true", true},
+		{"false", false},
+	}
+	for _, item := range cases {
+		b := append(cborEncode(item.value), 0xff)
+		v, rest, err := cborDecode(b)
+		if err != nil {
+			t.Errorf("%s: %v", item.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, item.value) {
+			t.Errorf("%s: decoded %#v, want %#v", item.name, v, item.value)
+		}
+		if !bytes.Equal(rest, []byte{0xff}) {
+			t.Errorf("%s: rest is %x, want ff", item.name, rest)
+		}
+	}
+}
+
+func TestCBORDecodeTag(t *testing.T) {
+	v, _, err := cborDecode(append(cborHead(6, 24), cborEncode([]byte{1})...))
+	if err != nil || !reflect.DeepEqual(v, []byte{1}) {
+		t.Errorf("tagged item decoded to %#v, %v", v, err)
+	}
+}
+
+func TestCBORDecodeMalformed(t *testing.T) {
+	nested := func(head byte, depth int) []byte {
+		return append(bytes.Repeat([]byte{head}, depth), 0x00)
+	}
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"truncated argument", []byte{0x19, 0x01}},
+		{"truncated bytes", []byte{0x43, 1, 2}},
+		{"truncated text", []byte{0x63, 'a'}},
+		{"truncated array", []byte{0x82, 0x01}},
+		{"truncated map", []byte{0xa1, 0x01}},
+		{"indefinite length", []byte{0x5f, 0x41, 0x01, 0xff}},
+		{"reserved argument", []byte{0x1c}},
+		{"array map key", []byte{0xa1, 0x80, 0x01}},
+		{"int out of range", cborHead(0, 1<<63)},
+		{"negative int out of range", cborHead(1, 1<<63)},
+		{"bytes length bomb", cborHead(2, 1<<63)},
+		{"text length bomb", cborHead(3, 1<<40)},
+		{"array length bomb", cborHead(4, 1<<62)},
+		{"map length bomb", cborHead(5, 1<<32)},
+		{"nested arrays", nested(0x81, 1000)},
+		{"nested maps", append(bytes.Repeat([]byte{0xa1, 0x01}, 1000), 0x00)},
+		{"nested tags", nested(0xc0, 1000)},
+	}
+	for _, item := range cases {
+		if v, _, err := cborDecode(item.data); err == nil {
+			t.Errorf("%s: decoded %#v, want an error", item.name, v)
+		}
+	}
+}
+
+func TestCBORDecodeMaxDepth(t *testing.T) {
+	ok := append(bytes.Repeat([]byte{0x81}, cborMaxDepth), 0x00)
+	if _, _, err := cborDecode(ok); err != nil {
+		t.Errorf("%d levels: %v", cborMaxDepth, err)
+	}
+	deep := append(bytes.Repeat([]byte{0x81}, cborMaxDepth+1), 0x00)
+	if _, _, err := cborDecode(deep); err == nil {
+		t.Errorf("%d levels decoded, want an error", cborMaxDepth+1)
+	}
+}
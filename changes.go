@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// the change journal is kept for this long, clients that synced longer ago list everything again
+const changesRetention = time.Hour * 24 * 30
+
+// the most changes sent at once by /api/changes, clients ask again from the cursor for the rest
+const changesMaxPage = 1000
+
+// FileChange is one entry of the change journal. Path ends with a slash for a folder that was
+// added, whose contents are not listed one by one.
+type FileChange struct {
+	ID    int64  `json:"id"`
+	Time  string `json:"time"`
+	Event string `json:"event"`
+	Path  string `json:"path"`
+}
+
+// recordFileChange adds event on fpath to the change journal, unless it repeats the newest entry
+// as the watcher does for every write to a file that is being copied in
+func recordFileChange(event string, fpath string) {
+	if isInternalPath(fpath) || isIgnoredPath(fpath) {
+		return
+	}
+	database.QueryPrepared(true, "insert into changes (id, time, event, path) select (select coalesce(max(id),-1)+1 from changes), ?, ?, ? where not exists (select 1 from changes where id = (select max(id) from changes) and event = ? and path = ?)", timeNow(), event, fpath, event, fpath)
+}
+
+// queryChangeBounds returns the id of the oldest entry of the journal and the id the next one will
+// have, both 0 while it is empty
+func queryChangeBounds() (int64, int64) {
+	var oldest, next int64
+	rows, err := database.Query(false, "select coalesce(min(id), 0), coalesce(max(id)+1, 0) from changes")
+	if err != nil {
+		return 0, 0
+	}
+	if rows.Next() {
+		rows.Scan(&oldest, &next)
+	}
+	rows.Close()
+	return oldest, next
+}
+
+// queryChanges returns at most limit entries from since up to but not including until, of dir and
+// everything in it
+func queryChanges(dir string, since int64, until int64, limit int) []FileChange {
+	result := []FileChange{}
+	rows, err := database.QueryPrepared(false, "select id, time, event, path from changes where id >= ? and id < ? and substr(path,1,length(?)) = ? order by id limit ?", since, until, dir, dir, limit)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		var v FileChange
+		rows.Scan(&v.ID, &v.Time, &v.Event, &v.Path)
+		result = append(result, v)
+	}
+	rows.Close()
+	return result
+}
+
+// initChangesPurger deletes entries past changesRetention, always keeping the newest so that ids
+// are never handed out twice
+func initChangesPurger() {
+	go func() {
+		for {
+			cutoff := time.Now().UTC().Add(-changesRetention).Format(time.RFC3339)
+			database.QueryPrepared(true, "delete from changes where time < ? and id < (select max(id) from changes)", cutoff)
+			time.Sleep(time.Hour * 6)
+		}
+	}()
+}
+
+//
+//
+
+// handler for http://andesite/api/changes
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		return
+	}
+	q := r.URL.Query()
+	dir, err := sanitizePath(findFirstNonEmpty(q.Get("path"), "/"))
+	if err != nil {
+		writeAPIResponse(r, w, false, F("Invalid path: %s", err.Error()))
+		return
+	}
+	dir = asDirPath(dir, true)
+	uAccess := queryAccess(user)
+	if !hasPathAccess(uAccess, dir) {
+		writeAPIResponse(r, w, false, F("You do not have access to %s", dir))
+		return
+	}
+	oldest, next := queryChangeBounds()
+	since, err := strconv.ParseInt(q.Get("since"), 10, 64)
+	// a cursor from before the oldest entry missed some that were purged, and one past the
+	// newest is from a journal that was started over
+	if err != nil || since < oldest || since > next {
+		writeJSON(w, map[string]interface{}{
+			"response": "good",
+			"reset":    true,
+			"cursor":   next,
+			"more":     false,
+			"changes":  []FileChange{},
+		})
+		return
+	}
+	found := queryChanges(dir, since, next, changesMaxPage)
+	cursor := next
+	if len(found) == changesMaxPage {
+		cursor = found[len(found)-1].ID + 1
+	}
+	result := []FileChange{}
+	for _, item := range found {
+		if hasPathAccess(uAccess, item.Path) && !isIgnoredPath(item.Path) && !strings.HasSuffix(item.Path, "/"+checksumsFileName) {
+			result = append(result, item)
+		}
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"reset":    false,
+		"cursor":   cursor,
+		"more":     cursor < next,
+		"changes":  result,
+	})
+}
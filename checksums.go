@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// checksumsFileName is the file every directory appears to have, listing the SHA-256 of its files
+const checksumsFileName = "SHA256SUMS"
+
+// mounts with the "scan" hash policy have their new and changed files hashed this often
+const checksumScanEvery = time.Hour
+
+// checksumLocks keeps two requests from hashing the same file at once
+var checksumLocks sync.Map
+
+// ChecksumRow is a checksum of the file at path when it had size and mtime
+type ChecksumRow struct {
+	size   int64
+	mtime  int64
+	sha256 string
+	md5    string
+}
+
+// current returns true if the file has not changed since v was computed
+func (v ChecksumRow) current(info os.FileInfo) bool {
+	return v.size == info.Size() && v.mtime == info.ModTime().UnixNano()
+}
+
+// get returns the checksum of the algorithm name, "sha256" or "md5"
+func (v ChecksumRow) get(name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case "sha256":
+		return v.sha256, true
+	case "md5":
+		return v.md5, true
+	}
+	return "", false
+}
+
+// checksumsEnabled returns false for files in a mount whose hash policy is "none"
+func checksumsEnabled(fpath string) bool {
+	return mountFor(fpath).Hash != HashNone
+}
+
+// queryChecksums returns the stored checksums of the files directly in dir, by their path
+func queryChecksums(dir string) map[string]ChecksumRow {
+	result := map[string]ChecksumRow{}
+	rows, err := database.QueryPrepared(false, "select path, size, mtime, sha256, md5 from checksums where parent = ?", dir)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		var p string
+		var v ChecksumRow
+		rows.Scan(&p, &v.size, &v.mtime, &v.sha256, &v.md5)
+		result[p] = v
+	}
+	rows.Close()
+	return result
+}
+
+func queryChecksum(fpath string) (ChecksumRow, bool) {
+	rows, err := database.QueryPrepared(false, "select size, mtime, sha256, md5 from checksums where path = ?", fpath)
+	if err != nil {
+		return ChecksumRow{}, false
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return ChecksumRow{}, false
+	}
+	var v ChecksumRow
+	rows.Scan(&v.size, &v.mtime, &v.sha256, &v.md5)
+	return v, true
+}
+
+// fileChecksum returns the checksums of the file fpath, computing them if they are not stored or
+// the file changed since they were
+func fileChecksum(fpath string, info os.FileInfo) (ChecksumRow, error) {
+	if !checksumsEnabled(fpath) {
+		return ChecksumRow{}, E("Checksums are turned off for " + mountFor(fpath).Path)
+	}
+	if v, ok := queryChecksum(fpath); ok && v.current(info) {
+		return v, nil
+	}
+	mu, _ := checksumLocks.LoadOrStore(fpath, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer func() {
+		mu.(*sync.Mutex).Unlock()
+		checksumLocks.Delete(fpath)
+	}()
+	// it may have been computed while waiting for the lock
+	if v, ok := queryChecksum(fpath); ok && v.current(info) {
+		return v, nil
+	}
+	file, err := rootDir.ReadFile(fpath)
+	if err != nil {
+		return ChecksumRow{}, err
+	}
+	if c, ok := file.(io.Closer); ok {
+		defer c.Close()
+	}
+	hs, hm := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(hs, hm), file); err != nil {
+		return ChecksumRow{}, err
+	}
+	v := ChecksumRow{info.Size(), info.ModTime().UnixNano(), hex.EncodeToString(hs.Sum(nil)), hex.EncodeToString(hm.Sum(nil))}
+	database.QueryPrepared(true, "delete from checksums where path = ?", fpath)
+	database.QueryPrepared(true, "insert into checksums (path, parent, size, mtime, sha256, md5) values (?, ?, ?, ?, ?, ?)", fpath, dirParent(fpath), v.size, v.mtime, v.sha256, v.md5)
+	return v, nil
+}
+
+// forgetChecksums deletes the stored checksums of fpath and, if it is a directory, of everything in it
+func forgetChecksums(fpath string) {
+	dir := strings.TrimSuffix(fpath, "/") + "/"
+	database.QueryPrepared(true, "delete from checksums where path = ? or substr(path,1,length(?)) = ?", fpath, dir, dir)
+}
+
+// withChecksums adds the stored checksums of the files of dir to their listing entries, those that
+// have not been computed yet or are out of date are left out
+func withChecksums(dir string, files []os.FileInfo, entries []map[string]interface{}) {
+	if !checksumsEnabled(dir) {
+		return
+	}
+	sums := queryChecksums(dir)
+	if len(sums) == 0 {
+		return
+	}
+	for i, item := range files {
+		if v, ok := sums[dir+item.Name()]; ok && !item.IsDir() && v.current(item) {
+			entries[i]["sha256"] = v.sha256
+			entries[i]["md5"] = v.md5
+		}
+	}
+}
+
+// hashMount computes the checksums of the files in the index that are in m and not in a mount
+// inside it, skipping those that are up to date
+func hashMount(m IndexMount) {
+	rows, err := database.QueryPrepared(false, "select path from files where substr(path,1,length(?)) = ?", m.Path, m.Path)
+	if err != nil {
+		return
+	}
+	list := []string{}
+	for rows.Next() {
+		var p string
+		rows.Scan(&p)
+		if mountFor(p).Path == m.Path {
+			list = append(list, p)
+		}
+	}
+	rows.Close()
+	start := time.Now()
+	hashed := 0
+	for _, item := range list {
+		info, err := rootDir.Stat(item)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if v, ok := queryChecksum(item); ok && v.current(info) {
+			continue
+		}
+		if _, err := fileChecksum(item, info); err != nil {
+			LogError("[checksums]", item, err.Error())
+			continue
+		}
+		hashed++
+	}
+	if hashed > 0 {
+		Log("[checksums]", "Hashed", hashed, "files in", m.Path, "in", time.Since(start).Round(time.Second).String())
+	}
+}
+
+// initChecksumScan keeps the checksums of every mount with the "scan" hash policy up to date, the
+// others are only hashed when someone asks
+func initChecksumScan() {
+	go func() {
+		for {
+			for _, item := range indexMounts {
+				if item.Hash == HashScan {
+					hashMount(item)
+				}
+			}
+			time.Sleep(checksumScanEvery)
+		}
+	}()
+}
+
+// handleChecksum responds with the checksum of the file qpath in the format of sha256sum and md5sum
+func handleChecksum(w http.ResponseWriter, r *http.Request, qpath string, info os.FileInfo, algo string) {
+	v, err := fileChecksum(qpath, info)
+	if err != nil {
+		writeResponse(r, w, "Checksums Unavailable", err.Error(), "")
+		return
+	}
+	sum, ok := v.get(algo)
+	if !ok {
+		writeResponse(r, w, "Unknown Checksum", F("'%s' is not a checksum, use 'sha256' or 'md5'.", algo), "")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, sum+"  "+info.Name()+"\n")
+}
+
+// handleChecksumsFile writes the SHA256SUMS of dir, the files in it that uAccess allows. Checksums
+// that are not stored yet are computed as the response is written.
+func handleChecksumsFile(w http.ResponseWriter, r *http.Request, dir string, uAccess []string) {
+	if !checksumsEnabled(dir) {
+		writeUserDenied(r, w, true, false)
+		return
+	}
+	files, _ := rootDir.ReadDir(dir)
+	rules := ignoreRulesFor(dir)
+	files = filter(files, func(x os.FileInfo) bool {
+		fpath := dir + x.Name()
+		if isListedDir(x) || isHiddenEntry(rules, fpath, false) {
+			return false
+		}
+		for _, item := range uAccess {
+			if pathHasPrefix(fpath, item) {
+				return true
+			}
+		}
+		return false
+	})
+	sortListing(files, "name", "asc")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, item := range files {
+		v, err := fileChecksum(dir+item.Name(), item)
+		if err != nil {
+			LogError("[checksums]", dir+item.Name(), err.Error())
+			continue
+		}
+		io.WriteString(w, v.sha256+"  "+item.Name()+"\n")
+	}
+}
+
+// isChecksumsFile returns true if qpath, which does not exist, is the SHA256SUMS of a directory
+func isChecksumsFile(qpath string) bool {
+	if path.Base(qpath) != checksumsFileName {
+		return false
+	}
+	info, err := rootDir.Stat(dirParent(qpath))
+	return err == nil && info.IsDir()
+}
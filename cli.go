@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/nektro/go-util/logger"
+
+	flag "github.com/spf13/pflag"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// cliCommands are the subcommands that manage an instance from the shell, by their name and
+// then the name of their action
+var cliCommands = map[string]map[string]func(args []string) error{
+	"user": {
+		"add":      runUserAdd,
+		"list":     runUserList,
+		"promote":  runUserPromote,
+		"password": runUserPassword,
+	},
+	"share": {
+		"list":   runShareList,
+		"revoke": runShareRevoke,
+	},
+	"access": {
+		"grant": runAccessGrant,
+	},
+	"config": {
+		"validate": runConfigValidate,
+	},
+	"policy": {
+		"export": runPolicyExport,
+		"import": runPolicyImport,
+	},
+	"migrate": {
+		"status": runMigrateStatus,
+		"up":     runMigrateUp,
+		"down":   runMigrateDown,
+	},
+}
+
+// runCLI runs `andesite <command> <action> [args]`
+func runCLI(command string, args []string) error {
+	actions := cliCommands[command]
+	if len(args) == 0 || actions[args[0]] == nil {
+		names := []string{}
+		for k := range actions {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return E(F("Usage: andesite %s <%s>", command, strings.Join(names, "|")))
+	}
+	return actions[args[0]](args[1:])
+}
+
+// the --config and --meta-dir of the subcommand being run
+var cliConfig, cliMeta *string
+
+// cliFlags returns the flags every subcommand that opens the database accepts
+func cliFlags(name string, usage string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	flagDataDir := fs.String("data-dir", "", "Directory for the database, defaults to the one the server uses")
+	cliConfig = fs.String("config", "", "Path of the config file the server uses")
+	cliMeta = fs.String("meta-dir", "", "The --meta-dir of the server")
+	fs.Usage = func() {
+		Log("Usage: andesite " + name + " " + usage)
+		fs.PrintDefaults()
+	}
+	return fs, flagDataDir
+}
+
+// cliOpen loads config.json and opens the database the server uses, the server may keep running
+func cliOpen(flagDataDir string) error {
+	if err := cliSetup(flagDataDir); err != nil {
+		return err
+	}
+	initDatabase()
+	return nil
+}
+
+// cliSetup loads config.json and finds the database the server uses, without opening it
+func cliSetup(flagDataDir string) error {
+	log.Level = logger.LevelWARN
+	home, _ := homedir.Dir()
+	p, err := loadConfig(home, *cliMeta, *cliConfig)
+	if err != nil {
+		return err
+	}
+	configFile = p
+	if err := initDirs(home, flagDataDir, "", ""); err != nil {
+		return err
+	}
+	if err := validateDatabaseConfig(config.Database); err != nil {
+		return err
+	}
+	// snowflakes are stored relative to the login providers
+	return initLoginProviders()
+}
+
+func cliArgs(fs *flag.FlagSet, args []string, n int) error {
+	fs.Parse(args)
+	if fs.NArg() != n {
+		fs.Usage()
+		return E(F("Expected %d argument(s), got %d", n, fs.NArg()))
+	}
+	return nil
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+// promoteUser makes snowflake an admin, adding the user if needed, and with rootAccess gives
+// them access to the whole root
+func promoteUser(snowflake string, actor string, rootAccess bool) error {
+	uu, ok := queryUserBySnowflake(snowflake)
+	if !ok {
+		uid, err := database.QueryNextID("users")
+		if err != nil {
+			return err
+		}
+		queryDoAddUser(uid, snowflake, true, "")
+		log.Log(logger.LevelINFO, F("Added user %s as an admin", snowflake))
+		auditLog(nil, actor, "user.create", snowflake, "admin=1")
+	} else {
+		if !uu.admin {
+			queryDoUpdate("users", "admin", "1", "id", strconv.FormatInt(int64(uu.id), 10))
+			log.Log(logger.LevelINFO, F("Set user '%s's status to admin", uu.snowflake))
+			auditLog(nil, actor, "user.update", uu.snowflake, "admin=1")
+		}
+	}
+	if !rootAccess {
+		return nil
+	}
+	nu, _ := queryUserBySnowflake(snowflake)
+	if !Contains(queryAccess(nu), "/") {
+		aid, err := database.QueryNextID("access")
+		if err != nil {
+			return err
+		}
+		database.QueryPrepared(true, "insert into access (id, user, path) values (?, ?, ?)", aid, nu.id, "/")
+		log.Log(logger.LevelINFO, F("Gave %s root folder access", nu.name))
+		auditLog(nil, actor, "access.create", nu.snowflake, "/")
+	}
+	return nil
+}
+
+//
+//
+
+// runUserAdd implements `andesite user add`
+func runUserAdd(args []string) error {
+	fs, flagDataDir := cliFlags("user add", "[options] SNOWFLAKE")
+	flagName := fs.String("name", "", "Display name of the user")
+	flagAdmin := fs.Bool("admin", false, "Make the user an admin")
+	if err := cliArgs(fs, args, 1); err != nil {
+		return err
+	}
+	if err := cliOpen(*flagDataDir); err != nil {
+		return err
+	}
+	snowflake := fs.Arg(0)
+	if err := checkSnowflake(snowflake); err != nil {
+		return err
+	}
+	if _, ok := queryUserBySnowflake(snowflake); ok {
+		return E(F("User %s already exists", snowflake))
+	}
+	uid, err := database.QueryNextID("users")
+	if err != nil {
+		return err
+	}
+	queryDoAddUser(uid, snowflake, *flagAdmin, *flagName)
+	auditLog(nil, "cli", "user.create", snowflake, "admin="+boolToString(*flagAdmin))
+	fmt.Printf("Created user %s.\n", snowflake)
+	return nil
+}
+
+// runUserList implements `andesite user list`
+func runUserList(args []string) error {
+	fs, flagDataDir := cliFlags("user list", "[options]")
+	if err := cliArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if err := cliOpen(*flagDataDir); err != nil {
+		return err
+	}
+	counts := queryAccessCounts()
+	tw := newTable()
+	fmt.Fprintln(tw, "SNOWFLAKE\tNAME\tPROVIDER\tADMIN\tACCESS\tLAST LOGIN")
+	for _, item := range queryAllUsers() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%d\t%s\n", item.snowflake, item.name, item.provider, item.admin, counts[item.id], findFirstNonEmpty(item.lastLogin, "never"))
+	}
+	return tw.Flush()
+}
+
+// runUserPromote implements `andesite user promote`
+func runUserPromote(args []string) error {
+	fs, flagDataDir := cliFlags("user promote", "[options] SNOWFLAKE")
+	flagRoot := fs.Bool("root-access", false, "Also give the user access to the whole root, like --admin of the server")
+	if err := cliArgs(fs, args, 1); err != nil {
+		return err
+	}
+	if err := cliOpen(*flagDataDir); err != nil {
+		return err
+	}
+	if err := promoteUser(fs.Arg(0), "cli", *flagRoot); err != nil {
+		return err
+	}
+	fmt.Printf("%s is an admin.\n", fs.Arg(0))
+	return nil
+}
+
+// runUserPassword implements `andesite user password`
+func runUserPassword(args []string) error {
+	fs, flagDataDir := cliFlags("user password", "[options] SNOWFLAKE < PASSWORD")
+	if err := cliArgs(fs, args, 1); err != nil {
+		return err
+	}
+	if err := cliOpen(*flagDataDir); err != nil {
+		return err
+	}
+	user, ok := queryUserBySnowflake(fs.Arg(0))
+	if !ok || user.provider != "local" {
+		return E(F("%s is not a local account", fs.Arg(0)))
+	}
+	// read from stdin rather than an argument, which would be left in the shell history
+	fmt.Fprintf(os.Stderr, "New password for %s: ", user.snowflake)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if err := checkPasswordRules(password); err != nil {
+		return err
+	}
+	if err := querySetPassword(user.id, password); err != nil {
+		return err
+	}
+	auditLog(nil, "cli", "password.reset", user.snowflake, "")
+	fmt.Printf("Set the password of %s.\n", user.snowflake)
+	return nil
+}
+
+// runShareList implements `andesite share list`
+func runShareList(args []string) error {
+	fs, flagDataDir := cliFlags("share list", "[options]")
+	if err := cliArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if err := cliOpen(*flagDataDir); err != nil {
+		return err
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "CODE\tPATH\tALLOWS")
+	for _, item := range queryAllShares() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", item["hash"], item["path"], findFirstNonEmpty(item["perms"], strings.Join(allSharePerms, ",")))
+	}
+	return tw.Flush()
+}
+
+// runShareRevoke implements `andesite share revoke`
+func runShareRevoke(args []string) error {
+	fs, flagDataDir := cliFlags("share revoke", "[options] CODE")
+	if err := cliArgs(fs, args, 1); err != nil {
+		return err
+	}
+	if err := cliOpen(*flagDataDir); err != nil {
+		return err
+	}
+	code := fs.Arg(0)
+	if len(queryAllSharesByCode(code)) == 0 {
+		return E("Share link does not exist")
+	}
+	database.QueryPrepared(true, "delete from shares where hash = ?", code)
+	auditLog(nil, "cli", "share.delete", code, "")
+	fmt.Printf("Deleted share link %s.\n", code)
+	return nil
+}
+
+// runAccessGrant implements `andesite access grant`
+func runAccessGrant(args []string) error {
+	fs, flagDataDir := cliFlags("access grant", "[options] SNOWFLAKE PATH")
+	if err := cliArgs(fs, args, 2); err != nil {
+		return err
+	}
+	fpath, err := sanitizePath(fs.Arg(1))
+	if err != nil {
+		return E("Invalid path: " + err.Error())
+	}
+	if err := cliOpen(*flagDataDir); err != nil {
+		return err
+	}
+	snowflake := fs.Arg(0)
+	u, ok := queryUserBySnowflake(snowflake)
+	if !ok {
+		uid, err := database.QueryNextID("users")
+		if err != nil {
+			return err
+		}
+		u.id = uid
+		queryDoAddUser(u.id, snowflake, false, "")
+	}
+	if Contains(queryAccess(u), fpath) {
+		return E(F("%s already has access to %s", snowflake, fpath))
+	}
+	aid, err := database.QueryNextID("access")
+	if err != nil {
+		return err
+	}
+	database.QueryPrepared(true, "insert into access (id, user, path) values (?, ?, ?)", aid, u.id, fpath)
+	auditLog(nil, "cli", "access.create", snowflake, fpath)
+	fmt.Printf("Gave %s access to %s.\n", snowflake, fpath)
+	return nil
+}
+
+// runConfigValidate implements `andesite config validate`, reporting every problem it finds
+// rather than stopping at the first like the server does
+func runConfigValidate(args []string) error {
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	flagRoot := fs.String("root", "", "Check this root directory instead of the one in the config")
+	flagConfig := fs.String("config", "", "Path of the config file to check")
+	flagMeta := fs.String("meta-dir", "", "The --meta-dir of the server, to check the config in it")
+	fs.Parse(args)
+	log.Level = logger.LevelWARN
+	home, _ := homedir.Dir()
+	configPath, err := findConfig(home, *flagMeta, *flagConfig)
+	if err != nil {
+		return err
+	}
+	problems := lintConfigFile(configPath)
+	for _, item := range problems {
+		if !item.Warning {
+			// the rest of the checks need the config to have been read
+			return reportConfigProblems(configPath, problems)
+		}
+	}
+	if err := readConfig(configPath); err != nil {
+		return err
+	}
+	authProblems := lintAuthConfig()
+	problems = append(problems, authProblems...)
+	if root := findFirstNonEmpty(*flagRoot, config.Root); len(root) > 0 {
+		root, _ = filepath.Abs(filepath.Clean(strings.Replace(root, "~", home, -1)))
+		problems = append(problems, lintRoot(root)...)
+	} else {
+		problems = append(problems, lintRoot("")...)
+	}
+	for _, check := range []func() error{
+		initUsageBackends,
+		func() error { return initTrustedProxies(config.TrustedProxies) },
+		func() error {
+			_, err := buildRateLimits(config.RateLimit)
+			return err
+		},
+		func() error { return initLockout(config.Lockout) },
+		func() error { return initIndexer(config.Index) },
+		func() error {
+			for _, item := range authProblems {
+				if !item.Warning {
+					// already reported, with more detail
+					return nil
+				}
+			}
+			return initLoginProviders()
+		},
+		func() error { return initProxyAuth(config.ProxyAuth) },
+	} {
+		if err := check(); err != nil {
+			problems = append(problems, ConfigProblem{"", err.Error(), false})
+		}
+	}
+	for _, check := range configValidators {
+		if err := check(config); err != nil {
+			problems = append(problems, ConfigProblem{"", err.Error(), false})
+		}
+	}
+	if err := reportConfigProblems(configPath, problems); err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid.\n", configPath)
+	return nil
+}
+
+// runMigrateStatus implements `andesite migrate status`
+func runMigrateStatus(args []string) error {
+	fs, flagDataDir := cliFlags("migrate status", "[options]")
+	if err := cliArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if err := cliSetup(*flagDataDir); err != nil {
+		return err
+	}
+	connectDatabase()
+	list, err := migrationStatus()
+	if err != nil {
+		return err
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "ID\tNAME\tAPPLIED\tREVERSIBLE")
+	for _, item := range list {
+		applied := item.Applied
+		if len(applied) == 0 {
+			applied = "pending"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%t\n", item.ID, item.Name, applied, item.Down != nil)
+	}
+	return tw.Flush()
+}
+
+// runMigrateUp implements `andesite migrate up`
+func runMigrateUp(args []string) error {
+	fs, flagDataDir := cliFlags("migrate up", "[options]")
+	flagTo := fs.Int("to", 0, "Stop after this migration, instead of applying all of them")
+	if err := cliArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if err := cliSetup(*flagDataDir); err != nil {
+		return err
+	}
+	connectDatabase()
+	if err := migrateUp(*flagTo); err != nil {
+		return err
+	}
+	fmt.Println("Schema is at version", schemaVersion())
+	return nil
+}
+
+// runMigrateDown implements `andesite migrate down`, for going back to an older version of
+// Andesite. Stop the server first, since it applies every migration when it starts.
+func runMigrateDown(args []string) error {
+	fs, flagDataDir := cliFlags("migrate down", "[options] --to ID")
+	flagTo := fs.Int("to", -1, "Undo every migration after this one")
+	if err := cliArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if *flagTo < 0 {
+		fs.Usage()
+		return E("--to is required")
+	}
+	if err := cliSetup(*flagDataDir); err != nil {
+		return err
+	}
+	connectDatabase()
+	if err := migrateDown(*flagTo); err != nil {
+		return err
+	}
+	fmt.Println("Schema is at version", schemaVersion())
+	return nil
+}
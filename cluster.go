@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/nektro/go-util/logger"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+const (
+	leaseTTL   = time.Second * 30
+	leaseRenew = time.Second * 10
+)
+
+// the lease row every node competes for, there is only ever one
+const leaderLeaseID = 0
+
+func clusterNodeID() string {
+	if len(config.Cluster.Node) > 0 {
+		return config.Cluster.Node
+	}
+	h, _ := os.Hostname()
+	return F("%s-%d", h, os.Getpid())
+}
+
+// runs task once this process holds the leader lease. Without cluster mode every process is the
+// leader. A leader that fails to renew its lease exits so that it can't run alongside the new one.
+func whenLeader(task func()) {
+	if !config.Cluster.Enabled {
+		task()
+		return
+	}
+	node := clusterNodeID()
+	rows, err := database.QueryPrepared(false, "select id from leases where id = ?", leaderLeaseID)
+	exists := false
+	if err == nil {
+		exists = rows.Next()
+		rows.Close()
+	}
+	if !exists {
+		// if another node starting at the same time wins, this insert fails harmlessly
+		database.QueryPrepared(true, "insert into leases values (?, '', '')", leaderLeaseID)
+	}
+	for !tryAcquireLease(node) {
+		time.Sleep(leaseRenew)
+	}
+	log.Log(logger.LevelINFO, F("[cluster] node '%s' is now the leader", node))
+	task()
+	go func() {
+		for {
+			time.Sleep(leaseRenew)
+			if !tryAcquireLease(node) {
+				log.Log(logger.LevelERROR, F("[cluster] node '%s' lost the leader lease, exiting", node))
+				os.Exit(1)
+			}
+		}
+	}()
+}
+
+func tryAcquireLease(node string) bool {
+	now := time.Now().UTC()
+	database.QueryPrepared(true, "update leases set node = ?, expires = ? where id = ? and (node = ? or expires < ?)", node, now.Add(leaseTTL).Format(time.RFC3339), leaderLeaseID, node, now.Format(time.RFC3339))
+	return queryLeaseHolder() == node
+}
+
+func queryLeaseHolder() string {
+	rows, err := database.QueryPrepared(false, "select node from leases where id = ?", leaderLeaseID)
+	if err != nil {
+		return ""
+	}
+	defer rows.Close()
+	holder := ""
+	if rows.Next() {
+		rows.Scan(&holder)
+	}
+	return holder
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// responses smaller than this are sent as they are unless "compression.min_size" says otherwise,
+// compressing them would save next to nothing
+const defaultCompressMinSize = 1024
+
+// compressibleTypes are the content types worth compressing, everything else such as images,
+// video, and archives is compressed already
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/manifest+json",
+	"application/wasm",
+	"image/svg+xml",
+	"image/x-icon",
+}
+
+var (
+	gzipPool   = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	brotliPool = sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, 5) }}
+)
+
+func validateCompressionConfig(cfg *Config) error {
+	if cfg.Compression.MinSize < 0 {
+		return E("compression.min_size must not be negative")
+	}
+	return nil
+}
+
+func compressMinSize() int {
+	if config.Compression.MinSize == 0 {
+		return defaultCompressMinSize
+	}
+	return config.Compression.MinSize
+}
+
+// isCompressible returns true if a response with the content type ctype is worth compressing
+func isCompressible(ctype string) bool {
+	ctype = strings.ToLower(strings.TrimSpace(strings.Split(ctype, ";")[0]))
+	for _, item := range compressibleTypes {
+		if strings.HasPrefix(ctype, item) {
+			return true
+		}
+	}
+	return strings.HasSuffix(ctype, "+json") || strings.HasSuffix(ctype, "+xml")
+}
+
+// negotiateEncoding picks "br" or "gzip" from the Accept-Encoding header, or "" for neither
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != "br" && name != "gzip" {
+			continue
+		}
+		q := 1.0
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, _ = strconv.ParseFloat(p[2:], 64)
+			}
+		}
+		// brotli wins a tie, it is smaller for the same work
+		if q > bestQ || (q == bestQ && q > 0 && name == "br") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// CompressWriter compresses a response once it knows from the headers that it should be
+type CompressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	started  bool
+	enc      io.WriteCloser
+	flusher  interface{ Flush() error }
+}
+
+// start decides whether to compress, b is the first of the body, to guess the type from if the
+// handler did not set one
+func (cw *CompressWriter) start(status int, b []byte) {
+	if cw.started {
+		return
+	}
+	cw.started = true
+	h := cw.Header()
+	if len(h.Get("Content-Type")) == 0 && len(b) > 0 {
+		h.Set("Content-Type", http.DetectContentType(b))
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if status != http.StatusOK || len(h.Get("Content-Encoding")) > 0 || len(h.Get("Content-Range")) > 0 || !isCompressible(h.Get("Content-Type")) {
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < cw.minSize {
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.encoding)
+	// the encoded bytes are not those of the file, so a strong ETag would let a client resume a
+	// compressed download with a range of the plain one through If-Range. A weak one still
+	// answers If-None-Match but never matches a range request.
+	if et := h.Get("ETag"); strings.HasPrefix(et, `"`) {
+		h.Set("ETag", "W/"+et)
+	}
+	switch cw.encoding {
+	case "br":
+		bw := brotliPool.Get().(*brotli.Writer)
+		bw.Reset(cw.ResponseWriter)
+		cw.enc, cw.flusher = bw, bw
+	case "gzip":
+		gw := gzipPool.Get().(*gzip.Writer)
+		gw.Reset(cw.ResponseWriter)
+		cw.enc, cw.flusher = gw, gw
+	}
+}
+
+//
+func (cw *CompressWriter) WriteHeader(code int) {
+	cw.start(code, nil)
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+//
+func (cw *CompressWriter) Write(b []byte) (int, error) {
+	if !cw.started {
+		cw.start(http.StatusOK, b)
+	}
+	if cw.enc == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.enc.Write(b)
+}
+
+//
+func (cw *CompressWriter) Flush() {
+	if cw.flusher != nil {
+		cw.flusher.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection, which is only done before anything is written
+func (cw *CompressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cw.started = true
+	return hijackThrough(cw.ResponseWriter)
+}
+
+// close finishes the compressed stream and returns the encoder to its pool
+func (cw *CompressWriter) close() {
+	if cw.enc == nil {
+		return
+	}
+	cw.enc.Close()
+	switch v := cw.enc.(type) {
+	case *brotli.Writer:
+		v.Reset(nil)
+		brotliPool.Put(v)
+	case *gzip.Writer:
+		v.Reset(nil)
+		gzipPool.Put(v)
+	}
+	cw.enc = nil
+}
+
+// compresses HTML, JSON, and other text responses for clients that accept it
+func mwCompress(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if config.Compression.Disabled || len(encoding) == 0 || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &CompressWriter{ResponseWriter: w, encoding: encoding, minSize: compressMinSize()}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// the names config is looked for under in metaDir
+var configNames = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
+
+// configFormat is "json", "yaml", or "toml", from the extension of fpath
+func configFormat(fpath string) string {
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+// existingConfig returns the config file in dir, or "" if there is none. The blank config.json
+// made on the first start is passed over for a file in another format written later, and more
+// than one file with settings is an error rather than a guess.
+func existingConfig(dir string) (string, error) {
+	found := []string{}
+	for _, item := range configNames {
+		if p := filepath.Join(dir, item); DoesFileExist(p) {
+			found = append(found, p)
+		}
+	}
+	if len(found) < 2 {
+		return strings.Join(found, ""), nil
+	}
+	set := []string{}
+	for _, item := range found {
+		if !isBlankConfig(item) {
+			set = append(set, item)
+		}
+	}
+	switch len(set) {
+	case 0:
+		return found[0], nil
+	case 1:
+		return set[0], nil
+	}
+	return "", E(F("There is more than one config file in %s, keep only one of %s", dir, strings.Join(set, ", ")))
+}
+
+// isBlankConfig returns true if the file at fpath has no settings, as the config.json that is
+// created when there is no config
+func isBlankConfig(fpath string) bool {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return false
+	}
+	s := strings.TrimSpace(string(data))
+	return len(s) == 0 || s == "{}"
+}
+
+// readConfigJSON returns the config at fpath as JSON, converting YAML and TOML so that every
+// format is checked and decoded the same way
+func readConfigJSON(fpath string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	switch configFormat(fpath) {
+	case "yaml":
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, E("Invalid YAML: " + err.Error())
+		}
+		if raw == nil {
+			// an empty file, or only comments
+			raw = map[string]interface{}{}
+		}
+	case "toml":
+		m := map[string]interface{}{}
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, E("Invalid TOML: " + err.Error())
+		}
+		raw = m
+	default:
+		return data, nil
+	}
+	raw, err = stringKeys(raw)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(raw)
+}
+
+// stringKeys converts the maps YAML decodes with non-string keys into ones JSON can encode
+func stringKeys(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, item := range x {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, E(F("Keys must be strings, found %v", k))
+			}
+			cv, err := stringKeys(item)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = cv
+		}
+		return m, nil
+	case map[string]interface{}:
+		for k, item := range x {
+			cv, err := stringKeys(item)
+			if err != nil {
+				return nil, err
+			}
+			x[k] = cv
+		}
+	case []interface{}:
+		for i, item := range x {
+			cv, err := stringKeys(item)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = cv
+		}
+	case []map[string]interface{}:
+		// arrays of tables in TOML
+		list := []interface{}{}
+		for _, item := range x {
+			cv, err := stringKeys(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, cv)
+		}
+		return list, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nektro/go-util/logger"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// ConfigProblem is one thing wrong with config.json. Warnings are logged, anything else stops
+// the server from starting.
+type ConfigProblem struct {
+	Key     string
+	Message string
+	Warning bool
+}
+
+func (cp ConfigProblem) String() string {
+	if len(cp.Key) == 0 {
+		return cp.Message
+	}
+	return F("%s: %s", cp.Key, cp.Message)
+}
+
+// lintConfigFile checks that the file at fpath fits Config, and warns about keys that Andesite
+// does not know, which are usually typos of ones it does
+func lintConfigFile(fpath string) []ConfigProblem {
+	data, err := readConfigJSON(fpath)
+	if err != nil {
+		return []ConfigProblem{{"", F("Unable to read %s: %s", fpath, err.Error()), false}}
+	}
+	// positions are only meaningful in the file as it was written
+	isJSON := configFormat(fpath) == "json"
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			line, col := lineColumn(data, se.Offset)
+			return []ConfigProblem{{"", F("Invalid JSON at line %d, column %d: %s", line, col, se.Error()), false}}
+		}
+		return []ConfigProblem{{"", "Invalid JSON: " + err.Error(), false}}
+	}
+	if _, ok := raw.(map[string]interface{}); !ok {
+		return []ConfigProblem{{"", "The config must be an object of keys, such as {\"root\": \"/srv/files\"}", false}}
+	}
+	result := []ConfigProblem{}
+	if err := json.Unmarshal(data, &Config{}); err != nil {
+		if te, ok := err.(*json.UnmarshalTypeError); ok {
+			msg := F("Must be %s, not a %s", describeType(te.Type), te.Value)
+			if isJSON {
+				line, col := lineColumn(data, te.Offset)
+				msg += F(" (line %d, column %d)", line, col)
+			}
+			result = append(result, ConfigProblem{te.Field, msg, false})
+		} else {
+			result = append(result, ConfigProblem{"", err.Error(), false})
+		}
+	}
+	return append(result, unknownKeys("", raw, reflect.TypeOf(Config{}))...)
+}
+
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return line, len(before) - bytes.LastIndexByte(before, '\n')
+}
+
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "a number"
+	case reflect.Slice:
+		return "a list"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a " + t.String()
+}
+
+// unknownKeys walks value alongside the type it is decoded into
+func unknownKeys(prefix string, value interface{}, t reflect.Type) []ConfigProblem {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	result := []ConfigProblem{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if t.Kind() == reflect.Map {
+			for k, item := range v {
+				result = append(result, unknownKeys(prefix+"."+k, item, t.Elem())...)
+			}
+			break
+		}
+		if t.Kind() != reflect.Struct {
+			break
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			if tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; len(tag) > 0 && tag != "-" {
+				fields[tag] = t.Field(i).Type
+			}
+		}
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ft, ok := fields[k]
+			if !ok {
+				// encoding/json matches keys regardless of case
+				for name, item := range fields {
+					if strings.EqualFold(name, k) {
+						ft, ok = item, true
+					}
+				}
+			}
+			if !ok {
+				msg := "Unknown key, it is ignored"
+				if s := closestKey(k, fields); len(s) > 0 {
+					msg += F(". Did you mean \"%s\"?", s)
+				}
+				result = append(result, ConfigProblem{strings.TrimPrefix(prefix+"."+k, "."), msg, true})
+				continue
+			}
+			result = append(result, unknownKeys(prefix+"."+k, v[k], ft)...)
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice {
+			for i, item := range v {
+				result = append(result, unknownKeys(F("%s[%d]", prefix, i), item, t.Elem())...)
+			}
+		}
+	}
+	return result
+}
+
+// closestKey returns the known key that is a few edits away from k, if there is one
+func closestKey(k string, fields map[string]reflect.Type) string {
+	best, bestD := "", 3
+	for name := range fields {
+		if d := editDistance(strings.ToLower(k), name); d < bestD || (d == bestD && len(best) > 0 && name < best) {
+			best, bestD = name, d
+		}
+	}
+	return best
+}
+
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// lintAuthConfig checks that every provider in "auth" has its client credentials, and warns about
+// the ones that are configured but not used
+func lintAuthConfig() []ConfigProblem {
+	result := []ConfigProblem{}
+	auth := config.Auth
+	if len(auth) == 0 {
+		auth = "discord"
+	}
+	enabled := map[string]bool{}
+	for _, item := range strings.Split(auth, ",") {
+		key := strings.TrimSpace(item)
+		enabled[key] = true
+		if _, ok := Oauth2Providers[key]; !ok {
+			continue
+		}
+		cidp := findStructValueWithTag(&config, "json", key).Interface().(*ConfigIDP)
+		example := F("\"%s\": {\"id\": \"CLIENT_ID\", \"secret\": \"CLIENT_SECRET\"}", key)
+		switch {
+		case cidp == nil:
+			result = append(result, ConfigProblem{key, F("\"auth\" uses %s but it has no client credentials, add %s with the values of your OAuth2 app", key, example), false})
+		case len(cidp.ID) == 0:
+			result = append(result, ConfigProblem{key + ".id", F("Missing the client ID of your %s OAuth2 app", strings.Title(key)), false})
+		case len(cidp.Secret) == 0:
+			result = append(result, ConfigProblem{key + ".secret", F("Missing the client secret of your %s OAuth2 app", strings.Title(key)), false})
+		}
+	}
+	for key := range Oauth2Providers {
+		if enabled[key] {
+			continue
+		}
+		if findStructValueWithTag(&config, "json", key).Interface().(*ConfigIDP) != nil {
+			result = append(result, ConfigProblem{key, F("Has credentials but is not in \"auth\" (\"%s\"), so it is not offered as a login", auth), true})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// lintRoot checks that the root is a directory Andesite can list
+func lintRoot(root string) []ConfigProblem {
+	if len(root) == 0 {
+		return []ConfigProblem{{"root", "No root directory, set \"root\" in config.json or pass --root", false}}
+	}
+	stat, err := os.Stat(root)
+	switch {
+	case os.IsNotExist(err):
+		return []ConfigProblem{{"root", F("%s does not exist", root), false}}
+	case os.IsPermission(err):
+		return []ConfigProblem{{"root", F("%s can not be accessed by the user Andesite runs as (uid %d)", root, os.Getuid()), false}}
+	case err != nil:
+		return []ConfigProblem{{"root", err.Error(), false}}
+	case !stat.IsDir():
+		return []ConfigProblem{{"root", F("%s is a file, it must be a directory", root), false}}
+	}
+	f, err := os.Open(root)
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+	}
+	if err != nil && err != io.EOF {
+		return []ConfigProblem{{"root", F("%s can not be listed by the user Andesite runs as (uid %d): %s", root, os.Getuid(), err.Error()), false}}
+	}
+	return nil
+}
+
+// configValidators check the parts of a config that need nothing set up first, filling in their
+// defaults. They run at start, in `andesite lint`, and on a reload before anything is applied.
+var configValidators = []func(cfg *Config) error{
+	func(cfg *Config) error { return validateDatabaseConfig(cfg.Database) },
+	validatePrivacyConfig,
+	validateWebhookConfig,
+	validateArrConfig,
+	validateSessionBindingConfig,
+	func(cfg *Config) error { return validateDiscordGate(cfg.Discord) },
+	func(cfg *Config) error { return validateGitHubGate(cfg.GitHub) },
+	validateProvisionConfig,
+	validatePasskeyConfig,
+	func(cfg *Config) error { return validateSMTPConfig(cfg.SMTP) },
+	func(cfg *Config) error { return validateDiscordWebhook(cfg.DiscordWebhook) },
+	validateQuotaConfig,
+	validateTrashConfig,
+	validateUploadConfig,
+	validateHooks,
+	validateSymlinkPolicy,
+	validateCompressionConfig,
+	validateListingCacheConfig,
+	validateScrubConfig,
+	validateHotlinkConfig,
+	validateContentTypes,
+}
+
+// reportConfigProblems logs every problem and returns an error if any of them is not a warning
+func reportConfigProblems(configPath string, problems []ConfigProblem) error {
+	fatal := 0
+	for _, item := range problems {
+		if item.Warning {
+			log.Log(logger.LevelWARN, "[config]", item.String())
+			continue
+		}
+		log.Log(logger.LevelERROR, "[config]", item.String())
+		fatal++
+	}
+	if fatal > 0 {
+		return E(F("%s has %d problem(s), see above", configPath, fatal))
+	}
+	return nil
+}
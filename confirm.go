@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/securecookie"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+const confirmTokenTTL = time.Minute * 5
+
+// requireConfirmation returns true if the request carries a valid token issued for this exact
+// user, action and form. Otherwise it writes a preview of the changes along with a new token
+// and returns false, so that the handler stops before touching anything.
+func requireConfirmation(r *http.Request, w http.ResponseWriter, user UserRow, changes []string) bool {
+	form := encodeFormWithout(r.PostForm, "confirm")
+	expect := F("%d\n%s\n%s", user.id, r.URL.Path, form)
+
+	if token := r.PostForm.Get("confirm"); len(token) > 0 {
+		v, ok := cache.Get("confirm:" + token)
+		cache.Delete("confirm:" + token)
+		if ok && v == expect {
+			return true
+		}
+	}
+
+	token := F("%x", securecookie.GenerateRandomKey(16))
+	cache.Set("confirm:"+token, expect, confirmTokenTTL)
+
+	if wantsJSON(r) {
+		writeStatus(r, w, http.StatusAccepted)
+		writeJSON(w, map[string]interface{}{
+			"response": "confirm",
+			"token":    token,
+			"changes":  changes,
+			"expires":  int(confirmTokenTTL.Seconds()),
+		})
+		return false
+	}
+	fields := []map[string]string{}
+	for k, v := range r.PostForm {
+		if k == "confirm" {
+			continue
+		}
+		for _, item := range v {
+			fields = append(fields, map[string]string{"name": k, "value": item})
+		}
+	}
+	writeHandlebarsFile(r, w, "/confirm.hbs", map[string]interface{}{
+		"action":  httpBase + r.URL.Path[1:],
+		"changes": changes,
+		"fields":  fields,
+		"token":   token,
+		"base":    httpBase,
+	})
+	return false
+}
+
+// encodes the form with sorted keys while skipping the given key
+func encodeFormWithout(form url.Values, skip string) string {
+	res := url.Values{}
+	for k, v := range form {
+		if k != skip {
+			res[k] = v
+		}
+	}
+	return res.Encode()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// values of "disposition" in "content_types"
+const (
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
+func validateContentTypes(cfg *Config) error {
+	for i, item := range cfg.ContentTypes {
+		if len(item.Extensions) == 0 {
+			return E(F("content_types[%d] needs at least one of 'extensions'", i))
+		}
+		for _, ext := range item.Extensions {
+			if !strings.HasPrefix(ext, ".") || strings.Contains(ext, "/") {
+				return E(F("Invalid content_types[%d] extension '%s', must be like '.mkv'", i, ext))
+			}
+		}
+		if len(item.Path) > 0 && (!strings.HasPrefix(item.Path, "/") || item.Path != path.Clean(item.Path) && item.Path != path.Clean(item.Path)+"/") {
+			return E(F("Invalid content_types[%d] path '%s', must be a clean path starting with '/'", i, item.Path))
+		}
+		if len(item.Type) > 0 {
+			if _, _, err := mime.ParseMediaType(item.Type); err != nil {
+				return E(F("Invalid content_types[%d] type '%s': %s", i, item.Type, err.Error()))
+			}
+		}
+		switch item.Disposition {
+		case "", DispositionInline, DispositionAttachment:
+		default:
+			return E(F("Invalid content_types[%d] disposition '%s', must be 'inline' or 'attachment'", i, item.Disposition))
+		}
+		if len(item.Type) == 0 && len(item.Disposition) == 0 {
+			return E(F("content_types[%d] needs a 'type' or a 'disposition'", i))
+		}
+	}
+	return nil
+}
+
+// contentRule returns the type and disposition the "content_types" rules give fpath, each from
+// the last rule that matches and sets it, or "" where none does
+func contentRule(fpath string) (string, string) {
+	ctype, disposition := "", ""
+	ext := strings.ToLower(path.Ext(fpath))
+	for _, item := range config.ContentTypes {
+		if len(item.Path) > 0 && !isPathBelow(fpath, item.Path) {
+			continue
+		}
+		for _, e := range item.Extensions {
+			if strings.ToLower(e) != ext {
+				continue
+			}
+			if len(item.Type) > 0 {
+				ctype = item.Type
+			}
+			if len(item.Disposition) > 0 {
+				disposition = item.Disposition
+			}
+			break
+		}
+	}
+	return ctype, disposition
+}
+
+// isPathBelow returns true if fpath is dir or in it, comparing whole path segments so that
+// "/untrusted" does not also match "/untrusted-2"
+func isPathBelow(fpath string, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return fpath == dir || strings.HasPrefix(fpath, dir+"/")
+}
+
+// contentTypeFor is the type fpath is served as, from the rules or else from its extension
+func contentTypeFor(fpath string) string {
+	ctype, _ := contentRule(fpath)
+	if len(ctype) == 0 {
+		ctype = mime.TypeByExtension(path.Ext(fpath))
+	}
+	return ctype
+}
+
+// contentHeaders returns the Content-Type of the file fpath and the Content-Disposition its rule
+// asks for. inlineOnly is for share links that do not allow downloads, which serve files inline.
+// A rule that says a file must be downloaded wins over that, since showing it could run it as a
+// page of this site, so the file may not be served at all and ok is false.
+func contentHeaders(fpath string, inlineOnly bool) (string, string, bool) {
+	ctype, disposition := contentRule(fpath)
+	if len(ctype) == 0 {
+		ctype = mime.TypeByExtension(path.Ext(fpath))
+	}
+	if inlineOnly {
+		if disposition == DispositionAttachment {
+			return "", "", false
+		}
+		disposition = DispositionInline
+	}
+	return ctype, disposition, true
+}
+
+// setContentHeaders sets the headers from contentHeaders of the file name. It is called only
+// right before the file is sent, so that an error in its place is not sent with them.
+func setContentHeaders(w http.ResponseWriter, name string, ctype string, disposition string) {
+	w.Header().Set("Content-Type", ctype)
+	if len(disposition) > 0 {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nektro/go-util/logger"
+)
+
+// directories for everything Andesite writes besides config.json and themes, which stay in metaDir
+var (
+	dataDir  string // database, session key, and certificates
+	cacheDir string // files that can be regenerated at any time
+	stateDir string // crash reports and other files useful only to this machine
+)
+
+// xdgDir returns $env/andesite when the XDG variable is set, and otherwise fallback
+func xdgDir(env string, fallback string) string {
+	if v := os.Getenv(env); len(v) > 0 && filepath.IsAbs(v) {
+		return filepath.Join(v, "andesite")
+	}
+	return fallback
+}
+
+// hasDatabase returns true if dir holds a SQLite database
+func hasDatabase(dir string) bool {
+	found, _ := filepath.Glob(dir + "/*.db")
+	return len(found) > 0
+}
+
+// initDirs picks each directory from its flag, then config.json, then the XDG environment, and
+// falls back to metaDir so that existing installs keep working unchanged
+func initDirs(home string, flagData string, flagCache string, flagState string) error {
+	xdg := xdgDir
+	if metaDirChosen {
+		// instances with their own meta dir keep everything in it, rather than sharing the
+		// XDG directories of the account
+		xdg = func(env string, fallback string) string { return fallback }
+	}
+	dataDir = findFirstNonEmpty(flagData, config.DataDir, xdg("XDG_DATA_HOME", metaDir))
+	if len(flagData) == 0 && len(config.DataDir) == 0 && dataDir != metaDir && hasDatabase(metaDir) && !hasDatabase(dataDir) {
+		// an install from before XDG_DATA_HOME was set keeps its database, rather than starting
+		// over with an empty one
+		log.Log(logger.LevelINFO, "Keeping the database in", metaDir+", move it to", dataDir, "to use XDG_DATA_HOME")
+		dataDir = metaDir
+	}
+	cacheDir = findFirstNonEmpty(flagCache, config.CacheDir, xdg("XDG_CACHE_HOME", metaDir+"/cache"))
+	stateDir = findFirstNonEmpty(flagState, config.StateDir, xdg("XDG_STATE_HOME", metaDir))
+	for _, item := range []*string{&dataDir, &cacheDir, &stateDir} {
+		p, err := filepath.Abs(strings.Replace(*item, "~", home, 1))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(p, 0700); err != nil {
+			return err
+		}
+		*item = p
+	}
+	if dataDir != metaDir && hasDatabase(metaDir) && !hasDatabase(dataDir) {
+		log.Log(logger.LevelWARN, "Found a database in", metaDir, "but the data directory is now", dataDir+", move it there to keep your users and shares")
+	}
+	log.Log(logger.LevelDEBUG, "Discovered directories:", "data", dataDir, "cache", cacheDir, "state", stateDir)
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/nektro/go-util/util"
+)
+
+// changes reported by the watcher are gathered for this long before sizes are updated, so that
+// copying in a folder of many files updates its parents once
+const dirSizeDelay = time.Second * 5
+
+// every directory is computed again once its stored size is this old, for changes made while the
+// server was stopped or that the watcher missed
+const dirSizeRefresh = time.Hour * 24
+
+// dirSizesDirty holds the directories whose size may have changed since the last update
+var dirSizesDirty = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// dirSizeRow is the total size and number of files of a directory and everything in it
+type dirSizeRow struct {
+	size  int64
+	files int64
+}
+
+// queryDirSizes returns the rows of the directories directly in dir, by their path
+func queryDirSizes(dir string) map[string]dirSizeRow {
+	result := map[string]dirSizeRow{}
+	rows, err := database.QueryPrepared(false, "select path, size, files from dir_sizes where parent = ?", dir)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		var p string
+		var v dirSizeRow
+		rows.Scan(&p, &v.size, &v.files)
+		result[p] = v
+	}
+	rows.Close()
+	return result
+}
+
+// computeDirSize updates the size of dir from its files and the stored sizes of its folders, and
+// computes those of folders without one. With recurse every folder below it is computed again.
+func computeDirSize(dir string, recurse bool) (dirSizeRow, bool) {
+	result := dirSizeRow{}
+	infos, err := ioutil.ReadDir(filepath.Join(rootDir.Base(), filepath.FromSlash(dir)))
+	if err != nil {
+		database.QueryPrepared(true, "delete from dir_sizes where substr(path,1,length(?)) = ?", dir, dir)
+		return result, false
+	}
+	known := queryDirSizes(dir)
+	rules := ignoreRulesFor(dir)
+	for _, item := range infos {
+		p := dir + item.Name()
+		// links are not followed, so that nothing is counted twice or goes in circles
+		if item.Mode()&os.ModeSymlink != 0 || isHiddenEntry(rules, p, item.IsDir()) {
+			continue
+		}
+		if !item.IsDir() {
+			result.size += item.Size()
+			result.files++
+			continue
+		}
+		child, ok := known[p+"/"]
+		delete(known, p+"/")
+		if recurse || !ok {
+			child, _ = computeDirSize(p+"/", recurse)
+		}
+		result.size += child.size
+		result.files += child.files
+	}
+	// folders that are gone
+	for p := range known {
+		database.QueryPrepared(true, "delete from dir_sizes where substr(path,1,length(?)) = ?", p, p)
+	}
+	if err := saveDirSize(dir, result); err != nil {
+		LogError("[dir-sizes]", dir, err.Error())
+	}
+	return result, true
+}
+
+// saveDirSize replaces the row of dir in one transaction, so that it is never missing for a
+// listing read at the same time
+func saveDirSize(dir string, v dirSizeRow) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("delete from dir_sizes where path = ?", dir); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("insert into dir_sizes (path, parent, size, files, updated) values (?, ?, ?, ?, ?)", dir, dirParent(dir), v.size, v.files, timeNow()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// dirSizesStale returns true if there are no sizes yet, or the oldest is past dirSizeRefresh.
+// Folders that did not change are only written by a full computation, so the oldest row is when
+// the last one ran.
+func dirSizesStale() bool {
+	rows, err := database.Query(false, "select coalesce(min(updated), '') from dir_sizes")
+	if err != nil {
+		return true
+	}
+	defer rows.Close()
+	oldest := ""
+	if rows.Next() {
+		rows.Scan(&oldest)
+	}
+	return len(oldest) == 0 || oldest < time.Now().UTC().Add(-dirSizeRefresh).Format(time.RFC3339)
+}
+
+// dirParent is the folder dir is in, with a trailing slash, or "" for the root
+func dirParent(dir string) string {
+	if dir == "/" {
+		return ""
+	}
+	p := path.Dir(strings.TrimSuffix(dir, "/"))
+	if p == "/" {
+		return p
+	}
+	return p + "/"
+}
+
+// markDirSizeDirty notes that the size of dir, a directory path, and so of its parents changed
+func markDirSizeDirty(dir string) {
+	dirSizesDirty.Lock()
+	dirSizesDirty.paths[dir] = true
+	dirSizesDirty.Unlock()
+}
+
+// updateDirSizes recomputes the directories marked dirty and all of their parents, deepest first
+// so that every folder is summed from up to date children
+func updateDirSizes() {
+	dirSizesDirty.Lock()
+	dirty := dirSizesDirty.paths
+	dirSizesDirty.paths = map[string]bool{}
+	dirSizesDirty.Unlock()
+	if len(dirty) == 0 {
+		return
+	}
+	all := map[string]bool{}
+	for p := range dirty {
+		for ; len(p) > 0 && !all[p]; p = dirParent(p) {
+			all[p] = true
+		}
+	}
+	list := []string{}
+	for p := range all {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Count(list[i], "/") > strings.Count(list[j], "/")
+	})
+	for _, p := range list {
+		computeDirSize(p, false)
+	}
+}
+
+// initDirSizes computes the size of every directory in the background when the stored sizes are
+// missing or past dirSizeRefresh, and otherwise only of the directories without one. They are
+// then kept up to date from the changes the watcher sees.
+func initDirSizes() {
+	go func() {
+		for {
+			if dirSizesStale() {
+				start := time.Now()
+				total, _ := computeDirSize("/", true)
+				Log("[dir-sizes]", "Computed the size of every directory,", byteCountIEC(total.size), "in", total.files, "files, in", time.Since(start).Round(time.Millisecond).String())
+			} else {
+				computeDirSize("/", false)
+			}
+			for end := time.Now().Add(time.Hour); time.Now().Before(end); {
+				time.Sleep(dirSizeDelay)
+				updateDirSizes()
+			}
+		}
+	}()
+}
+
+// SizedFileInfo is a directory with the size of everything in it instead of its own
+type SizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+//
+func (v SizedFileInfo) Size() int64 {
+	return v.size
+}
+
+// withDirSizes gives the directories in files, the entries of dir, their stored total size
+func withDirSizes(dir string, files []os.FileInfo) []os.FileInfo {
+	sizes := queryDirSizes(dir)
+	if len(sizes) == 0 {
+		return files
+	}
+	result := make([]os.FileInfo, len(files))
+	for i, item := range files {
+		result[i] = item
+		if v, ok := sizes[dir+item.Name()+"/"]; ok && item.IsDir() {
+			result[i] = SizedFileInfo{item, v.size}
+		}
+	}
+	return result
+}
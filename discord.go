@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+const discordAPI = "https://discord.com/api/v10"
+
+var discordClient = &http.Client{Timeout: time.Second * 10}
+
+func validateDiscordGate(cfg *ConfigIDP) error {
+	if cfg == nil || len(cfg.Guild) == 0 {
+		if cfg != nil && len(cfg.Roles) > 0 {
+			return E("discord.roles requires discord.guild")
+		}
+		return nil
+	}
+	if len(cfg.BotToken) == 0 {
+		return E("discord.guild requires discord.bot_token of a bot that is in the guild, to look up its members")
+	}
+	return nil
+}
+
+// discordGate only lets in members of discord.guild, and if discord.roles is set, only those with
+// one of the roles. The user's roles become their groups.
+func discordGate(app *ConfigIDP, id string, name string) ([]string, error) {
+	if len(app.Guild) == 0 {
+		return nil, nil
+	}
+	req, _ := http.NewRequest(http.MethodGet, discordAPI+"/guilds/"+app.Guild+"/members/"+id, nil)
+	req.Header.Set("Authorization", "Bot "+app.BotToken)
+	res, err := discordClient.Do(req)
+	if err != nil {
+		return nil, E("Unable to reach Discord to check your server membership, please try again later.")
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, E("You must be a member of this site's Discord server to log in.")
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, E(F("Discord responded '%s' when checking your server membership, please try again later.", res.Status))
+	}
+	member := struct {
+		Roles []string `json:"roles"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&member); err != nil {
+		return nil, err
+	}
+	if len(app.Roles) == 0 {
+		return member.Roles, nil
+	}
+	for _, item := range member.Roles {
+		if Contains(app.Roles, item) {
+			return member.Roles, nil
+		}
+	}
+	return nil, E("You do not have a role on this site's Discord server that is allowed to log in.")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// events posted to the Discord webhook
+const (
+	DiscordEventLogin    = "login"
+	DiscordEventRequest  = "request"
+	DiscordEventShare    = "share"
+	DiscordEventDownload = "download"
+)
+
+// embed colors of each event
+var discordColors = map[string]int{
+	DiscordEventLogin:    0x57f287,
+	DiscordEventRequest:  0xfee75c,
+	DiscordEventShare:    0x5865f2,
+	DiscordEventDownload: 0xeb459e,
+}
+
+// DiscordField is one name and value shown in an embed
+type DiscordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+func validateDiscordWebhook(cfg *ConfigDiscordWebhook) error {
+	if cfg == nil {
+		return nil
+	}
+	if !strings.HasPrefix(cfg.URL, "https://discord.com/api/webhooks/") && !strings.HasPrefix(cfg.URL, "https://discordapp.com/api/webhooks/") {
+		return E(F("Invalid discord_webhook.url '%s', copy it from Integrations in the settings of the channel", cfg.URL))
+	}
+	for _, ev := range cfg.Events {
+		if _, ok := discordColors[ev]; !ok {
+			return E(F("Invalid discord_webhook event '%s', must be one of 'login', 'request', 'share', 'download'", ev))
+		}
+	}
+	if cfg.LargeDownload < 0 {
+		return E("discord_webhook.large_download must not be negative")
+	}
+	if cfg.LargeDownload == 0 {
+		cfg.LargeDownload = 1 << 30
+	}
+	return nil
+}
+
+// postDiscord sends an embed for event to the Discord channel, if it is subscribed to it
+func postDiscord(r *http.Request, event string, title string, fields []DiscordField) {
+	cfg := config.DiscordWebhook
+	if cfg == nil || (len(cfg.Events) > 0 && !Contains(cfg.Events, event)) {
+		return
+	}
+	embed := map[string]interface{}{
+		"title":     title,
+		"color":     discordColors[event],
+		"fields":    fields,
+		"timestamp": timeNow(),
+	}
+	if r != nil {
+		embed["footer"] = map[string]string{"text": fullHost(r) + httpBase}
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"username":         "Andesite",
+		"embeds":           []interface{}{embed},
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	})
+	go sendWebhook(ConfigWebhook{URL: cfg.URL}, body)
+}
+
+// discordUserField names user the same way the admin panel does
+func discordUserField(name string, user UserRow) DiscordField {
+	return DiscordField{name, displayName(user.snowflake, user.name) + " (" + user.snowflake + ")", true}
+}
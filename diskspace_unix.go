@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// diskSpace returns the bytes available to unprivileged users and the size of the filesystem
+// that holds fpath
+func diskSpace(fpath string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(fpath, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	. "github.com/nektro/go-util/alias"
+)
+
+// diskSpace is not implemented on Windows, so disk alerts are not sent there
+func diskSpace(fpath string) (uint64, uint64, error) {
+	return 0, 0, E("not supported on Windows")
+}
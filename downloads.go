@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// downloads are kept this long unless "retention" says otherwise
+	downloadRetentionDays = 90
+	downloadsMaxPage      = 200
+)
+
+// DownloadRow is one file served to a logged in user
+type DownloadRow struct {
+	Time  string `json:"time"`
+	User  string `json:"user"`
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+	IP    string `json:"ip"`
+}
+
+// logDownload records a file served to user, once the response is written. Only bodies are
+// logged, not HEAD requests or revalidations, and each range of a resumed download is its own row.
+func logDownload(r *http.Request, user UserRow, fpath string, sw *StatusWriter) {
+	if r.Method != http.MethodGet || sw.bytes == 0 {
+		return
+	}
+	if sw.status != http.StatusOK && sw.status != http.StatusPartialContent {
+		return
+	}
+	id, err := database.QueryNextID("downloads")
+	if err != nil {
+		return
+	}
+	database.QueryPrepared(true, "insert into downloads (id, time, user, path, bytes, ip) values (?, ?, ?, ?, ?, ?)", id, timeNow(), user.id, fpath, sw.bytes, clientIPForStorage(r))
+	if config.DiscordWebhook != nil && sw.bytes >= config.DiscordWebhook.LargeDownload {
+		postDiscord(r, DiscordEventDownload, "Large download", []DiscordField{
+			discordUserField("User", user),
+			{"Size", byteCountIEC(sw.bytes), true},
+			{"Path", fpath, false},
+		})
+	}
+}
+
+// downloadUser is the user a download from r counts against, which is the one logged in for
+// /files/ and nobody for share links
+func downloadUser(r *http.Request, uID string) (UserRow, bool) {
+	if !strings.HasPrefix(r.URL.Path, "/files/") {
+		return UserRow{}, false
+	}
+	return queryUserBySnowflake(uID)
+}
+
+func queryDownloadsOf(uid int, limit int, offset int) []DownloadRow {
+	result := []DownloadRow{}
+	rows, err := database.QueryPrepared(false, "select downloads.time, users.snowflake, downloads.path, downloads.bytes, coalesce(downloads.ip,'') from downloads join users on users.id = downloads.user where downloads.user = ? order by downloads.id desc limit ? offset ?", uid, limit, offset)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		var v DownloadRow
+		rows.Scan(&v.Time, &v.User, &v.Path, &v.Bytes, &v.IP)
+		result = append(result, v)
+	}
+	rows.Close()
+	return result
+}
+
+// queryTopDownloads returns the most downloaded files since the time given, a resumed download
+// counts once per user per day
+func queryTopDownloads(since string, limit int) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	rows, err := database.QueryPrepared(false, "select path, count(distinct user || ' ' || substr(time,1,10)), count(distinct user), sum(bytes) from downloads where time >= ? group by path order by 2 desc, 4 desc limit ?", since, limit)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		var p string
+		var count, users, bytes int64
+		rows.Scan(&p, &count, &users, &bytes)
+		result = append(result, map[string]interface{}{
+			"path":      p,
+			"downloads": count,
+			"users":     users,
+			"bytes":     bytes,
+		})
+	}
+	rows.Close()
+	return result
+}
+
+func pageParams(r *http.Request, max int) (int, int) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > max {
+		limit = max
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+//
+//
+
+// handler for http://andesite/api/admin/downloads
+func handleAdminDownloads(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	user, ok := queryUserBySnowflake(r.URL.Query().Get("snowflake"))
+	if !ok {
+		writeAPIResponse(r, w, false, "User does not exist")
+		return
+	}
+	limit, offset := pageParams(r, downloadsMaxPage)
+	writeJSON(w, map[string]interface{}{
+		"response":  "good",
+		"downloads": queryDownloadsOf(user.id, limit, offset),
+	})
+}
+
+// handler for http://andesite/api/admin/downloads/top
+func handleAdminTopDownloads(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	limit, _ := pageParams(r, downloadsMaxPage)
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"files":    queryTopDownloads(r.URL.Query().Get("since"), limit),
+	})
+}
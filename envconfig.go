@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+const envPrefix = "ANDESITE_"
+
+// envField is where in Config an environment variable goes
+type envField struct {
+	key   string
+	index []int
+}
+
+// envFields names a variable for every key of Config, from its JSON path, so "discord"."secret"
+// is ANDESITE_DISCORD_SECRET. Objects are followed down to their keys, lists and maps are set
+// whole.
+func envFields(t reflect.Type, prefix string, keyPrefix string, index []int, result map[string]envField) {
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if len(tag) == 0 || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		key := keyPrefix + tag
+		idx := append(append([]int{}, index...), i)
+		ft := t.Field(i).Type
+		if ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			envFields(ft, name+"_", key+".", idx, result)
+			continue
+		}
+		result[name] = envField{key, idx}
+	}
+}
+
+// applyEnvConfig overrides cfg with the ANDESITE_* environment variables that are set
+func applyEnvConfig(cfg *Config) []ConfigProblem {
+	fields := map[string]envField{}
+	envFields(reflect.TypeOf(Config{}), envPrefix, "", nil, fields)
+	result := []ConfigProblem{}
+	for name, f := range fields {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvField(reflect.ValueOf(cfg).Elem(), f.index, value); err != nil {
+			result = append(result, ConfigProblem{name, F("Invalid value for \"%s\": %s", f.key, err.Error()), false})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+func setEnvField(v reflect.Value, index []int, value string) error {
+	for _, i := range index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return E("must be true or false")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return E("must be a whole number")
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			list := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); len(item) > 0 {
+					list = append(list, item)
+				}
+			}
+			v.Set(reflect.ValueOf(list))
+			return nil
+		}
+		fallthrough
+	default:
+		// lists of objects and maps are given as JSON
+		p := reflect.New(v.Type())
+		if err := json.Unmarshal([]byte(value), p.Interface()); err != nil {
+			return E("must be JSON, " + err.Error())
+		}
+		v.Set(p.Elem())
+	}
+	return nil
+}
+
+// applyEnvFlags sets each flag that was not given on the command line from its environment
+// variable, --read-only from ANDESITE_READ_ONLY, so the order is flags, then the environment,
+// then config.json
+func applyEnvFlags(fs *flag.FlagSet) []ConfigProblem {
+	result := []ConfigProblem{}
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, ok := os.LookupEnv(name)
+		if !ok || f.Changed {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			result = append(result, ConfigProblem{name, F("Invalid value for --%s: %s", f.Name, err.Error()), false})
+		}
+	})
+	return result
+}
+
+// unknownEnv warns about ANDESITE_* variables that set no key or flag of the server, which are
+// usually typos
+func unknownEnv(fs *flag.FlagSet) []ConfigProblem {
+	known := map[string]bool{envPrefix + "SESSION": true}
+	fields := map[string]envField{}
+	envFields(reflect.TypeOf(Config{}), envPrefix, "", nil, fields)
+	for name := range fields {
+		known[name] = true
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		known[envPrefix+strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))] = true
+	})
+	result := []ConfigProblem{}
+	for _, item := range os.Environ() {
+		name := strings.SplitN(item, "=", 2)[0]
+		if strings.HasPrefix(name, envPrefix) && !known[name] {
+			result = append(result, ConfigProblem{name, "Unknown environment variable, it is ignored", true})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// etagEpoch stands in for the modification time of files without one, such as the bundled
+// assets, which can only change when Andesite is restarted
+var etagEpoch = time.Now()
+
+// fileETag is the validator of a file from its size and modification time
+func fileETag(info os.FileInfo) string {
+	mod := info.ModTime()
+	if mod.IsZero() {
+		mod = etagEpoch
+	}
+	return F(`"%x-%x"`, info.Size(), mod.UnixNano())
+}
+
+// setETag adds the ETag of info to a response about to be written by http.ServeContent, which
+// then answers If-None-Match with a 304 as it does If-Modified-Since with Last-Modified
+func setETag(w http.ResponseWriter, info os.FileInfo) {
+	w.Header().Set("ETag", fileETag(info))
+}
+
+// handler for http://andesite/
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	themes := live().themes
+	if f, err := themes.Open(path.Clean("/" + r.URL.Path)); err == nil {
+		if info, err := f.Stat(); err == nil && !info.IsDir() {
+			setETag(w, info)
+		}
+		f.Close()
+	}
+	http.FileServer(themes).ServeHTTP(w, r)
+}
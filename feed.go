@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const feedSize = 50
+
+//
+type AtomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Link     AtomLink    `xml:"link"`
+	Entries  []AtomEntry `xml:"entry"`
+}
+
+//
+type AtomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    AtomLink `xml:"link"`
+}
+
+//
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+// FeedFile is a file of a feed and what it was when the feed was made
+type FeedFile struct {
+	WatchedFile
+	info os.FileInfo
+}
+
+// newestFiles returns up to feedSize of the files last added to the index under fpath that keep
+// returns true for, newest first. The index keeps no sizes or times, so only the files returned
+// are stat'd, rather than everything under fpath.
+func newestFiles(fpath string, keep func(WatchedFile) bool) ([]FeedFile, error) {
+	result := []FeedFile{}
+	q, err := database.QueryPrepared(false, "select * from files where substr(path,1,length(?)) = ? order by id desc", fpath, fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	for q.Next() && len(result) < feedSize {
+		wf := scanFile(q)
+		if isHiddenPath(wf.Path) || !keep(wf) {
+			continue
+		}
+		info, err := rootDir.Stat(wf.Path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		result = append(result, FeedFile{wf, info})
+	}
+	return result, nil
+}
+
+func feedToken(snowflake string, fpath string) string {
+	mac := hmac.New(sha256.New, randomKey)
+	mac.Write([]byte("feed:" + snowflake + ":" + fpath))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// the path of the feed for the given directory, relative to httpBase
+func feedURL(snowflake string, fpath string) string {
+	p := strings.TrimSuffix(fpath, "/")
+	if len(p) == 0 {
+		p = "/"
+	}
+	return "feed" + p + ".xml?" + url.Values{
+		"user":  {snowflake},
+		"token": {feedToken(snowflake, fpath)},
+	}.Encode()
+}
+
+// handler for http://andesite/feed/*.xml
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, ".xml") {
+		writeUserDenied(r, w, true, false)
+		return
+	}
+	fpath, err := sanitizeRequestPath(r, strings.TrimSuffix(r.URL.Path[5:], ".xml")+"/")
+	if err != nil {
+		writeUserDenied(r, w, true, false)
+		return
+	}
+	snowflake := r.URL.Query().Get("user")
+	token := r.URL.Query().Get("token")
+	if !checkLockout(r, w, AuthFeedToken, snowflake) {
+		return
+	}
+	if !hmac.Equal([]byte(token), []byte(feedToken(snowflake, fpath))) {
+		recordAuthFailure(r, AuthFeedToken, snowflake)
+		writeStatus(r, w, http.StatusForbidden)
+		writeResponse(r, w, "Forbidden", "Invalid feed token.", "")
+		return
+	}
+	clearAuthFailures(AuthFeedToken, snowflake)
+	user, ok := queryUserBySnowflake(snowflake)
+	if !ok {
+		writeUserDenied(r, w, true, false)
+		return
+	}
+	if !user.enabled {
+		writeSuspended(r, w, user)
+		return
+	}
+	ua := queryAccess(user)
+
+	entries, err := newestFiles(fpath, func(wf WatchedFile) bool {
+		for _, item := range ua {
+			if pathHasPrefix(wf.Path, item) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	base := fullHost(r) + httpBase
+	feed := AtomFeed{
+		Title:   "Andesite: " + fpath,
+		ID:      base + "files" + fpath,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Link:    AtomLink{base + "files" + fpath},
+	}
+	if indexWarming() {
+		feed.Subtitle = "The file index is still warming up, some files may be missing."
+	}
+	if len(entries) > 0 {
+		feed.Updated = entries[0].info.ModTime().UTC().Format(time.RFC3339)
+	}
+	for _, item := range entries {
+		u := base + "files" + item.Path
+		feed.Entries = append(feed.Entries, AtomEntry{
+			Title:   item.Name,
+			ID:      u,
+			Updated: item.info.ModTime().UTC().Format(time.RFC3339),
+			Link:    AtomLink{u},
+		})
+	}
+	w.Header().Add("Content-Type", "application/atom+xml")
+	bytes, _ := xml.Marshal(feed)
+	w.Write([]byte(xml.Header))
+	w.Write(bytes)
+}
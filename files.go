@@ -0,0 +1,325 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// resolveWritable returns the filesystem location of fpath for changing it. Unlike resolvePath it
+// follows symlinks in the parent directories, so that a link can not be used to reach outside
+// of the root. The last element itself is not followed, so a link is changed and not its target.
+// The folders Andesite keeps its own files in can not be changed this way.
+func resolveWritable(fpath string) (string, error) {
+	if isInternalPath(fpath) {
+		return "", E("path is reserved for Andesite")
+	}
+	full, err := resolvePath(rootDir.Base(), fpath)
+	if err != nil {
+		return "", err
+	}
+	base, err := filepath.EvalSymlinks(rootDir.Base())
+	if err != nil {
+		return "", err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(strings.TrimSuffix(full, string(filepath.Separator))))
+	if err != nil {
+		return "", E("parent directory does not exist")
+	}
+	if parent != base && !strings.HasPrefix(parent, base+string(filepath.Separator)) {
+		return "", E("path escapes the root")
+	}
+	return filepath.Join(parent, filepath.Base(full)), nil
+}
+
+// internalDirs are the folders in the root that Andesite keeps its own files in, they are left
+// out of the index and can not be changed through the file APIs
+var internalDirs = []string{trashDirName, uploadDirName}
+
+// isInternalPath returns true if fpath is one of internalDirs or in one
+func isInternalPath(fpath string) bool {
+	for _, item := range internalDirs {
+		if fpath == "/"+item || strings.HasPrefix(fpath, "/"+item+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// asDirPath adds the trailing slash that access rules use for directories
+func asDirPath(fpath string, isDir bool) string {
+	if isDir && !strings.HasSuffix(fpath, "/") {
+		return fpath + "/"
+	}
+	if !isDir {
+		return strings.TrimSuffix(fpath, "/")
+	}
+	return fpath
+}
+
+// isGrantRoot returns true if fpath is the folder one of the grants is on, which would leave
+// the grant pointing at nothing if it were changed
+func isGrantRoot(grants []UserAccessRow, fpath string) bool {
+	for _, item := range grants {
+		if item.path == fpath {
+			return true
+		}
+	}
+	return false
+}
+
+// movePath renames src to dst on disk. The access rules and shares on from, or anything in it
+// when it is a folder, are then moved along to to in one transaction, so that nobody loses access
+// or gains it to something else. The rename is undone if they can not be.
+func movePath(src string, dst string, from string, to string, isDir bool) error {
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if err := movePathRules(from, to, isDir); err != nil {
+		if err2 := os.Rename(dst, src); err2 != nil {
+			LogError("[files]", F("could not move %s back to %s: %s", dst, src, err2.Error()))
+		}
+		return err
+	}
+	return nil
+}
+
+func movePathRules(from string, to string, isDir bool) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"access", "shares", "stored_files"} {
+		only := ""
+		if table == "stored_files" {
+			// what is in the trash is restored to where it was
+			only = " and trash = -1"
+		}
+		if isDir {
+			_, err = tx.Exec("update "+table+" set path = ? || substr(path, length(?) + 1) where substr(path, 1, length(?)) = ?"+only, to, from, from, from)
+		} else {
+			_, err = tx.Exec("update "+table+" set path = ? where path = ?"+only, to, from)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// forgetPath removes what the database keeps about fpath, and everything in it when it is a
+// folder, once it is deleted. The watcher does the same for changes made outside of Andesite, but
+// it may be off or running on another node.
+func forgetPath(fpath string) {
+	file := strings.TrimSuffix(fpath, "/")
+	dir := file + "/"
+	database.QueryPrepared(true, "delete from files where path = ? or substr(path,1,length(?)) = ?", file, dir, dir)
+	database.QueryPrepared(true, "delete from shares where path = ? or substr(path,1,length(?)) = ?", fpath, dir, dir)
+	database.QueryPrepared(true, "delete from dir_sizes where substr(path,1,length(?)) = ?", dir, dir)
+	forgetChecksums(file)
+	markDirSizeDirty(dirParent(dir))
+	recordFileChange(FileEventRemove, file)
+}
+
+// movePathRecords moves the index entries, folder sizes, and checksums of from to to after it
+// was renamed, so that they don't have to be found and computed again
+func movePathRecords(from string, to string, isDir bool) {
+	if !isDir {
+		database.QueryPrepared(true, "update files set path = ?, name = ? where path = ?", to, path.Base(to), from)
+		database.QueryPrepared(true, "update checksums set path = ?, parent = ? where path = ?", to, dirParent(to), from)
+	} else {
+		database.QueryPrepared(true, "update files set path = ? || substr(path, length(?) + 1) where substr(path,1,length(?)) = ?", to, from, from, from)
+		database.QueryPrepared(true, "update checksums set path = ? || substr(path, length(?) + 1), parent = ? || substr(parent, length(?) + 1) where substr(path,1,length(?)) = ?", to, from, to, from, from, from)
+		database.QueryPrepared(true, "update dir_sizes set path = ? || substr(path, length(?) + 1), parent = ? || substr(parent, length(?) + 1) where substr(path,1,length(?)) = ? and path != ?", to, from, to, from, from, from, from)
+		database.QueryPrepared(true, "update dir_sizes set path = ?, parent = ? where path = ?", to, dirParent(to), from)
+	}
+	markDirSizeDirty(dirParent(asDirPath(from, true)))
+	markDirSizeDirty(dirParent(asDirPath(to, true)))
+	recordFileChange(FileEventRemove, strings.TrimSuffix(from, "/"))
+	recordFileChange(FileEventAdd, asDirPath(to, isDir))
+}
+
+//
+//
+
+// handler for http://andesite/api/file/delete
+func handleFileDelete(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "path", Kind: FieldPath})
+	if !ok {
+		return
+	}
+	grants := queryAccessGrants(user)
+	if !hasPathPerm(user, grants, asDirPath(vf.Get("path"), true), AccessDelete) {
+		writeAPIResponse(r, w, false, F("You are not allowed to delete %s", vf.Get("path")))
+		return
+	}
+	full, err := resolveWritable(vf.Get("path"))
+	if err != nil {
+		writeAPIResponse(r, w, false, F("Invalid path: %s", err.Error()))
+		return
+	}
+	info, err := os.Lstat(full)
+	if err != nil {
+		writeAPIResponse(r, w, false, "File does not exist")
+		return
+	}
+	fpath := asDirPath(vf.Get("path"), info.IsDir())
+	if !hasPathPerm(user, grants, fpath, AccessDelete) {
+		writeAPIResponse(r, w, false, F("You are not allowed to delete %s", fpath))
+		return
+	}
+	if fpath == "/" || isGrantRoot(grants, fpath) {
+		writeAPIResponse(r, w, false, F("%s is the folder your access is on and can not be deleted", fpath))
+		return
+	}
+	if trashEnabled() {
+		if info.IsDir() && !requireConfirmation(r, w, user, []string{F("Move the folder %s and everything in it to the trash", fpath)}) {
+			return
+		}
+		if err := moveToTrash(full, fpath, info.IsDir(), user.snowflake); err != nil {
+			writeAPIResponse(r, w, false, F("Could not move %s to the trash: %s", fpath, err.Error()))
+			return
+		}
+		forgetPath(fpath)
+		auditLog(r, user.snowflake, "file.delete", fpath, "trash")
+		runHooks(HookDelete, hookUserEnv(map[string]string{"ANDESITE_PATH": fpath, "ANDESITE_TRASH": "1"}, user))
+		writeAPIResponse(r, w, true, F("Moved %s to the trash, an admin can restore it for %d days.", fpath, config.Trash.Days))
+		return
+	}
+	if info.IsDir() && !requireConfirmation(r, w, user, []string{F("Delete the folder %s and everything in it", fpath)}) {
+		return
+	}
+	if err := os.RemoveAll(full); err != nil {
+		writeAPIResponse(r, w, false, F("Could not delete %s: %s", fpath, err.Error()))
+		return
+	}
+	forgetPath(fpath)
+	releaseStored(fpath, -1)
+	auditLog(r, user.snowflake, "file.delete", fpath, "")
+	runHooks(HookDelete, hookUserEnv(map[string]string{"ANDESITE_PATH": fpath, "ANDESITE_TRASH": "0"}, user))
+	writeAPIResponse(r, w, true, F("Deleted %s.", fpath))
+}
+
+// handler for http://andesite/api/file/rename
+func handleFileRename(w http.ResponseWriter, r *http.Request) {
+	handleMove(w, r, false)
+}
+
+// handler for http://andesite/api/dir/move
+func handleDirMove(w http.ResponseWriter, r *http.Request) {
+	handleMove(w, r, true)
+}
+
+func handleMove(w http.ResponseWriter, r *http.Request, dirOnly bool) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "path", Kind: FieldPath},
+		FormField{Name: "to", Kind: FieldPath},
+	)
+	if !ok {
+		return
+	}
+	grants := queryAccessGrants(user)
+	for _, item := range []string{vf.Get("path"), vf.Get("to")} {
+		if !hasPathPerm(user, grants, asDirPath(item, true), AccessWrite) {
+			writeAPIResponse(r, w, false, F("You are not allowed to write to %s", item))
+			return
+		}
+	}
+	src, err := resolveWritable(vf.Get("path"))
+	if err != nil {
+		writeAPIResponse(r, w, false, F("Invalid path: %s", err.Error()))
+		return
+	}
+	dst, err := resolveWritable(vf.Get("to"))
+	if err != nil {
+		writeAPIResponse(r, w, false, F("Invalid destination: %s", err.Error()))
+		return
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		writeAPIResponse(r, w, false, "File does not exist")
+		return
+	}
+	if dirOnly && !info.IsDir() {
+		writeAPIResponse(r, w, false, F("%s is not a folder", vf.Get("path")))
+		return
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		writeAPIResponse(r, w, false, "The destination already exists")
+		return
+	}
+	from := asDirPath(vf.Get("path"), info.IsDir())
+	to := asDirPath(vf.Get("to"), info.IsDir())
+	for _, item := range []string{from, to} {
+		if !hasPathPerm(user, grants, item, AccessWrite) {
+			writeAPIResponse(r, w, false, F("You are not allowed to write to %s", item))
+			return
+		}
+	}
+	if from == "/" || isGrantRoot(grants, from) {
+		writeAPIResponse(r, w, false, F("%s is the folder your access is on and can not be renamed", from))
+		return
+	}
+	if info.IsDir() && strings.HasPrefix(to, from) {
+		writeAPIResponse(r, w, false, "A folder can not be moved into itself")
+		return
+	}
+	if err := movePath(src, dst, from, to, info.IsDir()); err != nil {
+		writeAPIResponse(r, w, false, F("Could not rename %s: %s", from, err.Error()))
+		return
+	}
+	movePathRecords(from, to, info.IsDir())
+	if dirOnly {
+		auditLog(r, user.snowflake, "dir.move", from, to)
+		writeAPIResponse(r, w, true, F("Moved %s to %s.", from, to))
+		return
+	}
+	auditLog(r, user.snowflake, "file.rename", from, to)
+	writeAPIResponse(r, w, true, F("Renamed %s to %s.", from, to))
+}
+
+// handler for http://andesite/api/dir/create
+func handleDirCreate(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "path", Kind: FieldPath})
+	if !ok {
+		return
+	}
+	fpath := asDirPath(vf.Get("path"), true)
+	if !hasPathPerm(user, queryAccessGrants(user), fpath, AccessWrite) {
+		writeAPIResponse(r, w, false, F("You are not allowed to write to %s", fpath))
+		return
+	}
+	full, err := resolveWritable(fpath)
+	if err != nil {
+		writeAPIResponse(r, w, false, F("Invalid path: %s", err.Error()))
+		return
+	}
+	if _, err := os.Lstat(full); err == nil {
+		writeAPIResponse(r, w, false, F("%s already exists", fpath))
+		return
+	}
+	if err := os.Mkdir(full, 0755); err != nil {
+		writeAPIResponse(r, w, false, F("Could not create %s: %s", fpath, err.Error()))
+		return
+	}
+	auditLog(r, user.snowflake, "dir.create", fpath, "")
+	writeAPIResponse(r, w, true, F("Created %s.", fpath))
+}
@@ -30,9 +30,14 @@ func scanFile(rows *sql.Rows) WatchedFile {
 //
 //
 
+// events wait here while earlier ones are written to the index, its length is the backlog shown
+// in the admin stats
+const watchQueueSize = 4096
+
 var (
-	watcher *fsnotify.Watcher
-	wRoot   string
+	watcher    *fsnotify.Watcher
+	wRoot      string
+	watchQueue = make(chan fsnotify.Event, watchQueueSize)
 )
 
 func initFsWatcher() {
@@ -41,47 +46,88 @@ func initFsWatcher() {
 	wRoot = rootDir.Base()
 	database.CreateTableStruct("files", WatchedFile{})
 
-	if err := filepath.Walk(wRoot, wWatchDir); err != nil {
-		util.LogError(err)
-	}
+	// the server is already up, search and feeds say they may be incomplete until this is done
+	startIndexStatus()
+	indexTree(wRoot)
+	finishIndexStatus()
+	initMountRescans(wRoot)
+	initDirSizes()
+	initChecksumScan()
 
+	go func() {
+		for event := range watcher.Events {
+			watchQueue <- event
+		}
+	}()
 	go func() {
 		for {
 			select {
-			case event := <-watcher.Events:
+			case event := <-watchQueue:
 				// util.Log("fsnotify", "event", event.Name, event.Op.String())
 				r0 := strings.TrimPrefix(event.Name, wRoot)
 				r1 := strings.Replace(r0, string(filepath.Separator), "/", -1)
+				if isInternalPath(r1) {
+					continue
+				}
+				invalidateListing(filepath.Dir(event.Name))
+				markDirSizeDirty(dirParent(r1 + "/"))
 				switch event.Op {
 				case fsnotify.Rename, fsnotify.Remove:
-					if sqlite.QueryHasRows(database.QueryPrepared(false, "select * from files where path = ?", r1)) {
+					invalidateListing(event.Name)
+					forgetChecksums(r1)
+					rows, err := database.QueryPrepared(false, "select * from files where path = ?", r1)
+					if err != nil {
+						continue
+					}
+					if sqlite.QueryHasRows(rows) {
 						database.QueryPrepared(true, "delete from files where path = ?", r1)
 					} else {
 						r2 := r1 + "/"
 						database.QueryPrepared(true, "delete from files where substr(path,1,length(?)) = ?", r2, r2)
 					}
 					util.Log("[file-index-del]", r1)
+					fireFileEvent(FileEventRemove, r1)
 				case fsnotify.Create:
-					f, _ := os.Stat(event.Name)
+					f, err := os.Stat(event.Name)
+					if err != nil || isIgnoredPath(asDirPath(r1, f.IsDir())) {
+						continue
+					}
 					if !f.IsDir() {
 						n := f.Name()
-						i := database.QueryNextID("files")
+						i, err := database.QueryNextID("files")
+						if err != nil {
+							continue
+						}
 						database.QueryPrepared(true, "insert into files values (?, ?, ?)", i, r1, n)
 						util.Log("[file-index-add]", r1)
+						fireFileEvent(FileEventAdd, r1)
 					} else {
 						if err := filepath.Walk(event.Name, wWatchDir); err != nil {
 							util.LogError(err)
 						}
+						recordFileChange(FileEventAdd, r1+"/")
 					}
+				case fsnotify.Write:
+					fireFileEvent(FileEventModify, r1)
 				}
 			case err := <-watcher.Errors:
 				util.LogError("[fsnotify]", err)
+				alertAdmins("watcher", "alert_watcher", map[string]interface{}{"error": err.Error()})
 			}
 		}
 	}()
 }
 
 func wWatchDir(path string, fi os.FileInfo, err error) error {
+	if err != nil {
+		return nil
+	}
+	if isIgnoredPath(asDirPath(filepath.ToSlash(strings.TrimPrefix(path, wRoot)), fi.IsDir())) {
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
 	if fi.IsDir() {
 		return watcher.Add(path)
 	}
@@ -91,10 +137,14 @@ func wWatchDir(path string, fi os.FileInfo, err error) error {
 
 func wAddFile(path string, name string) {
 	pth := strings.Replace(path, string(filepath.Separator), "/", -1)
-	if sqlite.QueryHasRows(database.QueryPrepared(false, "select * from files where path = ?", pth)) {
+	rows, err := database.QueryPrepared(false, "select * from files where path = ?", pth)
+	if err != nil || sqlite.QueryHasRows(rows) {
+		return
+	}
+	id, err := database.QueryNextID("files")
+	if err != nil {
 		return
 	}
-	id := database.QueryNextID("files")
 	database.QueryPrepared(true, "insert into files values (?, ?, ?)", id, pth, name)
 	util.Log("[file-index-add]", pth)
 }
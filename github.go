@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+const githubAPI = "https://api.github.com"
+
+var githubClient = &http.Client{Timeout: time.Second * 10}
+
+func validateGitHubGate(cfg *ConfigIDP) error {
+	if cfg == nil {
+		return nil
+	}
+	if len(cfg.Team) > 0 && len(cfg.Org) == 0 {
+		return E("github.team requires github.org")
+	}
+	if len(cfg.Org) > 0 && len(cfg.Token) == 0 {
+		return E("github.org requires github.token with the read:org scope, to see private members")
+	}
+	return nil
+}
+
+func githubGet(app *ConfigIDP, path string) (*http.Response, error) {
+	req, _ := http.NewRequest(http.MethodGet, githubAPI+path, nil)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+app.Token)
+	return githubClient.Do(req)
+}
+
+// githubGate only lets in members of github.org, and if github.team is set, only members of that
+// team. name is the user's login. The org and team become their groups.
+func githubGate(app *ConfigIDP, id string, name string) ([]string, error) {
+	if len(app.Org) == 0 {
+		return nil, nil
+	}
+	org, login := url.PathEscape(app.Org), url.PathEscape(name)
+	if len(app.Team) == 0 {
+		res, err := githubGet(app, "/orgs/"+org+"/members/"+login)
+		if err != nil {
+			return nil, E("Unable to reach GitHub to check your organization membership, please try again later.")
+		}
+		res.Body.Close()
+		switch res.StatusCode {
+		case http.StatusNoContent:
+			return []string{app.Org}, nil
+		case http.StatusNotFound, http.StatusFound:
+			return nil, E(F("You must be a member of the '%s' GitHub organization to log in.", app.Org))
+		}
+		return nil, E(F("GitHub responded '%s' when checking your organization membership, please try again later.", res.Status))
+	}
+	res, err := githubGet(app, "/orgs/"+org+"/teams/"+url.PathEscape(app.Team)+"/memberships/"+login)
+	if err != nil {
+		return nil, E("Unable to reach GitHub to check your team membership, please try again later.")
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, E(F("You must be a member of the '%s/%s' GitHub team to log in.", app.Org, app.Team))
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, E(F("GitHub responded '%s' when checking your team membership, please try again later.", res.Status))
+	}
+	membership := struct {
+		State string `json:"state"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&membership); err != nil {
+		return nil, err
+	}
+	if membership.State != "active" {
+		return nil, E(F("Your invitation to the '%s/%s' GitHub team must be accepted before you can log in.", app.Org, app.Team))
+	}
+	return []string{app.Org, app.Org + "/" + app.Team}, nil
+}
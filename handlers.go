@@ -5,41 +5,93 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"mime"
+	"io"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
-
-	"github.com/nektro/go.etc"
+	"sync/atomic"
+	"time"
 
 	. "github.com/nektro/go-util/alias"
 	. "github.com/nektro/go-util/util"
 )
 
 func helperIsLoggedIn(r *http.Request) bool {
-	sess := etc.GetSession(r)
+	sess := getSession(r)
 	_, ok := sess.Values["user"]
 	return ok
 }
 
-func helperOA2SaveInfo(w http.ResponseWriter, r *http.Request, provider string, id string, name string) {
-	sess := etc.GetSession(r)
-	sess.Values["user"] = id
-	sess.Values["name"] = name
-	sess.Save(r, w)
-	queryAssertUserName(id, name)
-	Log("[user-login]", provider, id, name)
+// helperOA2SaveInfo saves users of lp by their ID as shown in Andesite, see externalSnowflake
+func helperOA2SaveInfo(lp LoginProvider) func(http.ResponseWriter, *http.Request, string, string, string) {
+	return func(w http.ResponseWriter, r *http.Request, provider string, id string, name string) {
+		sess := getSession(r)
+		if gate, ok := loginGates[lp.key]; ok && lp.app != nil {
+			groups, err := gate(lp.app, id, name)
+			if err != nil {
+				Log("[user-login-denied]", provider, id, name, err.Error())
+				auditFailure(r, externalSnowflake(lp.key, lp.dbp+id), "login", lp.key, err.Error())
+				sess.Values["login_error"] = err.Error()
+				sess.Save(r, w)
+				return
+			}
+			sess.Values["groups"] = strings.Join(groups, ",")
+		} else if lp.key != "proxy" {
+			// the proxy has already set them from its headers
+			delete(sess.Values, "groups")
+			delete(sess.Values, "email")
+		}
+		id = externalSnowflake(lp.key, lp.dbp+id)
+		if user, ok := queryUserBySnowflake(id); ok && !user.enabled {
+			Log("[user-login-denied]", provider, id, name, "suspended")
+			auditFailure(r, id, "login", lp.key, "suspended")
+			sess.Values["login_error"] = suspendedMessage(user)
+			sess.Save(r, w)
+			return
+		}
+		first, err := queryAssertUserName(id, name)
+		if err != nil {
+			LogError("[user-login]", provider, id, err.Error())
+			sess.Values["login_error"] = "Your account could not be saved, please try again."
+			sess.Save(r, w)
+			return
+		}
+		sess.Values["user"] = id
+		sess.Values["name"] = name
+		delete(sess.Values, "login_with")
+		bindSession(r, sess.Values)
+		user, _ := queryUserBySnowflake(id)
+		queryDoUpdate("users", "last_login", timeNow(), "id", strconv.Itoa(user.id))
+		if first && len(live().provision) > 0 {
+			groups, _ := sess.Values["groups"].(string)
+			email, _ := sess.Values["email"].(string)
+			provisionAccess(user, lp.key, email, strings.Split(groups, ","))
+		}
+		if first {
+			postDiscord(r, DiscordEventLogin, "New user logged in", []DiscordField{
+				discordUserField("User", user),
+				{"Provider", lp.key, true},
+			})
+		}
+		// a new login always gets a new session record
+		if old, ok := sess.Values["sid"].(string); ok {
+			deleteSessions("sid = ?", old)
+		}
+		recordSession(r, sess.Values, id)
+		sess.Save(r, w)
+		Log("[user-login]", provider, id, name)
+		auditLog(r, id, "login", lp.key, "")
+	}
 }
 
 // handler for http://andesite/test
 func handleTest(w http.ResponseWriter, r *http.Request) {
 	// sessions test
 	// increment number every refresh
-	sess := etc.GetSession(r)
+	sess := getSession(r)
 	i := sess.Values["int"]
 	if i == nil {
 		i = 0
@@ -50,9 +102,11 @@ func handleTest(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, strconv.Itoa(j))
 }
 
-func handleDirectoryListing(getAccess func(http.ResponseWriter, *http.Request) (string, []string, string, string, bool, error)) func(http.ResponseWriter, *http.Request) {
+// handleDirectoryListing serves files and folders to whoever getAccess says the request is from.
+// signed is set once getAccess has verified the signature of a signed link.
+func handleDirectoryListing(getAccess func(http.ResponseWriter, *http.Request) (string, []string, string, string, bool, bool, error)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		qpath, uAccess, uID, uName, isAdmin, err := getAccess(w, r)
+		qpath, uAccess, uID, uName, isAdmin, signed, err := getAccess(w, r)
 
 		// if getAccess errored, response has already been written
 		if err != nil {
@@ -60,34 +114,69 @@ func handleDirectoryListing(getAccess func(http.ResponseWriter, *http.Request) (
 		}
 
 		// disallow path tricks
-		if strings.Contains(string(r.URL.Path), "..") {
+		qpath, err = sanitizeRequestPath(r, qpath)
+		if err != nil {
+			writeUserDenied(r, w, true, false)
 			return
 		}
 
-		// disallow exploring dotfile folders
-		if strings.Contains(qpath, "/.") {
+		// admins may ask why a request was allowed or denied
+		if isAdmin && r.URL.Query().Get("trace") == "1" {
+			handleAccessTrace(w, r, qpath, uID, uAccess)
+			return
+		}
+
+		// disallow exploring hidden and ignored files
+		if isIgnoredPath(qpath) {
 			writeUserDenied(r, w, true, false)
 			return
 		}
 
 		// valid path check
 		stat, err := rootDir.Stat(qpath)
-		if os.IsNotExist(err) {
+		arc, inner, ab, inArchive := "", "", ArchiveBrowser{}, false
+		if err != nil {
+			arc, inner, ab, inArchive = splitArchivePath(qpath)
+		}
+		if err != nil && !inArchive && !isChecksumsFile(qpath) {
 			// 404
 			writeUserDenied(r, w, true, false)
 			return
 		}
 
+		// share links may only allow some operations
+		perms := allSharePerms
+		if strings.HasPrefix(r.URL.Path, "/open/") {
+			perms = querySharePerms(uID)
+		}
+
+		// the insides of archives are browsed like folders
+		if inArchive {
+			handleArchiveBrowse(w, r, arc, inner, ab, uAccess, uID, perms, func(files []os.FileInfo) {
+				writeListing(w, r, qpath, files, uAccess, uID, uName, isAdmin, true)
+			})
+			return
+		}
+
+		// every directory has a SHA256SUMS of its files
+		if err != nil {
+			if !Contains(perms, ShareBrowse) {
+				writeShareForbidden(r, w, "This share link does not allow browsing, use a link to a file in it.")
+				return
+			}
+			handleChecksumsFile(w, r, dirParent(qpath), uAccess)
+			return
+		}
+
 		// server file/folder
 		if stat.IsDir() {
-			w.Header().Add("Content-Type", "text/html")
-
 			// get list of all files
 			files, _ := rootDir.ReadDir(qpath)
 
-			// hide dot files
+			// hide dot files and ignored files
+			rules := ignoreRulesFor(qpath)
 			files = filter(files, func(x os.FileInfo) bool {
-				return !strings.HasPrefix(x.Name(), ".")
+				return !isHiddenEntry(rules, qpath+x.Name(), x.IsDir())
 			})
 
 			// amount of files in the directory
@@ -98,7 +187,7 @@ func handleDirectoryListing(getAccess func(http.ResponseWriter, *http.Request) (
 				ok := false
 				fpath := qpath + x.Name()
 				for _, item := range uAccess {
-					if strings.HasPrefix(item, fpath) || strings.HasPrefix(qpath, item) {
+					if pathHasPrefix(item, fpath) || pathHasPrefix(qpath, item) {
 						ok = true
 					}
 				}
@@ -113,45 +202,31 @@ func handleDirectoryListing(getAccess func(http.ResponseWriter, *http.Request) (
 				return
 			}
 
-			data := make([]map[string]string, len(files))
-			gi := 0
-			for i := 0; i < len(files); i++ {
-				name := files[i].Name()
-				a := ""
-				if files[i].IsDir() || files[i].Mode()&os.ModeSymlink != 0 {
-					a = name + "/"
-				} else {
-					a = name
-				}
-				ext := filepath.Ext(a)
-				if files[i].IsDir() {
-					ext = ".folder"
-				}
-				if len(ext) == 0 {
-					ext = ".asc"
+			if f := r.URL.Query().Get("archive"); len(f) > 0 {
+				if !Contains(perms, ShareDownload) {
+					writeShareForbidden(r, w, "This share link does not allow downloads.")
+					return
 				}
-				data[gi] = map[string]string{
-					"name": a,
-					"size": byteCountIEC(files[i].Size()),
-					"mod":  files[i].ModTime().UTC().String()[:19],
-					"ext":  ext[1:],
-				}
-				gi++
+				handleArchive(w, r, qpath, uAccess, uID, f)
+				return
 			}
 
-			writeHandlebarsFile(r, w, "/listing.hbs", map[string]interface{}{
-				"user":  uID,
-				"path":  qpath,
-				"files": data,
-				"admin": isAdmin,
-				"base":  httpBase,
-				"name":  oauth2Provider.idp.NamePrefix + uName,
-			})
+			if !Contains(perms, ShareBrowse) {
+				writeShareForbidden(r, w, "This share link does not allow browsing, use a link to a file in it.")
+				return
+			}
+
+			if r.URL.Query().Get("og") == "png" {
+				handleOGImage(w, r, qpath, uAccess, uID)
+				return
+			}
+
+			writeListing(w, r, qpath, files, uAccess, uID, uName, isAdmin, false)
 		} else {
 			// access check
 			can := false
 			for _, item := range uAccess {
-				if strings.HasPrefix(qpath, item) {
+				if pathHasPrefix(qpath, item) {
 					can = true
 				}
 			}
@@ -159,20 +234,227 @@ func handleDirectoryListing(getAccess func(http.ResponseWriter, *http.Request) (
 				writeUserDenied(r, w, true, false)
 				return
 			}
+			// shares of a single file unfurl with a card as folders do
+			if strings.HasPrefix(r.URL.Path, "/open/") {
+				if r.URL.Query().Get("og") == "png" {
+					handleOGImage(w, r, qpath, uAccess, uID)
+					return
+				}
+				if len(r.URL.RawQuery) == 0 && isLinkPreviewer(r) {
+					handleShareCard(w, r, qpath, uAccess, uID, perms)
+					return
+				}
+			}
+			if !checkHotlink(r, w, qpath, signed) {
+				return
+			}
+			if !shareAllowsFile(perms, r) {
+				writeShareForbidden(r, w, "This share link only allows playing files in the browser.")
+				return
+			}
+			if len(r.URL.Query().Get("thumb")) > 0 {
+				handleThumbnail(w, r, qpath, stat)
+				return
+			}
+			if algo := r.URL.Query().Get("checksum"); len(algo) > 0 {
+				handleChecksum(w, r, qpath, stat, algo)
+				return
+			}
+			ctype, disposition, allowed := contentHeaders(qpath, !Contains(perms, ShareDownload))
+			if !allowed {
+				writeShareForbidden(r, w, "This file may only be downloaded, which this share link does not allow.")
+				return
+			}
+			release, ok := acquireDownload(r, w)
+			if !ok {
+				return
+			}
+			defer release()
 
-			w.Header().Add("Content-Type", mime.TypeByExtension(path.Ext(qpath)))
 			file, _ := rootDir.ReadFile(qpath)
 			info, _ := rootDir.Stat(qpath)
-			http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+			serve := func(w http.ResponseWriter, file io.ReadSeeker) {
+				setContentHeaders(w, info.Name(), ctype, disposition)
+				setETag(w, info)
+				http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+			}
+			if strings.HasPrefix(r.URL.Path, "/open/") {
+				sw := &StatusWriter{ResponseWriter: w}
+				serve(sw, throttle(file, config.Quotas.Speed))
+				if isWholeDownload(r, sw) {
+					full, _ := resolvePath(rootDir.Base(), qpath)
+					runHooks(HookShareDownload, map[string]string{"ANDESITE_PATH": qpath, "ANDESITE_FILE": full, "ANDESITE_SHARE": uID, "ANDESITE_IP": clientIP(r)})
+				}
+				return
+			}
+			if !strings.HasPrefix(r.URL.Path, "/files/") {
+				serve(w, file)
+				return
+			}
+			user, ok := queryUserBySnowflake(uID)
+			if ok && !checkBandwidthQuota(r, w, user) {
+				return
+			}
+			sw := &StatusWriter{ResponseWriter: w}
+			serve(sw, throttle(file, downloadSpeed(user, ok)))
+			if ok {
+				logDownload(r, user, qpath, sw)
+			}
+		}
+	}
+}
+
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeListing responds with the entries files of the directory qpath, as JSON or as a page.
+// inArchive is set for folders inside an archive, which can not be changed or have a feed.
+func writeListing(w http.ResponseWriter, r *http.Request, qpath string, files []os.FileInfo, uAccess []string, uID string, uName string, isAdmin bool, inArchive bool) {
+	if r.URL.Query().Get("format") == "txt" {
+		// archives are only listed one folder at a time
+		writeListingText(w, r, qpath, files, uAccess, !inArchive && r.URL.Query().Get("recursive") == "1")
+		return
+	}
+	if !inArchive {
+		files = withDirSizes(qpath, files)
+	}
+	sortKey, sortOrder := listingSort(r, w)
+	sortListing(files, sortKey, sortOrder)
+	page, perPage := listingPage(r)
+	total := len(files)
+	if wantsJSON(r) {
+		resp := map[string]interface{}{
+			"response": "good",
+			"path":     qpath,
+			"files":    listingEntries(qpath, files),
+			"total":    total,
+			"sort":     sortKey,
+			"order":    sortOrder,
+		}
+		if isPaged(r) {
+			pageFiles, page, pages := pageOf(files, page, perPage)
+			resp["files"] = listingEntries(qpath, pageFiles)
+			resp["page"] = page
+			resp["per_page"] = perPage
+			resp["pages"] = pages
+		}
+		writeJSON(w, resp)
+		return
+	}
+	files, page, pages := pageOf(files, page, perPage)
+
+	data := make([]map[string]string, len(files))
+	gi := 0
+	for i := 0; i < len(files); i++ {
+		name := files[i].Name()
+		a := ""
+		if files[i].IsDir() || files[i].Mode()&os.ModeSymlink != 0 {
+			a = name + "/"
+		} else {
+			a = name
+		}
+		ext := filepath.Ext(a)
+		if files[i].IsDir() {
+			ext = ".folder"
+		}
+		if len(ext) == 0 {
+			ext = ".asc"
 		}
+		data[gi] = map[string]string{
+			"index": strconv.Itoa((page-1)*perPage + i),
+			"name":  a,
+			"size":  byteCountIEC(files[i].Size()),
+			"mod":   files[i].ModTime().UTC().String()[:19],
+			"ext":   ext[1:],
+		}
+		// archives can be opened like a folder
+		if _, ok := archiveBrowserFor(name); ok && !inArchive && files[i].Mode().IsRegular() {
+			data[gi]["browse"] = name + "/"
+		}
+		gi++
+	}
+
+	feed := ""
+	notices := []string{}
+	canWrite, canDelete := false, false
+	if strings.HasPrefix(r.URL.Path, "/files/") && !inArchive {
+		feed = httpBase + feedURL(uID, qpath)
+		if u, ok := queryUserBySnowflake(uID); ok {
+			notices = accessRequestNotices(u)
+			grants := queryAccessGrants(u)
+			canWrite = !isReadOnly() && hasPathPerm(u, grants, qpath, AccessWrite)
+			canDelete = !isReadOnly() && hasPathPerm(u, grants, qpath, AccessDelete)
+		}
+	}
+	var summary, og interface{}
+	if strings.HasPrefix(r.URL.Path, "/open/") && !inArchive {
+		summary = shareSummary(uID, uAccess, qpath)
+		og = shareMeta(r, qpath, uAccess, uID, querySharePerms(uID))
 	}
+
+	writeHandlebarsFile(r, w, "/listing.hbs", map[string]interface{}{
+		"user":       uID,
+		"path":       qpath,
+		"files":      data,
+		"admin":      isAdmin,
+		"base":       httpBase,
+		"name":       displayName(uID, uName),
+		"feed":       feed,
+		"summary":    summary,
+		"notices":    notices,
+		"requests":   strings.HasPrefix(r.URL.Path, "/files/"),
+		"og_image":   fullHost(r) + httpBase + r.URL.Path[1:] + "?og=png",
+		"og":         og,
+		"can_write":  canWrite,
+		"can_delete": canDelete,
+		"page":       page,
+		"pages":      pages,
+		"per_page":   perPage,
+		"total":      total,
+		"prev_page":  page - 1,
+		"next_page":  nextPage(page, pages),
+		"sort":       listingSortLinks(sortKey, sortOrder),
+		"in_archive": inArchive,
+		"basket":     strings.HasPrefix(r.URL.Path, "/files/") && !inArchive,
+	})
+}
+
+func listingEntries(dir string, files []os.FileInfo) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, item := range files {
+		t := "file"
+		if item.IsDir() || item.Mode()&os.ModeSymlink != 0 {
+			t = "directory"
+		}
+		result = append(result, map[string]interface{}{
+			"name":  item.Name(),
+			"size":  item.Size(),
+			"mtime": item.ModTime().UTC().Unix(),
+			"type":  t,
+		})
+	}
+	withChecksums(dir, files, result)
+	return result
 }
 
 // handler for http://andesite/files/*
-func handleFileListing(w http.ResponseWriter, r *http.Request) (string, []string, string, string, bool, error) {
+func handleFileListing(w http.ResponseWriter, r *http.Request) (string, []string, string, string, bool, bool, error) {
+	// signed links to a file work without a session
+	if isSignedRequest(r) {
+		user, ok := checkSignedLink(r, w, r.URL.Path[6:])
+		if !ok {
+			return "", []string{}, "", "", false, false, errors.New("")
+		}
+		return r.URL.Path[6:], queryAccess(user), user.snowflake, user.name, false, true, nil
+	}
+
 	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
 	if errr != nil {
-		return "", []string{}, "", "", false, errors.New("")
+		return "", []string{}, "", "", false, false, errors.New("")
 	}
 
 	// get path
@@ -182,7 +464,7 @@ func handleFileListing(w http.ResponseWriter, r *http.Request) (string, []string
 	userUser, _ := queryUserBySnowflake(user.snowflake)
 	userAccess := queryAccess(user)
 
-	return qpath, userAccess, user.snowflake, user.name, userUser.admin, nil
+	return qpath, userAccess, user.snowflake, user.name, userUser.admin, false, nil
 }
 
 // handler for http://andesite/admin
@@ -199,107 +481,256 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 		"user":     user.snowflake,
 		"accesses": accesses,
 		"base":     httpBase,
-		"name":     oauth2Provider.idp.NamePrefix + user.name,
+		"name":     displayName(user.snowflake, user.name),
 		"shares":   shares,
+		"readonly": isReadOnly(),
+		"local":    loginProviderEnabled("local"),
+	})
+}
+
+// handler for http://andesite/api/admin/settings
+func handleAdminSettings(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"response":  "good",
+		"read_only": isReadOnly(),
+		"panics":    atomic.LoadInt64(&panicCount),
+		"index":     getIndexStatus(),
+		"mounts":    indexMounts,
 	})
 }
 
+// handler for http://andesite/api/admin/usage
+func handleUsageAPI(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	fpath, err := sanitizePath(findFirstNonEmpty(r.URL.Query().Get("path"), "/"))
+	if err != nil {
+		writeAPIResponse(r, w, false, "Invalid path: "+err.Error())
+		return
+	}
+	n, backend, err := dirUsage(fpath)
+	if err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"path":     fpath,
+		"bytes":    n,
+		"size":     byteCountIEC(n),
+		"backend":  backend,
+	})
+}
+
+// handler for http://andesite/api/access/list
+func handleAccessList(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"accesses": queryAllAccess(),
+	})
+}
+
+// handler for http://andesite/api/share/list
+func handleShareList(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"shares":   queryAllShares(),
+	})
+}
+
+// handler for http://andesite/api/admin/read_only
+func handleReadOnlyUpdate(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	//
+	vf, ok := validateForm(r, w, FormField{Name: "enabled", Kind: FieldBool})
+	if !ok {
+		return
+	}
+	//
+	ro := vf.Bool("enabled")
+	setReadOnly(ro)
+	Log("[read-only]", ro)
+	auditLog(r, user.snowflake, "read_only.update", "", boolToString(ro))
+	if ro {
+		writeAPIResponse(r, w, true, "Read-only mode enabled.")
+	} else {
+		writeAPIResponse(r, w, true, "Read-only mode disabled.")
+	}
+}
+
 // handler for http://andesite/api/access/delete
 func handleAccessDelete(w http.ResponseWriter, r *http.Request) {
-	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
 	if errr != nil {
 		return
 	}
 	//
-	if !containsAll(r.PostForm, "id", "snowflake") {
-		writeAPIResponse(r, w, false, "Missing POST values")
+	vf, ok := validateForm(r, w,
+		FormField{Name: "id", Kind: FieldInt},
+		FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128},
+	)
+	if !ok {
 		return
 	}
 	//
-	aid := r.PostForm.Get("id")
-	iid, err := strconv.ParseInt(aid, 10, 32)
-	if err != nil {
-		writeAPIResponse(r, w, false, "ID parameter must be an integer")
+	iid := vf.Int("id")
+	uar, ok := queryAccessByID(iid)
+	if !ok {
+		writeAPIResponse(r, w, false, "Access grant does not exist")
+		return
+	}
+	au, _ := queryUserByID(uar.user)
+	if !requireConfirmation(r, w, user, []string{F("Remove access to '%s' from %s (%s)", uar.path, au.name, au.snowflake)}) {
 		return
 	}
 	//
-	database.Query(true, F("delete from access where id = '%d'", iid))
-	writeAPIResponse(r, w, true, F("Removed access from %s.", r.PostForm.Get("snowflake")))
+	database.QueryPrepared(true, "delete from access where id = ?", iid)
+	auditLog(r, user.snowflake, "access.delete", au.snowflake, uar.path)
+	writeAPIResponse(r, w, true, F("Removed access from %s.", vf.Get("snowflake")))
 }
 
 // handler for http://andesite/api/access/update
 func handleAccessUpdate(w http.ResponseWriter, r *http.Request) {
-	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
 	if errr != nil {
 		return
 	}
 	//
-	aid := r.PostForm.Get("id")
-	iid, err := strconv.ParseInt(string(aid), 10, 32)
-	if err != nil {
-		writeAPIResponse(r, w, false, "ID parameter must be an integer")
+	vf, ok := validateForm(r, w,
+		FormField{Name: "id", Kind: FieldInt},
+		FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128},
+		FormField{Name: "path", Kind: FieldPath},
+		FormField{Name: "perms", Kind: FieldAccessPerms, Optional: true},
+	)
+	if !ok {
 		return
 	}
 	//
-	if !containsAll(r.PostForm, "snowflake", "path") {
-		writeAPIResponse(r, w, false, "Missing POST values")
-		return
+	detail := vf.Get("path")
+	if vf.Has("perms") {
+		database.QueryPrepared(true, "update access set path = ?, perms = ? where id = ?", vf.Get("path"), vf.Get("perms"), vf.Get("id"))
+		detail += " perms=" + vf.Get("perms")
+	} else {
+		queryDoUpdate("access", "path", vf.Get("path"), "id", vf.Get("id"))
 	}
-	//
-	queryDoUpdate("access", "path", r.PostForm.Get("path"), "id", strconv.FormatInt(iid, 10))
-	writeAPIResponse(r, w, true, F("Updated access for %s.", r.PostForm.Get("snowflake")))
+	auditLog(r, user.snowflake, "access.update", vf.Get("snowflake"), detail)
+	writeAPIResponse(r, w, true, F("Updated access for %s.", vf.Get("snowflake")))
 }
 
 // handler for http://andesite/api/access/create
 func handleAccessCreate(w http.ResponseWriter, r *http.Request) {
-	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
 	if errr != nil {
 		return
 	}
 	//
-	if !containsAll(r.PostForm, "snowflake", "path") {
-		writeAPIResponse(r, w, false, "Missing POST values")
+	vf, ok := validateForm(r, w,
+		FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128},
+		FormField{Name: "path", Kind: FieldPath},
+		FormField{Name: "perms", Kind: FieldAccessPerms, Optional: true},
+	)
+	if !ok {
 		return
 	}
 	//
-	aid := database.QueryNextID("access")
-	asn := r.PostForm.Get("snowflake")
-	apt := r.PostForm.Get("path")
+	aid, err := database.QueryNextID("access")
+	if err != nil {
+		writeAPIResponse(r, w, false, F("The access could not be saved: %s", err.Error()))
+		return
+	}
+	asn := vf.Get("snowflake")
+	apt := vf.Get("path")
 	//
 	u, ok := queryUserBySnowflake(asn)
 	aud := -1
 	if ok {
 		aud = u.id
 	} else {
-		aud = database.QueryNextID("users")
+		if err := checkSnowflake(asn); err != nil {
+			writeAPIResponse(r, w, false, err.Error())
+			return
+		}
+		aud, err = database.QueryNextID("users")
+		if err != nil {
+			writeAPIResponse(r, w, false, F("User %s could not be created: %s", asn, err.Error()))
+			return
+		}
 		queryDoAddUser(aud, asn, false, "")
 	}
 	//
-	database.QueryPrepared(true, "insert into access values (?, ?, ?)", aid, aud, apt)
+	database.QueryPrepared(true, "insert into access (id, user, path, perms) values (?, ?, ?, ?)", aid, aud, apt, vf.Get("perms"))
+	auditLog(r, user.snowflake, "access.create", asn, apt)
 	writeAPIResponse(r, w, true, F("Created access for %s.", asn))
 }
 
 func handleShareCreate(w http.ResponseWriter, r *http.Request) {
-	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
 	if errr != nil {
 		return
 	}
 	//
-	if !containsAll(r.PostForm, "path") {
-		writeAPIResponse(r, w, false, "Missing POST values")
+	vf, ok := validateForm(r, w,
+		FormField{Name: "path", Kind: FieldPath},
+		FormField{Name: "perms", Kind: FieldSharePerms, Optional: true},
+		FormField{Name: "expires", Kind: FieldString, MaxLen: 16, Optional: true},
+	)
+	if !ok {
 		return
 	}
+	expires := ""
+	if vf.Has("expires") && len(vf.Get("expires")) > 0 {
+		d, err := time.ParseDuration(vf.Get("expires"))
+		if err != nil || d <= 0 {
+			writeAPIResponse(r, w, false, F("Invalid expires '%s', must be a duration such as '72h'", vf.Get("expires")))
+			return
+		}
+		expires = time.Now().UTC().Add(d).Format(time.RFC3339)
+	}
 	//
-	aid := database.QueryNextID("shares")
+	aid, err := database.QueryNextID("shares")
+	if err != nil {
+		writeAPIResponse(r, w, false, F("The share could not be saved: %s", err.Error()))
+		return
+	}
 	ahs1 := md5.Sum([]byte(F("astheno.andesite.share.%s.%s", strconv.FormatInt(int64(aid), 10), GetIsoDateTime())))
 	ahs2 := hex.EncodeToString(ahs1[:])
-	fpath := r.PostForm.Get("path")
+	fpath := vf.Get("path")
 	//
-	database.QueryPrepared(true, "insert into shares values (?, ?, ?)", aid, ahs2, fpath)
+	database.QueryPrepared(true, "insert into shares (id, hash, path, perms, creator, created, expires) values (?, ?, ?, ?, ?, ?, ?)", aid, ahs2, fpath, vf.Get("perms"), user.snowflake, timeNow(), expires)
+	auditLog(r, user.snowflake, "share.create", ahs2, fpath)
+	mailUser(user, "share_created", map[string]interface{}{
+		"code":    ahs2,
+		"path":    fpath,
+		"perms":   vf.Get("perms"),
+		"expires": expires,
+		"link":    fullHost(r) + httpBase + "open/" + ahs2 + "/",
+	})
+	// the code is left out since it is all it takes to open the share
+	postDiscord(r, DiscordEventShare, "Share created", []DiscordField{
+		discordUserField("By", user),
+		{"Path", fpath, true},
+	})
 	writeAPIResponse(r, w, true, F("Created share with code %s for folder %s.", ahs2, fpath))
 }
 
-func handleShareListing(w http.ResponseWriter, r *http.Request) (string, []string, string, string, bool, error) {
+func handleShareListing(w http.ResponseWriter, r *http.Request) (string, []string, string, string, bool, bool, error) {
 	u := r.URL.Path[6:]
 	if len(u) == 0 {
 		w.Header().Add("Location", "../")
@@ -307,113 +738,167 @@ func handleShareListing(w http.ResponseWriter, r *http.Request) (string, []strin
 	}
 	if match, _ := regexp.MatchString("^[0-9a-f]{32}/.*", u); !match {
 		writeResponse(r, w, "Invalid Share Link", "Invalid format for share code.", "")
-		return "", []string{}, "", "", false, errors.New("")
+		return "", []string{}, "", "", false, false, errors.New("")
 	}
 
 	h := u[:32]
+	if !checkLockout(r, w, AuthShareCode, "") {
+		return "", []string{}, "", "", false, false, errors.New("")
+	}
 	s := queryAccessByShare(h)
 	if len(s) == 0 {
+		recordAuthFailure(r, AuthShareCode, "")
 		writeResponse(r, w, "Not Found", "Public share code not found.", "")
-		return "", []string{}, "", "", false, errors.New("")
+		return "", []string{}, "", "", false, false, errors.New("")
 	}
 
-	return u[32:], s, h, "", false, nil
+	return u[32:], s, h, "", false, false, nil
 }
 
 func handleShareUpdate(w http.ResponseWriter, r *http.Request) {
-	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
 	if errr != nil {
 		return
 	}
 	//
-	if !containsAll(r.PostForm, "id", "hash", "path") {
-		writeAPIResponse(r, w, false, "Missing POST values")
+	vf, ok := validateForm(r, w,
+		FormField{Name: "hash", Kind: FieldHash},
+		FormField{Name: "path", Kind: FieldPath},
+		FormField{Name: "perms", Kind: FieldSharePerms, Optional: true},
+	)
+	if !ok {
 		return
 	}
 	//
-	ahs := r.PostForm.Get("hash")
-	aph := r.PostForm.Get("path")
+	ahs := vf.Get("hash")
+	aph := vf.Get("path")
 	// //
 	queryDoUpdate("shares", "path", aph, "hash", ahs)
-	writeAPIResponse(r, w, true, "Successfully updated share path.")
+	if vf.Has("perms") {
+		queryDoUpdate("shares", "perms", vf.Get("perms"), "hash", ahs)
+	}
+	auditLog(r, user.snowflake, "share.update", ahs, aph)
+	writeAPIResponse(r, w, true, "Successfully updated share.")
 }
 
 func handleShareDelete(w http.ResponseWriter, r *http.Request) {
-	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
 	if errr != nil {
 		return
 	}
 	//
-	if !containsAll(r.PostForm, "id", "hash", "path") {
-		writeAPIResponse(r, w, false, "Missing POST values")
+	vf, ok := validateForm(r, w, FormField{Name: "hash", Kind: FieldHash})
+	if !ok {
 		return
 	}
 	//
-	ahs := r.PostForm.Get("hash")
+	ahs := vf.Get("hash")
+	shrs := queryAllSharesByCode(ahs)
+	if len(shrs) == 0 {
+		writeAPIResponse(r, w, false, "Share link does not exist")
+		return
+	}
+	changes := []string{}
+	for _, item := range shrs {
+		changes = append(changes, F("Delete share link %s for '%s'", item.hash, item.path))
+	}
+	if !requireConfirmation(r, w, user, changes) {
+		return
+	}
 	//
 	database.QueryPrepared(true, "delete from shares where hash = ?", ahs)
+	auditLog(r, user.snowflake, "share.delete", ahs, "")
 	writeAPIResponse(r, w, true, "Successfully deleted share link.")
 }
 
 func handleLogout(w http.ResponseWriter, r *http.Request) {
-	sess, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	sess, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
 	if errr != nil {
 		return
 	}
 	//
+	auditLog(r, user.snowflake, "logout", "", "")
+	if sid, ok := sess.Values["sid"].(string); ok {
+		deleteSessions("sid = ?", sid)
+	}
 	sess.Options.MaxAge = -1
 	sess.Save(r, w)
 	writeResponse(r, w, "Success", "Successfully logged out.", "")
 }
 
-func handleSearch(w http.ResponseWriter, r *http.Request) {
+// handler for http://andesite/account
+func handleAccount(w http.ResponseWriter, r *http.Request) {
 	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
 	if errr != nil {
 		return
 	}
 	//
-	writeHandlebarsFile(r, w, "/search.hbs", map[string]interface{}{
-		"user": user.snowflake,
-		"base": httpBase,
-		"name": oauth2Provider.idp.NamePrefix + user.name,
+	data := accountData(user)
+	if wantsJSON(r) {
+		data["response"] = "good"
+		writeJSON(w, data)
+		return
+	}
+	writeHandlebarsFile(r, w, "/account.hbs", map[string]interface{}{
+		"user":     user.snowflake,
+		"base":     httpBase,
+		"name":     displayName(user.snowflake, user.name),
+		"admin":    user.admin,
+		"provider": data["provider"],
+		"local":    user.provider == "local",
+		"passkeys": loginProviderEnabled("passkey") && user.provider != "proxy",
+		"accesses": data["accesses"],
+		"email":    user.email,
+		"mail":     config.SMTP != nil,
 	})
 }
 
-func handleSearchAPI(w http.ResponseWriter, r *http.Request) {
+// accountData is what /account lists about user as JSON, which /me includes
+func accountData(user UserRow) map[string]interface{} {
+	return map[string]interface{}{
+		"snowflake": user.snowflake,
+		"name":      user.name,
+		"provider":  loginProviderOf(user.snowflake).key,
+		"admin":     user.admin,
+		"accesses":  queryAccess(user),
+		"email":     user.email,
+	}
+}
+
+func handleSearch(w http.ResponseWriter, r *http.Request) {
 	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
 	if errr != nil {
-		writeJSON(w, map[string]interface{}{
-			"response": "bad",
-			"message":  errr.Error(),
-		})
-		return
-	}
-	p := r.URL.Query()["q"]
-	if len(p) == 0 || len(p[0]) == 0 {
-		writeJSON(w, map[string]interface{}{
-			"response": "bad",
-			"message":  "'q' parameter is required",
-		})
 		return
 	}
 	//
-	v0 := p[0]
-	v1 := strings.Replace(v0, "!", "!!", -1)
+	writeHandlebarsFile(r, w, "/search.hbs", map[string]interface{}{
+		"user":    user.snowflake,
+		"base":    httpBase,
+		"name":    displayName(user.snowflake, user.name),
+		"warming": indexWarming(),
+	})
+}
+
+// searchFiles returns the first 25 files in the index whose path contains query that ua allows
+func searchFiles(ua []string, query string) []WatchedFile {
+	v1 := strings.Replace(query, "!", "!!", -1)
 	v2 := strings.Replace(v1, "%", "!%", -1)
 	v3 := strings.Replace(v2, "_", "!_", -1)
 	v4 := strings.Replace(v3, "[", "![", -1)
 	a := []WatchedFile{}
-	ua := queryAccess(user)
-	q := database.QueryPrepared(false, "select * from files where path like ? escape '!'", "%"+v4+"%")
+	q, err := database.QueryPrepared(false, "select * from files where path like ? escape '!'", "%"+v4+"%")
+	if err != nil {
+		return a
+	}
 	for q.Next() {
 		wf := scanFile(q)
 		wf.URL = httpBase + "files" + wf.Path
 		//
-		if strings.Contains(wf.Path, "/.") {
+		if isHiddenPath(wf.Path) {
 			continue
 		}
 		for _, item := range ua {
-			if strings.HasPrefix(wf.Path, item) {
+			if pathHasPrefix(wf.Path, item) {
 				a = append(a, wf)
 				break
 			}
@@ -423,9 +908,32 @@ func handleSearchAPI(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	q.Close()
+	return a
+}
+
+func handleSearchAPI(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		writeJSON(w, map[string]interface{}{
+			"response": "bad",
+			"message":  errr.Error(),
+		})
+		return
+	}
+	p := r.URL.Query()["q"]
+	if len(p) == 0 || len(p[0]) == 0 {
+		writeJSON(w, map[string]interface{}{
+			"response": "bad",
+			"message":  "'q' parameter is required",
+		})
+		return
+	}
+	//
+	a := searchFiles(queryAccess(user), p[0])
 	writeJSON(w, map[string]interface{}{
 		"response": "good",
 		"count":    len(a),
 		"results":  a,
+		"warming":  indexWarming(),
 	})
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultCSP = "default-src 'self'; " +
+		"script-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com https://semantic-ui.com; " +
+		"style-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com https://cdn.jsdelivr.net https://fonts.googleapis.com; " +
+		"font-src 'self' data: https://cdnjs.cloudflare.com https://cdn.jsdelivr.net https://fonts.gstatic.com; " +
+		"img-src 'self' data: https://cdn.jsdelivr.net; " +
+		"frame-ancestors 'none'"
+	// share links carry their secret in the path, so never send it to other sites
+	defaultReferrerPolicy = "same-origin"
+	defaultHSTSMaxAge     = 60 * 60 * 24 * 365
+)
+
+// securityHeaders fills in the defaults of cfg and picks the Content-Security-Policy of the
+// highest priority theme that overrides it
+func securityHeaders(cfg ConfigSecurityHeaders, themes []string) (ConfigSecurityHeaders, string) {
+	if len(cfg.ReferrerPolicy) == 0 {
+		cfg.ReferrerPolicy = defaultReferrerPolicy
+	}
+	if cfg.HSTSMaxAge == 0 {
+		cfg.HSTSMaxAge = defaultHSTSMaxAge
+	}
+	csp := findFirstNonEmpty(cfg.CSP, defaultCSP)
+	for _, item := range themes {
+		if v, ok := cfg.ThemeCSP[item]; ok {
+			csp = v
+			break
+		}
+	}
+	return cfg, csp
+}
+
+func setHeaderUnlessDisabled(w http.ResponseWriter, name string, value string) {
+	if value != "-" {
+		w.Header().Set(name, value)
+	}
+}
+
+func mwSecurityHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lc := live()
+		cfg := lc.headers
+		setHeaderUnlessDisabled(w, "Content-Security-Policy", lc.csp)
+		setHeaderUnlessDisabled(w, "Referrer-Policy", cfg.ReferrerPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if cfg.HSTSMaxAge > 0 && isHTTPS(r) {
+			w.Header().Set("Strict-Transport-Security", "max-age="+strconv.Itoa(cfg.HSTSMaxAge))
+		}
+		next.ServeHTTP(w, r)
+	}
+}
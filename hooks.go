@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// events hook commands can run after
+const (
+	HookUpload        = "upload"
+	HookDelete        = "delete"
+	HookShareDownload = "share_download"
+)
+
+var hookEvents = []string{HookUpload, HookDelete, HookShareDownload}
+
+const (
+	defaultHookTimeout = time.Minute
+	// output of a hook beyond this is left out of the log
+	maxHookOutput = 4096
+	// hooks that run at once, and that wait their turn before more are dropped
+	hookWorkers   = 4
+	hookQueueSize = 256
+)
+
+type hookJob struct {
+	hook ConfigHook
+	vars []string
+}
+
+var hookQueue = make(chan hookJob, hookQueueSize)
+
+// initHooks starts the workers that run hook commands, so that a burst of uploads or deletes can't
+// start an unbounded number of processes
+func initHooks() {
+	for i := 0; i < hookWorkers; i++ {
+		go func() {
+			for job := range hookQueue {
+				runHook(job.hook, job.vars)
+			}
+		}()
+	}
+}
+
+func validateHooks(cfg *Config) error {
+	for i, item := range cfg.Hooks {
+		if !Contains(hookEvents, item.Event) {
+			return E(F("Invalid hook event '%s', must be one of '%s'", item.Event, strings.Join(hookEvents, "', '")))
+		}
+		if len(item.Command) == 0 {
+			return E(F("hook %d requires 'command'", i))
+		}
+		if item.Timeout < 0 {
+			return E(F("hook %d 'timeout' must not be negative", i))
+		}
+	}
+	return nil
+}
+
+// runHooks queues every hook command of event to run in the background, with env added to the
+// environment Andesite was started with
+func runHooks(event string, env map[string]string) {
+	vars := []string{"ANDESITE_EVENT=" + event}
+	for k, v := range env {
+		vars = append(vars, k+"="+v)
+	}
+	sort.Strings(vars)
+	for _, item := range config.Hooks {
+		if item.Event != event {
+			continue
+		}
+		select {
+		case hookQueue <- hookJob{item, vars}:
+		default:
+			LogError("[hook]", "queue is full, dropped", event, item.Command[0], env["ANDESITE_PATH"])
+		}
+	}
+}
+
+// runHook runs one hook command to completion or its timeout and logs what it printed
+func runHook(hook ConfigHook, vars []string) {
+	timeout := defaultHookTimeout
+	if hook.Timeout > 0 {
+		timeout = time.Duration(hook.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(), vars...)
+	out, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if len(output) > maxHookOutput {
+		output = output[:maxHookOutput] + "..."
+	}
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		LogError("[hook]", hook.Event, hook.Command[0], "was stopped after", timeout.String(), output)
+	case err != nil:
+		LogError("[hook]", hook.Event, hook.Command[0], err.Error(), output)
+	case len(output) > 0:
+		Log("[hook]", hook.Event, hook.Command[0], output)
+	}
+}
+
+// hookUserEnv describes user to a hook command
+func hookUserEnv(env map[string]string, user UserRow) map[string]string {
+	env["ANDESITE_USER"] = user.snowflake
+	env["ANDESITE_USER_NAME"] = user.name
+	return env
+}
+
+// isWholeDownload returns true if the response sw wrote was a download from the start of the
+// file, so that a file streamed or resumed in ranges counts once
+func isWholeDownload(r *http.Request, sw *StatusWriter) bool {
+	if r.Method != http.MethodGet || sw.bytes == 0 {
+		return false
+	}
+	if sw.status == http.StatusOK {
+		return true
+	}
+	return sw.status == http.StatusPartialContent && strings.HasPrefix(r.Header.Get("Range"), "bytes=0-")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// signed links last this long unless "hotlink.token_ttl" or the request says otherwise
+const defaultSignedLinkTTL = time.Hour * 24
+
+func validateHotlinkConfig(cfg *Config) error {
+	if len(cfg.Hotlink.TokenTTL) > 0 {
+		d, err := time.ParseDuration(cfg.Hotlink.TokenTTL)
+		if err != nil || d < time.Minute {
+			return E(F("Invalid hotlink.token_ttl '%s', must be a duration of at least 1m", cfg.Hotlink.TokenTTL))
+		}
+	}
+	for _, item := range cfg.Hotlink.Referers {
+		if strings.Contains(item, "/") {
+			return E(F("Invalid hotlink.referers entry '%s', must be a host name such as 'example.com'", item))
+		}
+	}
+	return nil
+}
+
+func signedLinkTTL() time.Duration {
+	if d, err := time.ParseDuration(config.Hotlink.TokenTTL); err == nil && len(config.Hotlink.TokenTTL) > 0 {
+		return d
+	}
+	return defaultSignedLinkTTL
+}
+
+func signedLinkToken(snowflake string, fpath string, expires int64) string {
+	mac := hmac.New(sha256.New, randomKey)
+	mac.Write([]byte("signed:" + snowflake + ":" + fpath + ":" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedLinkURL is the link to the file fpath that works without logging in until expires, for
+// the user snowflake and only while they still have access to it. Relative to httpBase.
+func signedLinkURL(snowflake string, fpath string, expires time.Time) string {
+	e := expires.Unix()
+	return "files" + fpath + "?" + url.Values{
+		"user":    {snowflake},
+		"expires": {strconv.FormatInt(e, 10)},
+		"sig":     {signedLinkToken(snowflake, fpath, e)},
+	}.Encode()
+}
+
+// isSignedRequest returns true if r has the parameters of a signed link, which may still be
+// invalid until checkSignedLink says otherwise
+func isSignedRequest(r *http.Request) bool {
+	return len(r.URL.Query().Get("sig")) > 0
+}
+
+// checkSignedLink returns the user whose signed link r is for the file qpath, or writes why not
+func checkSignedLink(r *http.Request, w http.ResponseWriter, qpath string) (UserRow, bool) {
+	q := r.URL.Query()
+	snowflake := q.Get("user")
+	if !checkLockout(r, w, AuthSignedLink, snowflake) {
+		return UserRow{}, false
+	}
+	fpath, err := sanitizePath(qpath)
+	expires, err2 := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || err2 != nil || !hmac.Equal([]byte(q.Get("sig")), []byte(signedLinkToken(snowflake, fpath, expires))) {
+		recordAuthFailure(r, AuthSignedLink, snowflake)
+		writeStatus(r, w, http.StatusForbidden)
+		writeResponse(r, w, "Forbidden", "Invalid signed link.", "")
+		return UserRow{}, false
+	}
+	clearAuthFailures(AuthSignedLink, snowflake)
+	if time.Now().Unix() > expires {
+		writeStatus(r, w, http.StatusGone)
+		writeResponse(r, w, "Link Expired", "This link has expired, ask for a new one.", "")
+		return UserRow{}, false
+	}
+	user, ok := queryUserBySnowflake(snowflake)
+	if !ok {
+		writeUserDenied(r, w, true, false)
+		return UserRow{}, false
+	}
+	if !user.enabled {
+		writeSuspended(r, w, user)
+		return UserRow{}, false
+	}
+	return user, true
+}
+
+// isMediaPath returns true for the images, video, and audio other sites would embed
+func isMediaPath(fpath string) bool {
+	t := contentTypeFor(fpath)
+	return strings.HasPrefix(t, "image/") || strings.HasPrefix(t, "video/") || strings.HasPrefix(t, "audio/")
+}
+
+// isForeignReferer returns true if r was linked from a page of a site other than this one and
+// those in "hotlink.referers". Requests without a Referer are let through, browsers and privacy
+// tools leave it out for many reasons.
+func isForeignReferer(r *http.Request) bool {
+	ref := r.Referer()
+	if len(ref) == 0 {
+		return false
+	}
+	u, err := url.Parse(ref)
+	if err != nil || len(u.Host) == 0 {
+		return true
+	}
+	self, _ := url.Parse(fullHost(r))
+	host := strings.ToLower(u.Hostname())
+	if self != nil && host == strings.ToLower(self.Hostname()) {
+		return false
+	}
+	for _, item := range config.Hotlink.Referers {
+		item = strings.ToLower(item)
+		if host == item || strings.HasSuffix(host, "."+item) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHotlink refuses media embedded in the pages of other sites, unless it is from a signed
+// link, which is how a user allows it on purpose. signed must only be set once the signature of
+// the link was verified, a "sig" parameter alone proves nothing.
+func checkHotlink(r *http.Request, w http.ResponseWriter, qpath string, signed bool) bool {
+	if !config.Hotlink.Enabled || signed || !isMediaPath(qpath) || !isForeignReferer(r) {
+		return true
+	}
+	writeStatus(r, w, http.StatusForbidden)
+	writeResponse(r, w, "Forbidden", "This file may not be embedded in other sites.", "")
+	return false
+}
+
+// handler for http://andesite/api/sign
+func handleSignLink(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "path", Kind: FieldPath, MaxLen: 4096},
+		FormField{Name: "ttl", Kind: FieldString, Optional: true, MaxLen: 32},
+	)
+	if !ok {
+		return
+	}
+	fpath := vf.Get("path")
+	ttl := signedLinkTTL()
+	if s := vf.Get("ttl"); len(s) > 0 {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > ttl {
+			writeAPIResponse(r, w, false, F("ttl must be a duration of at most %s", ttl.String()))
+			return
+		}
+		ttl = d
+	}
+	if !hasPathAccess(queryAccess(user), fpath) || isIgnoredPath(fpath) {
+		writeUserDenied(r, w, true, false)
+		return
+	}
+	info, err := rootDir.Stat(fpath)
+	if err != nil || info.IsDir() {
+		writeAPIResponse(r, w, false, "Only files can be signed")
+		return
+	}
+	expires := time.Now().Add(ttl)
+	auditLog(r, user.snowflake, "link.sign", fpath, expires.UTC().Format(time.RFC3339))
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"url":      fullHost(r) + httpBase + signedLinkURL(user.snowflake, fpath, expires),
+		"expires":  expires.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ignoreFileName is the file that lists what to hide in the directory it is in and below
+const ignoreFileName = ".andesiteignore"
+
+// ignoreRule is one line of an ignore file, in the format of .gitignore
+type ignoreRule struct {
+	base     string // the directory the rule applies below, with a trailing slash
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool // the pattern has a slash and is matched against the whole path below base
+}
+
+// ignoreRules are every rule that applies in a directory, in the order they are applied
+type ignoreRules []ignoreRule
+
+type ignoreCacheEntry struct {
+	mod   time.Time
+	size  int64
+	rules ignoreRules
+}
+
+var (
+	ignoreCache   = map[string]ignoreCacheEntry{}
+	ignoreCacheMu sync.Mutex
+)
+
+// parseIgnoreRules reads the lines of an ignore file in the directory base
+func parseIgnoreRules(base string, lines []string) ignoreRules {
+	result := ignoreRules{}
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \r")
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = strings.TrimPrefix(line, "/")
+		if len(rule.pattern) > 0 {
+			result = append(result, rule)
+		}
+	}
+	return result
+}
+
+// matchSegments matches a path split on slashes, where "**" stands for any number of segments
+func matchSegments(pattern []string, segs []string) bool {
+	if len(pattern) == 0 {
+		return len(segs) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if matchSegments(pattern[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segs[0])
+	return ok && matchSegments(pattern[1:], segs[1:])
+}
+
+func (v ignoreRule) matches(fpath string, isDir bool) bool {
+	if v.dirOnly && !isDir {
+		return false
+	}
+	fpath = strings.TrimSuffix(fpath, "/")
+	if !strings.HasPrefix(fpath, v.base) {
+		return false
+	}
+	rel := strings.TrimPrefix(fpath, v.base)
+	if !v.anchored {
+		ok, _ := path.Match(v.pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(v.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// ignores returns true if the last rule matching fpath hides it
+func (rs ignoreRules) ignores(fpath string, isDir bool) bool {
+	result := false
+	for _, item := range rs {
+		if item.matches(fpath, isDir) {
+			result = !item.negate
+		}
+	}
+	return result
+}
+
+// loadIgnoreFile returns the rules of the ignore file in dir, reading it again only when it changed
+func loadIgnoreFile(dir string) ignoreRules {
+	full := filepath.Join(rootDir.Base(), filepath.FromSlash(dir), ignoreFileName)
+	info, err := os.Stat(full)
+	ignoreCacheMu.Lock()
+	defer ignoreCacheMu.Unlock()
+	if err != nil {
+		delete(ignoreCache, dir)
+		return nil
+	}
+	if c, ok := ignoreCache[dir]; ok && c.mod.Equal(info.ModTime()) && c.size == info.Size() {
+		return c.rules
+	}
+	b, err := ioutil.ReadFile(full)
+	if err != nil {
+		return nil
+	}
+	rules := parseIgnoreRules(dir, strings.Split(string(b), "\n"))
+	ignoreCache[dir] = ignoreCacheEntry{info.ModTime(), info.Size(), rules}
+	return rules
+}
+
+// ignoreRulesFor returns the rules that apply to the entries of dir, those of "ignore.patterns"
+// and then of the ignore files in dir and its parents, from the root down
+func ignoreRulesFor(dir string) ignoreRules {
+	rules := append(ignoreRules{}, parseIgnoreRules("/", config.Ignore.Patterns)...)
+	p := "/"
+	rules = append(rules, loadIgnoreFile(p)...)
+	for _, seg := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if len(seg) == 0 {
+			continue
+		}
+		p += seg + "/"
+		rules = append(rules, loadIgnoreFile(p)...)
+	}
+	return rules
+}
+
+// isHiddenName returns true for dotfiles, unless "ignore.show_dotfiles" is set, and for the files
+// Andesite keeps for itself, which are hidden either way
+func isHiddenName(fpath string) bool {
+	name := path.Base(strings.TrimSuffix(fpath, "/"))
+	if name == ignoreFileName || isInternalPath(fpath) {
+		return true
+	}
+	return strings.HasPrefix(name, ".") && !config.Ignore.ShowDotfiles
+}
+
+// isHiddenPath returns true if fpath is or is in something isHiddenName hides. It does not read
+// ignore files, for paths that come from the file index, which already leaves ignored files out.
+func isHiddenPath(fpath string) bool {
+	p := "/"
+	for _, seg := range strings.Split(strings.Trim(fpath, "/"), "/") {
+		if len(seg) == 0 {
+			continue
+		}
+		p += seg
+		if isHiddenName(p) {
+			return true
+		}
+		p += "/"
+	}
+	return false
+}
+
+// isHiddenEntry returns true if fpath, an entry of the directory rules were loaded for, is hidden
+func isHiddenEntry(rules ignoreRules, fpath string, isDir bool) bool {
+	return isHiddenName(fpath) || rules.ignores(fpath, isDir)
+}
+
+// isIgnoredPath returns true if fpath or any of its parents is hidden, by its name or by a
+// pattern. Paths of directories end in a slash.
+func isIgnoredPath(fpath string) bool {
+	if isHiddenPath(fpath) {
+		return true
+	}
+	segs := strings.Split(strings.Trim(fpath, "/"), "/")
+	rules := parseIgnoreRules("/", config.Ignore.Patterns)
+	dir := "/"
+	for i, seg := range segs {
+		if len(seg) == 0 {
+			continue
+		}
+		rules = append(rules, loadIgnoreFile(dir)...)
+		isDir := i < len(segs)-1 || strings.HasSuffix(fpath, "/")
+		if rules.ignores(dir+seg, isDir) {
+			return true
+		}
+		dir += seg + "/"
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+var (
+	indexConcurrency = runtime.NumCPU()
+	indexBatchSize   = 1000
+	indexLimiter     *RateLimiter
+)
+
+func initIndexer(cfg ConfigIndex) error {
+	if cfg.Concurrency < 0 || cfg.BatchSize < 0 || cfg.DirsPerSecond < 0 {
+		return E("index options must not be negative")
+	}
+	if cfg.Concurrency > 0 {
+		indexConcurrency = cfg.Concurrency
+	}
+	if cfg.BatchSize > 0 {
+		indexBatchSize = cfg.BatchSize
+	}
+	if cfg.DirsPerSecond > 0 {
+		indexLimiter = NewRateLimiter(float64(cfg.DirsPerSecond), float64(cfg.DirsPerSecond))
+	}
+	return initMounts(cfg.Mounts)
+}
+
+// indexItem is a file to add to the index, or with dir set, the marker that every file of the
+// directory path has been sent before it
+type indexItem struct {
+	path string
+	name string
+	dir  bool
+}
+
+// dirQueue holds the directories left to scan, by the priority of their mount. pop blocks until
+// there is one, or returns false once every directory pushed has been marked done.
+type dirQueue struct {
+	sync.Mutex
+	cond    *sync.Cond
+	items   map[int][]string
+	prios   []int
+	pending int
+	visited map[string]bool
+}
+
+func newDirQueue() *dirQueue {
+	q := &dirQueue{items: map[int][]string{}, visited: map[string]bool{}}
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+// visit returns false if the directory at real, a location with no symlinks in it, has already
+// been scanned, so that followed links can not make the scan go in circles
+func (q *dirQueue) visit(real string) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.visited[real] {
+		return false
+	}
+	q.visited[real] = true
+	return true
+}
+
+func (q *dirQueue) push(dir string, prio int) {
+	q.Lock()
+	if _, ok := q.items[prio]; !ok {
+		q.prios = append(q.prios, prio)
+		sort.Sort(sort.Reverse(sort.IntSlice(q.prios)))
+	}
+	q.items[prio] = append(q.items[prio], dir)
+	q.pending++
+	q.Unlock()
+	q.cond.Signal()
+}
+
+// pop takes from the highest priority, and from the end of that, going depth first keeps the
+// queue small on wide trees
+func (q *dirQueue) pop() (string, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for {
+		for _, p := range q.prios {
+			if l := len(q.items[p]); l > 0 {
+				dir := q.items[p][l-1]
+				q.items[p] = q.items[p][:l-1]
+				return dir, true
+			}
+		}
+		if q.pending == 0 {
+			return "", false
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *dirQueue) done() {
+	q.Lock()
+	q.pending--
+	last := q.pending == 0
+	q.Unlock()
+	if last {
+		q.cond.Broadcast()
+	}
+}
+
+// indexTree scans root with indexConcurrency workers, watching every directory and adding every
+// file to the index in batches. Directories are checkpointed as their files are committed, so a
+// scan that was interrupted skips the database work for them on the next start.
+func indexTree(root string) {
+	database.CreateTable("index_progress", []string{"path", "text primary key"}, [][]string{})
+	database.Query(true, "create index if not exists files_path on files (path)")
+	done := loadIndexCheckpoint()
+	if len(done) > 0 {
+		Log("[file-index]", "Resuming the initial scan,", len(done), "directories were already finished")
+	}
+	runIndexScan(root, "/", done, nil)
+	database.Query(true, "delete from index_progress")
+}
+
+// runIndexScan adds the files below start to the index. With done it checkpoints the initial
+// scan, and with seen it records every file path found.
+func runIndexScan(root string, start string, done map[string]bool, seen *indexSeen) {
+	items := make(chan indexItem, indexBatchSize)
+	written := make(chan struct{})
+	go indexWriter(items, written)
+
+	q := newDirQueue()
+	q.push(start, mountFor(start).Priority)
+	var wg sync.WaitGroup
+	for i := 0; i < indexConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := q.pop()
+				if !ok {
+					return
+				}
+				indexDir(root, dir, done, seen, q, items)
+				q.done()
+			}
+		}()
+	}
+	wg.Wait()
+	close(items)
+	<-written
+}
+
+// indexSeen is the set of files found by a rescan
+type indexSeen struct {
+	sync.Mutex
+	paths map[string]bool
+}
+
+func indexDir(root string, dir string, done map[string]bool, seen *indexSeen, q *dirQueue, items chan<- indexItem) {
+	if indexLimiter != nil {
+		if d := indexLimiter.take("index", 1); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	full := filepath.Join(root, filepath.FromSlash(dir))
+	if real, err := filepath.EvalSymlinks(full); err != nil || !q.visit(real) {
+		return
+	}
+	if mountFor(dir).Watch {
+		if err := watcher.Add(full); err != nil {
+			LogError("[file-index]", full, err.Error())
+			alertAdmins("watcher", "alert_watcher", map[string]interface{}{"error": full + ": " + err.Error()})
+		}
+	}
+	infos, err := ioutil.ReadDir(full)
+	if err != nil {
+		LogError("[file-index]", full, err.Error())
+		return
+	}
+	skipFiles := done[dir]
+	atomic.AddInt64(&indexDirs, 1)
+	rules := ignoreRulesFor(dir)
+	for _, item := range infos {
+		p := dir + item.Name()
+		if item.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(filepath.Join(full, item.Name()))
+			if err != nil || checkSymlinks(root, filepath.Join(full, item.Name())) != nil {
+				continue
+			}
+			item = target
+		}
+		if isHiddenEntry(rules, p, item.IsDir()) {
+			continue
+		}
+		if item.IsDir() {
+			q.push(p+"/", mountFor(p+"/").Priority)
+			continue
+		}
+		atomic.AddInt64(&indexFiles, 1)
+		if seen != nil {
+			seen.Lock()
+			seen.paths[p] = true
+			seen.Unlock()
+		}
+		if !skipFiles {
+			items <- indexItem{p, item.Name(), false}
+		}
+	}
+	if done != nil && !skipFiles {
+		items <- indexItem{dir, "", true}
+	}
+}
+
+// indexWriter collects the items of a scan into batches
+func indexWriter(items <-chan indexItem, written chan<- struct{}) {
+	batch := make([]indexItem, 0, indexBatchSize)
+	for item := range items {
+		batch = append(batch, item)
+		if len(batch) == indexBatchSize {
+			writeIndexBatch(batch)
+			batch = batch[:0]
+		}
+	}
+	writeIndexBatch(batch)
+	close(written)
+}
+
+// writeIndexBatch adds the files in one transaction. IDs are picked inside the insert since the
+// watcher and rescans of other mounts may be adding files at the same time.
+func writeIndexBatch(batch []indexItem) {
+	if len(batch) == 0 {
+		return
+	}
+	tx, err := database.Begin()
+	if err != nil {
+		LogError("[file-index]", err.Error())
+		return
+	}
+	for _, item := range batch {
+		if item.dir {
+			_, err = tx.Exec("insert into index_progress select ? where not exists (select 1 from index_progress where path = ?)", item.path, item.path)
+		} else {
+			_, err = tx.Exec("insert into files select (select coalesce(max(id),-1)+1 from files), ?, ? where not exists (select 1 from files where path = ?)", item.path, item.name, item.path)
+		}
+		if err != nil {
+			LogError("[file-index]", item.path, err.Error())
+			tx.Rollback()
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		LogError("[file-index]", err.Error())
+	}
+}
+
+func loadIndexCheckpoint() map[string]bool {
+	result := map[string]bool{}
+	rows, err := database.Query(false, "select path from index_progress")
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		var p string
+		rows.Scan(&p)
+		result[p] = true
+	}
+	rows.Close()
+	return result
+}
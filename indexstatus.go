@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	. "github.com/nektro/go-util/util"
+)
+
+// states of the file index
+const (
+	IndexWarming = "warming"
+	IndexReady   = "ready"
+)
+
+const indexStatusKey = "index_status"
+
+// how long the progress of a scan is kept without an update, so that a node that stops part way
+// through does not leave the index warming forever
+const indexWarmingTTL = 30 * time.Second
+
+// IndexStatus is the progress of the initial scan of the root, kept in the cache so that every
+// node of a cluster sees the leader's
+type IndexStatus struct {
+	State    string `json:"state"`
+	Dirs     int64  `json:"dirs"`
+	Files    int64  `json:"files"`
+	Started  int64  `json:"started"`
+	Finished int64  `json:"finished"`
+}
+
+var (
+	indexDirs    int64
+	indexFiles   int64
+	indexStarted time.Time
+	indexDone    = make(chan struct{})
+)
+
+// startIndexStatus publishes the progress of the scan every second until finishIndexStatus
+func startIndexStatus() {
+	indexStarted = time.Now()
+	saveIndexStatus(IndexWarming)
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				saveIndexStatus(IndexWarming)
+			case <-indexDone:
+				return
+			}
+		}
+	}()
+}
+
+func finishIndexStatus() {
+	close(indexDone)
+	saveIndexStatus(IndexReady)
+	Log("[file-index]", "Initial scan finished in", time.Since(indexStarted).Round(time.Second).String(), "with", atomic.LoadInt64(&indexFiles), "files")
+}
+
+func saveIndexStatus(state string) {
+	is := IndexStatus{
+		State:   state,
+		Dirs:    atomic.LoadInt64(&indexDirs),
+		Files:   atomic.LoadInt64(&indexFiles),
+		Started: indexStarted.Unix(),
+	}
+	ttl := indexWarmingTTL
+	if state == IndexReady {
+		is.Finished = time.Now().Unix()
+		ttl = 0
+	}
+	bytes, _ := json.Marshal(is)
+	cache.Set(indexStatusKey, string(bytes), ttl)
+}
+
+// getIndexStatus returns the progress of the scan, the State is empty if no node has started one
+func getIndexStatus() IndexStatus {
+	is := IndexStatus{}
+	if v, ok := cache.Get(indexStatusKey); ok {
+		json.Unmarshal([]byte(v), &is)
+	}
+	return is
+}
+
+// indexWarming returns true while results from the index may be missing files
+func indexWarming() bool {
+	return getIndexStatus().State == IndexWarming
+}
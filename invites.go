@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// InviteRow is a link that gives whoever logs in with it access to a set of paths
+type InviteRow struct {
+	id      int
+	code    string
+	paths   []string
+	creator string
+	created string
+	expires string
+	maxUses int
+	uses    int
+	note    string
+}
+
+const inviteColumns = "id, code, paths, creator, created, coalesce(expires, ''), max_uses, uses, coalesce(note, '')"
+
+func scanInvite(rows *sql.Rows) InviteRow {
+	var v InviteRow
+	var paths string
+	rows.Scan(&v.id, &v.code, &paths, &v.creator, &v.created, &v.expires, &v.maxUses, &v.uses, &v.note)
+	json.Unmarshal([]byte(paths), &v.paths)
+	return v
+}
+
+func queryInvites() []InviteRow {
+	result := []InviteRow{}
+	rows, err := database.Query(false, "select "+inviteColumns+" from invites order by id desc")
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		result = append(result, scanInvite(rows))
+	}
+	rows.Close()
+	return result
+}
+
+func queryInviteByCode(code string) (InviteRow, bool) {
+	rows, err := database.QueryPrepared(false, "select "+inviteColumns+" from invites where code = ?", code)
+	if err != nil {
+		return InviteRow{}, false
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return InviteRow{}, false
+	}
+	return scanInvite(rows), true
+}
+
+// usable returns true if the invite has not expired or been used up
+func (v InviteRow) usable() bool {
+	if len(v.expires) > 0 && v.expires < timeNow() {
+		return false
+	}
+	return v.maxUses == 0 || v.uses < v.maxUses
+}
+
+func inviteList(r *http.Request, rows []InviteRow) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, item := range rows {
+		result = append(result, map[string]interface{}{
+			"code":     item.code,
+			"link":     fullHost(r) + httpBase + "invite/" + item.code,
+			"paths":    item.paths,
+			"creator":  item.creator,
+			"created":  item.created,
+			"expires":  item.expires,
+			"max_uses": item.maxUses,
+			"uses":     item.uses,
+			"note":     item.note,
+			"usable":   item.usable(),
+		})
+	}
+	return result
+}
+
+// redeemInvite gives user the paths of the invite, and returns the ones they did not have yet
+func redeemInvite(r *http.Request, invite InviteRow, user UserRow) ([]string, error) {
+	granted := queryAccess(user)
+	missing := []string{}
+	for _, p := range invite.paths {
+		if !Contains(granted, p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return missing, nil
+	}
+	// counted first, so that two people racing for the last use can not both get it
+	res, err := database.Exec("update invites set uses = uses + 1 where id = ? and (max_uses = 0 or uses < max_uses)", invite.id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, E("This invite has been used up")
+	}
+	for _, p := range missing {
+		aid, err := database.QueryNextID("access")
+		if err != nil {
+			return nil, err
+		}
+		database.QueryPrepared(true, "insert into access (id, user, path) values (?, ?, ?)", aid, user.id, p)
+		auditLog(r, "invite", "access.create", user.snowflake, p)
+	}
+	auditLog(r, user.snowflake, "invite.redeem", invite.code, strings.Join(missing, ","))
+	return missing, nil
+}
+
+//
+//
+
+// handler for http://andesite/invite/{code}
+func handleInvite(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimPrefix(r.URL.Path, "/invite/")
+	invite, ok := InviteRow{}, false
+	if shareHashRegex.MatchString(code) {
+		invite, ok = queryInviteByCode(code)
+	}
+	if !ok || !invite.usable() {
+		writeStatus(r, w, http.StatusNotFound)
+		writeResponse(r, w, "Invalid Invite", "This invite link does not exist, has expired, or has been used up.", "")
+		return
+	}
+	if !helperIsLoggedIn(r) {
+		// the login brings the user back here, which then redeems it
+		w.Header().Set("Location", loginURL(r))
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		return
+	}
+	// opening the link only asks, the invite is used up by the POST of the form
+	form := "<form method='POST' action='" + httpBase + "api/invites/redeem'><input type='hidden' name='code' value='" + invite.code + "'><button class='ui button'>Accept</button></form>"
+	writeResponse(r, w, "Accept Invite", "This invite gives you access to "+strings.Join(invite.paths, ", ")+".", form)
+}
+
+// handler for http://andesite/api/invites/redeem
+func handleInviteRedeem(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "code", Kind: FieldHash})
+	if !ok {
+		return
+	}
+	invite, ok := queryInviteByCode(vf.Get("code"))
+	if !ok || !invite.usable() {
+		writeStatus(r, w, http.StatusNotFound)
+		writeResponse(r, w, "Invalid Invite", "This invite link does not exist, has expired, or has been used up.", "")
+		return
+	}
+	added, err := redeemInvite(r, invite, user)
+	if err != nil {
+		writeResponse(r, w, "Invalid Invite", err.Error(), "")
+		return
+	}
+	link := "<a href='" + httpBase + "files/'>Browse your files</a>."
+	if len(added) == 0 {
+		writeResponse(r, w, "Invite Accepted", "You already have access to everything in this invite.", link)
+		return
+	}
+	writeResponse(r, w, "Invite Accepted", "You now have access to "+strings.Join(added, ", ")+".", link)
+}
+
+// handler for http://andesite/api/admin/invites
+func handleInviteList(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"invites":  inviteList(r, queryInvites()),
+	})
+}
+
+// handler for http://andesite/api/admin/invites/create
+func handleInviteCreate(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "paths", Kind: FieldString, MaxLen: 4096},
+		FormField{Name: "max_uses", Kind: FieldInt, Optional: true},
+		FormField{Name: "expires", Kind: FieldString, MaxLen: 16, Optional: true},
+		FormField{Name: "note", Kind: FieldString, MaxLen: 256, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	paths := []string{}
+	for _, item := range strings.FieldsFunc(vf.Get("paths"), func(c rune) bool { return c == '\n' || c == ',' }) {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		p, err := sanitizePath(item)
+		if err != nil {
+			writeAPIResponse(r, w, false, F("Invalid path '%s': %s", item, err.Error()))
+			return
+		}
+		if !Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		writeAPIResponse(r, w, false, "An invite needs at least one path")
+		return
+	}
+	maxUses := 1
+	if vf.Has("max_uses") {
+		maxUses = vf.Int("max_uses")
+	}
+	if maxUses < 0 {
+		writeAPIResponse(r, w, false, "max_uses must not be negative")
+		return
+	}
+	expires := ""
+	if vf.Has("expires") && len(vf.Get("expires")) > 0 {
+		d, err := time.ParseDuration(vf.Get("expires"))
+		if err != nil || d <= 0 {
+			writeAPIResponse(r, w, false, F("Invalid expires '%s', must be a duration such as '72h'", vf.Get("expires")))
+			return
+		}
+		expires = time.Now().UTC().Add(d).Format(time.RFC3339)
+	}
+	code := F("%x", securecookie.GenerateRandomKey(16))
+	bys, _ := json.Marshal(paths)
+	id, err := database.QueryNextID("invites")
+	if err != nil {
+		writeAPIResponse(r, w, false, F("The invite could not be saved: %s", err.Error()))
+		return
+	}
+	database.QueryPrepared(true, "insert into invites (id, code, paths, creator, created, expires, max_uses, uses, note) values (?, ?, ?, ?, ?, ?, ?, 0, ?)", id, code, string(bys), admin.snowflake, timeNow(), expires, maxUses, vf.Get("note"))
+	auditLog(r, admin.snowflake, "invite.create", code, strings.Join(paths, ","))
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"message":  "Created an invite link.",
+		"code":     code,
+		"link":     fullHost(r) + httpBase + "invite/" + code,
+	})
+}
+
+// handler for http://andesite/api/admin/invites/delete
+func handleInviteDelete(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "code", Kind: FieldHash})
+	if !ok {
+		return
+	}
+	if _, ok := queryInviteByCode(vf.Get("code")); !ok {
+		writeAPIResponse(r, w, false, "Invite does not exist")
+		return
+	}
+	database.QueryPrepared(true, "delete from invites where code = ?", vf.Get("code"))
+	auditLog(r, admin.snowflake, "invite.delete", vf.Get("code"), "")
+	writeAPIResponse(r, w, true, "Deleted the invite, its link no longer works.")
+}
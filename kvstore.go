@@ -0,0 +1,244 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boj/redistore"
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/securecookie"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// KVStore holds short-lived shared state such as counters, tokens, and caches. It is kept in
+// memory by default or in Redis when configured, so that it is shared between clustered nodes.
+type KVStore interface {
+	Get(key string) (string, bool)
+	Set(key string, value string, ttl time.Duration)
+	Incr(key string, ttl time.Duration) int64
+	Delete(key string)
+	Keys(prefix string) []string
+}
+
+var cache KVStore = NewMemoryKV()
+
+//
+//
+
+//
+type MemoryKV struct {
+	sync.Mutex
+	items map[string]memoryKVItem
+}
+
+type memoryKVItem struct {
+	value   string
+	count   int64
+	expires time.Time
+}
+
+//
+func NewMemoryKV() *MemoryKV {
+	m := &MemoryKV{items: map[string]memoryKVItem{}}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			m.Lock()
+			for k, v := range m.items {
+				if v.expired() {
+					delete(m.items, k)
+				}
+			}
+			m.Unlock()
+		}
+	}()
+	return m
+}
+
+func (it memoryKVItem) expired() bool {
+	return !it.expires.IsZero() && time.Now().After(it.expires)
+}
+
+func expiryFromTTL(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+//
+func (m *MemoryKV) Get(key string) (string, bool) {
+	m.Lock()
+	defer m.Unlock()
+	it, ok := m.items[key]
+	if !ok || it.expired() {
+		return "", false
+	}
+	return it.value, true
+}
+
+//
+func (m *MemoryKV) Set(key string, value string, ttl time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.items[key] = memoryKVItem{value, 0, expiryFromTTL(ttl)}
+}
+
+// Incr increments the counter at key, the ttl is only applied when the counter is created
+func (m *MemoryKV) Incr(key string, ttl time.Duration) int64 {
+	m.Lock()
+	defer m.Unlock()
+	it, ok := m.items[key]
+	if !ok || it.expired() {
+		it = memoryKVItem{"", 0, expiryFromTTL(ttl)}
+	}
+	it.count++
+	it.value = F("%d", it.count)
+	m.items[key] = it
+	return it.count
+}
+
+//
+func (m *MemoryKV) Delete(key string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.items, key)
+}
+
+// Keys returns every live key starting with prefix
+func (m *MemoryKV) Keys(prefix string) []string {
+	m.Lock()
+	defer m.Unlock()
+	result := []string{}
+	for k, v := range m.items {
+		if strings.HasPrefix(k, prefix) && !v.expired() {
+			result = append(result, k)
+		}
+	}
+	return result
+}
+
+//
+//
+
+//
+type RedisKV struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+//
+func NewRedisKV(cfg ConfigRedis) *RedisKV {
+	return &RedisKV{
+		&redis.Pool{
+			MaxIdle:     10,
+			IdleTimeout: time.Minute * 4,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", cfg.Address, redis.DialPassword(cfg.Password), redis.DialDatabase(cfg.DB))
+			},
+		},
+		"andesite:",
+	}
+}
+
+//
+func (rk *RedisKV) Get(key string) (string, bool) {
+	conn := rk.pool.Get()
+	defer conn.Close()
+	v, err := redis.String(conn.Do("GET", rk.prefix+key))
+	if err != nil {
+		return "", false
+	}
+	return v, true
+}
+
+//
+func (rk *RedisKV) Set(key string, value string, ttl time.Duration) {
+	conn := rk.pool.Get()
+	defer conn.Close()
+	if ttl > 0 {
+		conn.Do("SET", rk.prefix+key, value, "PX", int64(ttl/time.Millisecond))
+	} else {
+		conn.Do("SET", rk.prefix+key, value)
+	}
+}
+
+// Incr increments the counter at key, the ttl is only applied when the counter is created
+func (rk *RedisKV) Incr(key string, ttl time.Duration) int64 {
+	conn := rk.pool.Get()
+	defer conn.Close()
+	n, _ := redis.Int64(conn.Do("INCR", rk.prefix+key))
+	if n == 1 && ttl > 0 {
+		conn.Do("PEXPIRE", rk.prefix+key, int64(ttl/time.Millisecond))
+	}
+	return n
+}
+
+//
+func (rk *RedisKV) Delete(key string) {
+	conn := rk.pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", rk.prefix+key)
+}
+
+// Keys returns every live key starting with prefix
+func (rk *RedisKV) Keys(prefix string) []string {
+	conn := rk.pool.Get()
+	defer conn.Close()
+	result := []string{}
+	cursor := "0"
+	for {
+		vals, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", rk.prefix+prefix+"*", "COUNT", 100))
+		if err != nil || len(vals) != 2 {
+			return result
+		}
+		cursor, _ = redis.String(vals[0], nil)
+		keys, _ := redis.Strings(vals[1], nil)
+		for _, item := range keys {
+			result = append(result, strings.TrimPrefix(item, rk.prefix))
+		}
+		if cursor == "0" {
+			return result
+		}
+	}
+}
+
+// ping checks that the configured server is reachable
+func (rk *RedisKV) ping() error {
+	conn := rk.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+// sharedSessionKey returns the session signing key stored in Redis, creating it on first use so
+// that sessions survive restarts and are valid on every node
+func (rk *RedisKV) sharedSessionKey(rotate bool) []byte {
+	conn := rk.pool.Get()
+	defer conn.Close()
+	if rotate {
+		conn.Do("DEL", rk.prefix+"session_key")
+	}
+	conn.Do("SETNX", rk.prefix+"session_key", F("%x", securecookie.GenerateRandomKey(32)))
+	v, _ := redis.String(conn.Do("GET", rk.prefix+"session_key"))
+	return []byte(strings.TrimSpace(v))
+}
+
+// initRedis switches the session store and KV cache over to Redis
+func initRedis(cfg ConfigRedis, rotate bool) error {
+	rk := NewRedisKV(cfg)
+	if err := rk.ping(); err != nil {
+		return err
+	}
+	randomKey = rk.sharedSessionKey(rotate)
+	rs, err := redistore.NewRediStoreWithPool(rk.pool, randomKey)
+	if err != nil {
+		return err
+	}
+	rs.SetKeyPrefix(rk.prefix + "session:")
+	cache = rk
+	store = rs
+	return nil
+}
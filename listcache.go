@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+const (
+	defaultListingCacheSize = 256
+	// entries are read again after this even without a change, for directories the watcher
+	// does not cover, whose files may have changed without changing the directory
+	listingCacheTTL = time.Minute
+)
+
+type listingCacheEntry struct {
+	mod   time.Time
+	read  time.Time
+	files []os.FileInfo
+}
+
+// listingCache holds the entries of recently listed directories by their location on disk
+var listingCache = struct {
+	sync.Mutex
+	items map[string]listingCacheEntry
+}{items: map[string]listingCacheEntry{}}
+
+func validateListingCacheConfig(cfg *Config) error {
+	if cfg.ListingCache.Size < 0 {
+		return E("listing_cache.size must not be negative")
+	}
+	return nil
+}
+
+func listingCacheSize() int {
+	if config.ListingCache.Size == 0 {
+		return defaultListingCacheSize
+	}
+	return config.ListingCache.Size
+}
+
+// cachedReadDir is ioutil.ReadDir, answered from the cache while the directory has the same
+// modification time and the watcher has not reported a change in it
+func cachedReadDir(full string) ([]os.FileInfo, error) {
+	if config.ListingCache.Disabled {
+		return ioutil.ReadDir(full)
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, err
+	}
+	listingCache.Lock()
+	e, ok := listingCache.items[full]
+	listingCache.Unlock()
+	if ok && e.mod.Equal(info.ModTime()) && time.Since(e.read) < listingCacheTTL {
+		return append([]os.FileInfo{}, e.files...), nil
+	}
+	files, err := ioutil.ReadDir(full)
+	if err != nil {
+		return nil, err
+	}
+	listingCache.Lock()
+	if _, ok := listingCache.items[full]; !ok && len(listingCache.items) >= listingCacheSize() {
+		oldest := ""
+		for k, v := range listingCache.items {
+			if len(oldest) == 0 || v.read.Before(listingCache.items[oldest].read) {
+				oldest = k
+			}
+		}
+		delete(listingCache.items, oldest)
+	}
+	listingCache.items[full] = listingCacheEntry{info.ModTime(), time.Now(), files}
+	listingCache.Unlock()
+	return append([]os.FileInfo{}, files...), nil
+}
+
+// invalidateListing drops the cached entries of the directory at full
+func invalidateListing(full string) {
+	listingCache.Lock()
+	delete(listingCache.items, full)
+	listingCache.Unlock()
+}
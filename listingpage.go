@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const (
+	// entries of a directory on each page of its listing, unless ?per_page= asks for another number
+	defaultPerPage = 500
+	maxPerPage     = 5000
+)
+
+// listingPage reads ?page=, starting at 1, and ?per_page= of a listing
+func listingPage(r *http.Request) (int, int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	return page, perPage
+}
+
+// isPaged returns true if a listing was asked for one page of it, JSON listings are otherwise
+// sent whole as they always were
+func isPaged(r *http.Request) bool {
+	q := r.URL.Query()
+	return len(q.Get("page")) > 0 || len(q.Get("per_page")) > 0
+}
+
+// pageOf returns the files on page of a listing, the page moved to within [1, pages], and how
+// many pages there are
+func pageOf(files []os.FileInfo, page int, perPage int) ([]os.FileInfo, int, int) {
+	pages := (len(files) + perPage - 1) / perPage
+	if pages == 0 {
+		pages = 1
+	}
+	if page > pages {
+		page = pages
+	}
+	if page < 1 {
+		page = 1
+	}
+	start := (page - 1) * perPage
+	end := start + perPage
+	if end > len(files) {
+		end = len(files)
+	}
+	return files[start:end], page, pages
+}
+
+// nextPage is the page after page, or 0 on the last one
+func nextPage(page int, pages int) int {
+	if page >= pages {
+		return 0
+	}
+	return page + 1
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+func TestPageOf(t *testing.T) {
+	files := make([]os.FileInfo, 25)
+	cases := []struct {
+		files   []os.FileInfo
+		page    int
+		perPage int
+		want    int
+		pages   int
+		count   int
+	}{
+		{files, 1, 10, 1, 3, 10},
+		{files, 3, 10, 3, 3, 5},
+		{files, 4, 10, 3, 3, 5},
+		{files, 0, 10, 1, 3, 10},
+		{files, -5, 10, 1, 3, 10},
+		{files, math.MaxInt64, 10, 3, 3, 5},
+		{files, math.MaxInt64 / 10, maxPerPage, 1, 1, 25},
+		{nil, 2, 10, 1, 1, 0},
+	}
+	for _, item := range cases {
+		got, page, pages := pageOf(item.files, item.page, item.perPage)
+		if page != item.want || pages != item.pages || len(got) != item.count {
+			t.Errorf("pageOf(%d files, %d, %d) = %d files on page %d of %d, want %d on %d of %d",
+				len(item.files), item.page, item.perPage, len(got), page, pages, item.count, item.want, item.pages)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/nektro/go-util/util"
+)
+
+// the columns a listing can be sorted by with ?sort=
+var listingSortKeys = []string{"name", "size", "mtime", "type"}
+
+// listingSort returns the column and order to sort a listing by. A choice made with ?sort= and
+// ?order= is kept in the session, so that it sticks while browsing.
+func listingSort(r *http.Request, w http.ResponseWriter) (string, string) {
+	sess := getSession(r)
+	key, order := r.URL.Query().Get("sort"), r.URL.Query().Get("order")
+	if order != "desc" {
+		order = "asc"
+	}
+	if Contains(listingSortKeys, key) {
+		sess.Values["listing_sort"] = key
+		sess.Values["listing_order"] = order
+		sess.Save(r, w)
+		return key, order
+	}
+	if v, ok := sess.Values["listing_sort"].(string); ok && Contains(listingSortKeys, v) {
+		order, _ = sess.Values["listing_order"].(string)
+		return v, order
+	}
+	return "name", "asc"
+}
+
+func isListedDir(x os.FileInfo) bool {
+	return x.IsDir() || x.Mode()&os.ModeSymlink != 0
+}
+
+// sortListing orders files by key, ties are broken by name
+func sortListing(files []os.FileInfo, key string, order string) {
+	byName := func(a, b os.FileInfo) bool {
+		la, lb := strings.ToLower(a.Name()), strings.ToLower(b.Name())
+		if la != lb {
+			return la < lb
+		}
+		return a.Name() < b.Name()
+	}
+	less := byName
+	switch key {
+	case "size":
+		less = func(a, b os.FileInfo) bool {
+			if a.Size() != b.Size() {
+				return a.Size() < b.Size()
+			}
+			return byName(a, b)
+		}
+	case "mtime":
+		less = func(a, b os.FileInfo) bool {
+			if !a.ModTime().Equal(b.ModTime()) {
+				return a.ModTime().Before(b.ModTime())
+			}
+			return byName(a, b)
+		}
+	case "type":
+		// folders first, then files by extension
+		less = func(a, b os.FileInfo) bool {
+			if da, db := isListedDir(a), isListedDir(b); da != db {
+				return da
+			}
+			ea, eb := strings.ToLower(filepath.Ext(a.Name())), strings.ToLower(filepath.Ext(b.Name()))
+			if ea != eb {
+				return ea < eb
+			}
+			return byName(a, b)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if order == "desc" {
+			return less(files[j], files[i])
+		}
+		return less(files[i], files[j])
+	})
+}
+
+// listingSortLinks are the header links of a listing, each sorting by its column and flipping
+// the order when it is the current one, with the icon showing the current order
+func listingSortLinks(key string, order string) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, item := range listingSortKeys {
+		link := map[string]string{"href": "?sort=" + item + "&order=asc", "icon": ""}
+		if item == key {
+			if order == "asc" {
+				link["href"] = "?sort=" + item + "&order=desc"
+				link["icon"] = "caret up icon"
+			} else {
+				link["icon"] = "caret down icon"
+			}
+		}
+		result[item] = link
+	}
+	return result
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// writeListingText responds with the link of every entry of files, one per line, for tools such
+// as wget -i. With recursive it lists every file below qpath instead, and no folders.
+func writeListingText(w http.ResponseWriter, r *http.Request, qpath string, files []os.FileInfo, uAccess []string, recursive bool) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	base := fullHost(r) + httpBase + (&url.URL{Path: r.URL.Path[1:]}).EscapedPath()
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	if !recursive {
+		sortListing(files, "name", "asc")
+		for _, item := range files {
+			name := item.Name()
+			if isListedDir(item) {
+				name += "/"
+			}
+			bw.WriteString(base + (&url.URL{Path: name}).EscapedPath() + "\n")
+		}
+		return
+	}
+	listFilesBelow(qpath, "", uAccess, func(rel string) {
+		bw.WriteString(base + (&url.URL{Path: rel}).EscapedPath() + "\n")
+	})
+}
+
+// listFilesBelow calls found with the path of every file below dir, relative to it with prefix in
+// front, skipping hidden and ignored files and anything the user may not read. Symlinked
+// directories are not followed, as in archives.
+func listFilesBelow(dir string, prefix string, uAccess []string, found func(string)) {
+	files, err := rootDir.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	rules := ignoreRulesFor(dir)
+	sortListing(files, "name", "asc")
+	for _, item := range files {
+		p := dir + item.Name()
+		if isHiddenEntry(rules, p, item.IsDir()) {
+			continue
+		}
+		if item.IsDir() {
+			if hasPathAccess(uAccess, p+"/") || archiveHasAccessBelow(uAccess, p+"/") {
+				listFilesBelow(p+"/", prefix+item.Name()+"/", uAccess, found)
+			}
+			continue
+		}
+		if hasPathAccess(uAccess, p) {
+			found(prefix + item.Name())
+		}
+	}
+}
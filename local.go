@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// AuthPassword is the lockout kind of local logins
+const AuthPassword = "password"
+
+const (
+	minPasswordLen      = 8
+	maxPasswordLen      = 72 // bcrypt ignores anything longer
+	passwordResetTTL    = time.Hour * 24
+	passwordResetPrefix = "password_reset:"
+)
+
+var usernameRegex = regexp.MustCompile("^[a-z0-9_.-]{1,64}$")
+
+// compared against when there is no such user, so that logins take as long either way
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("andesite"), bcrypt.DefaultCost)
+
+func checkPasswordRules(password string) error {
+	if len(password) < minPasswordLen {
+		return E(F("Passwords must be at least %d characters", minPasswordLen))
+	}
+	if len(password) > maxPasswordLen {
+		return E(F("Passwords must be at most %d bytes", maxPasswordLen))
+	}
+	return nil
+}
+
+func queryPasswordHash(uid int) ([]byte, bool) {
+	rows, err := database.QueryPrepared(false, "select hash from passwords where user = ?", uid)
+	if err != nil {
+		return nil, false
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, false
+	}
+	var hash string
+	rows.Scan(&hash)
+	return []byte(hash), true
+}
+
+func querySetPassword(uid int, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if _, ok := queryPasswordHash(uid); ok {
+		database.QueryPrepared(true, "update passwords set hash = ? where user = ?", string(hash), uid)
+		return nil
+	}
+	id, err := database.QueryNextID("passwords")
+	if err != nil {
+		return err
+	}
+	database.QueryPrepared(true, "insert into passwords values (?, ?, ?)", id, uid, string(hash))
+	return nil
+}
+
+// passwordResetURL creates a link that lets the user with uid set a new password, relative to httpBase
+func passwordResetURL(uid int) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	cache.Set(passwordResetPrefix+token, strconv.Itoa(uid), passwordResetTTL)
+	return "login/reset?" + url.Values{"token": {token}}.Encode()
+}
+
+// initLocalAdmin tells how a local --admin without a password can set one. The link itself is not
+// logged, since logs are often kept or shipped somewhere the password of an admin should not be.
+func initLocalAdmin(snowflake string) {
+	if !loginProviderEnabled("local") || loginProviderOf(snowflake).key != "local" {
+		return
+	}
+	user, ok := queryUserBySnowflake(snowflake)
+	if !ok {
+		return
+	}
+	if _, ok := queryPasswordHash(user.id); ok {
+		return
+	}
+	Log("[local-auth]", F("%s has no password, set one with `andesite user password %s`", snowflake, snowflake))
+}
+
+// handler for http://andesite/login?with=local
+func handleLocalLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeHandlebarsFile(r, w, "/login_local.hbs", map[string]interface{}{
+			"base": httpBase,
+		})
+		return
+	}
+	r.ParseForm()
+	username := r.PostForm.Get("username")
+	password := r.PostForm.Get("password")
+	if !checkLockout(r, w, AuthPassword, username) {
+		return
+	}
+	snowflake := externalSnowflake("local", username)
+	user, ok := queryUserBySnowflake(snowflake)
+	hash := dummyHash
+	if ok {
+		if h, found := queryPasswordHash(user.id); found {
+			hash = h
+		} else {
+			ok = false
+		}
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok {
+		recordAuthFailure(r, AuthPassword, username)
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusForbidden)
+		writeHandlebarsFile(r, w, "/login_local.hbs", map[string]interface{}{
+			"base":     httpBase,
+			"username": username,
+			"error":    "Invalid username or password.",
+		})
+		return
+	}
+	clearAuthFailures(AuthPassword, username)
+	helperOA2SaveInfo(loginProviderOf(snowflake))(w, r, "local", username, user.name)
+	handleLoginDone(w, r)
+}
+
+// handler for http://andesite/login/reset
+func handlePasswordReset(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	token := r.Form.Get("token")
+	v, ok := cache.Get(passwordResetPrefix + token)
+	if len(token) == 0 || !ok {
+		writeResponse(r, w, "Invalid Link", "This password reset link is invalid or has expired.", "")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeHandlebarsFile(r, w, "/login_reset.hbs", map[string]interface{}{
+			"base":  httpBase,
+			"token": token,
+		})
+		return
+	}
+	password := r.PostForm.Get("password")
+	if err := checkPasswordRules(password); err != nil {
+		writeHandlebarsFile(r, w, "/login_reset.hbs", map[string]interface{}{
+			"base":  httpBase,
+			"token": token,
+			"error": err.Error(),
+		})
+		return
+	}
+	uid, _ := strconv.Atoi(v)
+	if err := querySetPassword(uid, password); err != nil {
+		writeResponse(r, w, "Error", err.Error(), "")
+		return
+	}
+	cache.Delete(passwordResetPrefix + token)
+	if u, ok := queryUserByID(uid); ok {
+		auditLog(r, u.snowflake, "password.change", u.snowflake, "reset link")
+	}
+	writeResponse(r, w, "Password Set", "Your password has been changed.", "<a href='"+httpBase+"login?with=local'>Log in</a>")
+}
+
+// handler for http://andesite/api/account/password
+func handlePasswordChange(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "current", Kind: FieldString, MaxLen: maxPasswordLen},
+		FormField{Name: "password", Kind: FieldString, MaxLen: maxPasswordLen},
+	)
+	if !ok {
+		return
+	}
+	hash, ok := queryPasswordHash(user.id)
+	if user.provider != "local" || !ok {
+		writeAPIResponse(r, w, false, "Only local accounts have a password")
+		return
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(vf.Get("current"))) != nil {
+		writeAPIResponse(r, w, false, "Current password is incorrect")
+		return
+	}
+	if err := checkPasswordRules(vf.Get("password")); err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	if err := querySetPassword(user.id, vf.Get("password")); err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	auditLog(r, user.snowflake, "password.change", user.snowflake, "")
+	writeAPIResponse(r, w, true, "Changed your password.")
+}
+
+// handler for http://andesite/api/admin/users/create
+func handleLocalUserCreate(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "username", Kind: FieldString, MaxLen: 64},
+		FormField{Name: "password", Kind: FieldString, MaxLen: maxPasswordLen, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	if !loginProviderEnabled("local") {
+		writeAPIResponse(r, w, false, "Local accounts are not enabled")
+		return
+	}
+	username := vf.Get("username")
+	if !usernameRegex.MatchString(username) {
+		writeAPIResponse(r, w, false, "Usernames may only contain a-z, 0-9, '_', '.', and '-'")
+		return
+	}
+	snowflake := externalSnowflake("local", username)
+	if _, ok := queryUserBySnowflake(snowflake); ok {
+		writeAPIResponse(r, w, false, F("User '%s' already exists", username))
+		return
+	}
+	if vf.Has("password") && len(vf.Get("password")) > 0 {
+		if err := checkPasswordRules(vf.Get("password")); err != nil {
+			writeAPIResponse(r, w, false, err.Error())
+			return
+		}
+	}
+	uid, err := database.QueryNextID("users")
+	if err != nil {
+		writeAPIResponse(r, w, false, F("User '%s' could not be created: %s", username, err.Error()))
+		return
+	}
+	queryDoAddUser(uid, snowflake, false, username)
+	auditLog(r, admin.snowflake, "user.create", snowflake, "")
+	if len(vf.Get("password")) > 0 {
+		if err := querySetPassword(uid, vf.Get("password")); err != nil {
+			writeAPIResponse(r, w, false, F("Created user %s, but their password could not be set: %s", snowflake, err.Error()))
+			return
+		}
+		writeAPIResponse(r, w, true, F("Created user %s.", snowflake))
+		return
+	}
+	writeAPIResponse(r, w, true, F("Created user %s. They may set a password at %s%s", snowflake, fullHost(r)+httpBase, passwordResetURL(uid)))
+}
+
+// handler for http://andesite/api/admin/users/reset
+func handleLocalUserReset(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128})
+	if !ok {
+		return
+	}
+	user, ok := queryUserBySnowflake(vf.Get("snowflake"))
+	if !ok || user.provider != "local" {
+		writeAPIResponse(r, w, false, F("No local user '%s'", vf.Get("snowflake")))
+		return
+	}
+	auditLog(r, admin.snowflake, "password.reset", user.snowflake, "")
+	writeAPIResponse(r, w, true, F("%s may set a new password at %s%s", user.snowflake, fullHost(r)+httpBase, passwordResetURL(user.id)))
+}
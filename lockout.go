@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// kinds of credentials tracked by the lockout
+const (
+	AuthFeedToken  = "feed"
+	AuthArrToken   = "arr"
+	AuthShareCode  = "share"
+	AuthSignedLink = "signed"
+)
+
+const lockoutPrefix = "lockout:"
+
+// AuthFailures is the failure count of one account or IP, stored in the cache
+type AuthFailures struct {
+	Kind    string `json:"kind"`
+	Subject string `json:"subject"`
+	Count   int    `json:"count"`
+	Until   int64  `json:"until"`
+}
+
+var (
+	lockoutThreshold = 5
+	lockoutBase      = time.Second
+	lockoutMax       = time.Minute * 15
+	lockoutWindow    = time.Hour
+)
+
+func initLockout(cfg ConfigLockout) error {
+	if cfg.Threshold < 0 {
+		return E("lockout.threshold must not be negative")
+	}
+	if cfg.Threshold > 0 {
+		lockoutThreshold = cfg.Threshold
+	}
+	for _, item := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"base_delay", cfg.BaseDelay, &lockoutBase},
+		{"max_delay", cfg.MaxDelay, &lockoutMax},
+		{"window", cfg.Window, &lockoutWindow},
+	} {
+		if len(item.value) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(item.value)
+		if err != nil || d <= 0 {
+			return E(F("Invalid lockout.%s '%s'", item.name, item.value))
+		}
+		*item.dest = d
+	}
+	return nil
+}
+
+func lockoutKey(kind string, subject string) string {
+	return lockoutPrefix + kind + ":" + subject
+}
+
+func getAuthFailures(key string) AuthFailures {
+	af := AuthFailures{}
+	if v, ok := cache.Get(key); ok {
+		json.Unmarshal([]byte(v), &af)
+	}
+	return af
+}
+
+// lockoutSubjects are the keys a failure counts against, the account if known and the client IP
+func lockoutSubjects(r *http.Request, kind string, subject string) [][2]string {
+	result := [][2]string{{kind, "ip/" + clientIP(r)}}
+	if len(subject) > 0 {
+		result = append(result, [2]string{kind, subject})
+	}
+	return result
+}
+
+// checkLockout returns false and writes a 429 if the account or IP is currently backed off
+func checkLockout(r *http.Request, w http.ResponseWriter, kind string, subject string) bool {
+	now := time.Now().Unix()
+	for _, item := range lockoutSubjects(r, kind, subject) {
+		af := getAuthFailures(lockoutKey(item[0], item[1]))
+		if af.Until > now {
+			w.Header().Set("Retry-After", strconv.FormatInt(af.Until-now, 10))
+			writeStatus(r, w, http.StatusTooManyRequests)
+			writeResponse(r, w, "Too Many Attempts", "Too many failed attempts, please try again later.", "")
+			return false
+		}
+	}
+	return true
+}
+
+// recordAuthFailure counts a failed attempt, backing off exponentially once past the threshold
+func recordAuthFailure(r *http.Request, kind string, subject string) {
+	auditFailure(r, "", "auth."+kind, subject, "")
+	for _, item := range lockoutSubjects(r, kind, subject) {
+		key := lockoutKey(item[0], item[1])
+		af := getAuthFailures(key)
+		af.Kind, af.Subject = item[0], item[1]
+		af.Count++
+		ttl := lockoutWindow
+		if af.Count >= lockoutThreshold {
+			delay := time.Duration(float64(lockoutBase) * math.Pow(2, float64(af.Count-lockoutThreshold)))
+			if delay > lockoutMax || delay <= 0 {
+				delay = lockoutMax
+			}
+			af.Until = time.Now().Add(delay).Unix()
+			if delay > ttl {
+				ttl = delay
+			}
+			Log("[lockout]", kind, item[1], "locked for", delay.String(), "after", af.Count, "failures")
+			auditFailure(r, "", "lockout", item[1], F("%s for %s after %d failures", kind, delay.String(), af.Count))
+		}
+		bytes, _ := json.Marshal(af)
+		cache.Set(key, string(bytes), ttl)
+	}
+}
+
+// clearAuthFailures resets the account's count after a successful attempt
+func clearAuthFailures(kind string, subject string) {
+	cache.Delete(lockoutKey(kind, subject))
+}
+
+// handler for http://andesite/api/admin/lockouts
+func handleLockoutList(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	now := time.Now().Unix()
+	result := []map[string]interface{}{}
+	for _, key := range cache.Keys(lockoutPrefix) {
+		af := getAuthFailures(key)
+		result = append(result, map[string]interface{}{
+			"key":      key,
+			"kind":     af.Kind,
+			"subject":  af.Subject,
+			"failures": af.Count,
+			"locked":   af.Until > now,
+			"until":    af.Until,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["key"].(string) < result[j]["key"].(string)
+	})
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"lockouts": result,
+	})
+}
+
+// handler for http://andesite/api/admin/lockouts/clear
+func handleLockoutClear(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "key", Kind: FieldString, MaxLen: 256})
+	if !ok {
+		return
+	}
+	key := vf.Get("key")
+	if !strings.HasPrefix(key, lockoutPrefix) {
+		writeAPIResponse(r, w, false, "Not a lockout key")
+		return
+	}
+	cache.Delete(key)
+	auditLog(r, user.snowflake, "lockout.clear", key, "")
+	writeAPIResponse(r, w, true, F("Cleared %s.", key))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nektro/go.oauth2"
+)
+
+// safeNext returns true if next is a path on this site, and not a URL that would send the user
+// somewhere else after logging in
+func safeNext(next string) bool {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\r\n") {
+		return false
+	}
+	u, err := url.Parse(next)
+	return err == nil && len(u.Scheme) == 0 && len(u.Host) == 0
+}
+
+// loginURL is the login link that brings the user back to the page of r afterwards
+func loginURL(r *http.Request) string {
+	if r.Method != http.MethodGet {
+		return httpBase + "login"
+	}
+	return httpBase + "login?" + url.Values{"next": {r.URL.RequestURI()}}.Encode()
+}
+
+// mwLoginNext remembers the ?next= page of a login in the session
+func mwLoginNext(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if n := r.URL.Query().Get("next"); safeNext(n) {
+			sess := getSession(r)
+			sess.Values["next"] = n
+			sess.Save(r, w)
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// handler for http://andesite/login/done
+func handleLoginDone(w http.ResponseWriter, r *http.Request) {
+	target := "/files/"
+	sess := getSession(r)
+	if msg, ok := sess.Values["login_error"].(string); ok {
+		delete(sess.Values, "login_error")
+		sess.Save(r, w)
+		writeStatus(r, w, http.StatusForbidden)
+		writeResponse(r, w, "Login Denied", msg, "")
+		return
+	}
+	if n, ok := sess.Values["next"].(string); ok {
+		delete(sess.Values, "next")
+		sess.Save(r, w)
+		if safeNext(n) {
+			target = n
+		}
+	}
+	w.Header().Set("Location", httpBase+target[1:])
+	w.WriteHeader(http.StatusFound)
+}
+
+// loginGates may refuse a user after their provider has said who they are, given the ID and name
+// from the provider. Otherwise they return the groups the user is in there.
+var loginGates = map[string]func(app *ConfigIDP, id string, name string) ([]string, error){
+	"discord": discordGate,
+	"github":  githubGate,
+}
+
+// buildLoginHandlers creates the OAuth2 login and callback handlers of every login provider
+func buildLoginHandlers(providers []LoginProvider) (map[string]http.HandlerFunc, map[string]http.HandlerFunc) {
+	logins := map[string]http.HandlerFunc{}
+	callbacks := map[string]http.HandlerFunc{}
+	for _, item := range providers {
+		switch item.key {
+		case "local":
+			logins[item.key] = handleLocalLogin
+			continue
+		case "proxy":
+			logins[item.key] = handleProxyLogin
+			continue
+		case "passkey":
+			logins[item.key] = handlePasskeyLogin
+			continue
+		}
+		logins[item.key] = oauth2.HandleOAuthLogin(helperIsLoggedIn, "./login/done", item.idp, item.app.ID)
+		callbacks[item.key] = oauth2.HandleOAuthCallback(item.idp, item.app.ID, item.app.Secret, helperOA2SaveInfo(item), "./login/done")
+	}
+	return logins, callbacks
+}
+
+func initLoginHandlers() {
+	updateLive(func(lc *LiveConfig) {
+		lc.logins, lc.callbacks = buildLoginHandlers(lc.providers)
+	})
+}
+
+// handler for http://andesite/login
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	lc := live()
+	key := r.URL.Query().Get("with")
+	if len(key) == 0 && len(lc.providers) == 1 {
+		key = lc.providers[0].key
+	}
+	if h, ok := lc.logins[key]; ok {
+		sess := getSession(r)
+		sess.Values["login_with"] = key
+		sess.Save(r, w)
+		h(w, r)
+		return
+	}
+	if helperIsLoggedIn(r) {
+		handleLoginDone(w, r)
+		return
+	}
+	providers := []map[string]string{}
+	for _, item := range lc.providers {
+		q := url.Values{"with": {item.key}}
+		if n := r.URL.Query().Get("next"); safeNext(n) {
+			q.Set("next", n)
+		}
+		providers = append(providers, map[string]string{
+			"name": item.Name(),
+			"link": "./login?" + q.Encode(),
+		})
+	}
+	writeHandlebarsFile(r, w, "/login.hbs", map[string]interface{}{
+		"base":      httpBase,
+		"providers": providers,
+	})
+}
+
+// handler for http://andesite/callback, finishing the login with the provider it was started with
+func handleCallback(w http.ResponseWriter, r *http.Request) {
+	lc := live()
+	key, _ := getSession(r).Values["login_with"].(string)
+	h, ok := lc.callbacks[key]
+	if !ok {
+		h = lc.callbacks[lc.providers[0].key]
+	}
+	// local accounts, the auth proxy, and passkeys log in without a callback
+	if h == nil {
+		writeStatus(r, w, http.StatusBadRequest)
+		writeResponse(r, w, "Bad Request", "No login is in progress.", "")
+		return
+	}
+	h(w, r)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aymerick/raymond"
+	"github.com/gorilla/securecookie"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// TLS modes of the SMTP server
+const (
+	SMTPStartTLS = "starttls"
+	SMTPTLS      = "tls"
+	SMTPNone     = "none"
+)
+
+const (
+	mailMaxAttempts = 3
+	// the same alert is sent at most this often
+	alertCooldown = time.Hour
+	// how often the free space of the root is checked
+	diskCheckEvery = time.Minute * 15
+	// how long a link to confirm an email address works
+	emailConfirmTTL = time.Hour * 24
+	// creators of share links are warned this long before they expire
+	shareWarnBefore = time.Hour * 24
+)
+
+func validateSMTPConfig(cfg *ConfigSMTP) error {
+	if cfg == nil {
+		return nil
+	}
+	if len(cfg.Host) == 0 || len(cfg.From) == 0 {
+		return E("smtp.host and smtp.from are required")
+	}
+	if !validEmail(cfg.From) {
+		return E(F("Invalid smtp.from '%s'", cfg.From))
+	}
+	switch cfg.TLS {
+	case "":
+		cfg.TLS = SMTPStartTLS
+	case SMTPStartTLS, SMTPTLS, SMTPNone:
+	default:
+		return E(F("Invalid smtp.tls '%s', must be one of 'starttls', 'tls', 'none'", cfg.TLS))
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 587
+		if cfg.TLS == SMTPTLS {
+			cfg.Port = 465
+		}
+	}
+	for _, item := range cfg.Alerts {
+		if !validEmail(item) {
+			return E(F("Invalid smtp.alerts address '%s'", item))
+		}
+	}
+	if cfg.DiskFreePercent < 0 || cfg.DiskFreePercent > 100 {
+		return E("smtp.disk_free_percent must be between 0 and 100")
+	}
+	if cfg.DiskFreePercent == 0 {
+		cfg.DiskFreePercent = 5
+	}
+	return nil
+}
+
+// validEmail is a loose check, the server has the final say, but it keeps header injection out
+func validEmail(addr string) bool {
+	at := strings.LastIndex(addr, "@")
+	return at > 0 && at < len(addr)-1 && len(addr) <= 254 && !strings.ContainsAny(addr, " <>,;\r\n\"")
+}
+
+// renderMail renders the template /mail/name.hbs, which may be overridden by a theme. The first
+// line of the result is the subject and the rest is the plain text body.
+func renderMail(name string, context map[string]interface{}) (string, string, error) {
+	context["site"] = config.SMTP.URL
+	tmpl := readServerFile("/mail/" + name + ".hbs")
+	if len(tmpl) == 0 {
+		return "", "", E(F("Mail template mail/%s.hbs does not exist", name))
+	}
+	result, err := raymond.Render(string(tmpl), context)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(strings.TrimLeft(result, "\r\n"), "\n", 2)
+	subject := strings.TrimSpace(parts[0])
+	body := ""
+	if len(parts) > 1 {
+		body = strings.TrimLeft(parts[1], "\r\n")
+	}
+	return subject, body, nil
+}
+
+// sendMail renders a template and sends it to every address in to, in the background
+func sendMail(to []string, name string, context map[string]interface{}) {
+	if config.SMTP == nil || len(to) == 0 {
+		return
+	}
+	subject, body, err := renderMail(name, context)
+	if err != nil {
+		LogError("[mail]", err.Error())
+		return
+	}
+	cfg := *config.SMTP
+	for _, item := range to {
+		go deliverMail(cfg, item, buildMessage(cfg.From, item, subject, body))
+	}
+}
+
+func buildMessage(from string, to string, subject string, body string) []byte {
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+	var b bytes.Buffer
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Auto-Submitted: auto-generated\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return b.Bytes()
+}
+
+// deliverMail sends msg, retrying with backoff like webhooks
+func deliverMail(cfg ConfigSMTP, to string, msg []byte) {
+	wait := time.Second * 5
+	for i := 1; i <= mailMaxAttempts; i++ {
+		err := smtpSend(cfg, to, msg)
+		if err == nil {
+			return
+		}
+		LogError("[mail]", to, F("attempt %d/%d:", i, mailMaxAttempts), err)
+		time.Sleep(wait)
+		wait *= 4
+	}
+}
+
+func smtpSend(cfg ConfigSMTP, to string, msg []byte) error {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	tc := &tls.Config{ServerName: cfg.Host}
+	var c *smtp.Client
+	if cfg.TLS == SMTPTLS {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second * 30}, "tcp", addr, tc)
+		if err != nil {
+			return err
+		}
+		if c, err = smtp.NewClient(conn, cfg.Host); err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		conn, err := net.DialTimeout("tcp", addr, time.Second*30)
+		if err != nil {
+			return err
+		}
+		if c, err = smtp.NewClient(conn, cfg.Host); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	defer c.Close()
+	if cfg.TLS == SMTPStartTLS {
+		if err := c.StartTLS(tc); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Username) > 0 {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(msg); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// mailUser sends a message to the address the user gave on their account page, if any
+func mailUser(user UserRow, name string, context map[string]interface{}) {
+	if len(user.email) == 0 {
+		return
+	}
+	context["name"] = displayName(user.snowflake, user.name)
+	sendMail([]string{user.email}, name, context)
+}
+
+// alertAddresses are smtp.alerts, or else every admin that gave an address
+func alertAddresses() []string {
+	if config.SMTP == nil {
+		return nil
+	}
+	if len(config.SMTP.Alerts) > 0 {
+		return config.SMTP.Alerts
+	}
+	result := []string{}
+	for _, item := range queryAllUsers() {
+		if item.admin && len(item.email) > 0 {
+			result = append(result, item.email)
+		}
+	}
+	return result
+}
+
+// alertAdmins sends an alert of kind, unless one was sent within alertCooldown. The cooldown is
+// kept in the cache so that clustered nodes share it.
+func alertAdmins(kind string, name string, context map[string]interface{}) {
+	if config.SMTP == nil {
+		return
+	}
+	key := "alert:" + kind
+	if _, ok := cache.Get(key); ok {
+		return
+	}
+	cache.Set(key, timeNow(), alertCooldown)
+	Log("[mail]", "Sending", kind, "alert")
+	context["kind"] = kind
+	sendMail(alertAddresses(), name, context)
+}
+
+// initDiskAlerts warns the admins when the filesystem of the root is almost full
+func initDiskAlerts() {
+	if config.SMTP == nil {
+		return
+	}
+	go func() {
+		for {
+			free, total, err := diskSpace(rootDir.Base())
+			if err != nil {
+				// the root may only be missing for a while, such as when a drive is remounted
+				LogError("[mail]", "checking free space:", err.Error())
+			} else if total > 0 && free*100/total < uint64(config.SMTP.DiskFreePercent) {
+				alertAdmins("disk", "alert_disk", map[string]interface{}{
+					"path":    rootDir.Base(),
+					"free":    byteCountIEC(int64(free)),
+					"total":   byteCountIEC(int64(total)),
+					"percent": free * 100 / total,
+				})
+			}
+			time.Sleep(diskCheckEvery)
+		}
+	}()
+}
+
+// initShareWarnings tells the creators of share links a day before the links expire
+func initShareWarnings() {
+	if config.SMTP == nil {
+		return
+	}
+	go func() {
+		for {
+			warnExpiringShares()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func warnExpiringShares() {
+	now := time.Now().UTC()
+	rows, err := database.QueryPrepared(false, "select "+shareColumns+" from shares where expires > ? and expires <= ? and coalesce(warned, '') = ''", now.Format(time.RFC3339), now.Add(shareWarnBefore).Format(time.RFC3339))
+	if err != nil {
+		LogError("[mail]", "finding expiring shares:", err.Error())
+		return
+	}
+	shrs := []ShareRow{}
+	for rows.Next() {
+		shrs = append(shrs, scanShare(rows))
+	}
+	rows.Close()
+	for _, item := range shrs {
+		database.QueryPrepared(true, "update shares set warned = ? where id = ?", timeNow(), item.id)
+		user, ok := queryUserBySnowflake(item.creator)
+		if !ok {
+			continue
+		}
+		mailUser(user, "share_expiring", map[string]interface{}{
+			"code":    item.hash,
+			"path":    item.path,
+			"expires": item.expires,
+		})
+	}
+}
+
+//
+//
+
+// handler for http://andesite/api/account/email
+func handleAccountEmail(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "email", Kind: FieldString, MaxLen: 254})
+	if !ok {
+		return
+	}
+	email := strings.TrimSpace(vf.Get("email"))
+	if len(email) == 0 {
+		database.QueryPrepared(true, "update users set email = '' where id = ?", user.id)
+		auditLog(r, user.snowflake, "user.update", user.snowflake, "email")
+		writeAPIResponse(r, w, true, "You will no longer get emails.")
+		return
+	}
+	if !validEmail(email) {
+		writeAPIResponse(r, w, false, F("'%s' is not an email address", email))
+		return
+	}
+	if config.SMTP == nil {
+		writeAPIResponse(r, w, false, "smtp is not configured")
+		return
+	}
+	// the address is only saved once its owner opens the link, so nobody is sent mail they did not ask for
+	token := F("%x", securecookie.GenerateRandomKey(16))
+	cache.Set("email:"+token, F("%d\n%s", user.id, email), emailConfirmTTL)
+	sendMail([]string{email}, "confirm_email", map[string]interface{}{
+		"name": displayName(user.snowflake, user.name),
+		"link": fullHost(r) + httpBase + "api/account/email/confirm?token=" + token,
+	})
+	writeAPIResponse(r, w, true, F("A confirmation link was sent to %s, notifications will be sent there once it is opened.", email))
+}
+
+// handler for http://andesite/api/account/email/confirm
+func handleAccountEmailConfirm(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		token = r.PostForm.Get("token")
+	}
+	v, ok := "", false
+	if shareHashRegex.MatchString(token) {
+		v, ok = cache.Get("email:" + token)
+	}
+	if !ok {
+		writeStatus(r, w, http.StatusNotFound)
+		writeResponse(r, w, "Invalid Link", "This confirmation link does not exist or has expired.", "")
+		return
+	}
+	parts := strings.SplitN(v, "\n", 2)
+	id, _ := strconv.Atoi(parts[0])
+	if r.Method != http.MethodPost {
+		// opening the link only asks, so that mail scanners following it do not confirm the address
+		writeResponse(r, w, "Confirm Email", F("Send notifications to %s?", parts[1]), "<form method='POST' action='"+httpBase+"api/account/email/confirm'><input type='hidden' name='token' value='"+token+"'><button class='ui button'>Confirm</button></form>")
+		return
+	}
+	cache.Delete("email:" + token)
+	user, ok := queryUserByID(id)
+	if !ok {
+		writeResponse(r, w, "Invalid Link", "This confirmation link does not exist or has expired.", "")
+		return
+	}
+	database.QueryPrepared(true, "update users set email = ? where id = ?", parts[1], id)
+	auditLog(r, user.snowflake, "user.update", user.snowflake, "email")
+	writeAPIResponse(r, w, true, F("Notifications will be sent to %s.", parts[1]))
+}
+
+// handler for http://andesite/api/admin/mail/test
+func handleMailTest(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	if config.SMTP == nil {
+		writeAPIResponse(r, w, false, "smtp is not configured")
+		return
+	}
+	to := alertAddresses()
+	if len(admin.email) > 0 && !Contains(to, admin.email) {
+		to = append(to, admin.email)
+	}
+	if len(to) == 0 {
+		writeAPIResponse(r, w, false, "There is nobody to send to, set smtp.alerts or your email on your account page")
+		return
+	}
+	sendMail(to, "test", map[string]interface{}{"sender": admin.snowflake})
+	writeAPIResponse(r, w, true, F("Sending a test email to %s, check the log if it does not arrive.", strings.Join(to, ", ")))
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -13,7 +16,9 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/aymerick/raymond"
 	"github.com/gobuffalo/packr/v2"
@@ -21,12 +26,11 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/mitchellh/go-homedir"
 	"github.com/nektro/go-util/logger"
-	"github.com/nektro/go-util/sqlite"
 	"github.com/nektro/go-util/types"
 	"github.com/nektro/go.etc"
-	"github.com/nektro/go.oauth2"
 
 	flag "github.com/spf13/pflag"
+	"golang.org/x/crypto/acme/autocert"
 
 	. "github.com/nektro/go-util/alias"
 	. "github.com/nektro/go-util/util"
@@ -35,23 +39,52 @@ import (
 const (
 	version     = 1
 	accessToken = "access_token"
+	sessionName = "session_andesite"
+
+	shutdownTimeout = time.Second * 30
 )
 
 var (
-	config          *Config
-	oauth2AppConfig *ConfigIDP
-	oauth2Provider  Oauth2Provider
-	database        *sqlite.DB
-	wwFFS           types.MultiplexFileSystem
-	httpBase        string
-	rootDir         RootDir
-	metaDir         string
-	randomKey       = securecookie.GenerateRandomKey(32)
-	store           = sessions.NewCookieStore(randomKey)
-	log             = logger.New()
+	config   *Config
+	database Database
+	httpBase string
+	rootDir  RootDir
+	metaDir  string
+	// set when metaDir was given with --meta-dir, so it is not shared with others
+	metaDirChosen bool
+	randomKey     = securecookie.GenerateRandomKey(32)
+	store         = sessions.Store(sessions.NewCookieStore(randomKey))
+	log           = logger.New()
+	readOnly      int32
+	devMode       bool
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sync":
+			DieOnError(runSync(os.Args[2:]))
+			return
+		case "bench":
+			DieOnError(runBench(os.Args[2:]))
+			return
+		case "backup":
+			DieOnError(runBackup(os.Args[2:]))
+			return
+		case "restore":
+			DieOnError(runRestore(os.Args[2:]))
+			return
+		case "serve":
+			// the same as no subcommand, kept for scripts that are explicit
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		default:
+			if _, ok := cliCommands[os.Args[1]]; ok {
+				DieOnError(runCLI(os.Args[1], os.Args[2:]))
+				return
+			}
+		}
+	}
+
 	log.Log(logger.LevelINFO, "Initializing Andesite...")
 
 	flagRoot := flag.String("root", "", "Path of root directory for files")
@@ -61,7 +94,20 @@ func main() {
 	flagBase := flag.String("base", "", "")
 	flagRType := flag.String("root-type", "dir", "Type of path --root points to. One of 'dir', 'http'")
 	flagLLevel := flag.Int("log-level", int(logger.LevelINFO), "Logging level to be used for github.com/nektro/go-util/logger")
+	flagReadOnly := flag.Bool("read-only", false, "Disable all endpoints that modify files, access, or shares")
+	flagCert := flag.String("cert", "", "Path to a TLS certificate, enables HTTPS when used with --key")
+	flagKey := flag.String("key", "", "Path to the TLS private key for --cert")
+	flagRedirect := flag.Int("redirect-port", 0, "When using TLS, also listen on this port and redirect HTTP requests to HTTPS")
+	flagListen := flag.String("listen", "", "Address to listen on instead of --port, such as 'unix:/run/andesite.sock' or '127.0.0.1:8000'")
+	flagRotateKey := flag.Bool("rotate-session-key", false, "Generate a new session signing key, logging out every user and invalidating feed links")
+	flagDataDir := flag.String("data-dir", "", "Directory for the database and other persistent data")
+	flagCacheDir := flag.String("cache-dir", "", "Directory for generated files that can be safely deleted")
+	flagStateDir := flag.String("state-dir", "", "Directory for crash reports and other machine-local state")
+	flagConfig := flag.String("config", "", "Path of the config file, which may be JSON, YAML, or TOML by its extension")
+	flagMeta := flag.String("meta-dir", "", "Directory for the config, themes, and by default the database, instead of ~/.config/andesite")
+	flagDev := flag.Bool("dev", false, "Enable theme development helpers such as ?template_context=1")
 	flag.Parse()
+	DieOnError(reportConfigProblems("the environment", append(applyEnvFlags(flag.CommandLine), unknownEnv(flag.CommandLine)...)))
 
 	//
 	// parse options and find config
@@ -69,15 +115,9 @@ func main() {
 	log.Level = logger.LogLevel(*flagLLevel)
 	homedir, _ := homedir.Dir()
 
-	metaDir := homedir + "/.config/andesite"
-	configPath := metaDir + "/config.json"
-
-	if !DoesFileExist(configPath) {
-		log.Log(logger.LevelDEBUG, "Configuration file does not exist, creating blank!")
-		os.MkdirAll(metaDir, os.ModePerm)
-		ioutil.WriteFile(configPath, []byte("{}"), os.ModePerm)
-	}
-	etc.InitConfig(configPath, &config)
+	configPath, err := loadConfig(homedir, *flagMeta, *flagConfig)
+	DieOnError(err)
+	configFile = configPath
 
 	opRoot := findFirstNonEmpty(*flagRoot, config.Root)
 	log.Log(logger.LevelDEBUG, "Discovered option:", "--root", opRoot)
@@ -85,16 +125,42 @@ func main() {
 	log.Log(logger.LevelDEBUG, "Discovered option:", "--port", opPort)
 	opBase := findFirstNonEmpty(*flagBase, config.HTTPBase, "/")
 	log.Log(logger.LevelDEBUG, "Discovered option:", "--base", opBase)
+	opCert := findFirstNonEmpty(*flagCert, config.Cert)
+	opKey := findFirstNonEmpty(*flagKey, config.Key)
+	opRedirect := findFirstNonZero(*flagRedirect, config.Redirect)
+	opListen := findFirstNonEmpty(*flagListen, config.Listen)
+	opSockMode := findFirstNonEmpty(config.SocketMode, "0660")
+	DieOnError(Assert((opCert == "") == (opKey == ""), "--cert and --key must be used together!"))
+	DieOnError(Assert(opCert == "" || config.LetsEncrypt == nil, "--cert and letsencrypt can not be used together!"))
+	DieOnError(initDirs(homedir, *flagDataDir, *flagCacheDir, *flagStateDir))
+	DieOnError(validateDatabaseConfig(config.Database))
+	DieOnError(validatePrivacyConfig(config))
+	DieOnError(validateWebhookConfig(config))
+	DieOnError(initAccessLog(config.AccessLog))
+	DieOnError(initAuditSinks())
+	initHooks()
+	DieOnError(initUsageBackends())
+	DieOnError(initTrustedProxies(config.TrustedProxies))
+	DieOnError(initRateLimit(config.RateLimit))
+	DieOnError(validateArrConfig(config))
+	DieOnError(validateSessionBindingConfig(config))
+	DieOnError(initLockout(config.Lockout))
+	DieOnError(initIndexer(config.Index))
+	DieOnError(initScanners())
+	setReadOnly(*flagReadOnly || config.ReadOnly)
+	devMode = *flagDev
 
 	//
 	// configure root dir
 
 	switch RootDirType(*flagRType) {
 	case RootTypeDir:
-		DieOnError(Assert(opRoot != "", "Please pass a directory as a root parameter!"))
-		s, _ := filepath.Abs(filepath.Clean(strings.Replace(opRoot, "~", homedir, -1)))
+		s := ""
+		if len(opRoot) > 0 {
+			s, _ = filepath.Abs(filepath.Clean(strings.Replace(opRoot, "~", homedir, -1)))
+		}
 		log.Log(logger.LevelDEBUG, "Trying root dir:", s)
-		DieOnError(Assert(DoesDirectoryExist(s), "Please pass a valid directory as a root parameter!"))
+		DieOnError(reportConfigProblems(configPath, lintRoot(s)))
 		rootDir = FsRoot{s}
 	// case RootTypeHttp:
 	// 	rootDir = HttpRoot{opRoot}
@@ -110,168 +176,391 @@ func main() {
 	//
 	// discover OAuth2 config info
 
-	etc.InitConfig(configPath, &config)
+	DieOnError(readConfig(configPath))
+
+	DieOnError(reportConfigProblems(configPath, lintAuthConfig()))
+	DieOnError(initLoginProviders())
+	DieOnError(initProxyAuth(config.ProxyAuth))
+	DieOnError(validateDiscordGate(config.Discord))
+	DieOnError(validateGitHubGate(config.GitHub))
+	DieOnError(validateProvisionConfig(config))
+	DieOnError(validatePasskeyConfig(config))
+	DieOnError(validateSMTPConfig(config.SMTP))
+	DieOnError(validateDiscordWebhook(config.DiscordWebhook))
+	DieOnError(validateQuotaConfig(config))
+	DieOnError(validateTrashConfig(config))
+	DieOnError(validateUploadConfig(config))
+	DieOnError(validateHooks(config))
+	DieOnError(validateSymlinkPolicy(config))
+	DieOnError(validateCompressionConfig(config))
+	DieOnError(validateListingCacheConfig(config))
+	DieOnError(validateScrubConfig(config))
+	DieOnError(validateHotlinkConfig(config))
+	DieOnError(validateContentTypes(config))
 
-	if len(config.Auth) == 0 {
-		config.Auth = "discord"
-	}
-	if cfp, ok := Oauth2Providers[config.Auth]; ok {
-		cidp := findStructValueWithTag(&config, "json", config.Auth).Interface().(*ConfigIDP)
-		DieOnError(Assert(cidp != nil, F("Authorization keys not set for identity prodvider '%s' in config.json!", config.Auth)))
-		DieOnError(Assert(cidp.ID != "", F("App ID not set for identity prodvider '%s' in config.json!", config.Auth)))
-		DieOnError(Assert(cidp.Secret != "", F("App Secret not set for identity prodvider '%s' in config.json!", config.Auth)))
-		oauth2AppConfig = cidp
-		oauth2Provider = cfp
-	} else {
-		foundP := false
-		for _, item := range config.Providers {
-			if item.ID == config.Auth {
-				oauth2Provider = Oauth2Provider{item, config.Auth}
-				foundP = true
-				break
-			}
-		}
-		if !foundP {
-			DieOnError(E(F("Unable to find OAuth2 app type '%s' in config.json", config.Auth)))
-		}
-		//
-		foundI := false
-		for _, item := range config.CustomIds {
-			if item.Auth == config.Auth {
-				oauth2AppConfig = &item
-				foundI = true
-				break
-			}
-		}
-		if !foundI {
-			DieOnError(E(F("Unable to find OAuth2 client config for '%s' config.json", config.Auth)))
-		}
+	//
+	// shared state initialization
+
+	DieOnError(initSessionKey(*flagRotateKey))
+	if config.Redis != nil {
+		DieOnError(initRedis(*config.Redis, *flagRotateKey))
+		log.Log(logger.LevelINFO, "Using Redis at", config.Redis.Address, "for sessions and caches")
 	}
 
 	//
 	// database initialization
 
-	database = sqlite.Connect(metaDir)
-	checkErr(database.Ping())
-
-	database.CreateTable("users", []string{"id", "int primary key"}, [][]string{
-		{"snowflake", "text"},
-		{"admin", "tinyint(1)"},
-		{"name", "text"},
-	})
-	database.CreateTable("access", []string{"id", "int primary key"}, [][]string{
-		{"user", "int"},
-		{"path", "text"},
-	})
-	database.CreateTable("shares", []string{"id", "int primary key"}, [][]string{
-		{"hash", "text"}, // character(32)
-		{"path", "text"},
-	})
+	initDatabase()
 
 	//
 	// admin creation from (optional) CLI argument
 
 	if *flagAdmin != "" {
-		uu, ok := queryUserBySnowflake(*flagAdmin)
-		if !ok {
-			uid := database.QueryNextID("users")
-			queryDoAddUser(uid, *flagAdmin, true, "")
-			log.Log(logger.LevelINFO, F("Added user %s as an admin", *flagAdmin))
-		} else {
-			if !uu.admin {
-				database.QueryDoUpdate("users", "admin", "1", "id", strconv.FormatInt(int64(uu.id), 10))
-				log.Log(logger.LevelINFO, F("Set user '%s's status to admin", uu.snowflake))
-			}
-		}
-		nu, _ := queryUserBySnowflake(*flagAdmin)
-		if !Contains(queryAccess(nu), "/") {
-			aid := database.QueryNextID("access")
-			database.Query(true, F("insert into access values ('%d', '%d', '/')", aid, nu.id))
-			log.Log(logger.LevelINFO, F("Gave %s root folder access", nu.name))
-		}
+		DieOnError(promoteUser(*flagAdmin, "cli", true))
 	}
 
 	//
 	// set HTTP base dir
 	httpBase = opBase
+	initLocalAdmin(*flagAdmin)
 
 	//
 	// graceful stop
 
-	gracefulStop := make(chan os.Signal)
+	server := &http.Server{}
+	gracefulStop := make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM)
 	signal.Notify(gracefulStop, syscall.SIGINT)
+	initReloadSignal()
 
 	go func() {
 		sig := <-gracefulStop
 		log.Log(logger.LevelINFO, F("Caught signal '%+v'", sig))
 		log.Log(logger.LevelINFO, "Gracefully shutting down...")
 
+		log.Log(logger.LevelINFO, "Waiting for open connections to finish")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Log(logger.LevelWARN, "Timed out, closing remaining connections:", err)
+		}
+		cancel()
+
 		log.Log(logger.LevelINFO, "Saving database to disk")
 		database.Close()
-		log.Log(logger.LevelINFO, "Closing filesystem watcher")
-		watcher.Close()
+		if watcher != nil {
+			log.Log(logger.LevelINFO, "Closing filesystem watcher")
+			watcher.Close()
+		}
 
 		log.Log(logger.LevelINFO, "Done!")
 		os.Exit(0)
 	}()
 
 	//
-	// initialize filesystem watching
-	go initFsWatcher()
-
-	//
-	// http server pre-setup
-
-	etc.SetSessionName("session_andesite")
-	p := strconv.Itoa(opPort)
-	dirs := []http.FileSystem{}
+	// initialize filesystem watching and scheduled jobs, on one node only when clustered
+	go whenLeader(func() {
+		go initFsWatcher()
+		initRetentionPurger()
+		initChangesPurger()
+		initSessionPurger()
+		initDiskAlerts()
+		initShareWarnings()
+		initTrashPurger()
+		initUploadPurger()
+		initScrubber()
+	})
 
 	//
 	// theme setup
 
-	for _, item := range *flagTheme {
-		loc := metaDir + "/themes/" + item
-		DieOnError(Assert(DoesDirectoryExist(loc), F("'%s' does not exist!", loc)))
-		dirs = append(dirs, http.Dir(loc))
-	}
-	for _, item := range config.Themes {
-		loc := metaDir + "/themes/" + item
-		DieOnError(Assert(DoesDirectoryExist(loc), F("'%s' does not exist!", loc)))
-		dirs = append(dirs, http.Dir(loc))
-	}
+	themeFlags = *flagTheme
+	themes := append(append([]string{}, themeFlags...), config.Themes...)
+	fs, err := buildThemeFS(themes)
+	DieOnError(err)
+	updateLive(func(lc *LiveConfig) {
+		lc.themes = fs
+		lc.headers, lc.csp = securityHeaders(config.SecurityHeaders, themes)
+		lc.provision = config.Provision
+	})
 
 	//
 	// http server setup and launch
 
-	mw := chainMiddleware(mwAddAttribution)
-	dirs = append(dirs, http.Dir("./www/"))
-	dirs = append(dirs, packr.New("", "./www/"))
-	wwFFS = types.MultiplexFileSystem{dirs}
-
-	http.HandleFunc("/", mw(http.FileServer(wwFFS).ServeHTTP))
-	http.HandleFunc("/login", mw(oauth2.HandleOAuthLogin(helperIsLoggedIn, "./files/", oauth2Provider.idp, oauth2AppConfig.ID)))
-	http.HandleFunc("/callback", mw(oauth2.HandleOAuthCallback(oauth2Provider.idp, oauth2AppConfig.ID, oauth2AppConfig.Secret, helperOA2SaveInfo, "./files")))
+	mw := chainMiddleware(mwAccessLog, mwRecover, mwAddAttribution, mwCompress, mwSecurityHeaders, mwProxyAuth, mwSessionBinding, mwSessionRecord, mwRateLimit)
+	mwm := chainMiddleware(mwAccessLog, mwRecover, mwAddAttribution, mwCompress, mwSecurityHeaders, mwProxyAuth, mwSessionBinding, mwSessionRecord, mwRateLimit, mwReadOnly)
+	// the themes are looked up on every request since a reload may change them
+	http.HandleFunc("/", mw(handleStatic))
+	initLoginHandlers()
+	http.HandleFunc("/login", mw(mwForwarded(mwLoginNext(handleLogin))))
+	http.HandleFunc("/callback", mw(mwForwarded(handleCallback)))
+	http.HandleFunc("/login/done", mw(handleLoginDone))
+	http.HandleFunc("/login/reset", mw(handlePasswordReset))
 	http.HandleFunc("/test", mw(handleTest))
 	http.HandleFunc("/files/", mw(handleDirectoryListing(handleFileListing)))
 	http.HandleFunc("/admin", mw(handleAdmin))
-	http.HandleFunc("/api/access/delete", mw(handleAccessDelete))
-	http.HandleFunc("/api/access/update", mw(handleAccessUpdate))
-	http.HandleFunc("/api/access/create", mw(handleAccessCreate))
+	http.HandleFunc("/api/access/delete", mwm(handleAccessDelete))
+	http.HandleFunc("/api/access/update", mwm(handleAccessUpdate))
+	http.HandleFunc("/api/access/create", mwm(handleAccessCreate))
 	http.HandleFunc("/open/", mw(handleDirectoryListing(handleShareListing)))
-	http.HandleFunc("/api/share/create", mw(handleShareCreate))
-	http.HandleFunc("/api/share/update", mw(handleShareUpdate))
-	http.HandleFunc("/api/share/delete", mw(handleShareDelete))
+	http.HandleFunc("/api/share/create", mwm(handleShareCreate))
+	http.HandleFunc("/api/share/update", mwm(handleShareUpdate))
+	http.HandleFunc("/api/share/delete", mwm(handleShareDelete))
+	http.HandleFunc("/api/file/delete", mwm(handleFileDelete))
+	http.HandleFunc("/api/file/rename", mwm(handleFileRename))
+	http.HandleFunc("/api/dir/create", mwm(handleDirCreate))
+	http.HandleFunc("/api/dir/move", mwm(handleDirMove))
+	http.HandleFunc("/api/upload", mwm(handleUpload))
+	http.HandleFunc("/api/upload/", mwm(handleUpload))
+	http.HandleFunc("/api/admin/trash", mw(handleTrashList))
+	http.HandleFunc("/api/admin/trash/restore", mwm(handleTrashRestore))
+	http.HandleFunc("/api/admin/trash/delete", mwm(handleTrashDelete))
+	http.HandleFunc("/api/admin/integrity", mw(handleIntegrityList))
+	http.HandleFunc("/api/admin/integrity/accept", mwm(handleIntegrityAccept))
 	http.HandleFunc("/logout", mw(handleLogout))
+	http.HandleFunc("/account", mw(handleAccount))
 	http.HandleFunc("/search", mw(handleSearch))
 	http.HandleFunc("/api/search", mw(handleSearchAPI))
+	http.HandleFunc("/api/changes", mw(handleChanges))
+	http.HandleFunc("/api/capabilities", mw(handleCapabilities))
+	http.HandleFunc("/api/authorize/check", mw(handleAuthorizeCheck))
+	http.HandleFunc("/api/spec", mw(handleAPISpec))
+	http.HandleFunc("/feed/", mw(handleFeed))
+	http.HandleFunc("/arr/", mw(handleArr))
+	http.HandleFunc("/api/admin/read_only", mw(handleReadOnlyUpdate))
+	http.HandleFunc("/api/admin/settings", mw(handleAdminSettings))
+	http.HandleFunc("/api/stats", mw(handleStats))
+	http.HandleFunc("/api/admin/reload", mw(handleReload))
+	http.HandleFunc("/api/admin/usage", mw(handleUsageAPI))
+	http.HandleFunc("/api/admin/lockouts", mw(handleLockoutList))
+	http.HandleFunc("/api/admin/scan", mw(handleScanAPI))
+	http.HandleFunc("/api/admin/scan/status", mw(handleScanStatus))
+	http.HandleFunc("/api/admin/lockouts/clear", mwm(handleLockoutClear))
+	http.HandleFunc("/api/admin/users/create", mwm(handleLocalUserCreate))
+	http.HandleFunc("/api/admin/users/reset", mwm(handleLocalUserReset))
+	http.HandleFunc("/api/account/password", mwm(handlePasswordChange))
+	http.HandleFunc("/api/account/email", mwm(handleAccountEmail))
+	http.HandleFunc("/api/account/email/confirm", mwm(handleAccountEmailConfirm))
+	http.HandleFunc("/api/admin/mail/test", mw(handleMailTest))
+	http.HandleFunc("/sessions", mw(handleSessions))
+	http.HandleFunc("/me", mw(handleMe))
+	http.HandleFunc("/requests", mw(handleAccessRequests))
+	http.HandleFunc("/basket", mw(handleBasket))
+	http.HandleFunc("/ws", mw(handleWebSocket))
+	http.HandleFunc("/api/basket/add", mwm(handleBasketAdd))
+	http.HandleFunc("/api/sign", mw(handleSignLink))
+	http.HandleFunc("/api/basket/remove", mwm(handleBasketRemove))
+	http.HandleFunc("/api/basket/clear", mwm(handleBasketClear))
+	http.HandleFunc("/api/basket/download", mw(handleBasketDownload))
+	http.HandleFunc("/invite/", mw(handleInvite))
+	http.HandleFunc("/api/admin/invites", mw(handleInviteList))
+	http.HandleFunc("/api/admin/invites/create", mwm(handleInviteCreate))
+	http.HandleFunc("/api/admin/invites/delete", mwm(handleInviteDelete))
+	http.HandleFunc("/api/invites/redeem", mwm(handleInviteRedeem))
+	http.HandleFunc("/api/requests/create", mwm(handleAccessRequestCreate))
+	http.HandleFunc("/api/requests/seen", mwm(handleAccessRequestSeen))
+	http.HandleFunc("/api/admin/requests", mw(handleAdminAccessRequests))
+	http.HandleFunc("/api/admin/requests/approve", mwm(handleAccessRequestApprove))
+	http.HandleFunc("/api/admin/requests/deny", mwm(handleAccessRequestDeny))
+	http.HandleFunc("/api/account/sessions/revoke", mwm(handleSessionRevoke))
+	http.HandleFunc("/api/admin/audit", mw(handleAuditList))
+	http.HandleFunc("/api/admin/downloads", mw(handleAdminDownloads))
+	http.HandleFunc("/api/admin/downloads/top", mw(handleAdminTopDownloads))
+	http.HandleFunc("/api/admin/policy", mw(handlePolicyExport))
+	http.HandleFunc("/api/admin/policy/import", mwm(handlePolicyImport))
+	http.HandleFunc("/api/users", mw(handleUserList))
+	http.HandleFunc("/api/users/create", mwm(handleUserCreate))
+	http.HandleFunc("/api/users/update", mwm(handleUserUpdate))
+	http.HandleFunc("/api/users/delete", mwm(handleUserDelete))
+	http.HandleFunc("/api/users/suspend", mwm(handleUserSuspend))
+	http.HandleFunc("/api/users/unsuspend", mwm(handleUserUnsuspend))
+	http.HandleFunc("/api/admin/users/purge", mwm(handleUserPurge))
+	http.HandleFunc("/api/account/export", mw(handleAccountExport))
+	http.HandleFunc("/api/account/delete", mwm(handleAccountDelete))
+	http.HandleFunc("/api/admin/sessions", mw(handleAdminSessions))
+	http.HandleFunc("/api/admin/sessions/revoke", mwm(handleAdminSessionRevoke))
+	http.HandleFunc("/api/account/passkeys", mw(handlePasskeyList))
+	http.HandleFunc("/api/account/passkeys/begin", mwm(handlePasskeyRegisterBegin))
+	http.HandleFunc("/api/account/passkeys/finish", mwm(handlePasskeyRegisterFinish))
+	http.HandleFunc("/api/account/passkeys/delete", mwm(handlePasskeyDelete))
+	http.HandleFunc("/api/login/passkey/begin", mw(handlePasskeyLoginBegin))
+	http.HandleFunc("/api/login/passkey/finish", mw(handlePasskeyLoginFinish))
+	http.HandleFunc("/api/access/list", mw(handleAccessList))
+	http.HandleFunc("/api/share/list", mw(handleShareList))
+
+	ln, addr, err := openListener(opListen, opPort, opSockMode)
+	DieOnError(err)
+	if config.LetsEncrypt != nil {
+		le := config.LetsEncrypt
+		DieOnError(Assert(le.Domain != "", "letsencrypt.domain is required!"))
+		acm := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(le.Domain, ",")...),
+			Cache:      autocert.DirCache(dataDir + "/certs"),
+			Email:      le.Email,
+		}
+		server.TLSConfig = acm.TLSConfig()
+		// HTTP-01 challenges are answered on the redirect port, everything else is sent to HTTPS
+		go func() {
+			checkErr(http.ListenAndServe(":"+strconv.Itoa(findFirstNonZero(opRedirect, 80)), acm.HTTPHandler(nil)))
+		}()
+		log.Log(logger.LevelINFO, "Initialization complete. Starting HTTPS server for "+le.Domain+" on "+addr)
+		err = server.ServeTLS(ln, "", "")
+	} else if len(opCert) > 0 {
+		if opRedirect > 0 {
+			go serveHTTPSRedirect(opRedirect, opPort)
+		}
+		log.Log(logger.LevelINFO, "Initialization complete. Starting HTTPS server on "+addr)
+		err = server.ServeTLS(ln, opCert, opKey)
+	} else {
+		log.Log(logger.LevelINFO, "Initialization complete. Starting server on "+addr)
+		err = server.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		DieOnError(err)
+	}
+	// wait for the graceful stop to finish and exit
+	select {}
+}
+
+// findConfig picks metaDir, from --meta-dir or else the default, and returns the path of the
+// config given with --config, or else the one in metaDir, creating config.json if this is the
+// first start
+func findConfig(homedir string, flagMeta string, flagConfig string) (string, error) {
+	metaDir = xdgDir("XDG_CONFIG_HOME", homedir+"/.config/andesite")
+	if len(flagMeta) > 0 {
+		metaDir, _ = filepath.Abs(strings.Replace(flagMeta, "~", homedir, 1))
+		metaDirChosen = true
+	}
+	if len(flagConfig) > 0 {
+		p, _ := filepath.Abs(strings.Replace(flagConfig, "~", homedir, 1))
+		if !DoesFileExist(p) {
+			return p, E(F("--config %s does not exist", p))
+		}
+		return p, nil
+	}
+	if p, err := existingConfig(metaDir); err != nil || len(p) > 0 {
+		return p, err
+	}
+	configPath := metaDir + "/config.json"
+	log.Log(logger.LevelDEBUG, "Configuration file does not exist, creating blank!")
+	os.MkdirAll(metaDir, os.ModePerm)
+	ioutil.WriteFile(configPath, []byte("{}"), os.ModePerm)
+	return configPath, nil
+}
+
+// loadConfig reads the config, after checking that it is valid, and returns its path
+func loadConfig(homedir string, flagMeta string, flagConfig string) (string, error) {
+	configPath, err := findConfig(homedir, flagMeta, flagConfig)
+	if err != nil {
+		return configPath, err
+	}
+	if err := reportConfigProblems(configPath, lintConfigFile(configPath)); err != nil {
+		return configPath, err
+	}
+	return configPath, readConfig(configPath)
+}
+
+// buildThemeFS layers the themes over the built-in pages, the first theme with a file wins
+func buildThemeFS(themes []string) (types.MultiplexFileSystem, error) {
+	dirs := []http.FileSystem{}
+	for _, item := range themes {
+		loc := metaDir + "/themes/" + item
+		if !DoesDirectoryExist(loc) {
+			return types.MultiplexFileSystem{}, E(F("Theme '%s' does not exist, it should be a directory at %s", item, loc))
+		}
+		dirs = append(dirs, http.Dir(loc))
+	}
+	dirs = append(dirs, http.Dir("./www/"))
+	dirs = append(dirs, packr.New("", "./www/"))
+	return types.MultiplexFileSystem{dirs}, nil
+}
+
+// readConfig reads the config and then the environment variables that override it
+func readConfig(configPath string) error {
+	if err := decodeConfig(configPath, &config); err != nil {
+		return err
+	}
+	return reportConfigProblems("the environment", applyEnvConfig(config))
+}
+
+// decodeConfig reads the config file into cfg, which is allocated if needed
+func decodeConfig(configPath string, cfg **Config) error {
+	if configFormat(configPath) == "json" {
+		etc.InitConfig(configPath, cfg)
+	} else {
+		data, err := readConfigJSON(configPath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return err
+		}
+	}
+	if *cfg == nil {
+		*cfg = &Config{}
+	}
+	return nil
+}
 
-	log.Log(logger.LevelINFO, "Initialization complete. Starting server on port "+p)
-	http.ListenAndServe(":"+p, nil)
+// initDatabase opens the database and brings its schema up to date
+func initDatabase() {
+	connectDatabase()
+	DieOnError(migrateUp(0))
+}
+
+// connectDatabase opens the database without changing its schema
+func connectDatabase() {
+	db, err := openDatabase(config.Database)
+	DieOnError(err)
+	database = db
+	checkErr(database.Ping())
+}
+
+// openListener listens on a "unix:/path/to.sock" socket, a "host:port" address, or the port if
+// listen is empty. Returns the listener and a description of where it is listening.
+func openListener(listen string, port int, sockMode string) (net.Listener, string, error) {
+	if strings.HasPrefix(listen, "unix:") {
+		pth := listen[5:]
+		mode, err := strconv.ParseUint(sockMode, 8, 32)
+		if err != nil {
+			return nil, "", E(F("Invalid socket_mode '%s', must be an octal permission such as 0660", sockMode))
+		}
+		// remove a socket left over from an unclean shutdown
+		if fi, err := os.Stat(pth); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(pth)
+		}
+		ln, err := net.Listen("unix", pth)
+		if err != nil {
+			return nil, "", err
+		}
+		return ln, "socket " + pth, os.Chmod(pth, os.FileMode(mode))
+	}
+	addr := ":" + strconv.Itoa(port)
+	if len(listen) > 0 {
+		addr = listen
+	}
+	ln, err := net.Listen("tcp", addr)
+	return ln, "address " + addr, err
+}
+
+// listens on port and sends every request to the same URL over HTTPS on tlsPort
+func serveHTTPSRedirect(port int, tlsPort int) {
+	log.Log(logger.LevelINFO, F("Redirecting HTTP requests on port %d to HTTPS", port))
+	err := http.ListenAndServe(":"+strconv.Itoa(port), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != 443 {
+			host += ":" + strconv.Itoa(tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}))
+	checkErr(err)
 }
 
 func readServerFile(path string) []byte {
-	reader, _ := wwFFS.Open(path)
+	reader, _ := live().themes.Open(path)
 	bytes, _ := ioutil.ReadAll(reader)
 	return bytes
 }
@@ -294,10 +583,10 @@ func byteCountIEC(b int64) string {
 
 func fullHost(r *http.Request) string {
 	urL := "http"
-	if r.TLS != nil {
+	if isHTTPS(r) {
 		urL += "s"
 	}
-	return urL + "://" + r.Host
+	return urL + "://" + findFirstNonEmpty(forwardedHeader(r, "X-Forwarded-Host"), r.Host)
 }
 
 func filter(stack []os.FileInfo, cb func(os.FileInfo) bool) []os.FileInfo {
@@ -320,11 +609,11 @@ func checkErr(err error, args ...string) {
 
 func writeUserDenied(r *http.Request, w http.ResponseWriter, fileOrAdmin bool, showLogin bool) {
 	me := ""
-	sess := etc.GetSession(r)
+	sess := getSession(r)
 	sessName := sess.Values["name"]
 	if sessName != nil {
 		sessID := sess.Values["user"]
-		me += F("%s%s (%s)", oauth2Provider.idp.NamePrefix, sessName.(string), sessID.(string))
+		me += F("%s (%s)", displayName(sessID.(string), sessName.(string)), sessID.(string))
 	}
 
 	message := ""
@@ -339,17 +628,32 @@ func writeUserDenied(r *http.Request, w http.ResponseWriter, fileOrAdmin bool, s
 	}
 
 	linkmsg := ""
+	if fileOrAdmin && sessName != nil && strings.HasPrefix(r.URL.Path, "/files/") {
+		linkmsg = "<a href='" + httpBase + "requests?path=" + url.QueryEscape(r.URL.Path[6:]) + "'>Request access</a> from an admin."
+	}
 	if showLogin {
-		linkmsg = "Please <a href='" + httpBase + "login'>Log In</a>."
-		w.WriteHeader(http.StatusForbidden)
+		linkmsg = "Please <a href='" + html.EscapeString(loginURL(r)) + "'>Log In</a>."
+		writeStatus(r, w, http.StatusForbidden)
 		writeResponse(r, w, "Forbidden", message, linkmsg)
 	} else {
-		w.WriteHeader(http.StatusForbidden)
+		writeStatus(r, w, http.StatusForbidden)
 		writeResponse(r, w, "Not Found", message, linkmsg)
 	}
 }
 
+func getSession(r *http.Request) *sessions.Session {
+	sess, _ := store.Get(r, sessionName)
+	return sess
+}
+
 func writeHandlebarsFile(r *http.Request, w http.ResponseWriter, file string, context map[string]interface{}) {
+	if devMode && r.URL.Query().Get("template_context") == "1" {
+		writeJSON(w, map[string]interface{}{
+			"template": file,
+			"context":  context,
+		})
+		return
+	}
 	template := string(readServerFile(file))
 	result, _ := raymond.Render(template, context)
 	w.Header().Add("Content-Type", "text/html")
@@ -358,7 +662,18 @@ func writeHandlebarsFile(r *http.Request, w http.ResponseWriter, file string, co
 
 func writeAPIResponse(r *http.Request, w http.ResponseWriter, good bool, message string) {
 	if !good {
-		w.WriteHeader(http.StatusForbidden)
+		writeStatus(r, w, http.StatusForbidden)
+	}
+	if wantsJSON(r) {
+		resp := "good"
+		if !good {
+			resp = "bad"
+		}
+		writeJSON(w, map[string]interface{}{
+			"response": resp,
+			"message":  message,
+		})
+		return
 	}
 	titlemsg := ""
 	if good {
@@ -369,14 +684,6 @@ func writeAPIResponse(r *http.Request, w http.ResponseWriter, good bool, message
 	writeResponse(r, w, titlemsg, message, "Return to <a href='"+httpBase+"admin'>the dashboard</a>.")
 }
 
-func fixID(id interface{}) string {
-	switch id.(type) {
-	case float64:
-		return strconv.Itoa(int(id.(float64)))
-	}
-	return id.(string)
-}
-
 func boolToString(x bool) string {
 	if x {
 		return "1"
@@ -385,6 +692,13 @@ func boolToString(x bool) string {
 }
 
 func writeResponse(r *http.Request, w http.ResponseWriter, title string, message string, link string) {
+	if wantsJSON(r) {
+		writeJSON(w, map[string]interface{}{
+			"title":   title,
+			"message": message,
+		})
+		return
+	}
 	writeHandlebarsFile(r, w, "/response.hbs", map[string]interface{}{
 		"title":   title,
 		"message": message,
@@ -393,22 +707,13 @@ func writeResponse(r *http.Request, w http.ResponseWriter, title string, message
 	})
 }
 
-func containsAll(mp url.Values, keys ...string) bool {
-	for _, item := range keys {
-		if _, ok := mp[item]; !ok {
-			return false
-		}
-	}
-	return true
-}
-
 func apiBootstrapRequireLogin(r *http.Request, w http.ResponseWriter, method string, requireAdmin bool) (*sessions.Session, UserRow, error) {
 	if r.Method != method {
 		writeAPIResponse(r, w, false, "This action requires using HTTP "+method)
 		return nil, UserRow{}, E("")
 	}
 
-	sess := etc.GetSession(r)
+	sess := getSession(r)
 	sessID := sess.Values["user"]
 
 	if sessID == nil {
@@ -423,6 +728,10 @@ func apiBootstrapRequireLogin(r *http.Request, w http.ResponseWriter, method str
 		writeResponse(r, w, "Access Denied", "This action requires being a member of this server. ("+userID+")", "")
 		return nil, UserRow{}, E("")
 	}
+	if !user.enabled {
+		writeSuspended(r, w, user)
+		return nil, UserRow{}, E("")
+	}
 	if requireAdmin && !user.admin {
 		writeAPIResponse(r, w, false, "This action requires being a site administrator. ("+userID+")")
 		return nil, UserRow{}, E("")
@@ -465,8 +774,42 @@ func mwAddAttribution(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// rejects the request while the instance is in read-only mode
+func mwReadOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isReadOnly() {
+			writeStatus(r, w, http.StatusServiceUnavailable)
+			if wantsJSON(r) {
+				writeJSON(w, map[string]interface{}{
+					"response": "bad",
+					"message":  "This instance is in read-only mode",
+				})
+				return
+			}
+			writeResponse(r, w, "Read-Only Mode", "This instance is currently in read-only mode. Browsing and downloads are still available.", "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func isReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) == 1
+}
+
+func setReadOnly(x bool) {
+	if x {
+		atomic.StoreInt32(&readOnly, 1)
+	} else {
+		atomic.StoreInt32(&readOnly, 0)
+	}
+}
+
 func findStructValueWithTag(item interface{}, ttype string, tag string) reflect.Value {
-	v := reflect.ValueOf(config).Elem()
+	v := reflect.ValueOf(item)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
 	t := v.Type()
 	for i := 0; i < v.NumField(); i++ {
 		f := t.Field(i)
@@ -495,6 +838,17 @@ func findFirstNonZero(values ...int) int {
 	return 0
 }
 
+// writeStatus sends status along with the content type that writeJSON or writeHandlebarsFile
+// would set, since headers set after the status are not sent
+func writeStatus(r *http.Request, w http.ResponseWriter, status int) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/html")
+	}
+	w.WriteHeader(status)
+}
+
 func writeJSON(w http.ResponseWriter, data map[string]interface{}) {
 	w.Header().Add("content-type", "application/json")
 	bytes, _ := json.Marshal(data)
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+)
+
+// the number of recent downloads shown on /me
+const meDownloads = 20
+
+// handler for http://andesite/me
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	sess, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		return
+	}
+	// the same as /account, /sessions, and /api/account/passkeys list, with what only this shows
+	data := accountData(user)
+	feeds := map[string]string{}
+	for _, item := range data["accesses"].([]string) {
+		feeds[item] = httpBase + feedURL(user.snowflake, item)
+	}
+	downloads := []map[string]interface{}{}
+	for _, item := range queryDownloadsOf(user.id, meDownloads, 0) {
+		downloads = append(downloads, map[string]interface{}{
+			"time":  item.Time,
+			"path":  item.Path,
+			"bytes": item.Bytes,
+			"size":  byteCountIEC(item.Bytes),
+		})
+	}
+	data["feeds"] = feeds
+	data["sessions"] = userSessionList(sess, user)
+	data["passkeys"] = passkeyList(user)
+	data["requests"] = accessRequestList(queryAccessRequests("where user = ? order by id desc", user.id))
+	data["downloads"] = downloads
+	data["quotas"] = quotaUsage(user)
+	if wantsJSON(r) {
+		data["response"] = "good"
+		writeJSON(w, data)
+		return
+	}
+	data["user"] = user.snowflake
+	data["base"] = httpBase
+	data["name"] = displayName(user.snowflake, user.name)
+	writeHandlebarsFile(r, w, "/me.hbs", data)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// Migration is one numbered change to the schema. Each is applied once, in order, and recorded
+// in the migrations table. Down undoes Up, and is nil for migrations that can not be undone.
+// Each runs in a transaction, together with its row in the migrations table.
+type Migration struct {
+	ID   int
+	Name string
+	Up   func(tx Tx) error
+	Down func(tx Tx) error
+}
+
+// migrations must only ever be added to the end of. Changes to a released schema go in a new
+// migration rather than an edit to an old one.
+var migrations = []Migration{
+	{1, "create tables", func(tx Tx) error {
+		// tables already made by versions from before migrations are completed with their
+		// missing columns
+		tables := []struct {
+			name    string
+			columns [][]string
+		}{
+			{"users", [][]string{
+				{"snowflake", "text"},
+				{"admin", "tinyint(1)"},
+				{"name", "text"},
+				{"provider", "text"},
+				{"last_login", "text"},
+			}},
+			{"passwords", [][]string{
+				{"user", "int"},
+				{"hash", "text"},
+			}},
+			{"passkeys", [][]string{
+				{"user", "int"},
+				{"credential", "text"},
+				{"public_key", "text"},
+				{"sign_count", "int"},
+				{"name", "text"},
+				{"created", "text"},
+				{"used", "text"},
+			}},
+			{"access", [][]string{
+				{"user", "int"},
+				{"path", "text"},
+			}},
+			{"shares", [][]string{
+				{"hash", "text"}, // character(32)
+				{"path", "text"},
+				{"perms", "text"},
+			}},
+			{"audit", [][]string{
+				{"time", "text"},
+				{"actor", "text"},
+				{"action", "text"},
+				{"target", "text"},
+				{"ip", "text"},
+				{"detail", "text"},
+				{"failed", "tinyint(1)"},
+			}},
+			{"sessions", [][]string{
+				{"sid", "text"},
+				{"user", "int"},
+				{"created", "text"},
+				{"seen", "text"},
+				{"ip", "text"},
+				{"agent", "text"},
+			}},
+			{"downloads", [][]string{
+				{"time", "text"},
+				{"user", "int"},
+				{"path", "text"},
+				{"bytes", "int"},
+				{"ip", "text"},
+			}},
+			{"leases", [][]string{
+				{"node", "text"},
+				{"expires", "text"},
+			}},
+		}
+		for _, item := range tables {
+			if err := tx.CreateTable(item.name, []string{"id", "int primary key"}, item.columns); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil},
+	{2, "store the provider of users", func(tx Tx) error {
+		return queryMigrateUserProviders(tx)
+	}, func(tx Tx) error {
+		_, err := tx.Exec("drop index if exists users_provider_snowflake")
+		return err
+	}},
+	{3, "index sessions and downloads", func(tx Tx) error {
+		if _, err := tx.Exec("create unique index if not exists sessions_sid on sessions (sid)"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("create index if not exists downloads_user on downloads (user)")
+		return err
+	}, func(tx Tx) error {
+		if _, err := tx.Exec("drop index if exists sessions_sid"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("drop index if exists downloads_user")
+		return err
+	}},
+	{4, "add access requests", func(tx Tx) error {
+		if err := tx.CreateTable("access_requests", []string{"id", "int primary key"}, [][]string{
+			{"user", "int"},
+			{"path", "text"},
+			{"reason", "text"},
+			{"created", "text"},
+			{"status", "text"},
+			{"decided", "text"},
+			{"decider", "text"},
+			{"note", "text"},
+			{"seen", "tinyint(1)"},
+		}); err != nil {
+			return err
+		}
+		_, err := tx.Exec("create index if not exists access_requests_user on access_requests (user)")
+		return err
+	}, func(tx Tx) error {
+		_, err := tx.Exec("drop table if exists access_requests")
+		return err
+	}},
+	{5, "add invites", func(tx Tx) error {
+		if err := tx.CreateTable("invites", []string{"id", "int primary key"}, [][]string{
+			{"code", "text"},
+			{"paths", "text"},
+			{"creator", "text"},
+			{"created", "text"},
+			{"expires", "text"},
+			{"max_uses", "int"},
+			{"uses", "int"},
+			{"note", "text"},
+		}); err != nil {
+			return err
+		}
+		_, err := tx.Exec("create unique index if not exists invites_code on invites (code)")
+		return err
+	}, func(tx Tx) error {
+		_, err := tx.Exec("drop table if exists invites")
+		return err
+	}},
+	{6, "store the email of users", func(tx Tx) error {
+		return tx.CreateTable("users", []string{"id", "int primary key"}, [][]string{
+			{"email", "text"},
+		})
+	}, nil},
+	{7, "add user quotas", func(tx Tx) error {
+		return tx.CreateTable("users", []string{"id", "int primary key"}, [][]string{
+			{"quota_storage", "int"},
+			{"quota_bandwidth", "int"},
+			{"stored", "int"},
+		})
+	}, nil},
+	{8, "add user suspension", func(tx Tx) error {
+		return tx.CreateTable("users", []string{"id", "int primary key"}, [][]string{
+			{"enabled", "tinyint(1)"},
+			{"suspend_reason", "text"},
+		})
+	}, nil},
+	{9, "add access permissions", func(tx Tx) error {
+		return tx.CreateTable("access", []string{"id", "int primary key"}, [][]string{
+			{"perms", "text"},
+		})
+	}, nil},
+	{10, "add the trash", func(tx Tx) error {
+		return tx.CreateTable("trash", []string{"id", "int primary key"}, [][]string{
+			{"path", "text"},
+			{"deleter", "text"},
+			{"deleted", "text"},
+			{"is_dir", "tinyint(1)"},
+		})
+	}, func(tx Tx) error {
+		_, err := tx.Exec("drop table if exists trash")
+		return err
+	}},
+	{11, "add unfinished uploads", func(tx Tx) error {
+		return tx.CreateTable("uploads", []string{"id", "int primary key"}, [][]string{
+			{"token", "text"},
+			{"user", "int"},
+			{"path", "text"},
+			{"length", "bigint"},
+			{"created", "text"},
+		})
+	}, func(tx Tx) error {
+		_, err := tx.Exec("drop table if exists uploads")
+		return err
+	}},
+	{12, "add directory sizes", func(tx Tx) error {
+		if err := tx.CreateTable("dir_sizes", []string{"path", "text primary key"}, [][]string{
+			{"parent", "text"},
+			{"size", "bigint"},
+			{"files", "bigint"},
+			{"updated", "text"},
+		}); err != nil {
+			return err
+		}
+		_, err := tx.Exec("create index if not exists dir_sizes_parent on dir_sizes (parent)")
+		return err
+	}, func(tx Tx) error {
+		_, err := tx.Exec("drop table if exists dir_sizes")
+		return err
+	}},
+	{13, "add user speed limits", func(tx Tx) error {
+		return tx.CreateTable("users", []string{"id", "int primary key"}, [][]string{
+			{"quota_speed", "int"},
+		})
+	}, nil},
+	{14, "add file checksums", func(tx Tx) error {
+		if err := tx.CreateTable("checksums", []string{"path", "text primary key"}, [][]string{
+			{"parent", "text"},
+			{"size", "bigint"},
+			{"mtime", "bigint"},
+			{"sha256", "text"},
+			{"md5", "text"},
+		}); err != nil {
+			return err
+		}
+		_, err := tx.Exec("create index if not exists checksums_parent on checksums (parent)")
+		return err
+	}, func(tx Tx) error {
+		_, err := tx.Exec("drop table if exists checksums")
+		return err
+	}},
+	{15, "add integrity verification", func(tx Tx) error {
+		return tx.CreateTable("checksums", []string{"path", "text primary key"}, [][]string{
+			{"verified", "text"},
+			{"corrupt", "text"},
+		})
+	}, nil},
+	{16, "add download baskets", func(tx Tx) error {
+		if err := tx.CreateTable("basket", []string{"id", "int primary key"}, [][]string{
+			{"sid", "text"},
+			{"path", "text"},
+			{"added", "text"},
+		}); err != nil {
+			return err
+		}
+		_, err := tx.Exec("create index if not exists basket_sid on basket (sid)")
+		return err
+	}, func(tx Tx) error {
+		_, err := tx.Exec("drop table if exists basket")
+		return err
+	}},
+	{17, "add upload status", func(tx Tx) error {
+		return tx.CreateTable("uploads", []string{"id", "int primary key"}, [][]string{
+			{"status", "text"},
+			{"message", "text"},
+		})
+	}, nil},
+	{18, "add share expiry", func(tx Tx) error {
+		if err := tx.CreateTable("shares", []string{"id", "int primary key"}, [][]string{
+			{"creator", "text"},
+			{"created", "text"},
+			{"expires", "text"},
+			{"warned", "text"},
+		}); err != nil {
+			return err
+		}
+		// shares made before this only have their audit event to tell who made them
+		_, err := tx.Exec("update shares set creator = (select actor from audit where action = 'share.create' and target = shares.hash order by id limit 1) where creator is null")
+		return err
+	}, nil},
+	{19, "add the change journal", func(tx Tx) error {
+		return tx.CreateTable("changes", []string{"id", "int primary key"}, [][]string{
+			{"time", "text"},
+			{"event", "text"},
+			{"path", "text"},
+		})
+	}, func(tx Tx) error {
+		_, err := tx.Exec("drop table if exists changes")
+		return err
+	}},
+	{20, "record who uploaded each file", func(tx Tx) error {
+		return tx.CreateTable("stored_files", []string{"id", "int primary key"}, [][]string{
+			{"path", "text"},
+			{"user", "int"},
+			{"bytes", "bigint"},
+			{"trash", "int"},
+		})
+	}, func(tx Tx) error {
+		_, err := tx.Exec("drop table if exists stored_files")
+		return err
+	}},
+}
+
+// MigrationStatus is a migration and when it was applied, which is empty if it has not been
+type MigrationStatus struct {
+	Migration
+	Applied string
+}
+
+func queryAppliedMigrations() (map[int]string, error) {
+	if _, err := database.Exec("create table if not exists migrations (id int primary key, name text, applied text)"); err != nil {
+		return nil, err
+	}
+	result := map[int]string{}
+	rows, err := database.Query(false, "select id, applied from migrations")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var applied string
+		rows.Scan(&id, &applied)
+		result[id] = applied
+	}
+	rows.Close()
+	return result, nil
+}
+
+// migrationStatus lists every migration this version knows, in order
+func migrationStatus() ([]MigrationStatus, error) {
+	applied, err := queryAppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	result := []MigrationStatus{}
+	for _, item := range migrations {
+		result = append(result, MigrationStatus{item, applied[item.ID]})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+// migrateUp applies the migrations that have not been, up to and including target, or all of
+// them if target is 0
+func migrateUp(target int) error {
+	list, err := migrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, item := range list {
+		if len(item.Applied) > 0 {
+			continue
+		}
+		if target > 0 && item.ID > target {
+			break
+		}
+		Log("[migrate]", "Applying", item.ID, item.Name)
+		err := inMigration(item.Up, "insert into migrations values (?, ?, ?)", item.ID, item.Name, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return E(F("Migration %d (%s) failed, nothing of it was applied: %s", item.ID, item.Name, err.Error()))
+		}
+	}
+	return nil
+}
+
+// inMigration runs step and then record in one transaction, so that a migration that fails
+// part way leaves the schema as it was
+func inMigration(step func(tx Tx) error, record string, args ...interface{}) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	if err := step(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateDown undoes the applied migrations after target, newest first
+func migrateDown(target int) error {
+	list, err := migrationStatus()
+	if err != nil {
+		return err
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		item := list[i]
+		if item.ID <= target || len(item.Applied) == 0 {
+			continue
+		}
+		if item.Down == nil {
+			return E(F("Migration %d (%s) can not be undone", item.ID, item.Name))
+		}
+		Log("[migrate]", "Undoing", item.ID, item.Name)
+		if err := inMigration(item.Down, "delete from migrations where id = ?", item.ID); err != nil {
+			return E(F("Undoing migration %d (%s) failed, nothing of it was undone: %s", item.ID, item.Name, err.Error()))
+		}
+	}
+	return nil
+}
+
+// schemaVersion is the newest migration applied
+func schemaVersion() int {
+	v := 0
+	list, _ := migrationStatus()
+	for _, item := range list {
+		if len(item.Applied) > 0 && item.ID > v {
+			v = item.ID
+		}
+	}
+	return v
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// hash policies of a mount
+const (
+	HashNone = "none"
+	HashLazy = "lazy"
+	HashScan = "scan"
+)
+
+// IndexMount is how the index treats one folder of the root and everything below it, up to the
+// next mount inside it
+type IndexMount struct {
+	Path     string        `json:"path"`
+	Watch    bool          `json:"watch"`
+	Rescan   time.Duration `json:"rescan"`
+	Hash     string        `json:"hash"`
+	Priority int           `json:"priority"`
+}
+
+// MarshalJSON writes Rescan as a duration such as "6h0m0s", the way it is given in the config,
+// rather than in nanoseconds. It is empty for mounts that are not rescanned.
+func (m IndexMount) MarshalJSON() ([]byte, error) {
+	type mount IndexMount
+	rescan := ""
+	if m.Rescan > 0 {
+		rescan = m.Rescan.String()
+	}
+	return json.Marshal(struct {
+		mount
+		Rescan string `json:"rescan"`
+	}{mount(m), rescan})
+}
+
+// indexMounts is sorted longest path first, so the first match is the closest mount
+var indexMounts = []IndexMount{{Path: "/", Watch: true, Hash: HashLazy}}
+
+// only one mount is rescanned at a time, to go easy on the disks
+var rescanLock sync.Mutex
+
+func initMounts(cfg map[string]ConfigMount) error {
+	for fpath, item := range cfg {
+		p, err := sanitizePath(fpath)
+		if err != nil {
+			return E(F("Invalid index.mounts path '%s': %s", fpath, err.Error()))
+		}
+		if !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+		im := IndexMount{Path: p, Watch: true, Hash: HashLazy, Priority: item.Priority}
+		if item.Watch != nil {
+			im.Watch = *item.Watch
+		}
+		if len(item.Rescan) > 0 {
+			d, err := time.ParseDuration(item.Rescan)
+			if err != nil || d < time.Minute {
+				return E(F("Invalid index.mounts['%s'].rescan '%s', must be a duration of at least 1m", fpath, item.Rescan))
+			}
+			im.Rescan = d
+		}
+		switch item.Hash {
+		case "":
+		case HashNone, HashLazy, HashScan:
+			im.Hash = item.Hash
+		default:
+			return E(F("Invalid index.mounts['%s'].hash '%s', must be one of 'none', 'lazy', 'scan'", fpath, item.Hash))
+		}
+		if p == "/" {
+			indexMounts[0] = im
+			continue
+		}
+		indexMounts = append(indexMounts, im)
+	}
+	sort.Slice(indexMounts, func(i, j int) bool {
+		return len(indexMounts[i].Path) > len(indexMounts[j].Path)
+	})
+	return nil
+}
+
+// mountFor returns the mount that fpath is in
+func mountFor(fpath string) IndexMount {
+	for _, item := range indexMounts {
+		if strings.HasPrefix(fpath, item.Path) {
+			return item
+		}
+	}
+	return indexMounts[len(indexMounts)-1]
+}
+
+// initMountRescans starts rescanning every mount that has an interval, after the initial scan
+func initMountRescans(root string) {
+	for _, item := range indexMounts {
+		if item.Rescan == 0 {
+			continue
+		}
+		go func(m IndexMount) {
+			for {
+				time.Sleep(m.Rescan)
+				rescanMount(root, m)
+			}
+		}(item)
+	}
+}
+
+// rescanMount adds the files of m that the index is missing and removes the ones that are gone,
+// for mounts that are not watched or whose storage does not send change events
+func rescanMount(root string, m IndexMount) {
+	rescanLock.Lock()
+	defer rescanLock.Unlock()
+	start := time.Now()
+	seen := &indexSeen{paths: map[string]bool{}}
+	runIndexScan(root, m.Path, nil, seen)
+
+	// only prune the files of this mount, not those of mounts inside it
+	gone := []string{}
+	rows, err := database.QueryPrepared(false, "select path from files where substr(path,1,length(?)) = ?", m.Path, m.Path)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var p string
+		rows.Scan(&p)
+		if !seen.paths[p] && mountFor(p).Path == m.Path {
+			gone = append(gone, p)
+		}
+	}
+	rows.Close()
+	for _, item := range gone {
+		database.QueryPrepared(true, "delete from files where path = ?", item)
+		fireFileEvent(FileEventRemove, item)
+	}
+	Log("[file-index]", "Rescanned", m.Path, "in", time.Since(start).Round(time.Second).String(), "and removed", len(gone), "missing files")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// the size recommended for og:image by most chat apps
+const (
+	ogWidth  = 1200
+	ogHeight = 630
+	ogMargin = 80
+)
+
+// the most images kept in each folder of the cache, the least recently used are removed past it
+const imageCacheMax = 1000
+
+var (
+	ogBackground = color.RGBA{0x1b, 0x1c, 0x1d, 0xff}
+	ogForeground = color.RGBA{0xf5, 0xf5, 0xf5, 0xff}
+	ogMuted      = color.RGBA{0x9a, 0x9a, 0x9a, 0xff}
+	ogAccent     = color.RGBA{0x21, 0x85, 0xd0, 0xff}
+)
+
+// handleOGImage writes a social preview PNG of the directory qpath, with its name and what is in
+// it. Images are cached in the cache directory by their text, so they change when the contents do.
+// They are only for whoever may see qpath, so browsers and proxies must not share them.
+func handleOGImage(w http.ResponseWriter, r *http.Request, qpath string, uAccess []string, key string) {
+	name := path.Base(strings.TrimSuffix(qpath, "/"))
+	if name == "/" || name == "." {
+		name = "/"
+	}
+	ss := shareSummary(key, uAccess, qpath)
+	lines := []string{name, F("%d files, %s", ss.Files, byteCountIEC(ss.Bytes))}
+	if len(ss.Mostly) > 0 {
+		lines[1] += ", mostly " + ss.Mostly
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	fpath := cacheDir + "/og/" + hex.EncodeToString(sum[:]) + ".png"
+	data, err := ioutil.ReadFile(fpath)
+	if err == nil {
+		// the modification time is when it was last used, for pruneImageCache
+		now := time.Now()
+		os.Chtimes(fpath, now, now)
+	} else {
+		data, err = renderOGImage(lines[0], lines[1])
+		if err != nil {
+			LogError("[og-image]", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		os.MkdirAll(cacheDir+"/og", os.ModePerm)
+		if err := ioutil.WriteFile(fpath, data, 0644); err != nil {
+			LogError("[og-image]", err.Error())
+		}
+		pruneImageCache(cacheDir + "/og")
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(data)
+}
+
+// pruneImageCache removes the least recently used images in dir past imageCacheMax
+func pruneImageCache(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) <= imageCacheMax {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, item := range files[:len(files)-imageCacheMax] {
+		os.Remove(dir + "/" + item.Name())
+	}
+}
+
+func renderOGImage(title string, subtitle string) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, ogWidth, ogHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(ogBackground), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, ogWidth, 16), image.NewUniform(ogAccent), image.ZP, draw.Src)
+
+	drawOGText(img, ogMargin, 200, 9, title, ogForeground)
+	drawOGText(img, ogMargin, 360, 4, subtitle, ogMuted)
+	drawOGText(img, ogMargin, ogHeight-ogMargin-13*3, 3, "Andesite", ogAccent)
+
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, img)
+	return buf.Bytes(), err
+}
+
+// drawOGText draws text with its top left at x,y in the built-in bitmap font, scaled up by scale
+// since there is no vector font to fall back on. Text that would not fit is cut off with "...".
+func drawOGText(dst *image.RGBA, x int, y int, scale int, text string, col color.Color) {
+	const glyphW, glyphH, ascent = 7, 13, 11
+	max := (ogWidth - x - ogMargin) / (glyphW * scale)
+	if r := []rune(text); len(r) > max {
+		text = string(r[:max-3]) + "..."
+	}
+	small := image.NewRGBA(image.Rect(0, 0, len([]rune(text))*glyphW, glyphH))
+	d := &font.Drawer{
+		Dst:  small,
+		Src:  image.NewUniform(col),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(0, ascent),
+	}
+	d.DrawString(text)
+	b := small.Bounds()
+	for sy := b.Min.Y; sy < b.Max.Y; sy++ {
+		for sx := b.Min.X; sx < b.Max.X; sx++ {
+			c := small.RGBAAt(sx, sy)
+			if c.A == 0 {
+				continue
+			}
+			rect := image.Rect(x+sx*scale, y+sy*scale, x+(sx+1)*scale, y+(sy+1)*scale)
+			draw.Draw(dst, rect, image.NewUniform(c), image.ZP, draw.Over)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+//
+type APIEndpoint struct {
+	Path    string
+	Method  string
+	Summary string
+	Admin   bool
+	Params  []string
+	JSON    bool
+}
+
+// every route documented in /api/spec, add new API routes here too.
+// POST routes respond with JSON instead of HTML when sent 'Accept: application/json'.
+// Their form values are checked by validateForm and errors are reported as {"response": "bad", "message"}.
+var apiEndpoints = []APIEndpoint{
+	{"/files/{path}", http.MethodGet, "List a directory or download a file. Add ?format=json for a JSON listing, ?format=txt for the link of each entry on its own line (of every file below it with &recursive=1), ?archive=zip or ?archive=tar.zst to download a directory, ?og=png for its social preview image, or ?checksum=sha256 or ?checksum=md5 for the checksum of a file. Every directory also has a generated SHA256SUMS, and archives are browsed as folders by adding a slash to their path. Admins may add ?trace=1 (and ?as={snowflake}) for an explanation of the access decision.", false, []string{"format", "recursive", "archive", "og", "checksum", "trace", "as"}, false},
+	{"/open/{hash}/{path}", http.MethodGet, "List a directory or download a file through a share link. Takes ?format=txt, ?recursive=1, and ?checksum= as /files/ does.", false, []string{"format", "recursive", "checksum"}, false},
+	{"/feed/{path}.xml", http.MethodGet, "Atom feed of the newest files under a directory. The link is shown on each listing page.", false, []string{"user", "token"}, false},
+	{"/arr/{name}/list.json", http.MethodGet, "Sonarr/Radarr Custom List of the folders in a configured \"arr\" path. Authenticated with ?token= or X-Api-Key.", false, []string{"token"}, true},
+	{"/arr/{name}/rss.xml", http.MethodGet, "RSS feed of the newest files in a configured \"arr\" path. Authenticated with ?token= or X-Api-Key.", false, []string{"token"}, false},
+	{"/search", http.MethodGet, "Search page.", false, nil, false},
+	{"/api/search", http.MethodGet, "Search indexed file paths the current user has access to.", false, []string{"q"}, true},
+	{"/api/changes", http.MethodGet, "Changes to files in 'path' since the cursor 'since', oldest first, each with 'id', 'time', 'event', and 'path'. Ask again with the returned 'cursor' while 'more' is set. 'reset' means the changes since then are no longer kept and everything has to be listed again.", false, []string{"path", "since"}, true},
+	{"/ws", http.MethodGet, "WebSocket of JSON messages. Sends an 'event' with 'event' and 'path' for every change to a file the user can see. Send {'type': 'search', 'id', 'q'} for 'results' as from /api/search, {'type': 'subscribe', 'path'} to only get events below 'path', or {'type': 'ping'}.", false, nil, false},
+	{"/api/authorize/check", http.MethodPost, "Check many permissions at once. Send 'check' once per item as 'OPERATION:/path', where OPERATION is one of read, list, share, manage_access, write, delete.", false, []string{"check"}, true},
+	{"/account", http.MethodGet, "The current user's identity and access grants. Add 'Accept: application/json' for JSON.", false, nil, false},
+	{"/admin", http.MethodGet, "Admin dashboard.", true, nil, false},
+	{"/api/access/list", http.MethodGet, "List every access grant.", true, nil, true},
+	{"/api/access/create", http.MethodPost, "Grant a user access to a path. 'perms' may add 'write' and 'delete' to reading, as a comma separated list.", true, []string{"snowflake", "path", "perms"}, false},
+	{"/api/access/update", http.MethodPost, "Change the path of an access grant, and its 'perms' when given.", true, []string{"id", "snowflake", "path", "perms"}, false},
+	{"/api/file/delete", http.MethodPost, "Delete the file or folder at 'path', which needs the delete permission. Folders respond with a preview and a confirmation token unless 'confirm' is set.", false, []string{"path"}, false},
+	{"/api/file/rename", http.MethodPost, "Rename or move the file or folder at 'path' to 'to', which needs the write permission on both. The destination must not exist. Access rules and shares on a folder move with it.", false, []string{"path", "to"}, false},
+	{"/api/dir/create", http.MethodPost, "Create the folder at 'path', which needs the write permission. Its parent must exist.", false, []string{"path"}, false},
+	{"/api/upload", http.MethodPost, "Start a resumable upload with the tus 1.0.0 protocol. Send 'Upload-Length' and 'Upload-Metadata' with 'filename' and the folder 'path', then PATCH the chunks to the returned 'Location'. HEAD it to find where to resume, and once every chunk is sent until its 'Andesite-Upload-Status' is 'done' or 'failed'. DELETE it to cancel.", false, nil, false},
+	{"/api/dir/move", http.MethodPost, "Move the folder at 'path' to 'to', like /api/file/rename but only for folders.", false, []string{"path", "to"}, false},
+	{"/api/access/delete", http.MethodPost, "Remove an access grant. Responds with a preview and a confirmation token unless 'confirm' is set.", true, []string{"id", "snowflake"}, false},
+	{"/api/share/list", http.MethodGet, "List every share link.", true, nil, true},
+	{"/api/share/create", http.MethodPost, "Create a public share link for a path. 'perms' is a comma separated list of browse, download, stream, and defaults to all of them. 'expires' is a duration such as '168h' after which the link stops working.", true, []string{"path", "perms", "expires"}, false},
+	{"/api/share/update", http.MethodPost, "Change the path, and optionally the perms, of a share link.", true, []string{"hash", "path", "perms"}, false},
+	{"/api/share/delete", http.MethodPost, "Delete a share link. Responds with a preview and a confirmation token unless 'confirm' is set.", true, []string{"hash"}, false},
+	{"/api/admin/audit", http.MethodGet, "The newest audit log events, filtered by 'actor', 'target', and 'action' (eg. 'share' or 'share.delete'), and times 'since' and 'until' as RFC 3339. Pages of 'limit' events, at most 200, from 'offset'.", true, []string{"actor", "action", "target", "since", "until", "limit", "offset"}, true},
+	{"/api/admin/downloads", http.MethodGet, "The files downloaded by the user with 'snowflake', newest first, in pages of 'limit' rows, at most 200, from 'offset'.", true, []string{"snowflake", "limit", "offset"}, true},
+	{"/api/admin/downloads/top", http.MethodGet, "The most downloaded files 'since' an RFC 3339 time, with their downloads, distinct users, and bytes sent, at most 'limit'.", true, []string{"since", "limit"}, true},
+	{"/api/admin/policy", http.MethodGet, "Export every user with their access, and every share link, as a file for 'format' 'json' (the default) or 'csv'.", true, []string{"format"}, true},
+	{"/api/admin/policy/import", http.MethodPost, "Bring users, access, and shares in line with an exported 'policy' of 'format' 'json' or 'csv'. With 'prune' access and shares missing from it are removed, users are never deleted. 'dry_run' only lists the 'changes', otherwise responds with a preview and a confirmation token unless 'confirm' is set.", true, []string{"policy", "format", "prune", "dry_run"}, false},
+	{"/requests", http.MethodGet, "Your access requests and their status. Responds with JSON when requested with 'Accept: application/json'.", false, nil, true},
+	{"/api/requests/create", http.MethodPost, "Ask the admins for access to 'path', with an optional 'reason'.", false, []string{"path", "reason"}, false},
+	{"/api/requests/seen", http.MethodPost, "Stop showing the decisions on your access requests above your files.", false, nil, false},
+	{"/basket", http.MethodGet, "The files and folders in the basket of your session, with their sizes. Responds with JSON when requested with 'Accept: application/json'.", false, nil, true},
+	{"/api/sign", http.MethodPost, "Create a link to the file at 'path' that works without logging in and may be embedded in other sites, for 'ttl' (a duration, default and at most hotlink.token_ttl). Returns 'url' and 'expires'.", false, []string{"path", "ttl"}, false},
+	{"/api/basket/add", http.MethodPost, "Add the file or folder at 'path' to the basket of your session, at most 1000 items.", false, []string{"path"}, false},
+	{"/api/basket/remove", http.MethodPost, "Take 'path' out of the basket of your session.", false, []string{"path"}, false},
+	{"/api/basket/clear", http.MethodPost, "Empty the basket of your session.", false, nil, false},
+	{"/api/basket/download", http.MethodGet, "Download everything in the basket of your session as one zip, with the full path of each file.", false, nil, false},
+	{"/api/admin/requests", http.MethodGet, "Access requests with 'status' 'pending' (the default), 'approved', or 'denied', newest first, in pages of 'limit' rows, at most 200, from 'offset'.", true, []string{"status", "limit", "offset"}, true},
+	{"/api/admin/requests/approve", http.MethodPost, "Approve a pending access request by 'id', giving the user access to its path. The user sees the decision and optional 'note' on their next visit.", true, []string{"id", "note"}, false},
+	{"/api/admin/requests/deny", http.MethodPost, "Deny a pending access request by 'id', with an optional 'note' shown to the user.", true, []string{"id", "note"}, false},
+	{"/api/admin/invites", http.MethodGet, "Every invite link with its paths, uses, and expiry, newest first.", true, nil, true},
+	{"/api/admin/invites/create", http.MethodPost, "Create an invite 'link' that gives whoever opens it after logging in access to 'paths', one per line. It may be used 'max_uses' times, 1 by default and 0 for no limit, and stops working after 'expires', a duration such as '168h'.", true, []string{"paths", "max_uses", "expires", "note"}, true},
+	{"/api/invites/redeem", http.MethodPost, "Accept the invite of 'code', which gives the current user access to its paths.", false, []string{"code"}, false},
+	{"/api/admin/invites/delete", http.MethodPost, "Delete an invite by its 'code', so that its link stops working. Access already given by it is kept.", true, []string{"code"}, false},
+	{"/api/users", http.MethodGet, "List every user with their provider, last login, number of access grants, quota usage, and whether they are suspended.", true, nil, true},
+	{"/api/users/create", http.MethodPost, "Add a user by their snowflake before they have logged in. Users of providers other than the first are written 'key:id'.", true, []string{"snowflake", "name", "admin"}, false},
+	{"/api/users/update", http.MethodPost, "Rename a user, promote ('1') or demote ('0') them with 'admin', or set their 'quota_storage', monthly 'quota_bandwidth', and per second download 'quota_speed' as a size such as '20GiB', '0' for unlimited, or empty for the default. 'recount_stored' set to '1' counts their storage again from the files they uploaded that are still there. The last admin can not be demoted.", true, []string{"snowflake", "name", "admin", "quota_storage", "quota_bandwidth", "quota_speed", "recount_stored"}, false},
+	{"/api/admin/trash", http.MethodGet, "List what is in the trash, with who deleted it and when it will be purged.", true, nil, true},
+	{"/api/admin/trash/restore", http.MethodPost, "Move the item 'id' out of the trash back to where it was deleted from.", true, []string{"id"}, false},
+	{"/api/admin/trash/delete", http.MethodPost, "Delete the item 'id' from the trash for good. Responds with a preview and a confirmation token unless 'confirm' is set.", true, []string{"id"}, false},
+	{"/api/admin/integrity", http.MethodGet, "List the files whose contents no longer match their checksum, and how many checksums have been verified within 'scrub.every'.", true, nil, true},
+	{"/api/admin/integrity/accept", http.MethodPost, "Accept the file 'path' as it is now, its checksum is computed again.", true, []string{"path"}, false},
+	{"/api/admin/users/purge", http.MethodPost, "Delete a user, if they still exist, and replace their snowflake and IPs in the audit log, access log, access requests, invites, share links, and trash. Responds with a preview and a confirmation token unless 'confirm' is set.", true, []string{"snowflake"}, false},
+	{"/api/account/export", http.MethodGet, "Download everything stored about the current user as JSON: their user row, access, shares they created, sessions, passkeys, access requests, downloads, and audit events.", false, nil, true},
+	{"/api/account/delete", http.MethodPost, "Delete the current user's account and erase them from the audit log and access log. Responds with a preview and a confirmation token unless 'confirm' is set.", false, nil, false},
+	{"/api/users/suspend", http.MethodPost, "Suspend a user, with an optional 'reason' shown to them. They are logged out of every session and can not log in again until unsuspended.", true, []string{"snowflake", "reason"}, false},
+	{"/api/users/unsuspend", http.MethodPost, "Let a suspended user log in again.", true, []string{"snowflake"}, false},
+	{"/api/users/delete", http.MethodPost, "Delete a user with their access grants, password, passkeys, sessions, and share links, and erase them from the audit log and access log. Responds with a preview and a confirmation token unless 'confirm' is set.", true, []string{"snowflake"}, false},
+	{"/api/admin/reload", http.MethodPost, "Reload themes, security headers, rate limits, provisioning rules, and login provider credentials from the config file and environment. 'restart' lists changed keys that need a restart.", true, nil, true},
+	{"/api/stats", http.MethodGet, "Server statistics: 'files' in the index and their total 'bytes', 'users' counts, active 'shares', 'downloads_24h', the bytes stored under each of the index 'mounts', and the 'watcher' event backlog.", true, nil, true},
+	{"/api/admin/settings", http.MethodGet, "Current instance settings, the progress of the file index in 'index', and the settings of each index mount in 'mounts'.", true, nil, true},
+	{"/api/admin/usage", http.MethodGet, "Bytes stored under a directory, from the filesystem's quota accounting when configured.", true, []string{"path"}, true},
+	{"/api/admin/lockouts", http.MethodGet, "Accounts and IPs with recent failed token or share code attempts, and whether they are locked out.", true, nil, true},
+	{"/api/admin/lockouts/clear", http.MethodPost, "Reset the failures of a lockout entry, unlocking it.", true, []string{"key"}, false},
+	{"/api/admin/users/create", http.MethodPost, "Create a local account. Without a 'password' the response holds a link where the user may set one.", true, []string{"username", "password"}, false},
+	{"/api/admin/users/reset", http.MethodPost, "Create a password reset link for a local account, valid for 24 hours.", true, []string{"snowflake"}, false},
+	{"/api/account/email", http.MethodPost, "Send a link to confirm the 'email' address notifications are sent to, or clear it with an empty value.", false, []string{"email"}, false},
+	{"/api/account/email/confirm", http.MethodPost, "Start sending notifications to the address of the confirmation 'token' that was emailed to it.", false, []string{"token"}, false},
+	{"/api/admin/mail/test", http.MethodPost, "Send a test email to the alert addresses and to yourself, to check the smtp settings.", true, nil, false},
+	{"/api/account/password", http.MethodPost, "Change the password of your local account.", false, []string{"current", "password"}, false},
+	{"/me", http.MethodGet, "Everything kept about the current user: the same as /account, with the 'feeds' of its 'accesses', quota usage, access requests, sessions, passkeys, and recent downloads. Add 'Accept: application/json' for JSON.", false, nil, false},
+	{"/sessions", http.MethodGet, "The current user's logged in sessions. Add 'Accept: application/json' for JSON.", false, nil, false},
+	{"/api/account/sessions/revoke", http.MethodPost, "Log out of one of your sessions by its 'sid', or of every other one with 'others' set to '1'.", false, []string{"sid", "others"}, false},
+	{"/api/admin/sessions", http.MethodGet, "The logged in sessions of a user.", true, []string{"snowflake"}, true},
+	{"/api/admin/sessions/revoke", http.MethodPost, "Log a user out of one session by its 'sid', or of every session without one. Logging out of every session responds with a preview and a confirmation token unless 'confirm' is set.", true, []string{"snowflake", "sid"}, false},
+	{"/api/account/passkeys", http.MethodGet, "List the passkeys of your account.", false, nil, true},
+	{"/api/account/passkeys/begin", http.MethodPost, "Start adding a passkey. Responds with the 'publicKey' options for navigator.credentials.create, with binary values as base64url.", false, nil, true},
+	{"/api/account/passkeys/finish", http.MethodPost, "Add the passkey created from the options of /begin, with its clientDataJSON and attestationObject as base64url.", false, []string{"client_data", "attestation", "name"}, false},
+	{"/api/account/passkeys/delete", http.MethodPost, "Remove one of your passkeys.", false, []string{"id"}, false},
+	{"/api/login/passkey/begin", http.MethodPost, "Start logging in with a passkey. Responds with the 'publicKey' options for navigator.credentials.get.", false, nil, true},
+	{"/api/login/passkey/finish", http.MethodPost, "Log in with the passkey assertion for the options of /begin, with binary values as base64url. Responds with the 'location' to go to next.", false, []string{"id", "client_data", "authenticator_data", "signature"}, true},
+	{"/api/admin/scan", http.MethodPost, "Start running the configured scanners over a file or every file below a directory in the background, returning its 'id'. One scan runs at a time.", true, []string{"path"}, true},
+	{"/api/admin/scan/status", http.MethodGet, "The 'results' so far of the scan 'id', with 'done' once it finished. Kept for 24 hours.", true, []string{"id"}, true},
+	{"/api/admin/read_only", http.MethodPost, "Turn read-only mode on ('1') or off ('0').", true, []string{"enabled"}, false},
+	{"/login", http.MethodGet, "Start the OAuth2 login flow with the provider 'with', or show a choice when several are configured. Afterwards the user is sent to 'next', a path on this site, or /files/.", false, []string{"with", "next"}, false},
+	{"/callback", http.MethodGet, "OAuth2 redirect target.", false, []string{"code", "state"}, false},
+	{"/logout", http.MethodGet, "End the current session.", false, nil, false},
+	{"/api/capabilities", http.MethodGet, "Which optional features this instance has: login providers, uploads, WebDAV, transcoding, search modes, archive formats, and more. Does not require a login.", false, nil, true},
+	{"/api/spec", http.MethodGet, "This document.", false, nil, true},
+}
+
+// handler for http://andesite/api/spec
+func handleAPISpec(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, buildAPISpec(fullHost(r)+strings.TrimSuffix(httpBase, "/")))
+}
+
+func buildAPISpec(server string) map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, item := range apiEndpoints {
+		op := map[string]interface{}{
+			"summary":   item.Summary,
+			"responses": specResponses(item),
+		}
+		if item.Admin {
+			op["description"] = "Requires a site administrator."
+		}
+		params := []map[string]interface{}{}
+		for _, seg := range strings.Split(item.Path, "/") {
+			if strings.HasPrefix(seg, "{") {
+				params = append(params, specParam(strings.Trim(seg, "{}"), "path", true))
+			}
+		}
+		if item.Method == http.MethodPost {
+			props := map[string]interface{}{}
+			for _, name := range item.Params {
+				props[name] = map[string]string{"type": "string"}
+			}
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/x-www-form-urlencoded": map[string]interface{}{
+						"schema": map[string]interface{}{
+							"type":       "object",
+							"properties": props,
+							"required":   item.Params,
+						},
+					},
+				},
+			}
+		} else {
+			for _, name := range item.Params {
+				params = append(params, specParam(name, "query", false))
+			}
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if _, ok := paths[item.Path]; !ok {
+			paths[item.Path] = map[string]interface{}{}
+		}
+		paths[item.Path].(map[string]interface{})[strings.ToLower(item.Method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Andesite",
+			"version": F("%d", version),
+		},
+		"servers": []map[string]string{
+			{"url": server},
+		},
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]string{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": "session_andesite",
+				},
+			},
+		},
+		"security": []map[string][]string{
+			{"session": {}},
+		},
+		"paths": paths,
+	}
+}
+
+func specParam(name string, in string, required bool) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     name,
+		"in":       in,
+		"required": required,
+		"schema":   map[string]string{"type": "string"},
+	}
+}
+
+func specResponses(item APIEndpoint) map[string]interface{} {
+	ctype := "text/html"
+	if item.JSON {
+		ctype = "application/json"
+	}
+	return map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "OK",
+			"content": map[string]interface{}{
+				ctype: map[string]interface{}{},
+			},
+		},
+		"403": map[string]interface{}{
+			"description": "Not logged in or not allowed",
+		},
+	}
+}
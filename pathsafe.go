@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// sanitizePath is the single place a path from a URL or form becomes a path within the root.
+// It rejects anything that could step outside of it and cleans the path while keeping a trailing
+// slash so that directory rules stay prefixes of their contents only. Unicode is left as it is,
+// since a file named in NFD on disk could not be opened by its NFC name, see pathHasPrefix.
+func sanitizePath(v string) (string, error) {
+	if !strings.HasPrefix(v, "/") {
+		return "", E("must start with '/'")
+	}
+	if !utf8.ValidString(v) {
+		return "", E("must be valid UTF-8")
+	}
+	if strings.ContainsRune(v, 0) {
+		return "", E("must not contain null bytes")
+	}
+	if strings.ContainsRune(v, '\\') {
+		return "", E("must not contain '\\'")
+	}
+	for _, seg := range strings.Split(v, "/") {
+		if seg == ".." {
+			return "", E("must not contain '..'")
+		}
+	}
+	c := path.Clean(v)
+	if strings.HasSuffix(v, "/") && c != "/" {
+		c += "/"
+	}
+	return c, nil
+}
+
+// pathHasPrefix returns true if fpath is prefix or below it, comparing both in NFC so that an
+// access rule covers its paths however the client or the filesystem composed their accents
+func pathHasPrefix(fpath string, prefix string) bool {
+	return strings.HasPrefix(norm.NFC.String(fpath), norm.NFC.String(prefix))
+}
+
+// sanitizeRequestPath checks the raw request URL for encoded separators, which would be decoded
+// into qpath as real ones, before sanitizing qpath
+func sanitizeRequestPath(r *http.Request, qpath string) (string, error) {
+	raw := strings.ToLower(r.URL.EscapedPath())
+	for _, item := range []string{"%2f", "%5c", "%00"} {
+		if strings.Contains(raw, item) {
+			return "", E("must not contain encoded separators")
+		}
+	}
+	return sanitizePath(qpath)
+}
+
+// resolvePath returns the filesystem location of a path within base, refusing any result that
+// is not base itself or below it
+func resolvePath(base string, fpath string) (string, error) {
+	clean, err := sanitizePath(fpath)
+	if err != nil {
+		return "", err
+	}
+	b := filepath.Clean(base)
+	full := filepath.Join(b, filepath.FromSlash(clean))
+	if full != b && !strings.HasPrefix(full, b+string(filepath.Separator)) {
+		return "", E("path escapes the root")
+	}
+	return full, nil
+}
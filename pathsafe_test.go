@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	cases := []struct {
+		path  string
+		clean string
+		valid bool
+	}{
+		{"/", "/", true},
+		{"/music/", "/music/", true},
+		{"/music/a.mp3", "/music/a.mp3", true},
+		{"/music//a.mp3", "/music/a.mp3", true},
+		{"/music/./a.mp3", "/music/a.mp3", true},
+		{"/music/..a.mp3", "/music/..a.mp3", true},
+		{"music/", "", false},
+		{"", "", false},
+		{"/..", "", false},
+		{"/../", "", false},
+		{"/music/../etc/passwd", "", false},
+		{"/music/..", "", false},
+		{"/music\\..\\etc", "", false},
+		{"/music/\x00.mp3", "", false},
+		{"/music/\xff.mp3", "", false},
+		// names are kept as they are given, a file named in NFD must stay reachable by that name
+		{"/Cafe\u0301/", "/Cafe\u0301/", true},
+		{"/Caf\u00e9/", "/Caf\u00e9/", true},
+	}
+	for _, item := range cases {
+		clean, err := sanitizePath(item.path)
+		if (err == nil) != item.valid {
+			t.Errorf("sanitizePath(%q) error = %v, want valid %v", item.path, err, item.valid)
+			continue
+		}
+		if clean != item.clean {
+			t.Errorf("sanitizePath(%q) = %q, want %q", item.path, clean, item.clean)
+		}
+	}
+}
+
+func TestSanitizeRequestPath(t *testing.T) {
+	cases := []struct {
+		raw   string
+		valid bool
+	}{
+		{"/files/music/a.mp3", true},
+		{"/files/music/a%20b.mp3", true},
+		{"/files/music%2f..%2fetc/", false},
+		{"/files/music%2F..%2Fetc/", false},
+		{"/files/music%5c..%5cetc/", false},
+		{"/files/music/a%00.mp3", false},
+	}
+	for _, item := range cases {
+		u, err := url.Parse(item.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &http.Request{URL: u}
+		if _, err := sanitizeRequestPath(r, "/music/a.mp3"); (err == nil) != item.valid {
+			t.Errorf("sanitizeRequestPath(%q) error = %v, want valid %v", item.raw, err, item.valid)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	base := filepath.FromSlash("/srv/files")
+	cases := []struct {
+		path  string
+		full  string
+		valid bool
+	}{
+		{"/", base, true},
+		{"/music/a.mp3", filepath.Join(base, "music", "a.mp3"), true},
+		{"/../files2/", "", false},
+		{"/music/../../etc/passwd", "", false},
+		{"/\x00", "", false},
+	}
+	for _, item := range cases {
+		full, err := resolvePath(base, item.path)
+		if (err == nil) != item.valid {
+			t.Errorf("resolvePath(%q) error = %v, want valid %v", item.path, err, item.valid)
+			continue
+		}
+		if full != item.full {
+			t.Errorf("resolvePath(%q) = %q, want %q", item.path, full, item.full)
+		}
+	}
+}
+
+func TestPathHasPrefix(t *testing.T) {
+	cases := []struct {
+		fpath  string
+		prefix string
+		want   bool
+	}{
+		{"/music/a.mp3", "/music/", true},
+		{"/music2/a.mp3", "/music/", false},
+		{"/music/", "/music/", true},
+		{"/Cafe\u0301/menu.pdf", "/Caf\u00e9/", true},
+		{"/Caf\u00e9/menu.pdf", "/Cafe\u0301/", true},
+		{"/Cafe/menu.pdf", "/Caf\u00e9/", false},
+	}
+	for _, item := range cases {
+		if v := pathHasPrefix(item.fpath, item.prefix); v != item.want {
+			t.Errorf("pathHasPrefix(%q, %q) = %v, want %v", item.fpath, item.prefix, v, item.want)
+		}
+	}
+}
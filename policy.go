@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// Policy is the permission model of an instance, its users and their access and the share links,
+// in a form that can be kept in version control and loaded into another instance
+type Policy struct {
+	Users  []PolicyUser  `json:"users"`
+	Shares []PolicyShare `json:"shares"`
+}
+
+// PolicyUser is a user and the paths they may read. Perms holds what the grants on some of those
+// paths allow besides reading.
+type PolicyUser struct {
+	Snowflake string            `json:"snowflake"`
+	Name      string            `json:"name"`
+	Admin     bool              `json:"admin"`
+	Access    []string          `json:"access"`
+	Perms     map[string]string `json:"perms,omitempty"`
+}
+
+// PolicyShare is one path of a share link, a code with several paths has several
+type PolicyShare struct {
+	Code  string `json:"code"`
+	Path  string `json:"path"`
+	Perms string `json:"perms"`
+}
+
+// the columns of a policy as CSV, id is the snowflake of users and the code of shares
+var policyCSVHeader = []string{"type", "id", "name", "admin", "path", "perms"}
+
+// policyChange is one step of bringing the database in line with a policy
+type policyChange struct {
+	desc   string
+	action string
+	target string
+	detail string
+	apply  func(tx Tx) error
+}
+
+// exportPolicy reads the policy of the database, sorted so that exports diff cleanly
+func exportPolicy() Policy {
+	p := Policy{Users: []PolicyUser{}, Shares: []PolicyShare{}}
+	for _, item := range queryAllUsers() {
+		acc := []string{}
+		perms := map[string]string{}
+		for _, g := range queryAccessGrants(item) {
+			acc = append(acc, g.path)
+			if len(g.perms) > 0 {
+				perms[g.path] = g.perms
+			}
+		}
+		sort.Strings(acc)
+		p.Users = append(p.Users, PolicyUser{item.snowflake, item.name, item.admin, acc, perms})
+	}
+	sort.Slice(p.Users, func(i, j int) bool { return p.Users[i].Snowflake < p.Users[j].Snowflake })
+	for _, item := range queryAllShares() {
+		p.Shares = append(p.Shares, PolicyShare{item["hash"], item["path"], item["perms"]})
+	}
+	sort.Slice(p.Shares, func(i, j int) bool {
+		if p.Shares[i].Code != p.Shares[j].Code {
+			return p.Shares[i].Code < p.Shares[j].Code
+		}
+		return p.Shares[i].Path < p.Shares[j].Path
+	})
+	return p
+}
+
+func writePolicy(w io.Writer, p Policy, format string) error {
+	if format != "csv" {
+		bys, err := json.MarshalIndent(p, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(bys, '\n'))
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(policyCSVHeader)
+	for _, item := range p.Users {
+		cw.Write([]string{"user", item.Snowflake, item.Name, boolToString(item.Admin), "", ""})
+		for _, a := range item.Access {
+			cw.Write([]string{"access", item.Snowflake, "", "", a, item.Perms[a]})
+		}
+	}
+	for _, item := range p.Shares {
+		cw.Write([]string{"share", item.Code, "", "", item.Path, item.Perms})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func readPolicy(r io.Reader, format string) (Policy, error) {
+	p := Policy{}
+	switch format {
+	case "", "json":
+		if err := json.NewDecoder(r).Decode(&p); err != nil {
+			return p, E("Invalid policy JSON: " + err.Error())
+		}
+		return p, nil
+	case "csv":
+	default:
+		return p, E(F("Unknown policy format '%s', must be 'json' or 'csv'", format))
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(policyCSVHeader)
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return p, E("Invalid policy CSV: " + err.Error())
+	}
+	users := map[string]int{}
+	for i, row := range rows {
+		if i == 0 && row[0] == policyCSVHeader[0] {
+			continue
+		}
+		switch row[0] {
+		case "user":
+			users[row[1]] = len(p.Users)
+			p.Users = append(p.Users, PolicyUser{row[1], row[2], row[3] == "1" || row[3] == "true", []string{}, map[string]string{}})
+		case "access":
+			j, ok := users[row[1]]
+			if !ok {
+				return p, E(F("Line %d: access of %s comes before their user row", i+1, row[1]))
+			}
+			p.Users[j].Access = append(p.Users[j].Access, row[4])
+			if len(row[5]) > 0 {
+				p.Users[j].Perms[row[4]] = row[5]
+			}
+		case "share":
+			p.Shares = append(p.Shares, PolicyShare{row[1], row[4], row[5]})
+		default:
+			return p, E(F("Line %d: unknown type '%s', must be 'user', 'access', or 'share'", i+1, row[0]))
+		}
+	}
+	return p, nil
+}
+
+// normalizePolicy checks every value of p the same way the admin endpoints do
+func normalizePolicy(p *Policy) error {
+	seen := map[string]bool{}
+	for i := range p.Users {
+		u := &p.Users[i]
+		if len(u.Snowflake) == 0 || len(u.Snowflake) > 128 || len(u.Name) > 128 {
+			return E(F("Invalid user '%s'", u.Snowflake))
+		}
+		if seen[u.Snowflake] {
+			return E(F("User %s is listed more than once", u.Snowflake))
+		}
+		seen[u.Snowflake] = true
+		perms := map[string]string{}
+		listed := map[string]bool{}
+		for j, a := range u.Access {
+			listed[a] = true
+			v, err := sanitizePath(a)
+			if err != nil {
+				return E(F("Invalid access path '%s' of %s: %s", a, u.Snowflake, err.Error()))
+			}
+			u.Access[j] = v
+			if perms[v], err = parseAccessPerms(u.Perms[a]); err != nil {
+				return E(F("Invalid perms of '%s' for %s: %s", a, u.Snowflake, err.Error()))
+			}
+		}
+		for a := range u.Perms {
+			if !listed[a] {
+				return E(F("%s has perms for '%s', which is not in their access", u.Snowflake, a))
+			}
+		}
+		u.Perms = perms
+	}
+	for i := range p.Shares {
+		s := &p.Shares[i]
+		if !shareHashRegex.MatchString(s.Code) {
+			return E(F("Invalid share code '%s', must be a 32 character hex string", s.Code))
+		}
+		v, err := sanitizePath(s.Path)
+		if err != nil {
+			return E(F("Invalid path '%s' of share %s: %s", s.Path, s.Code, err.Error()))
+		}
+		s.Path = v
+		if s.Perms, err = parseSharePerms(s.Perms); err != nil {
+			return E(F("Invalid perms of share %s: %s", s.Code, err.Error()))
+		}
+	}
+	return nil
+}
+
+// planPolicy returns the changes that make the database match p. Users missing from p are kept,
+// with prune their access is removed along with the shares missing from p.
+func planPolicy(p Policy, prune bool) ([]policyChange, error) {
+	if err := normalizePolicy(&p); err != nil {
+		return nil, err
+	}
+	changes := []policyChange{}
+	admins := 0
+	listed := map[string]bool{}
+	for _, item := range p.Users {
+		listed[item.Snowflake] = true
+		if item.Admin {
+			admins++
+		}
+	}
+	for _, item := range queryAllUsers() {
+		if listed[item.snowflake] {
+			continue
+		}
+		if item.admin {
+			admins++
+		}
+		if !prune {
+			continue
+		}
+		for _, a := range queryAccess(item) {
+			changes = append(changes, policyRevoke(item.snowflake, a))
+		}
+	}
+	if admins == 0 {
+		return nil, E("The policy would leave no administrators")
+	}
+	for _, item := range p.Users {
+		u := item
+		old, exists := queryUserBySnowflake(u.Snowflake)
+		if !exists {
+			if err := checkSnowflake(u.Snowflake); err != nil {
+				return nil, err
+			}
+			changes = append(changes, policyChange{
+				F("Add user %s (%s), admin=%s", u.Name, u.Snowflake, boolToString(u.Admin)),
+				"user.create", u.Snowflake, "admin=" + boolToString(u.Admin),
+				func(tx Tx) error {
+					provider, stored := dbSnowflake(u.Snowflake)
+					_, err := tx.Exec("insert into users (id, snowflake, admin, name, provider) values ((select coalesce(max(id),-1)+1 from users), ?, ?, ?, ?)", stored, boolToString(u.Admin), u.Name, provider)
+					return err
+				},
+			})
+		} else {
+			if old.admin != u.Admin {
+				changes = append(changes, policyChange{
+					F("Set admin=%s for %s", boolToString(u.Admin), u.Snowflake),
+					"user.update", u.Snowflake, "admin=" + boolToString(u.Admin),
+					func(tx Tx) error {
+						_, err := tx.Exec("update users set admin = ? where id = ?", boolToString(u.Admin), old.id)
+						return err
+					},
+				})
+			}
+			if len(u.Name) > 0 && old.name != u.Name {
+				changes = append(changes, policyChange{
+					F("Rename %s from '%s' to '%s'", u.Snowflake, old.name, u.Name),
+					"user.update", u.Snowflake, "name=" + u.Name,
+					func(tx Tx) error {
+						_, err := tx.Exec("update users set name = ? where id = ?", u.Name, old.id)
+						return err
+					},
+				})
+			}
+		}
+		has := map[string]string{}
+		if exists {
+			for _, g := range queryAccessGrants(old) {
+				has[g.path] = g.perms
+			}
+		}
+		want := map[string]bool{}
+		for _, a := range u.Access {
+			if want[a] {
+				continue
+			}
+			want[a] = true
+			perms, ok := has[a]
+			if !ok {
+				changes = append(changes, policyGrant(u.Snowflake, a, u.Perms[a]))
+			} else if perms != u.Perms[a] {
+				changes = append(changes, policySetPerms(u.Snowflake, a, u.Perms[a]))
+			}
+		}
+		if !prune || !exists {
+			continue
+		}
+		for _, a := range queryAccess(old) {
+			if !want[a] {
+				changes = append(changes, policyRevoke(u.Snowflake, a))
+			}
+		}
+	}
+	current := map[string]string{}
+	for _, item := range queryAllShares() {
+		current[item["hash"]+item["path"]] = item["perms"]
+	}
+	want := map[string]bool{}
+	for _, item := range p.Shares {
+		s := item
+		key := s.Code + s.Path
+		if want[key] {
+			continue
+		}
+		want[key] = true
+		perms, exists := current[key]
+		if !exists {
+			changes = append(changes, policyChange{
+				F("Share %s as %s", s.Path, s.Code),
+				"share.create", s.Code, s.Path,
+				func(tx Tx) error {
+					_, err := tx.Exec("insert into shares (id, hash, path, perms) values ((select coalesce(max(id),-1)+1 from shares), ?, ?, ?)", s.Code, s.Path, s.Perms)
+					return err
+				},
+			})
+		} else if perms != s.Perms {
+			changes = append(changes, policyChange{
+				F("Set the perms of share %s for %s to '%s'", s.Code, s.Path, s.Perms),
+				"share.update", s.Code, "perms=" + s.Perms,
+				func(tx Tx) error {
+					_, err := tx.Exec("update shares set perms = ? where hash = ? and path = ?", s.Perms, s.Code, s.Path)
+					return err
+				},
+			})
+		}
+	}
+	if prune {
+		for _, item := range queryAllShares() {
+			code, fpath := item["hash"], item["path"]
+			if want[code+fpath] {
+				continue
+			}
+			changes = append(changes, policyChange{
+				F("Delete share %s for %s", code, fpath),
+				"share.delete", code, fpath,
+				func(tx Tx) error {
+					_, err := tx.Exec("delete from shares where hash = ? and path = ?", code, fpath)
+					return err
+				},
+			})
+		}
+	}
+	return changes, nil
+}
+
+// policyUserID selects the id of a user by the provider and stored snowflake of dbSnowflake,
+// inside the transaction that may have just added them
+const policyUserID = "(select id from users where provider = ? and snowflake = ?)"
+
+func policyGrant(snowflake string, fpath string, perms string) policyChange {
+	return policyChange{
+		F("Give %s access to '%s' (%s)", snowflake, fpath, describeAccessPerms(perms)),
+		"access.create", snowflake, fpath,
+		func(tx Tx) error {
+			provider, stored := dbSnowflake(snowflake)
+			_, err := tx.Exec("insert into access (id, user, path, perms) values ((select coalesce(max(id),-1)+1 from access), "+policyUserID+", ?, ?)", provider, stored, fpath, perms)
+			return err
+		},
+	}
+}
+
+func policySetPerms(snowflake string, fpath string, perms string) policyChange {
+	return policyChange{
+		F("Set the access of %s to '%s' to %s", snowflake, fpath, describeAccessPerms(perms)),
+		"access.update", snowflake, fpath + " perms=" + perms,
+		func(tx Tx) error {
+			provider, stored := dbSnowflake(snowflake)
+			_, err := tx.Exec("update access set perms = ? where user = "+policyUserID+" and path = ?", perms, provider, stored, fpath)
+			return err
+		},
+	}
+}
+
+// describeAccessPerms is perms as a list that always includes read
+func describeAccessPerms(perms string) string {
+	if len(perms) == 0 {
+		return "read"
+	}
+	return "read," + perms
+}
+
+func policyRevoke(snowflake string, fpath string) policyChange {
+	return policyChange{
+		F("Remove the access of %s to '%s'", snowflake, fpath),
+		"access.delete", snowflake, fpath,
+		func(tx Tx) error {
+			provider, stored := dbSnowflake(snowflake)
+			_, err := tx.Exec("delete from access where user = "+policyUserID+" and path = ?", provider, stored, fpath)
+			return err
+		},
+	}
+}
+
+func policyDescriptions(changes []policyChange) []string {
+	result := []string{}
+	for _, item := range changes {
+		result = append(result, item.desc)
+	}
+	return result
+}
+
+// applyPolicy makes the changes in order, since access grants of new users need them added first.
+// They are made in one transaction, a change that fails leaves the database as it was.
+func applyPolicy(r *http.Request, actor string, changes []policyChange) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	for _, item := range changes {
+		if err := item.apply(tx); err != nil {
+			tx.Rollback()
+			return E(F("%s failed, no changes were made: %s", item.desc, err.Error()))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, item := range changes {
+		auditLog(r, actor, item.action, item.target, item.detail)
+	}
+	return nil
+}
+
+//
+//
+
+// handler for http://andesite/api/admin/policy
+func handlePolicyExport(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "csv" {
+		format = "json"
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\"andesite-policy."+format+"\"")
+	writePolicy(w, exportPolicy(), format)
+}
+
+// handler for http://andesite/api/admin/policy/import
+func handlePolicyImport(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "policy", Kind: FieldString, MaxLen: 8 << 20},
+		FormField{Name: "format", Kind: FieldString, MaxLen: 4, Optional: true},
+		FormField{Name: "prune", Kind: FieldBool, Optional: true},
+		FormField{Name: "dry_run", Kind: FieldBool, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	p, err := readPolicy(strings.NewReader(vf.Get("policy")), vf.Get("format"))
+	if err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	changes, err := planPolicy(p, vf.Bool("prune"))
+	if err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	if vf.Bool("dry_run") {
+		writeJSON(w, map[string]interface{}{
+			"response": "good",
+			"changes":  policyDescriptions(changes),
+		})
+		return
+	}
+	if len(changes) == 0 {
+		writeAPIResponse(r, w, true, "The policy already matches.")
+		return
+	}
+	if !requireConfirmation(r, w, admin, policyDescriptions(changes)) {
+		return
+	}
+	if err := applyPolicy(r, admin.snowflake, changes); err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	writeAPIResponse(r, w, true, F("Made %d changes.", len(changes)))
+}
+
+// policyFormat is the format of a policy file by its extension, unless one is given
+func policyFormat(fpath string, format string) string {
+	if len(format) > 0 {
+		return format
+	}
+	if strings.HasSuffix(strings.ToLower(fpath), ".csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+// runPolicyExport implements `andesite policy export`
+func runPolicyExport(args []string) error {
+	fs, flagDataDir := cliFlags("policy export", "[options]")
+	flagOutput := fs.String("output", "", "File to write instead of the standard output")
+	flagFormat := fs.String("format", "", "json or csv, defaults to the extension of --output")
+	if err := cliArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if err := cliOpen(*flagDataDir); err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if len(*flagOutput) > 0 {
+		f, err := os.Create(*flagOutput)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return writePolicy(out, exportPolicy(), policyFormat(*flagOutput, *flagFormat))
+}
+
+// runPolicyImport implements `andesite policy import`
+func runPolicyImport(args []string) error {
+	fs, flagDataDir := cliFlags("policy import", "[options] FILE")
+	flagFormat := fs.String("format", "", "json or csv, defaults to the extension of FILE")
+	flagPrune := fs.Bool("prune", false, "Also remove access and shares that are not in FILE")
+	flagDryRun := fs.Bool("dry-run", false, "Only print the changes")
+	if err := cliArgs(fs, args, 1); err != nil {
+		return err
+	}
+	bys, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := cliOpen(*flagDataDir); err != nil {
+		return err
+	}
+	p, err := readPolicy(bytes.NewReader(bys), policyFormat(fs.Arg(0), *flagFormat))
+	if err != nil {
+		return err
+	}
+	changes, err := planPolicy(p, *flagPrune)
+	if err != nil {
+		return err
+	}
+	for _, item := range changes {
+		fmt.Println(item.desc)
+	}
+	if *flagDryRun {
+		fmt.Println(len(changes), "changes, none were made")
+		return nil
+	}
+	if err := applyPolicy(nil, "cli", changes); err != nil {
+		return err
+	}
+	fmt.Println("Made", len(changes), "changes")
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "github.com/lib/pq"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// PostgresDB runs the SQLite queries of Andesite on PostgreSQL, for clusters and instances with
+// many writers
+type PostgresDB struct {
+	*sql.DB
+	// translated queries, by their SQLite form
+	cache sync.Map
+	// tables whose id sequence is known to exist
+	sequences sync.Map
+}
+
+func connectPostgres(dsn string) (*PostgresDB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, E("Unable to connect to postgres: " + err.Error())
+	}
+	return &PostgresDB{DB: db}, nil
+}
+
+var (
+	// user is a reserved word in PostgreSQL, and the name of a column in several tables
+	pgReservedColumn = regexp.MustCompile(`\buser\b`)
+	// SQLite's like ignores the case of ASCII letters
+	pgLike = regexp.MustCompile(`\blike\b`)
+	// the next id of a table picked inside an insert, which races between writers on postgres
+	pgNextID = regexp.MustCompile(`\(select coalesce\(max\(id\),-1\)\+1 from (\w+)\)`)
+)
+
+// translate turns ? placeholders into $1, $2, etc, quotes reserved column names, and takes next
+// ids from sequences, outside of string literals
+func (db *PostgresDB) translate(query string) string {
+	if v, ok := db.cache.Load(query); ok {
+		return v.(string)
+	}
+	var sb strings.Builder
+	n := 0
+	cache := true
+	parts := strings.Split(query, "'")
+	for i, part := range parts {
+		if i > 0 {
+			sb.WriteString("'")
+		}
+		if i%2 == 1 {
+			// inside a string literal
+			sb.WriteString(part)
+			continue
+		}
+		part = pgReservedColumn.ReplaceAllString(part, `"user"`)
+		part = pgLike.ReplaceAllString(part, "ilike")
+		part = pgNextID.ReplaceAllStringFunc(part, func(s string) string {
+			seq, err := db.sequence(pgNextID.FindStringSubmatch(s)[1])
+			if err != nil {
+				LogError("[postgres]", err.Error())
+				cache = false
+				return s
+			}
+			return "nextval('" + seq + "')"
+		})
+		for _, c := range part {
+			if c == '?' {
+				n++
+				sb.WriteString("$" + strconv.Itoa(n))
+				continue
+			}
+			sb.WriteRune(c)
+		}
+	}
+	result := sb.String()
+	if cache {
+		db.cache.Store(query, result)
+	}
+	return result
+}
+
+//
+func (db *PostgresDB) Query(modify bool, query string) (*sql.Rows, error) {
+	return db.QueryPrepared(modify, query)
+}
+
+//
+func (db *PostgresDB) QueryPrepared(modify bool, query string, args ...interface{}) (*sql.Rows, error) {
+	q := db.translate(query)
+	if modify {
+		_, err := db.DB.Exec(q, args...)
+		if err != nil {
+			LogError("[postgres]", err.Error(), q)
+		}
+		return nil, err
+	}
+	rows, err := db.DB.Query(q, args...)
+	if err != nil {
+		LogError("[postgres]", err.Error(), q)
+	}
+	return rows, err
+}
+
+//
+func (db *PostgresDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.translate(query), args...)
+}
+
+// QueryNextID takes the next id of table from a sequence, like a serial column, so that writers
+// on other nodes never get the same one
+func (db *PostgresDB) QueryNextID(table string) (int, error) {
+	seq, err := db.sequence(table)
+	if err != nil {
+		LogError("[postgres]", err.Error())
+		return 0, err
+	}
+	var id int
+	if err := db.DB.QueryRow(F("select nextval('%s')", seq)).Scan(&id); err != nil {
+		LogError("[postgres]", err.Error())
+		return 0, err
+	}
+	return id, nil
+}
+
+// sequence creates the id sequence of table if it is missing, starting after the ids already in
+// the table and without ever moving it back. An empty table that has never handed out an id
+// starts at 0, as it does on SQLite.
+func (db *PostgresDB) sequence(table string) (string, error) {
+	seq := table + "_id_seq"
+	if _, ok := db.sequences.Load(table); ok {
+		return seq, nil
+	}
+	if _, err := db.DB.Exec(F("create sequence if not exists %s minvalue 0 start 0", seq)); err != nil {
+		return "", err
+	}
+	var max sql.NullInt64
+	if err := db.DB.QueryRow(F("select max(id) from %s", table)).Scan(&max); err != nil {
+		return "", err
+	}
+	var err error
+	if max.Valid {
+		_, err = db.DB.Exec(F("select setval('%s', greatest(%d, (select last_value from %s)))", seq, max.Int64, seq))
+	} else {
+		_, err = db.DB.Exec(F("select setval('%s', 0, false) where not (select is_called from %s)", seq, seq))
+	}
+	if err != nil {
+		return "", err
+	}
+	db.sequences.Store(table, true)
+	return seq, nil
+}
+
+// pgColumnType maps the SQLite column types Andesite uses to PostgreSQL ones. Integers are 64-bit
+// since they hold byte counts.
+func pgColumnType(t string) string {
+	t = strings.ToLower(t)
+	switch {
+	case strings.HasPrefix(t, "tinyint"):
+		return "smallint"
+	case strings.HasPrefix(t, "int"):
+		return "bigint" + strings.TrimPrefix(t, "int")
+	}
+	return t
+}
+
+// CreateTable creates the table if it is missing, and adds any columns it is missing
+func (db *PostgresDB) CreateTable(name string, pk []string, columns [][]string) {
+	if err := pgCreateTable(db.DB, name, pk, columns); err != nil {
+		LogError("[postgres]", err.Error())
+	}
+}
+
+// pgExecer is a connection or a transaction, that pgCreateTable can run untranslated queries on
+type pgExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func pgCreateTable(db pgExecer, name string, pk []string, columns [][]string) error {
+	if _, err := db.Exec(F(`create table if not exists %s ("%s" %s)`, name, pk[0], pgColumnType(pk[1]))); err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	rows, err := db.Query("select column_name from information_schema.columns where table_schema = current_schema() and table_name = $1", name)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var c string
+		rows.Scan(&c)
+		have[c] = true
+	}
+	rows.Close()
+	for _, item := range columns {
+		if have[item[0]] {
+			continue
+		}
+		if _, err := db.Exec(F(`alter table %s add column "%s" %s`, name, item[0], pgColumnType(item[1]))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateTableStruct creates a table from the fields of v that have a sqlite tag, after its id
+func (db *PostgresDB) CreateTableStruct(name string, v interface{}) {
+	t := reflect.TypeOf(v)
+	columns := [][]string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if ct := f.Tag.Get("sqlite"); len(ct) > 0 {
+			columns = append(columns, []string{strings.ToLower(f.Name), ct})
+		}
+	}
+	db.CreateTable(name, []string{"id", "int primary key"}, columns)
+}
+
+//
+func (db *PostgresDB) Begin() (Tx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return pgTx{tx, db}, nil
+}
+
+// pgTx translates the queries of a transaction
+type pgTx struct {
+	*sql.Tx
+	db *PostgresDB
+}
+
+//
+func (tx pgTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.db.translate(query), args...)
+}
+
+//
+func (tx pgTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.db.translate(query), args...)
+}
+
+//
+func (tx pgTx) CreateTable(name string, pk []string, columns [][]string) error {
+	return pgCreateTable(tx.Tx, name, pk, columns)
+}
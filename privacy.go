@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/nektro/go-util/logger"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+const (
+	AnonymizeNone     = ""
+	AnonymizeTruncate = "truncate"
+	AnonymizeHash     = "hash"
+)
+
+// tables that store a `time` column and may be listed under "retention"
+var purgeableTables = map[string]bool{
+	"audit":     true,
+	"downloads": true,
+}
+
+// formats the current time for `time` columns so that rows sort and compare lexically
+func timeNow() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// returns the client IP in the form it is allowed to be stored in
+func clientIPForStorage(r *http.Request) string {
+	return anonymizeIP(clientIP(r))
+}
+
+func anonymizeIP(ip string) string {
+	switch config.Privacy.AnonymizeIP {
+	case AnonymizeTruncate:
+		pip := net.ParseIP(ip)
+		if pip == nil {
+			return ""
+		}
+		if v4 := pip.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return pip.Mask(net.CIDRMask(48, 128)).String()
+	case AnonymizeHash:
+		mac := hmac.New(sha256.New, randomKey)
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+	return ip
+}
+
+func validatePrivacyConfig(cfg *Config) error {
+	switch cfg.Privacy.AnonymizeIP {
+	case AnonymizeNone, AnonymizeTruncate, AnonymizeHash:
+	default:
+		return E(F("Invalid value '%s' for privacy.anonymize_ip, must be one of 'truncate', 'hash'", cfg.Privacy.AnonymizeIP))
+	}
+	if cfg.Privacy.Retention == nil {
+		cfg.Privacy.Retention = map[string]ConfigRetention{}
+	}
+	if _, ok := cfg.Privacy.Retention["downloads"]; !ok {
+		cfg.Privacy.Retention["downloads"] = ConfigRetention{Days: downloadRetentionDays}
+	}
+	for table, item := range cfg.Privacy.Retention {
+		if !purgeableTables[table] {
+			return E(F("Table '%s' does not support retention", table))
+		}
+		if item.Days <= 0 {
+			return E(F("Retention for '%s' must be at least 1 day", table))
+		}
+		if _, err := parseRetentionInterval(item); err != nil {
+			return E(F("Invalid purge interval for '%s': %s", table, err.Error()))
+		}
+	}
+	return nil
+}
+
+func parseRetentionInterval(item ConfigRetention) (time.Duration, error) {
+	if len(item.Every) == 0 {
+		return time.Hour * 24, nil
+	}
+	return time.ParseDuration(item.Every)
+}
+
+// starts one purge loop per table listed under "retention"
+func initRetentionPurger() {
+	for table, item := range config.Privacy.Retention {
+		every, _ := parseRetentionInterval(item)
+		go func(table string, days int, every time.Duration) {
+			for {
+				purgeTable(table, days)
+				time.Sleep(every)
+			}
+		}(table, item.Days, every)
+	}
+}
+
+func purgeTable(table string, days int) {
+	cutoff := time.Now().UTC().AddDate(0, 0, -days).Format(time.RFC3339)
+	res, err := database.Exec(F("delete from %s where time < ?", table), cutoff)
+	if err != nil {
+		log.Log(logger.LevelERROR, F("[retention] could not purge '%s': %s", table, err.Error()))
+		return
+	}
+	n, _ := res.RowsAffected()
+	log.Log(logger.LevelINFO, F("[retention] purged %d rows from '%s' older than %s", n, table, cutoff))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+func validateProvisionConfig(cfg *Config) error {
+	return validateProvisionRules(cfg.Provision)
+}
+
+// validateProvisionRules checks rules and cleans their paths in place
+func validateProvisionRules(rules []ConfigProvision) error {
+	for i, item := range rules {
+		if len(item.Group) == 0 && len(item.EmailDomain) == 0 && len(item.Provider) == 0 {
+			return E(F("provision[%d] must match on at least one of provider, group, email_domain", i))
+		}
+		if len(item.Provider) > 0 && !loginProviderEnabled(item.Provider) {
+			return E(F("provision[%d].provider '%s' is not one of the providers in auth", i, item.Provider))
+		}
+		if len(item.Paths) == 0 {
+			return E(F("provision[%d].paths must not be empty", i))
+		}
+		for j, p := range item.Paths {
+			s, err := sanitizePath(p)
+			if err != nil {
+				return E(F("Invalid provision[%d].paths path '%s': %s", i, p, err.Error()))
+			}
+			rules[i].Paths[j] = s
+		}
+	}
+	return nil
+}
+
+// provisionMatches returns true if the user meets every condition rule sets. Email domains are
+// only matched against email, an address the provider has verified, never against IDs or names
+// users choose themselves. Without one a rule with an email domain does not match.
+func provisionMatches(rule ConfigProvision, provider string, email string, groups []string) bool {
+	if len(rule.Provider) > 0 && rule.Provider != provider {
+		return false
+	}
+	if len(rule.Group) > 0 && !Contains(groups, rule.Group) {
+		return false
+	}
+	if len(rule.EmailDomain) > 0 {
+		suffix := "@" + strings.ToLower(strings.TrimPrefix(rule.EmailDomain, "@"))
+		if len(email) == 0 || !strings.HasSuffix(strings.ToLower(email), suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// provisionAccess grants a user logging in for the first time the paths of every rule they match
+func provisionAccess(user UserRow, provider string, email string, groups []string) {
+	granted := queryAccess(user)
+	for _, rule := range live().provision {
+		if !provisionMatches(rule, provider, email, groups) {
+			continue
+		}
+		for _, p := range rule.Paths {
+			if Contains(granted, p) {
+				continue
+			}
+			aid, err := database.QueryNextID("access")
+			if err != nil {
+				return
+			}
+			database.QueryPrepared(true, "insert into access (id, user, path) values (?, ?, ?)", aid, user.id, p)
+			granted = append(granted, p)
+			Log("[provision]", user.snowflake, "was given access to", p)
+			auditLog(nil, "provision", "access.create", user.snowflake, p)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+var (
+	trustedProxies  []*net.IPNet
+	trustUnixSocket bool
+)
+
+// initTrustedProxies parses the "trusted_proxies" list of IPs and CIDR ranges. The special
+// entry "unix" trusts every connection made over a Unix socket from --listen.
+func initTrustedProxies(list []string) error {
+	nets, unix, err := parseAddressList(list, "trusted_proxies")
+	trustedProxies, trustUnixSocket = nets, unix
+	return err
+}
+
+// parseAddressList parses a config list of IPs, CIDR ranges, and "unix"
+func parseAddressList(list []string, option string) ([]*net.IPNet, bool, error) {
+	result := []*net.IPNet{}
+	unix := false
+	for _, item := range list {
+		if item == "unix" {
+			unix = true
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, false, E(F("Invalid %s entry '%s'", option, item))
+		}
+		result = append(result, ipnet)
+	}
+	return result, unix, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, item := range trustedProxies {
+		if item.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host of the connection and whether it came from a trusted proxy
+func remoteHost(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// unix sockets have no remote address
+		return r.RemoteAddr, trustUnixSocket
+	}
+	return host, isTrustedProxy(host)
+}
+
+// clientIP returns the address of the client, following X-Forwarded-For back through every
+// trusted proxy to the first address that was not added by one
+func clientIP(r *http.Request) string {
+	host, trusted := remoteHost(r)
+	if !trusted {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if len(hop) == 0 {
+			continue
+		}
+		host = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// forwardedHeader returns the first value of a X-Forwarded-* header, only if the request came
+// through a trusted proxy
+func forwardedHeader(r *http.Request, name string) string {
+	if _, trusted := remoteHost(r); !trusted {
+		return ""
+	}
+	return strings.TrimSpace(strings.Split(r.Header.Get(name), ",")[0])
+}
+
+// isHTTPS returns true if the client connected with TLS, either to us or to a trusted proxy
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || forwardedHeader(r, "X-Forwarded-Proto") == "https"
+}
+
+// mwForwarded rewrites the request to the host and scheme the client used, for handlers from
+// other packages that build absolute URLs from r.Host and r.TLS such as the OAuth2 redirect
+func mwForwarded(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if host := forwardedHeader(r, "X-Forwarded-Host"); len(host) > 0 {
+			r.Host = host
+		}
+		if isHTTPS(r) && r.TLS == nil {
+			r.TLS = &tls.ConnectionState{}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+var (
+	proxyAuthNets []*net.IPNet
+	proxyAuthUnix bool
+	proxyAuth     ConfigProxyAuth
+)
+
+// initProxyAuth sets up "auth": "proxy", where a reverse proxy such as Authelia or Authentik has
+// already logged the user in and passes who they are in headers
+func initProxyAuth(cfg *ConfigProxyAuth) error {
+	if !loginProviderEnabled("proxy") {
+		return nil
+	}
+	if cfg == nil || len(cfg.Upstream) == 0 {
+		return E("\"auth\": \"proxy\" requires the addresses of the proxy in proxy_auth.upstream")
+	}
+	nets, unix, err := parseAddressList(cfg.Upstream, "proxy_auth.upstream")
+	if err != nil {
+		return err
+	}
+	proxyAuthNets, proxyAuthUnix, proxyAuth = nets, unix, *cfg
+	if len(proxyAuth.UserHeader) == 0 {
+		proxyAuth.UserHeader = "Remote-User"
+	}
+	if len(proxyAuth.NameHeader) == 0 {
+		proxyAuth.NameHeader = "Remote-Name"
+	}
+	if len(proxyAuth.GroupsHeader) == 0 {
+		proxyAuth.GroupsHeader = "Remote-Groups"
+	}
+	if len(proxyAuth.EmailHeader) == 0 {
+		proxyAuth.EmailHeader = "Remote-Email"
+	}
+	return nil
+}
+
+// fromProxyAuthUpstream returns true if the connection itself came from the auth proxy. The
+// headers of anyone else are ignored, X-Forwarded-For is not followed.
+func fromProxyAuthUpstream(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return proxyAuthUnix
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, item := range proxyAuthNets {
+		if item.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyAuthGroups returns the groups of the user from the groups header
+func proxyAuthGroups(r *http.Request) []string {
+	result := []string{}
+	for _, item := range strings.Split(r.Header.Get(proxyAuth.GroupsHeader), ",") {
+		if g := strings.TrimSpace(item); len(g) > 0 {
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+// validProxyUsername returns false for usernames that could be mistaken for the snowflake of a
+// user of another provider, such as "github:123"
+func validProxyUsername(username string) bool {
+	return len(username) > 0 && !strings.ContainsAny(username, ":\x00")
+}
+
+// mwProxyAuth logs in the user named by the proxy, and out again once the proxy stops sending them
+func mwProxyAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(proxyAuthNets) == 0 && !proxyAuthUnix {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sess := getSession(r)
+		current, _ := sess.Values["user"].(string)
+		username := strings.TrimSpace(r.Header.Get(proxyAuth.UserHeader))
+		if len(username) == 0 || !fromProxyAuthUpstream(r) {
+			if len(current) > 0 && loginProviderOf(current).key == "proxy" {
+				delete(sess.Values, "user")
+				delete(sess.Values, "name")
+				delete(sess.Values, "groups")
+				delete(sess.Values, "email")
+				sess.Save(r, w)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validProxyUsername(username) {
+			Log("[proxy-auth]", "refused username", strconv.Quote(username))
+			writeStatus(r, w, http.StatusForbidden)
+			writeResponse(r, w, "Login Denied", "The username given by the proxy is not allowed.", "")
+			return
+		}
+		snowflake := externalSnowflake("proxy", username)
+		groups := proxyAuthGroups(r)
+		if current != snowflake {
+			name := r.Header.Get(proxyAuth.NameHeader)
+			if len(name) == 0 {
+				name = username
+			}
+			// groups and the email the proxy verified are saved first so that provisioning sees them
+			sess.Values["groups"] = strings.Join(groups, ",")
+			sess.Values["email"] = strings.TrimSpace(r.Header.Get(proxyAuth.EmailHeader))
+			lp := loginProviderOf(snowflake)
+			helperOA2SaveInfo(lp)(w, r, "proxy", username, name)
+			if msg, ok := sess.Values["login_error"].(string); ok {
+				// there is no login page to show it on, such as for a suspended user
+				delete(sess.Values, "login_error")
+				sess.Save(r, w)
+				writeStatus(r, w, http.StatusForbidden)
+				writeResponse(r, w, "Login Denied", msg, "")
+				return
+			}
+		}
+		// only look at the groups again when they change
+		if g := strings.Join(groups, ","); current != snowflake || sess.Values["groups"] != g {
+			sess.Values["groups"] = g
+			sess.Save(r, w)
+			if len(proxyAuth.AdminGroups) > 0 {
+				syncProxyAdmin(snowflake, groups)
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// syncProxyAdmin makes the user an admin exactly when they are in one of proxy_auth.admin_groups
+func syncProxyAdmin(snowflake string, groups []string) {
+	user, ok := queryUserBySnowflake(snowflake)
+	if !ok {
+		return
+	}
+	admin := false
+	for _, item := range groups {
+		if Contains(proxyAuth.AdminGroups, item) {
+			admin = true
+			break
+		}
+	}
+	if admin == user.admin {
+		return
+	}
+	queryDoUpdate("users", "admin", boolToString(admin), "id", strconv.Itoa(user.id))
+	Log("[proxy-auth]", snowflake, "admin set to", admin, "from groups", strings.Join(groups, ","))
+	auditLog(nil, "proxy", "user.update", snowflake, "admin="+boolToString(admin))
+}
+
+// handler for http://andesite/login?with=proxy, the proxy has logged the user in before they get here
+func handleProxyLogin(w http.ResponseWriter, r *http.Request) {
+	if helperIsLoggedIn(r) {
+		handleLoginDone(w, r)
+		return
+	}
+	writeResponse(r, w, "Not Logged In", "Andesite is set up to be logged in to by the proxy in front of it, but it did not say who you are.", "")
+}
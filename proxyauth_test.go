@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidProxyUsername(t *testing.T) {
+	cases := []struct {
+		username string
+		valid    bool
+	}{
+		{"alice", true},
+		{"alice@example.com", true},
+		{"Alice Smith", true},
+		{"", false},
+		{"github:123", false},
+		{"proxy:alice", false},
+		{":", false},
+		{"alice\x00", false},
+	}
+	for _, item := range cases {
+		if v := validProxyUsername(item.username); v != item.valid {
+			t.Errorf("validProxyUsername(%q) = %v, want %v", item.username, v, item.valid)
+		}
+	}
+}
+
+// a username the proxy may send must never become the snowflake of a user of another provider
+func TestProxyUsernameSnowflake(t *testing.T) {
+	saved := live()
+	defer liveConfig.Store(saved)
+	github := LoginProvider{Oauth2Providers["github"], "github", nil}
+
+	for _, providers := range [][]LoginProvider{
+		{{key: "proxy"}, github},
+		{github, {key: "proxy"}},
+	} {
+		liveConfig.Store(&LiveConfig{providers: providers})
+		for _, username := range []string{"alice", "github:123", "2:123"} {
+			snowflake := externalSnowflake("proxy", username)
+			if validProxyUsername(username) && loginProviderOf(snowflake).key != "proxy" {
+				t.Errorf("with %s first, username %q became %q of provider %s", providers[0].key, username, snowflake, loginProviderOf(snowflake).key)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1 << 40,
+	"tib": 1 << 40,
+}
+
+func validateQuotaConfig(cfg *Config) error {
+	if cfg.Quotas.Storage < 0 || cfg.Quotas.Bandwidth < 0 || cfg.Quotas.Speed < 0 {
+		return E("quotas.storage, quotas.bandwidth, and quotas.speed must not be negative")
+	}
+	return nil
+}
+
+// parseByteSize reads a size such as '500MiB' or '2.5 GB', the units are binary either way
+func parseByteSize(v string) (int64, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	i := strings.IndexFunc(v, func(c rune) bool { return (c < '0' || c > '9') && c != '.' })
+	if i == -1 {
+		i = len(v)
+	}
+	n, err := strconv.ParseFloat(v[:i], 64)
+	unit, ok := byteUnits[strings.TrimSpace(v[i:])]
+	if err != nil || !ok || n < 0 || n*float64(unit) > math.MaxInt64/2 {
+		return 0, E(F("'%s' is not a size, such as '500MiB' or '20GiB'", v))
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// userQuotas are the storage and monthly bandwidth limits of user in bytes, 0 is unlimited
+func userQuotas(user UserRow) (int64, int64) {
+	storage, bandwidth := user.quotaStorage, user.quotaBandwidth
+	if storage < 0 {
+		storage = config.Quotas.Storage
+	}
+	if bandwidth < 0 {
+		bandwidth = config.Quotas.Bandwidth
+	}
+	return storage, bandwidth
+}
+
+// monthStart is the time bandwidth was last reset, the first of the month in UTC
+func monthStart() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// queryBandwidthUsed is the number of bytes user has downloaded this month
+func queryBandwidthUsed(uid int) int64 {
+	var total int64
+	rows, err := database.QueryPrepared(false, "select coalesce(sum(bytes), 0) from downloads where user = ? and time >= ?", uid, monthStart().Format(time.RFC3339))
+	if err != nil {
+		return 0
+	}
+	if rows.Next() {
+		rows.Scan(&total)
+	}
+	rows.Close()
+	return total
+}
+
+// checkStorageQuota returns an error if storing size more bytes would put user over their quota,
+// counting the uploads they have started but not finished
+func checkStorageQuota(user UserRow, size int64) error {
+	storage, _ := userQuotas(user)
+	if storage == 0 {
+		return nil
+	}
+	used := user.stored + queryUploadsPending(user.id) + size
+	if used <= storage {
+		return nil
+	}
+	return E(F("This would use %s of your %s of storage", byteCountIEC(used), byteCountIEC(storage)))
+}
+
+// addStored counts delta more bytes against the storage quota of the user
+func addStored(uid int, delta int64) {
+	database.QueryPrepared(true, "update users set stored = case when coalesce(stored, 0) + ? < 0 then 0 else coalesce(stored, 0) + ? end where id = ?", delta, delta, uid)
+}
+
+// recordStored counts the file fpath that uid uploaded against their storage quota, until it is
+// deleted
+func recordStored(uid int, fpath string, length int64) {
+	addStored(uid, length)
+	id, err := database.QueryNextID("stored_files")
+	if err != nil {
+		return
+	}
+	database.QueryPrepared(true, "insert into stored_files (id, path, user, bytes, trash) values (?, ?, ?, ?, -1)", id, fpath, uid, length)
+}
+
+// storedWhere selects the uploaded files that are fpath, or in it when it is a folder
+func storedWhere(fpath string) (string, []interface{}) {
+	if strings.HasSuffix(fpath, "/") {
+		return "substr(path,1,length(?)) = ?", []interface{}{fpath, fpath}
+	}
+	return "path = ?", []interface{}{fpath}
+}
+
+// releaseStored stops counting the uploaded files at fpath, or in it when it is a folder, against
+// the quotas of their uploaders. Those moved to the trash item trash are kept for restoreStored,
+// and with -1 they are forgotten.
+func releaseStored(fpath string, trash int) {
+	where, args := storedWhere(fpath)
+	changeStored("trash = -1 and "+where, args, -1)
+	if trash < 0 {
+		database.QueryPrepared(true, "delete from stored_files where trash = -1 and "+where, args...)
+		return
+	}
+	database.QueryPrepared(true, "update stored_files set trash = ? where trash = -1 and "+where, append([]interface{}{trash}, args...)...)
+}
+
+// restoreStored counts the uploaded files of the trash item trash again once it is restored
+func restoreStored(trash int) {
+	changeStored("trash = ?", []interface{}{trash}, 1)
+	database.QueryPrepared(true, "update stored_files set trash = -1 where trash = ?", trash)
+}
+
+// purgeStored forgets the uploaded files of the trash item trash once it is deleted for good
+func purgeStored(trash int) {
+	database.QueryPrepared(true, "delete from stored_files where trash = ?", trash)
+}
+
+// changeStored adds the bytes of the uploaded files that match where, times sign, to the storage
+// used by each of their uploaders
+func changeStored(where string, args []interface{}, sign int64) {
+	rows, err := database.QueryPrepared(false, "select user, coalesce(sum(bytes), 0) from stored_files where "+where+" group by user", args...)
+	if err != nil {
+		return
+	}
+	totals := map[int]int64{}
+	for rows.Next() {
+		var uid int
+		var n int64
+		rows.Scan(&uid, &n)
+		totals[uid] = n
+	}
+	rows.Close()
+	for uid, n := range totals {
+		addStored(uid, sign*n)
+	}
+}
+
+// recountStored forgets the files uid uploaded that are gone, such as those deleted outside of
+// Andesite, and sets the storage they use to the size of the rest
+func recountStored(uid int) {
+	rows, err := database.QueryPrepared(false, "select id, path from stored_files where user = ? and trash = -1", uid)
+	if err != nil {
+		return
+	}
+	gone := []int{}
+	for rows.Next() {
+		var id int
+		var fpath string
+		rows.Scan(&id, &fpath)
+		full, err := resolvePath(rootDir.Base(), fpath)
+		if err == nil {
+			_, err = os.Lstat(full)
+		}
+		if err != nil {
+			gone = append(gone, id)
+		}
+	}
+	rows.Close()
+	for _, id := range gone {
+		database.QueryPrepared(true, "delete from stored_files where id = ?", id)
+	}
+	database.QueryPrepared(true, "update users set stored = (select coalesce(sum(bytes), 0) from stored_files where user = ? and trash = -1) where id = ?", uid, uid)
+}
+
+// checkBandwidthQuota writes a 429 and returns false once user has used up their bandwidth for
+// the month. A download that is already going is not cut off.
+func checkBandwidthQuota(r *http.Request, w http.ResponseWriter, user UserRow) bool {
+	_, bandwidth := userQuotas(user)
+	if bandwidth == 0 || r.Method != http.MethodGet {
+		return true
+	}
+	if queryBandwidthUsed(user.id) < bandwidth {
+		return true
+	}
+	reset := monthStart().AddDate(0, 1, 0)
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+	writeStatus(r, w, http.StatusTooManyRequests)
+	writeResponse(r, w, "Bandwidth Used Up", F("You have downloaded your %s for this month, downloads start again on %s.", byteCountIEC(bandwidth), reset.Format("January 2")), "")
+	return false
+}
+
+// quotaUsage describes how much of their quotas user has used, for the /me page and admin panel
+func quotaUsage(user UserRow) map[string]interface{} {
+	storage, bandwidth := userQuotas(user)
+	meter := func(used int64, limit int64, own int64) map[string]interface{} {
+		result := map[string]interface{}{
+			"default":    own < 0,
+			"used":       used,
+			"used_size":  byteCountIEC(used),
+			"limit":      limit,
+			"limit_size": byteCountIEC(limit),
+			"percent":    0,
+		}
+		if limit > 0 {
+			result["percent"] = int(math.Min(100, float64(used)*100/float64(limit)))
+		}
+		return result
+	}
+	return map[string]interface{}{
+		"storage":   meter(user.stored, storage, user.quotaStorage),
+		"bandwidth": meter(queryBandwidthUsed(user.id), bandwidth, user.quotaBandwidth),
+		"speed":     meter(0, userSpeedLimit(user), user.quotaSpeed),
+		"reset":     monthStart().AddDate(0, 1, 0).Format(time.RFC3339),
+	}
+}
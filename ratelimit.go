@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// TokenBucket holds up to burst tokens and refills at rate tokens per second
+type TokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps one token bucket per key
+type RateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*TokenBucket
+	swept   time.Time
+}
+
+// RateLimits are the limiters of one "rate_limit", each nil when it is off. A reload replaces them
+// as a whole, while requests already going keep the ones they started with.
+type RateLimits struct {
+	cfg       *ConfigRateLimit
+	requests  *RateLimiter
+	downloads *RateLimiter
+	users     *ConcurrencyLimiter
+	ips       *ConcurrencyLimiter
+}
+
+// a client turned away for having too many downloads going is told to try again after this long
+const concurrentRetryAfter = 10
+
+//
+func NewRateLimiter(rate float64, burst float64) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: burst, buckets: map[string]*TokenBucket{}, swept: time.Now()}
+}
+
+// sweep forgets the buckets that have filled up again, at most once a minute. It is done while
+// taking tokens rather than on a timer so that a limiter a reload replaced can be collected.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.swept) < time.Minute {
+		return
+	}
+	rl.swept = now
+	for k, v := range rl.buckets {
+		if now.Sub(v.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+// take removes n tokens from the bucket at key, going into debt if there are not enough. It
+// returns how long the caller must wait before the bucket is back to zero.
+func (rl *RateLimiter) take(key string, n float64) time.Duration {
+	rl.Lock()
+	defer rl.Unlock()
+	now := time.Now()
+	rl.sweep(now)
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &TokenBucket{rl.burst, now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rl.rate * float64(time.Second))
+}
+
+// allow takes a single token only if one is available, otherwise it returns the time until one is
+func (rl *RateLimiter) allow(key string) (bool, time.Duration) {
+	wait := rl.take(key, 1)
+	if wait == 0 {
+		return true, 0
+	}
+	rl.take(key, -1)
+	return false, wait
+}
+
+//
+//
+
+// buildRateLimits checks cfg, fills in its defaults, and creates its limiters
+func buildRateLimits(cfg *ConfigRateLimit) (*RateLimits, error) {
+	result := &RateLimits{cfg: cfg}
+	if cfg == nil {
+		return result, nil
+	}
+	if cfg.Requests < 0 || cfg.Burst < 0 || cfg.DownloadKB < 0 || cfg.PerUser < 0 || cfg.PerIP < 0 {
+		return nil, E("rate_limit values must not be negative")
+	}
+	if cfg.Requests > 0 {
+		if cfg.Burst == 0 {
+			cfg.Burst = int(math.Max(1, cfg.Requests/6))
+		}
+		result.requests = NewRateLimiter(cfg.Requests/60, float64(cfg.Burst))
+	}
+	if cfg.DownloadKB > 0 {
+		rate := float64(cfg.DownloadKB * 1024)
+		result.downloads = NewRateLimiter(rate, rate)
+	}
+	if cfg.PerUser > 0 {
+		result.users = NewConcurrencyLimiter(cfg.PerUser)
+	}
+	if cfg.PerIP > 0 {
+		result.ips = NewConcurrencyLimiter(cfg.PerIP)
+	}
+	if len(cfg.Paths) == 0 {
+		cfg.Paths = []string{"/files/", "/open/", "/api/search"}
+	}
+	return result, nil
+}
+
+func initRateLimit(cfg *ConfigRateLimit) error {
+	limits, err := buildRateLimits(cfg)
+	if err != nil {
+		return err
+	}
+	updateLive(func(lc *LiveConfig) {
+		lc.limits = limits
+	})
+	return nil
+}
+
+// rateLimits returns the limiters in use, which are never nil though each of them may be
+func rateLimits() *RateLimits {
+	if l := live().limits; l != nil {
+		return l
+	}
+	return &RateLimits{}
+}
+
+// rateLimitKey identifies the client by user when logged in, or else by IP
+func rateLimitKey(r *http.Request) string {
+	if u, ok := getSession(r).Values["user"].(string); ok {
+		return "user:" + u
+	}
+	return "ip:" + clientIP(r)
+}
+
+func isRateLimited(limits *RateLimits, r *http.Request) bool {
+	return isPathRateLimited(limits, r.URL.Path)
+}
+
+// isPathRateLimited returns true if requests to upath count against the request limit, also used
+// for what WebSocket clients ask of the same endpoints
+func isPathRateLimited(limits *RateLimits, upath string) bool {
+	if limits.cfg == nil {
+		return false
+	}
+	for _, item := range limits.cfg.Paths {
+		if strings.HasPrefix(upath, item) {
+			return true
+		}
+	}
+	return false
+}
+
+func mwRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limits := rateLimits()
+		if !isRateLimited(limits, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := rateLimitKey(r)
+		if limits.requests != nil {
+			if ok, wait := limits.requests.allow(key); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeStatus(r, w, http.StatusTooManyRequests)
+				writeResponse(r, w, "Too Many Requests", "You are sending requests too quickly, please slow down and try again shortly.", "")
+				return
+			}
+		}
+		if limits.downloads != nil {
+			w = &ThrottledWriter{w, key, limits.downloads}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// ThrottledWriter slows down a response to the download rate of its client, with the limiter it
+// started with even if a reload replaces it
+type ThrottledWriter struct {
+	http.ResponseWriter
+	key     string
+	limiter *RateLimiter
+}
+
+//
+func (tw *ThrottledWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijackThrough(tw.ResponseWriter)
+}
+
+//
+func (tw *ThrottledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > 32*1024 {
+			chunk = chunk[:32*1024]
+		}
+		time.Sleep(tw.limiter.take(tw.key, float64(len(chunk))))
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// ConcurrencyLimiter is a counting semaphore per key, for how many downloads a client has going
+type ConcurrencyLimiter struct {
+	sync.Mutex
+	limit  int
+	active map[string]int
+}
+
+//
+func NewConcurrencyLimiter(limit int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{limit: limit, active: map[string]int{}}
+}
+
+// acquire takes a slot for key, it returns false if all of them are taken
+func (cl *ConcurrencyLimiter) acquire(key string) bool {
+	cl.Lock()
+	defer cl.Unlock()
+	if cl.active[key] >= cl.limit {
+		return false
+	}
+	cl.active[key]++
+	return true
+}
+
+// release gives back a slot taken by acquire
+func (cl *ConcurrencyLimiter) release(key string) {
+	cl.Lock()
+	defer cl.Unlock()
+	cl.active[key]--
+	if cl.active[key] <= 0 {
+		delete(cl.active, key)
+	}
+}
+
+// acquireDownload takes a download slot for the user of r, if logged in, and for its IP. If either
+// is used up it writes a 429 and returns false, otherwise the returned func gives the slots back
+// once the download is done.
+func acquireDownload(r *http.Request, w http.ResponseWriter) (func(), bool) {
+	limits := rateLimits()
+	users, ips := limits.users, limits.ips
+	user, _ := getSession(r).Values["user"].(string)
+	ip := clientIP(r)
+	if users != nil && len(user) > 0 && !users.acquire(user) {
+		writeTooManyDownloads(r, w)
+		return nil, false
+	}
+	if ips != nil && !ips.acquire(ip) {
+		if users != nil && len(user) > 0 {
+			users.release(user)
+		}
+		writeTooManyDownloads(r, w)
+		return nil, false
+	}
+	return func() {
+		if users != nil && len(user) > 0 {
+			users.release(user)
+		}
+		if ips != nil {
+			ips.release(ip)
+		}
+	}, true
+}
+
+func writeTooManyDownloads(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(concurrentRetryAfter))
+	writeStatus(r, w, http.StatusTooManyRequests)
+	writeResponse(r, w, "Too Many Downloads", "You have too many downloads going at once, wait for one to finish and try again.", "")
+}
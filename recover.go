@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/nektro/go-util/logger"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// amount of requests that have panicked since startup
+var panicCount int64
+
+// mwRecover turns a panicking handler into a 500 page and a crash report in stateDir/crashes/
+func mwRecover(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &StatusWriter{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			atomic.AddInt64(&panicCount, 1)
+			stack := debug.Stack()
+			log.Log(logger.LevelERROR, F("[panic] %s %s: %v", r.Method, r.URL.RequestURI(), rec))
+			writeCrashReport(r, rec, stack)
+			if sw.status == 0 {
+				writeStatus(r, w, http.StatusInternalServerError)
+				writeResponse(r, w, "Internal Server Error", "Something went wrong while handling your request. The error has been logged.", "")
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	}
+}
+
+func writeCrashReport(r *http.Request, rec interface{}, stack []byte) {
+	dir := stateDir + "/crashes"
+	os.MkdirAll(dir, 0700)
+	user, _ := getSession(r).Values["user"].(string)
+	now := time.Now().UTC()
+	name := F("%s/%s-%x.txt", dir, now.Format("20060102T150405Z"), securecookie.GenerateRandomKey(4))
+	report := F("Time: %s\nMethod: %s\nURL: %s\nIP: %s\nUser: %s\nUser-Agent: %s\nPanic: %v\n\n%s",
+		now.Format(time.RFC3339), r.Method, r.URL.RequestURI(), clientIPForStorage(r), user, r.UserAgent(), rec, stack)
+	if err := ioutil.WriteFile(name, []byte(report), 0600); err != nil {
+		log.Log(logger.LevelERROR, "[panic] unable to write crash report:", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/nektro/go-util/logger"
+	"github.com/nektro/go-util/types"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+var (
+	// the config file the server was started with
+	configFile string
+	// the --theme flags, which stay ahead of the themes in the config across reloads
+	themeFlags []string
+	reloadLock sync.Mutex
+	liveConfig atomic.Value
+)
+
+// LiveConfig is what the config keys a reload applies are turned into. A reload builds and checks
+// a whole new one before publishing it at once, so that every request sees either all of the old
+// config or all of the new.
+type LiveConfig struct {
+	providers []LoginProvider
+	logins    map[string]http.HandlerFunc
+	callbacks map[string]http.HandlerFunc
+	themes    types.MultiplexFileSystem
+	headers   ConfigSecurityHeaders
+	csp       string
+	provision []ConfigProvision
+	limits    *RateLimits
+}
+
+// live returns the reloadable config in use
+func live() *LiveConfig {
+	if lc, ok := liveConfig.Load().(*LiveConfig); ok {
+		return lc
+	}
+	return &LiveConfig{}
+}
+
+// updateLive publishes a copy of the live config changed by fn, for start up, which sets it up one
+// piece at a time
+func updateLive(fn func(lc *LiveConfig)) {
+	lc := *live()
+	fn(&lc)
+	liveConfig.Store(&lc)
+}
+
+// reloadableKeys are the config keys reloadConfig applies, along with the client credentials of
+// the built-in providers, the rest need a restart
+var reloadableKeys = map[string]bool{
+	"themes":           true,
+	"security_headers": true,
+	"rate_limit":       true,
+	"provision":        true,
+	"providers":        true,
+	"custom":           true,
+}
+
+// initReloadSignal reloads the config every time the process gets SIGHUP
+func initReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Log(logger.LevelINFO, "Caught SIGHUP, reloading", configFile)
+			if _, err := reloadConfig(); err != nil {
+				log.Log(logger.LevelERROR, "[reload]", err.Error())
+			}
+		}
+	}()
+}
+
+// reloadConfig reads the config file and environment again and applies themes, security headers,
+// rate limits, provisioning rules, and the credentials of login providers. Sessions and requests
+// in progress are not affected. Nothing is applied if the new config has a problem. It returns
+// the keys that changed but only take effect after a restart.
+func reloadConfig() ([]string, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if err := reportConfigProblems(configFile, lintConfigFile(configFile)); err != nil {
+		return nil, err
+	}
+	var nc *Config
+	if err := decodeConfig(configFile, &nc); err != nil {
+		return nil, err
+	}
+	if err := reportConfigProblems("the environment", applyEnvConfig(nc)); err != nil {
+		return nil, err
+	}
+
+	// build and check everything before changing anything
+	for _, check := range configValidators {
+		if err := check(nc); err != nil {
+			return nil, err
+		}
+	}
+	themes := append(append([]string{}, themeFlags...), nc.Themes...)
+	fs, err := buildThemeFS(themes)
+	if err != nil {
+		return nil, err
+	}
+	providers := []LoginProvider{}
+	for _, item := range loginProviders() {
+		lp, err := findLoginProvider(nc, item.key)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, lp)
+	}
+	limits, err := buildRateLimits(nc.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	lc := &LiveConfig{providers: providers, themes: fs, provision: nc.Provision, limits: limits}
+	lc.logins, lc.callbacks = buildLoginHandlers(providers)
+	lc.headers, lc.csp = securityHeaders(nc.SecurityHeaders, themes)
+	liveConfig.Store(lc)
+
+	restart := changedKeys(config, nc)
+	for _, item := range restart {
+		log.Log(logger.LevelWARN, "[reload]", F("\"%s\" changed, restart Andesite to apply it", item))
+	}
+	log.Log(logger.LevelINFO, "[reload]", "Reloaded", configFile)
+	return restart, nil
+}
+
+// changedKeys returns the keys whose values differ between a and b, other than the ones a
+// reload applies
+func changedKeys(a *Config, b *Config) []string {
+	result := []string{}
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		key := strings.Split(va.Type().Field(i).Tag.Get("json"), ",")[0]
+		if _, ok := Oauth2Providers[key]; ok || reloadableKeys[key] {
+			continue
+		}
+		ja, _ := json.Marshal(va.Field(i).Interface())
+		jb, _ := json.Marshal(vb.Field(i).Interface())
+		if string(ja) != string(jb) {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+//
+//
+
+// handler for http://andesite/api/admin/reload
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	restart, err := reloadConfig()
+	if err != nil {
+		auditFailure(r, user.snowflake, "config.reload", configFile, err.Error())
+		writeAPIResponse(r, w, false, "The config was not reloaded: "+err.Error())
+		return
+	}
+	auditLog(r, user.snowflake, "config.reload", configFile, strings.Join(restart, ","))
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"message":  "Reloaded the config.",
+		"restart":  restart,
+	})
+}
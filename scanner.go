@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/securecookie"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+const (
+	maxScanFiles = 1000
+	scanTimeout  = time.Minute * 5
+	// the results of a scan started from the API are kept this long after it was last updated
+	scanJobTTL = time.Hour * 24
+)
+
+// ScanResult is the verdict of a Scanner on one file
+type ScanResult struct {
+	Clean  bool   `json:"clean"`
+	Reason string `json:"reason"`
+}
+
+// Scanner checks a file against an antivirus or content policy
+type Scanner interface {
+	Name() string
+	Scan(fpath string) (ScanResult, error)
+}
+
+var scanners []Scanner
+
+func initScanners() error {
+	for i, item := range config.Scanners {
+		switch item.Type {
+		case "command":
+			if len(item.Command) == 0 {
+				return E(F("scanner %d requires 'command'", i))
+			}
+			scanners = append(scanners, CommandScanner{item.Command, item.InfectedCodes})
+		case "http":
+			if len(item.URL) == 0 {
+				return E(F("scanner %d requires 'url'", i))
+			}
+			scanners = append(scanners, HTTPScanner{item.URL, &http.Client{Timeout: scanTimeout}})
+		case "icap":
+			if len(item.Address) == 0 || len(item.Service) == 0 {
+				return E(F("scanner %d requires 'address' and 'service'", i))
+			}
+			scanners = append(scanners, ICAPScanner{item.Address, item.Service})
+		default:
+			return E(F("Invalid scanner type '%s', must be one of 'command', 'http', 'icap'", item.Type))
+		}
+	}
+	return nil
+}
+
+// runScanners runs every configured scanner on the file at fpath, a path on disk, stopping at the
+// first that does not pass it
+func runScanners(fpath string) (ScanResult, error) {
+	for _, item := range scanners {
+		res, err := item.Scan(fpath)
+		if err != nil {
+			return res, E(F("%s: %s", item.Name(), err.Error()))
+		}
+		if !res.Clean {
+			res.Reason = item.Name() + ": " + res.Reason
+			return res, nil
+		}
+	}
+	return ScanResult{Clean: true}, nil
+}
+
+//
+//
+
+// CommandScanner runs a program with the file path substituted for "{file}" in its arguments.
+// Exit code 0 is clean, and the codes in infected (default 1, as clamscan uses) are not.
+type CommandScanner struct {
+	command  []string
+	infected []int
+}
+
+//
+func (cs CommandScanner) Name() string {
+	return cs.command[0]
+}
+
+//
+func (cs CommandScanner) Scan(fpath string) (ScanResult, error) {
+	args := make([]string, len(cs.command)-1)
+	for i, item := range cs.command[1:] {
+		args[i] = strings.Replace(item, "{file}", fpath, -1)
+	}
+	out, err := exec.Command(cs.command[0], args...).CombinedOutput()
+	if err == nil {
+		return ScanResult{Clean: true}, nil
+	}
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		return ScanResult{}, err
+	}
+	infected := cs.infected
+	if len(infected) == 0 {
+		infected = []int{1}
+	}
+	for _, item := range infected {
+		if ee.ExitCode() == item {
+			return ScanResult{Clean: false, Reason: strings.TrimSpace(string(out))}, nil
+		}
+	}
+	return ScanResult{}, E(F("exited with %d: %s", ee.ExitCode(), strings.TrimSpace(string(out))))
+}
+
+//
+//
+
+// HTTPScanner POSTs the file as the request body and expects {"clean": bool, "reason": string}
+type HTTPScanner struct {
+	url    string
+	client *http.Client
+}
+
+//
+func (hs HTTPScanner) Name() string {
+	return hs.url
+}
+
+//
+func (hs HTTPScanner) Scan(fpath string) (ScanResult, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer f.Close()
+	req, _ := http.NewRequest(http.MethodPost, hs.url, f)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Filename", filepath.Base(fpath))
+	res, err := hs.client.Do(req)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ScanResult{}, E(res.Status)
+	}
+	sr := ScanResult{}
+	err = json.NewDecoder(res.Body).Decode(&sr)
+	return sr, err
+}
+
+//
+//
+
+// ICAPScanner sends the file to an ICAP (RFC 3507) service in a RESPMOD request
+type ICAPScanner struct {
+	address string
+	service string
+}
+
+//
+func (is ICAPScanner) Name() string {
+	return "icap://" + is.address + "/" + is.service
+}
+
+//
+func (is ICAPScanner) Scan(fpath string) (ScanResult, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer f.Close()
+	conn, err := net.DialTimeout("tcp", is.address, time.Second*10)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(scanTimeout))
+
+	resHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+	bw := bufio.NewWriter(conn)
+	bw.WriteString("RESPMOD " + is.Name() + " ICAP/1.0\r\n")
+	bw.WriteString("Host: " + is.address + "\r\n")
+	bw.WriteString("Allow: 204\r\n")
+	bw.WriteString("Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(resHdr)) + "\r\n\r\n")
+	bw.WriteString(resHdr)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			bw.WriteString(strconv.FormatInt(int64(n), 16) + "\r\n")
+			bw.Write(buf[:n])
+			bw.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, err
+		}
+	}
+	bw.WriteString("0\r\n\r\n")
+	if err := bw.Flush(); err != nil {
+		return ScanResult{}, err
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	status, err := tp.ReadLine()
+	if err != nil {
+		return ScanResult{}, err
+	}
+	header, _ := tp.ReadMIMEHeader()
+	parts := strings.SplitN(status, " ", 3)
+	if len(parts) < 2 {
+		return ScanResult{}, E("invalid ICAP response '" + status + "'")
+	}
+	switch parts[1] {
+	case "204":
+		return ScanResult{Clean: true}, nil
+	case "200":
+		for _, item := range []string{"X-Infection-Found", "X-Virus-Id", "X-Violations-Found"} {
+			if v := header.Get(item); len(v) > 0 {
+				return ScanResult{Clean: false, Reason: v}, nil
+			}
+		}
+		return ScanResult{Clean: true}, nil
+	}
+	return ScanResult{}, E("ICAP server responded '" + status + "'")
+}
+
+//
+//
+
+// ScanJob is a run of the scanners started from /api/admin/scan. It is kept in the cache so that
+// every node of a cluster can report on it.
+type ScanJob struct {
+	ID        string                   `json:"id"`
+	Path      string                   `json:"path"`
+	Started   string                   `json:"started"`
+	Finished  string                   `json:"finished"`
+	Results   []map[string]interface{} `json:"results"`
+	Truncated bool                     `json:"truncated"`
+}
+
+// 1 while a scan started from the API runs on this node, scanners are slow enough that one at a
+// time is plenty
+var scanRunning int32
+
+func saveScanJob(job *ScanJob) {
+	bytes, _ := json.Marshal(job)
+	cache.Set("scan:"+job.ID, string(bytes), scanJobTTL)
+}
+
+// runScanJob scans every file below full, saving the results as it goes
+func runScanJob(job *ScanJob, full string) {
+	defer atomic.StoreInt32(&scanRunning, 0)
+	filepath.Walk(full, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if len(job.Results) == maxScanFiles {
+			job.Truncated = true
+			return io.EOF
+		}
+		res, err := runScanners(p)
+		item := map[string]interface{}{
+			"path":   filepath.ToSlash(strings.TrimPrefix(p, filepath.Clean(rootDir.Base()))),
+			"clean":  res.Clean,
+			"reason": res.Reason,
+		}
+		if err != nil {
+			item["error"] = err.Error()
+		} else if !res.Clean {
+			LogError("[scan]", item["path"], res.Reason)
+		}
+		job.Results = append(job.Results, item)
+		saveScanJob(job)
+		return nil
+	})
+	job.Finished = timeNow()
+	saveScanJob(job)
+	Log("[scan]", "Scanned", len(job.Results), "files in", job.Path)
+}
+
+// handler for http://andesite/api/admin/scan
+func handleScanAPI(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "path", Kind: FieldPath})
+	if !ok {
+		return
+	}
+	if len(scanners) == 0 {
+		writeAPIResponse(r, w, false, "No scanners are configured")
+		return
+	}
+	full, err := resolvePath(rootDir.Base(), vf.Get("path"))
+	if err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&scanRunning, 0, 1) {
+		writeAPIResponse(r, w, false, "A scan is already running")
+		return
+	}
+	job := &ScanJob{
+		ID:      F("%x", securecookie.GenerateRandomKey(16)),
+		Path:    vf.Get("path"),
+		Started: timeNow(),
+		Results: []map[string]interface{}{},
+	}
+	saveScanJob(job)
+	go runScanJob(job, full)
+	auditLog(r, admin.snowflake, "scan.start", job.Path, "")
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"id":       job.ID,
+	})
+}
+
+// handler for http://andesite/api/admin/scan/status
+func handleScanStatus(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	v, ok := cache.Get("scan:" + r.URL.Query().Get("id"))
+	job := ScanJob{}
+	if !ok || json.Unmarshal([]byte(v), &job) != nil {
+		writeAPIResponse(r, w, false, "Unknown or expired scan")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"response":  "good",
+		"path":      job.Path,
+		"started":   job.Started,
+		"finished":  job.Finished,
+		"done":      len(job.Finished) > 0,
+		"results":   job.Results,
+		"truncated": job.Truncated,
+	})
+}
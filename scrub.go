@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+const (
+	// every file with a checksum is read again this often unless "scrub.every" says otherwise
+	defaultScrubEvery = time.Hour * 24 * 30
+	// the scrubber reads at most this many KiB a second unless "scrub.speed_kbps" says otherwise,
+	// so that it does not get in the way of downloads
+	defaultScrubSpeedKB = 10240
+	// how often the scrubber looks for files that are due
+	scrubCheckEvery = time.Hour
+)
+
+// CorruptFile is a file whose contents no longer match its checksum while its size and
+// modification time are unchanged
+type CorruptFile struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Detected string `json:"detected"`
+}
+
+func validateScrubConfig(cfg *Config) error {
+	if cfg.Scrub.SpeedKB < 0 {
+		return E("scrub.speed_kbps must not be negative")
+	}
+	if len(cfg.Scrub.Every) > 0 {
+		d, err := time.ParseDuration(cfg.Scrub.Every)
+		if err != nil || d < time.Hour {
+			return E(F("Invalid scrub.every '%s', must be a duration of at least 1h", cfg.Scrub.Every))
+		}
+	}
+	return nil
+}
+
+func scrubEvery() time.Duration {
+	if d, err := time.ParseDuration(config.Scrub.Every); err == nil && len(config.Scrub.Every) > 0 {
+		return d
+	}
+	return defaultScrubEvery
+}
+
+func scrubSpeed() int64 {
+	if config.Scrub.SpeedKB == 0 {
+		return defaultScrubSpeedKB * 1024
+	}
+	return config.Scrub.SpeedKB * 1024
+}
+
+// queryCorruptFiles returns every file the scrubber found not to match its checksum
+func queryCorruptFiles() []CorruptFile {
+	result := []CorruptFile{}
+	rows, err := database.QueryPrepared(false, "select path, sha256, corrupt, coalesce(verified, '') from checksums where coalesce(corrupt, '') != '' order by path")
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		var v CorruptFile
+		rows.Scan(&v.Path, &v.Expected, &v.Actual, &v.Detected)
+		result = append(result, v)
+	}
+	rows.Close()
+	return result
+}
+
+// scrubFile reads fpath again and compares it to its stored checksum. Files that changed since
+// the checksum was computed have it deleted instead, it is computed again when next needed.
+func scrubFile(fpath string, sum ChecksumRow) {
+	info, err := rootDir.Stat(fpath)
+	if err != nil || info.IsDir() || !sum.current(info) {
+		forgetChecksums(fpath)
+		return
+	}
+	file, err := rootDir.ReadFile(fpath)
+	if err != nil {
+		LogError("[scrub]", fpath, err.Error())
+		database.QueryPrepared(true, "update checksums set verified = ? where path = ?", timeNow(), fpath)
+		return
+	}
+	if c, ok := file.(io.Closer); ok {
+		defer c.Close()
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, throttle(file, scrubSpeed())); err != nil {
+		LogError("[scrub]", fpath, err.Error())
+		database.QueryPrepared(true, "update checksums set verified = ? where path = ?", timeNow(), fpath)
+		return
+	}
+	// a file written to while it was read is not corrupt, just changed
+	if after, err := rootDir.Stat(fpath); err != nil || !sum.current(after) {
+		forgetChecksums(fpath)
+		return
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual == sum.sha256 {
+		database.QueryPrepared(true, "update checksums set verified = ? where path = ?", timeNow(), fpath)
+		return
+	}
+	database.QueryPrepared(true, "update checksums set verified = ?, corrupt = ? where path = ?", timeNow(), actual, fpath)
+	LogError("[scrub]", fpath, "does not match its checksum, expected", sum.sha256, "but read", actual)
+	fireFileEvent(FileEventCorrupt, fpath)
+	alertAdmins("integrity", "alert_integrity", map[string]interface{}{
+		"path":     fpath,
+		"expected": sum.sha256,
+		"actual":   actual,
+	})
+}
+
+// corruptReplaced returns true if the corrupt file was deleted or changed since it was found
+func corruptReplaced(item CorruptFile) bool {
+	sum, ok := queryChecksum(item.Path)
+	info, err := rootDir.Stat(item.Path)
+	return !ok || err != nil || !sum.current(info)
+}
+
+// scrubDue checks every file that was last verified longer than scrubEvery ago, oldest first
+func scrubDue() {
+	start := time.Now()
+	checked := 0
+	for _, item := range queryCorruptFiles() {
+		if corruptReplaced(item) {
+			forgetChecksums(item.Path)
+		}
+	}
+	for {
+		cutoff := time.Now().UTC().Add(-scrubEvery()).Format(time.RFC3339)
+		rows, err := database.QueryPrepared(false, "select path, size, mtime, sha256, md5 from checksums where coalesce(corrupt, '') = '' and coalesce(verified, '') < ? order by coalesce(verified, '') limit 100", cutoff)
+		if err != nil {
+			return
+		}
+		due := map[string]ChecksumRow{}
+		for rows.Next() {
+			var p string
+			var v ChecksumRow
+			rows.Scan(&p, &v.size, &v.mtime, &v.sha256, &v.md5)
+			due[p] = v
+		}
+		rows.Close()
+		if len(due) == 0 {
+			break
+		}
+		for p, v := range due {
+			if !checksumsEnabled(p) {
+				forgetChecksums(p)
+				continue
+			}
+			scrubFile(p, v)
+			checked++
+		}
+	}
+	if checked > 0 {
+		Log("[scrub]", "Verified", checked, "files in", time.Since(start).Round(time.Second).String())
+	}
+}
+
+// initScrubber reads every file with a stored checksum again on a schedule, to find those that
+// were damaged on disk without being changed
+func initScrubber() {
+	if config.Scrub.Disabled {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(scrubCheckEvery)
+			scrubDue()
+		}
+	}()
+}
+
+//
+//
+
+// handler for http://andesite/api/admin/integrity
+func handleIntegrityList(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	// files that were replaced since, such as from a backup, are no longer corrupt, their
+	// checksums are forgotten by the next run of the scrubber
+	result := []CorruptFile{}
+	for _, item := range queryCorruptFiles() {
+		if corruptReplaced(item) {
+			continue
+		}
+		result = append(result, item)
+	}
+	var total, verified int64
+	rows, err := database.QueryPrepared(false, "select count(*), coalesce(sum(case when coalesce(verified, '') >= ? then 1 else 0 end), 0) from checksums", time.Now().UTC().Add(-scrubEvery()).Format(time.RFC3339))
+	if err == nil {
+		if rows.Next() {
+			rows.Scan(&total, &verified)
+		}
+		rows.Close()
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"enabled":  !config.Scrub.Disabled,
+		"every":    scrubEvery().String(),
+		"total":    total,
+		"verified": verified,
+		"corrupt":  result,
+	})
+}
+
+// handler for http://andesite/api/admin/integrity/accept
+func handleIntegrityAccept(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "path", Kind: FieldString, MaxLen: 4096})
+	if !ok {
+		return
+	}
+	fpath := vf.Get("path")
+	if _, ok := queryChecksum(fpath); !ok {
+		writeAPIResponse(r, w, false, F("%s has no checksum", fpath))
+		return
+	}
+	forgetChecksums(fpath)
+	auditLog(r, admin.snowflake, "integrity.accept", fpath, "")
+	writeAPIResponse(r, w, true, F("The checksum of %s will be computed again from what is on disk now.", fpath))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+const (
+	BindIPOff    = ""
+	BindIPPrefix = "prefix"
+	BindIPExact  = "exact"
+
+	BindActionLogout = "logout"
+	BindActionLog    = "log"
+)
+
+func validateSessionBindingConfig(cfg *Config) error {
+	sb := &cfg.SessionBinding
+	switch sb.IP {
+	case BindIPOff, BindIPPrefix, BindIPExact:
+	default:
+		return E(F("Invalid session_binding.ip '%s', must be one of '%s', '%s'", sb.IP, BindIPPrefix, BindIPExact))
+	}
+	switch sb.Action {
+	case "":
+		sb.Action = BindActionLogout
+	case BindActionLogout, BindActionLog:
+	default:
+		return E(F("Invalid session_binding.action '%s', must be one of '%s', '%s'", sb.Action, BindActionLogout, BindActionLog))
+	}
+	return nil
+}
+
+func bindingHash(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sessionBindings returns the fingerprints a session is tied to for the client making r
+func sessionBindings(r *http.Request) map[string]string {
+	result := map[string]string{}
+	cfg := config.SessionBinding
+	if cfg.IP != BindIPOff {
+		ip := clientIP(r)
+		if pip := net.ParseIP(ip); pip != nil && cfg.IP == BindIPPrefix {
+			if v4 := pip.To4(); v4 != nil {
+				ip = v4.Mask(net.CIDRMask(24, 32)).String()
+			} else {
+				ip = pip.Mask(net.CIDRMask(48, 128)).String()
+			}
+		}
+		result["bind_ip"] = bindingHash(ip)
+	}
+	if cfg.UserAgent {
+		result["bind_ua"] = bindingHash(r.UserAgent())
+	}
+	return result
+}
+
+// bindSession ties a newly logged in session to the client
+func bindSession(r *http.Request, values map[interface{}]interface{}) {
+	for k, v := range sessionBindings(r) {
+		values[k] = v
+	}
+}
+
+// mwSessionBinding ends sessions that are used from a different IP or browser than they were
+// created in, when "session_binding" is enabled
+func mwSessionBinding(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess := getSession(r)
+		user, ok := sess.Values["user"].(string)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for k, v := range sessionBindings(r) {
+			bound, ok := sess.Values[k].(string)
+			if !ok {
+				// sessions from before binding was enabled are bound on their next request
+				sess.Values[k] = v
+				sess.Save(r, w)
+				continue
+			}
+			if bound == v {
+				continue
+			}
+			Log("[session-binding]", "mismatch", k, "user", user, "from", clientIPForStorage(r), config.SessionBinding.Action)
+			if config.SessionBinding.Action == BindActionLogout {
+				delete(sess.Values, "user")
+				delete(sess.Values, "name")
+				sess.Options.MaxAge = -1
+				sess.Save(r, w)
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/nektro/go-util/logger"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// loadSessionKey reads the key that signs sessions and tokens from session.key in dataDir,
+// creating it on first boot or when rotate is set, so that restarts do not log everyone out
+func loadSessionKey(rotate bool) ([]byte, error) {
+	fpath := dataDir + "/session.key"
+	if !rotate {
+		bytes, err := ioutil.ReadFile(fpath)
+		if err == nil {
+			if info, _ := os.Stat(fpath); info != nil && info.Mode().Perm()&0077 != 0 {
+				log.Log(logger.LevelWARN, "Session key was readable by other users, changing permissions to 0600")
+				os.Chmod(fpath, 0600)
+			}
+			key, err := hex.DecodeString(strings.TrimSpace(string(bytes)))
+			if err != nil || len(key) < 32 {
+				return nil, E(F("Invalid session key in '%s', fix it or start with --rotate-session-key", fpath))
+			}
+			return key, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	key := securecookie.GenerateRandomKey(32)
+	if err := ioutil.WriteFile(fpath, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	log.Log(logger.LevelINFO, "Generated a new session key, all existing sessions have been logged out")
+	return key, nil
+}
+
+// initSessionKey switches the cookie store over to the persistent key
+func initSessionKey(rotate bool) error {
+	key, err := loadSessionKey(rotate)
+	if err != nil {
+		return err
+	}
+	randomKey = key
+	store = sessions.NewCookieStore(randomKey)
+	return nil
+}
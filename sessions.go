@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+const (
+	// how often the last seen time of a session is written, to keep requests from all writing
+	sessionSeenEvery = time.Minute
+	// sessions not seen for this long are removed, the same as the lifetime of the cookie
+	sessionStaleAfter = time.Hour * 24 * 30
+	maxUserAgentLen   = 256
+	// sessions known to be live are not looked up again for this long, so a revoked session on
+	// another node of a cluster lasts at most this much longer
+	sessionCacheTTL = sessionSeenEvery
+)
+
+// SessionRow is the server-side record of a logged in session
+type SessionRow struct {
+	id      int
+	sid     string
+	user    int
+	created string
+	seen    string
+	ip      string
+	agent   string
+}
+
+func scanSession(rows *sql.Rows) SessionRow {
+	var v SessionRow
+	rows.Scan(&v.id, &v.sid, &v.user, &v.created, &v.seen, &v.ip, &v.agent)
+	return v
+}
+
+func querySessionBySID(sid string) (SessionRow, bool) {
+	rows, err := database.QueryPrepared(false, "select * from sessions where sid = ?", sid)
+	if err != nil {
+		return SessionRow{}, false
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return SessionRow{}, false
+	}
+	return scanSession(rows), true
+}
+
+func querySessionsOf(uid int) []SessionRow {
+	result := []SessionRow{}
+	rows, err := database.QueryPrepared(false, "select * from sessions where user = ? order by seen desc", uid)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		result = append(result, scanSession(rows))
+	}
+	rows.Close()
+	return result
+}
+
+// recordSession starts the server-side record of the session of user, in sess.Values["sid"]
+func recordSession(r *http.Request, values map[interface{}]interface{}, snowflake string) {
+	user, ok := queryUserBySnowflake(snowflake)
+	if !ok {
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	sid := hex.EncodeToString(b)
+	agent := r.UserAgent()
+	if len(agent) > maxUserAgentLen {
+		agent = agent[:maxUserAgentLen]
+	}
+	now := timeNow()
+	id, err := database.QueryNextID("sessions")
+	if err != nil {
+		return
+	}
+	database.QueryPrepared(true, "insert into sessions (id, sid, user, created, seen, ip, agent) values (?, ?, ?, ?, ?, ?, ?)", id, sid, user.id, now, now, clientIPForStorage(r), agent)
+	values["sid"] = sid
+}
+
+// deleteSessions removes the records of the sessions matching where, and then their cached status
+// so that they end on their next request
+func deleteSessions(where string, args ...interface{}) {
+	sids := []string{}
+	rows, err := database.QueryPrepared(false, "select sid from sessions where "+where, args...)
+	if err == nil {
+		for rows.Next() {
+			var sid string
+			rows.Scan(&sid)
+			sids = append(sids, sid)
+		}
+		rows.Close()
+	}
+	database.QueryPrepared(true, "delete from sessions where "+where, args...)
+	for _, item := range sids {
+		cache.Delete("session:" + item)
+	}
+}
+
+// mwSessionRecord ends sessions whose record was revoked, and keeps the last seen time of the
+// others up to date. Sessions from before records were kept are given one.
+func mwSessionRecord(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess := getSession(r)
+		user, ok := sess.Values["user"].(string)
+		sid, hasSID := sess.Values["sid"].(string)
+		if !ok {
+			if hasSID {
+				// logged out by something else, such as session binding or the auth proxy
+				deleteSessions("sid = ?", sid)
+				delete(sess.Values, "sid")
+				sess.Save(r, w)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !hasSID {
+			recordSession(r, sess.Values, user)
+			sess.Save(r, w)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := cache.Get("session:" + sid); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sr, found := querySessionBySID(sid)
+		if !found {
+			Log("[session]", "revoked session of", user, "used from", clientIPForStorage(r))
+			delete(sess.Values, "user")
+			delete(sess.Values, "name")
+			delete(sess.Values, "sid")
+			sess.Options.MaxAge = -1
+			sess.Save(r, w)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if seen, err := time.Parse(time.RFC3339, sr.seen); err != nil || time.Since(seen) > sessionSeenEvery {
+			database.QueryPrepared(true, "update sessions set seen = ?, ip = ? where id = ?", timeNow(), clientIPForStorage(r), sr.id)
+		}
+		cache.Set("session:"+sid, sr.seen, sessionCacheTTL)
+		next.ServeHTTP(w, r)
+	}
+}
+
+// initSessionPurger removes the records of sessions whose cookies have expired
+func initSessionPurger() {
+	go func() {
+		for {
+			cutoff := time.Now().UTC().Add(-sessionStaleAfter).Format(time.RFC3339)
+			deleteSessions("seen < ?", cutoff)
+			// baskets go with the session they were filled in
+			database.QueryPrepared(true, "delete from basket where sid not in (select sid from sessions)")
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func sessionList(rows []SessionRow, current string) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, item := range rows {
+		result = append(result, map[string]interface{}{
+			"sid":     item.sid,
+			"created": item.created,
+			"seen":    item.seen,
+			"ip":      item.ip,
+			"agent":   item.agent,
+			"current": item.sid == current,
+		})
+	}
+	return result
+}
+
+//
+//
+
+// handler for http://andesite/sessions
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	sess, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		return
+	}
+	list := userSessionList(sess, user)
+	if wantsJSON(r) {
+		writeJSON(w, map[string]interface{}{
+			"response": "good",
+			"sessions": list,
+		})
+		return
+	}
+	writeHandlebarsFile(r, w, "/sessions.hbs", map[string]interface{}{
+		"user":     user.snowflake,
+		"base":     httpBase,
+		"name":     displayName(user.snowflake, user.name),
+		"admin":    user.admin,
+		"sessions": list,
+	})
+}
+
+// userSessionList is what /sessions lists of the sessions of user, marking sess as the current
+// one, which /me includes
+func userSessionList(sess *sessions.Session, user UserRow) []map[string]interface{} {
+	current, _ := sess.Values["sid"].(string)
+	return sessionList(querySessionsOf(user.id), current)
+}
+
+// handler for http://andesite/api/account/sessions/revoke
+func handleSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	sess, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "sid", Kind: FieldString, MaxLen: 32, Optional: true},
+		FormField{Name: "others", Kind: FieldBool, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	current, _ := sess.Values["sid"].(string)
+	if vf.Bool("others") {
+		deleteSessions("user = ? and sid != ?", user.id, current)
+		auditLog(r, user.snowflake, "session.revoke", user.snowflake, "all others")
+		writeAPIResponse(r, w, true, "Logged out of every other session.")
+		return
+	}
+	sr, found := querySessionBySID(vf.Get("sid"))
+	if !found || sr.user != user.id {
+		writeAPIResponse(r, w, false, "Session does not exist")
+		return
+	}
+	deleteSessions("id = ?", sr.id)
+	auditLog(r, user.snowflake, "session.revoke", user.snowflake, sr.ip+" "+sr.agent)
+	writeAPIResponse(r, w, true, "Logged out of the session.")
+}
+
+// handler for http://andesite/api/admin/sessions
+func handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	user, ok := queryUserBySnowflake(r.URL.Query().Get("snowflake"))
+	if !ok {
+		writeAPIResponse(r, w, false, "User does not exist")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"sessions": sessionList(querySessionsOf(user.id), ""),
+	})
+}
+
+// handler for http://andesite/api/admin/sessions/revoke
+func handleAdminSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128},
+		FormField{Name: "sid", Kind: FieldString, MaxLen: 32, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	user, ok := queryUserBySnowflake(vf.Get("snowflake"))
+	if !ok {
+		writeAPIResponse(r, w, false, "User does not exist")
+		return
+	}
+	if vf.Has("sid") {
+		sr, found := querySessionBySID(vf.Get("sid"))
+		if !found || sr.user != user.id {
+			writeAPIResponse(r, w, false, "Session does not exist")
+			return
+		}
+		deleteSessions("id = ?", sr.id)
+		auditLog(r, admin.snowflake, "session.revoke", user.snowflake, sr.ip+" "+sr.agent)
+		writeAPIResponse(r, w, true, F("Logged %s out of the session.", user.snowflake))
+		return
+	}
+	if !requireConfirmation(r, w, admin, []string{F("Log %s (%s) out of every session", user.name, user.snowflake)}) {
+		return
+	}
+	deleteSessions("user = ?", user.id)
+	auditLog(r, admin.snowflake, "session.revoke", user.snowflake, "all")
+	writeAPIResponse(r, w, true, F("Logged %s out everywhere.", user.snowflake))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	. "github.com/nektro/go-util/util"
+)
+
+// linkPreviewers are parts of the User-Agent of the bots chat apps and social sites send to
+// unfurl a pasted link
+var linkPreviewers = []string{
+	"discordbot",
+	"slackbot",
+	"slack-imgproxy",
+	"twitterbot",
+	"facebookexternalhit",
+	"telegrambot",
+	"whatsapp",
+	"linkedinbot",
+	"mastodon",
+	"skypeuripreview",
+	"redditbot",
+	"embedly",
+	"iframely",
+}
+
+// isLinkPreviewer returns true if r is from a bot looking for what to show of a pasted link
+func isLinkPreviewer(r *http.Request) bool {
+	agent := strings.ToLower(r.UserAgent())
+	for _, item := range linkPreviewers {
+		if strings.Contains(agent, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// shareMeta returns the OpenGraph and Twitter card properties of the share link page for qpath.
+// A share of a single image is previewed by the image itself, if the link allows downloading it,
+// everything else by the generated image of ?og=png.
+func shareMeta(r *http.Request, qpath string, uAccess []string, uID string, perms []string) map[string]interface{} {
+	title := path.Base(strings.TrimSuffix(qpath, "/"))
+	if title == "/" || title == "." {
+		title = "Shared files"
+	}
+	ss := shareSummary(uID, uAccess, qpath)
+	result := map[string]interface{}{
+		"title":       title,
+		"description": ss.Text,
+		"url":         fullHost(r) + httpBase + r.URL.Path[1:],
+		"image":       fullHost(r) + httpBase + r.URL.Path[1:] + "?og=png",
+		"image_size":  true,
+		"card":        "summary_large_image",
+	}
+	if ss.Files == 1 && len(ss.Previews) == 1 && Contains(perms, ShareDownload) {
+		result["image"] = fullHost(r) + ss.Previews[0] + "?og=image"
+		result["image_size"] = false
+	}
+	return result
+}
+
+// handleShareCard answers a link preview bot asking for a share of a single file with a page of
+// only its card, since the file itself has nothing for the bot to show
+func handleShareCard(w http.ResponseWriter, r *http.Request, qpath string, uAccess []string, uID string, perms []string) {
+	writeHandlebarsFile(r, w, "/share.hbs", map[string]interface{}{
+		"base": httpBase,
+		"path": qpath,
+		"href": httpBase + r.URL.Path[1:],
+		"og":   shareMeta(r, qpath, uAccess, uID, perms),
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// operations a share link may allow, shares from before these were added allow all of them
+const (
+	ShareBrowse   = "browse"
+	ShareDownload = "download"
+	ShareStream   = "stream"
+)
+
+var allSharePerms = []string{ShareBrowse, ShareDownload, ShareStream}
+
+// parseSharePerms normalizes a comma separated list of share operations. Empty means all.
+func parseSharePerms(v string) (string, error) {
+	found := map[string]bool{}
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(strings.ToLower(item))
+		if len(item) == 0 {
+			continue
+		}
+		if !Contains(allSharePerms, item) {
+			return "", E(F("'%s' is not one of browse, download, stream", item))
+		}
+		found[item] = true
+	}
+	if len(found) == 0 || len(found) == len(allSharePerms) {
+		return "", nil
+	}
+	result := []string{}
+	for k := range found {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return strings.Join(result, ","), nil
+}
+
+// querySharePerms returns the operations allowed by any of the rows of the share code
+func querySharePerms(code string) []string {
+	result := []string{}
+	for _, item := range queryAllSharesByCode(code) {
+		if item.expired() {
+			continue
+		}
+		if len(item.perms) == 0 {
+			return allSharePerms
+		}
+		for _, p := range strings.Split(item.perms, ",") {
+			if !Contains(result, p) {
+				result = append(result, p)
+			}
+		}
+	}
+	return result
+}
+
+// isStreamRequest returns true for file requests made by a media element in a page, rather than
+// by the user saving the file. It is only advisory: browsers send Sec-Fetch-Dest on their own and
+// pages can not change it, but any other client can send whatever it likes. Range is not looked
+// at, since download managers send it as much as players do.
+func isStreamRequest(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Dest") {
+	case "audio", "video", "track", "image":
+		return true
+	}
+	return false
+}
+
+// shareAllowsFile returns true if a share with perms may serve the file request r
+func shareAllowsFile(perms []string, r *http.Request) bool {
+	if Contains(perms, ShareDownload) {
+		return true
+	}
+	return Contains(perms, ShareStream) && isStreamRequest(r)
+}
+
+func writeShareForbidden(r *http.Request, w http.ResponseWriter, msg string) {
+	writeStatus(r, w, http.StatusForbidden)
+	writeResponse(r, w, "Forbidden", msg, "")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+const (
+	sharePreviewCount = 6
+	shareSummaryTTL   = time.Minute * 10
+)
+
+var previewExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+
+// ShareSummary describes what a share link contains below the directory being viewed
+type ShareSummary struct {
+	Files    int      `json:"files"`
+	Bytes    int64    `json:"bytes"`
+	Mostly   string   `json:"mostly"`
+	Text     string   `json:"text"`
+	Previews []string `json:"previews"`
+}
+
+// shareSummary totals the indexed files of the share under qpath, and picks the first few
+// images to preview. Results are cached since every file has to be stat'd for its size.
+func shareSummary(hash string, shares []string, qpath string) *ShareSummary {
+	key := "share_summary:" + hash + ":" + qpath
+	if v, ok := cache.Get(key); ok {
+		ss := &ShareSummary{}
+		if json.Unmarshal([]byte(v), ss) == nil {
+			return ss
+		}
+	}
+	ss := &ShareSummary{Previews: []string{}}
+	exts := map[string]int{}
+	images := []string{}
+	for _, item := range shares {
+		root := ""
+		switch {
+		case pathHasPrefix(qpath, item):
+			root = qpath
+		case pathHasPrefix(item, qpath):
+			root = item
+		default:
+			continue
+		}
+		q, err := database.QueryPrepared(false, "select * from files where substr(path,1,length(?)) = ?", root, root)
+		if err != nil {
+			continue
+		}
+		for q.Next() {
+			wf := scanFile(q)
+			if isHiddenPath(wf.Path) {
+				continue
+			}
+			info, err := rootDir.Stat(wf.Path)
+			if err != nil {
+				continue
+			}
+			ext := strings.ToLower(path.Ext(wf.Name))
+			ss.Files++
+			ss.Bytes += info.Size()
+			exts[ext]++
+			if previewExts[ext] {
+				images = append(images, wf.Path)
+			}
+		}
+		q.Close()
+	}
+	for ext, n := range exts {
+		if len(ext) > 1 && n*2 > ss.Files {
+			ss.Mostly = strings.ToUpper(ext[1:])
+		}
+	}
+	sort.Strings(images)
+	for _, item := range images {
+		if len(ss.Previews) == sharePreviewCount {
+			break
+		}
+		ss.Previews = append(ss.Previews, httpBase+"open/"+hash+item)
+	}
+	ss.Text = F("%d files, %s", ss.Files, byteCountIEC(ss.Bytes))
+	if ss.Files == 1 {
+		ss.Text = F("1 file, %s", byteCountIEC(ss.Bytes))
+	}
+	if len(ss.Mostly) > 0 {
+		ss.Text += ", mostly " + ss.Mostly
+	}
+	bytes, _ := json.Marshal(ss)
+	cache.Set(key, string(bytes), shareSummaryTTL)
+	return ss
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// userSpeedLimit is the most bytes per second user may download at over one connection, 0 is
+// unlimited
+func userSpeedLimit(user UserRow) int64 {
+	if user.quotaSpeed < 0 {
+		return config.Quotas.Speed
+	}
+	return user.quotaSpeed
+}
+
+// downloadSpeed is the speed limit of a download by user, or by a share link when isUser is false
+func downloadSpeed(user UserRow, isUser bool) int64 {
+	if isUser {
+		return userSpeedLimit(user)
+	}
+	return config.Quotas.Speed
+}
+
+// throttle wraps file so that it is read no faster than rate bytes per second, 0 leaves it as is
+func throttle(file io.ReadSeeker, rate int64) io.ReadSeeker {
+	if rate <= 0 || file == nil {
+		return file
+	}
+	return &ThrottledReader{ReadSeeker: file, rate: rate}
+}
+
+// ThrottledReader reads a file at a fixed rate, for a single download. Unlike ThrottledWriter it
+// does not share its rate with other downloads of the same client.
+type ThrottledReader struct {
+	io.ReadSeeker
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+//
+func (tr *ThrottledReader) Read(b []byte) (int, error) {
+	if tr.start.IsZero() {
+		tr.start = time.Now()
+	}
+	// small reads keep the rate smooth instead of sending a burst and then waiting
+	if max := int(tr.rate / 4); len(b) > max && max > 0 {
+		b = b[:max]
+	}
+	if len(b) > 32*1024 {
+		b = b[:32*1024]
+	}
+	n, err := tr.ReadSeeker.Read(b)
+	tr.read += int64(n)
+	due := time.Duration(float64(tr.read) / float64(tr.rate) * float64(time.Second))
+	if wait := due - time.Since(tr.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// throttleWriter wraps w so that it is written to no faster than rate bytes per second, for
+// downloads such as archives that are built as they are sent. 0 leaves it as is.
+func throttleWriter(w http.ResponseWriter, rate int64) http.ResponseWriter {
+	if rate <= 0 {
+		return w
+	}
+	return &ThrottledResponse{ResponseWriter: w, rate: rate}
+}
+
+// ThrottledResponse writes a single download at a fixed rate, as ThrottledReader reads one
+type ThrottledResponse struct {
+	http.ResponseWriter
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+//
+func (tr *ThrottledResponse) Write(b []byte) (int, error) {
+	if tr.start.IsZero() {
+		tr.start = time.Now()
+	}
+	total := 0
+	for len(b) > 0 {
+		chunk := b
+		if max := int(tr.rate / 4); len(chunk) > max && max > 0 {
+			chunk = chunk[:max]
+		}
+		if len(chunk) > 32*1024 {
+			chunk = chunk[:32*1024]
+		}
+		n, err := tr.ResponseWriter.Write(chunk)
+		total += n
+		tr.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		due := time.Duration(float64(tr.written) / float64(tr.rate) * float64(time.Second))
+		if wait := due - time.Since(tr.start); wait > 0 {
+			time.Sleep(wait)
+		}
+		b = b[n:]
+	}
+	return total, nil
+}
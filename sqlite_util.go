@@ -2,30 +2,56 @@ package main
 
 import (
 	"database/sql"
+	"regexp"
 	"strconv"
 
 	. "github.com/nektro/go-util/alias"
 	. "github.com/nektro/go-util/util"
 )
 
+var sqlIdentifierRegex = regexp.MustCompile("^[a-z_]+$")
+
+// the columns read by scanUser, users that never logged in have no last_login and users that
+// never gave an address have no email
+const userColumns = "id, snowflake, admin, name, provider, coalesce(last_login, ''), coalesce(email, ''), coalesce(quota_storage, -1), coalesce(quota_bandwidth, -1), coalesce(quota_speed, -1), coalesce(stored, 0), coalesce(enabled, 1), coalesce(suspend_reason, '')"
+
 func scanUser(rows *sql.Rows) UserRow {
 	var v UserRow
-	rows.Scan(&v.id, &v.snowflake, &v.admin, &v.name)
+	rows.Scan(&v.id, &v.snowflake, &v.admin, &v.name, &v.provider, &v.lastLogin, &v.email, &v.quotaStorage, &v.quotaBandwidth, &v.quotaSpeed, &v.stored, &v.enabled, &v.suspendReason)
 	return v
 }
 
+const accessColumns = "id, user, path, coalesce(perms, '')"
+
 func scanAccessRow(rows *sql.Rows) UserAccessRow {
 	var v UserAccessRow
-	rows.Scan(&v.id, &v.user, &v.path)
+	rows.Scan(&v.id, &v.user, &v.path, &v.perms)
 	return v
 }
 
 //
 //
 
+// queryAccessGrants returns the access rows of user along with what each allows
+func queryAccessGrants(user UserRow) []UserAccessRow {
+	result := []UserAccessRow{}
+	rows, err := database.QueryPrepared(false, "select "+accessColumns+" from access where user = ?", user.id)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		result = append(result, scanAccessRow(rows))
+	}
+	rows.Close()
+	return result
+}
+
 func queryAccess(user UserRow) []string {
 	result := []string{}
-	rows := database.Query(false, F("select * from access where user = '%d'", user.id))
+	rows, err := database.QueryPrepared(false, "select "+accessColumns+" from access where user = ?", user.id)
+	if err != nil {
+		return result
+	}
 	for rows.Next() {
 		result = append(result, scanAccessRow(rows).path)
 	}
@@ -35,31 +61,53 @@ func queryAccess(user UserRow) []string {
 
 func queryUserBySnowflake(snowflake string) (UserRow, bool) {
 	var ur UserRow
-	rows := database.Query(false, F("select * from users where snowflake = '%s'", oauth2Provider.dbp+snowflake))
+	provider, stored := dbSnowflake(snowflake)
+	rows, err := database.QueryPrepared(false, "select "+userColumns+" from users where provider = ? and snowflake = ?", provider, stored)
+	if err != nil {
+		return ur, false
+	}
 	if !rows.Next() {
 		return ur, false
 	}
 	ur = scanUser(rows)
 	rows.Close()
-	ur.snowflake = ur.snowflake[len(oauth2Provider.dbp):]
+	ur.snowflake = externalSnowflake(ur.provider, ur.snowflake)
 	return ur, true
 }
 
 func queryUserByID(id int) (UserRow, bool) {
 	var ur UserRow
-	rows := database.Query(false, F("select * from users where id = '%d'", id))
+	rows, err := database.QueryPrepared(false, "select "+userColumns+" from users where id = ?", id)
+	if err != nil {
+		return ur, false
+	}
 	if !rows.Next() {
 		return ur, false
 	}
-	rows.Scan(&ur.id, &ur.snowflake, &ur.admin, &ur.name)
+	ur = scanUser(rows)
 	rows.Close()
-	ur.snowflake = ur.snowflake[len(oauth2Provider.dbp):]
+	ur.snowflake = externalSnowflake(ur.provider, ur.snowflake)
 	return ur, true
 }
 
+func queryAccessByID(id int) (UserAccessRow, bool) {
+	rows, err := database.QueryPrepared(false, "select "+accessColumns+" from access where id = ?", id)
+	if err != nil {
+		return UserAccessRow{}, false
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return UserAccessRow{}, false
+	}
+	return scanAccessRow(rows), true
+}
+
 func queryAllAccess() []map[string]string {
 	var result []map[string]string
-	rows := database.Query(false, "select * from access")
+	rows, err := database.Query(false, "select "+accessColumns+" from access")
+	if err != nil {
+		return result
+	}
 	accs := []UserAccessRow{}
 	for rows.Next() {
 		accs = append(accs, scanAccessRow(rows))
@@ -77,47 +125,112 @@ func queryAllAccess() []map[string]string {
 			"snowflake": ids[uar.user][0],
 			"name":      ids[uar.user][1],
 			"path":      uar.path,
+			"perms":     uar.perms,
 		})
 	}
 	return result
 }
 
 func queryDoAddUser(id int, snowflake string, admin bool, name string) {
-	database.QueryPrepared(true, F("insert into users values ('%d', '%s', '%s', ?)", id, oauth2Provider.dbp+snowflake, boolToString(admin)), name)
+	provider, stored := dbSnowflake(snowflake)
+	database.QueryPrepared(true, "insert into users (id, snowflake, admin, name, provider) values (?, ?, ?, ?, ?)", id, stored, boolToString(admin), name, provider)
+}
+
+// queryMigrateUserProviders fills in the provider of users from before it was stored, and makes
+// (provider, snowflake) unique
+func queryMigrateUserProviders(tx Tx) error {
+	rows, err := tx.Query("select id, snowflake from users where provider is null or provider = ''")
+	if err != nil {
+		return err
+	}
+	found := map[int]string{}
+	for rows.Next() {
+		var id int
+		var stored string
+		rows.Scan(&id, &stored)
+		found[id] = storedProvider(stored)
+	}
+	rows.Close()
+	for id, provider := range found {
+		if _, err := tx.Exec("update users set provider = ? where id = ?", provider, id); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("create unique index if not exists users_provider_snowflake on users (provider, snowflake)")
+	return err
 }
 
+// queryDoUpdate binds the values, the table and column names can not be bound so they must be
+// plain identifiers from our own code
 func queryDoUpdate(table string, col string, value string, where string, search string) {
+	for _, item := range []string{table, col, where} {
+		if !sqlIdentifierRegex.MatchString(item) {
+			LogError("[sql]", F("refusing to update with identifier '%s'", item))
+			return
+		}
+	}
 	database.QueryPrepared(true, F("update %s set %s = ? where %s = ?", table, col, where), value, search)
 }
 
-func queryAssertUserName(snowflake string, name string) {
-	_, ok := queryUserBySnowflake(snowflake)
+// queryAssertUserName saves the name of the user, adding them if they are new. It returns true
+// if this is their first login, users added by an admin or an access grant have not logged in
+// until then.
+func queryAssertUserName(snowflake string, name string) (bool, error) {
+	ur, ok := queryUserBySnowflake(snowflake)
 	if ok {
-		queryDoUpdate("users", "name", name, "snowflake", oauth2Provider.dbp+snowflake)
+		queryDoUpdate("users", "name", name, "id", strconv.Itoa(ur.id))
+		return len(ur.lastLogin) == 0, nil
 	} else {
-		uid := database.QueryNextID("users")
+		first := queryCount("select count(*) from users") == 0
+		uid, err := database.QueryNextID("users")
+		if err != nil {
+			return false, err
+		}
 		queryDoAddUser(uid, snowflake, false, name)
 
-		if uid == 0 {
+		if first {
 			// always admin first user
-			database.QueryDoUpdate("users", "admin", "1", "id", "0")
-			aid := database.QueryNextID("access")
-			database.Query(true, F("insert into access values ('%d', '%d', '/')", aid, uid))
+			queryDoUpdate("users", "admin", "1", "id", strconv.Itoa(uid))
+			aid, err := database.QueryNextID("access")
+			if err != nil {
+				return true, err
+			}
+			database.QueryPrepared(true, "insert into access (id, user, path) values (?, ?, ?)", aid, uid, "/")
 			Log(F("Set user '%s's status to admin", snowflake))
+			auditLog(nil, "system", "user.update", snowflake, "admin=1, as the first user")
 		}
+		return true, nil
 	}
 }
 
+const shareColumns = "id, hash, path, coalesce(perms, ''), coalesce(creator, ''), coalesce(expires, '')"
+
+func scanShare(rows *sql.Rows) ShareRow {
+	var sr ShareRow
+	rows.Scan(&sr.id, &sr.hash, &sr.path, &sr.perms, &sr.creator, &sr.expires)
+	return sr
+}
+
+// expired returns true once the share is past its expiry, if it has one
+func (v ShareRow) expired() bool {
+	return len(v.expires) > 0 && v.expires < timeNow()
+}
+
 func queryAllShares() []map[string]string {
 	var result []map[string]string
-	rows := database.Query(false, "select * from shares")
+	rows, err := database.Query(false, "select "+shareColumns+" from shares")
+	if err != nil {
+		return result
+	}
 	for rows.Next() {
-		var sr ShareRow
-		rows.Scan(&sr.id, &sr.hash, &sr.path)
+		sr := scanShare(rows)
 		result = append(result, map[string]string{
-			"id":   strconv.Itoa(sr.id),
-			"hash": sr.hash,
-			"path": sr.path,
+			"id":      strconv.Itoa(sr.id),
+			"hash":    sr.hash,
+			"path":    sr.path,
+			"perms":   sr.perms,
+			"creator": sr.creator,
+			"expires": sr.expires,
 		})
 	}
 	rows.Close()
@@ -126,11 +239,12 @@ func queryAllShares() []map[string]string {
 
 func queryAllSharesByCode(code string) []ShareRow {
 	shrs := []ShareRow{}
-	rows := database.QueryPrepared(false, "select * from shares where hash = ?", code)
+	rows, err := database.QueryPrepared(false, "select "+shareColumns+" from shares where hash = ?", code)
+	if err != nil {
+		return shrs
+	}
 	for rows.Next() {
-		var sr ShareRow
-		rows.Scan(&sr.id, &sr.hash, &sr.path)
-		shrs = append(shrs, sr)
+		shrs = append(shrs, scanShare(rows))
 	}
 	rows.Close()
 	return shrs
@@ -139,7 +253,78 @@ func queryAllSharesByCode(code string) []ShareRow {
 func queryAccessByShare(code string) []string {
 	result := []string{}
 	for _, item := range queryAllSharesByCode(code) {
+		if item.expired() {
+			continue
+		}
 		result = append(result, item.path)
 	}
 	return result
 }
+
+func queryAllUsers() []UserRow {
+	result := []UserRow{}
+	rows, err := database.Query(false, "select "+userColumns+" from users order by id")
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		ur := scanUser(rows)
+		ur.snowflake = externalSnowflake(ur.provider, ur.snowflake)
+		result = append(result, ur)
+	}
+	rows.Close()
+	return result
+}
+
+// queryAccessCounts returns how many access grants each user id has
+func queryAccessCounts() map[int]int {
+	result := map[int]int{}
+	rows, err := database.Query(false, "select user, count(*) from access group by user")
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		var uid, n int
+		rows.Scan(&uid, &n)
+		result[uid] = n
+	}
+	rows.Close()
+	return result
+}
+
+func queryAdminCount() int {
+	n := 0
+	rows, err := database.Query(false, "select count(*) from users where admin = 1 and coalesce(enabled, 1) = 1")
+	if err != nil {
+		return 0
+	}
+	if rows.Next() {
+		rows.Scan(&n)
+	}
+	rows.Close()
+	return n
+}
+
+// queryDeleteUser removes a user and everything that belongs to them, including the share links
+// they created
+func queryDeleteUser(user UserRow) {
+	uid := user.id
+	database.QueryPrepared(true, "delete from basket where sid in (select sid from sessions where user = ?)", uid)
+	ups := []UploadRow{}
+	rows, err := database.QueryPrepared(false, "select "+uploadColumns+" from uploads where user = ?", uid)
+	if err == nil {
+		for rows.Next() {
+			ups = append(ups, scanUpload(rows))
+		}
+		rows.Close()
+	}
+	for _, item := range ups {
+		item.discard()
+	}
+	deleteSessions("user = ?", uid)
+	for _, table := range []string{"access", "passwords", "passkeys", "downloads", "access_requests", "stored_files"} {
+		database.QueryPrepared(true, F("delete from %s where user = ?", table), uid)
+	}
+	database.QueryPrepared(true, "delete from shares where creator = ?", user.snowflake)
+	database.QueryPrepared(true, "delete from users where id = ?", uid)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/nektro/go-util/util"
+)
+
+// walking the tree is slow, so the usage of each mount is measured in the background at most
+// this often
+const statsUsageEvery = time.Minute * 15
+
+// MountUsage is the bytes stored under a mount, as of Measured
+type MountUsage struct {
+	Path     string `json:"path"`
+	Bytes    int64  `json:"bytes"`
+	Backend  string `json:"backend"`
+	Measured int64  `json:"measured"`
+}
+
+var (
+	statsUsage     = map[string]MountUsage{}
+	statsUsageLock sync.Mutex
+	statsMeasuring int32
+)
+
+// mountUsages returns the last measured usage of every mount, starting a new measurement once
+// the last is older than statsUsageEvery
+func mountUsages() []MountUsage {
+	statsUsageLock.Lock()
+	result := []MountUsage{}
+	stale := len(statsUsage) == 0
+	for _, item := range indexMounts {
+		u, ok := statsUsage[item.Path]
+		if !ok {
+			u = MountUsage{Path: item.Path}
+		}
+		if time.Since(time.Unix(u.Measured, 0)) > statsUsageEvery {
+			stale = true
+		}
+		result = append(result, u)
+	}
+	statsUsageLock.Unlock()
+	if stale && atomic.CompareAndSwapInt32(&statsMeasuring, 0, 1) {
+		go measureMounts()
+	}
+	return result
+}
+
+func measureMounts() {
+	defer atomic.StoreInt32(&statsMeasuring, 0)
+	for _, item := range indexMounts {
+		n, backend, err := dirUsage(item.Path)
+		if err != nil {
+			LogError("[stats]", item.Path, err)
+			continue
+		}
+		statsUsageLock.Lock()
+		statsUsage[item.Path] = MountUsage{item.Path, n, backend, time.Now().Unix()}
+		statsUsageLock.Unlock()
+	}
+}
+
+func queryCount(query string, args ...interface{}) int64 {
+	var n int64
+	rows, err := database.QueryPrepared(false, query, args...)
+	if err != nil {
+		return 0
+	}
+	if rows.Next() {
+		rows.Scan(&n)
+	}
+	rows.Close()
+	return n
+}
+
+// serverStats puts together the numbers for the stats panel of the admin page
+func serverStats() map[string]interface{} {
+	index := getIndexStatus()
+	day := time.Now().UTC().Add(-time.Hour * 24).Format(time.RFC3339)
+	month := time.Now().UTC().AddDate(0, 0, -30).Format(time.RFC3339)
+	result := map[string]interface{}{
+		"index": index,
+		"users": map[string]interface{}{
+			"total":          queryCount("select count(*) from users"),
+			"admins":         queryCount("select count(*) from users where admin = 1"),
+			"active_30d":     queryCount("select count(*) from users where last_login >= ? or id in (select user from sessions where seen >= ?)", month, month),
+			"online_24h":     queryCount("select count(distinct user) from sessions where seen >= ?", day),
+			"with_passwords": queryCount("select count(*) from passwords"),
+		},
+		// links past their expiry stay in the table until they are deleted, but no longer work
+		"shares": queryCount("select count(*) from shares where coalesce(expires, '') = '' or expires > ?", timeNow()),
+		"downloads_24h": map[string]interface{}{
+			"count": queryCount("select count(*) from downloads where time >= ?", day),
+			"bytes": queryCount("select coalesce(sum(bytes),0) from downloads where time >= ?", day),
+			"users": queryCount("select count(distinct user) from downloads where time >= ?", day),
+		},
+		"mounts": mountUsages(),
+		// only the node running the index watches, the others report 0
+		"watcher": map[string]interface{}{"running": watcher != nil, "backlog": len(watchQueue), "capacity": cap(watchQueue)},
+	}
+	if len(index.State) > 0 {
+		result["files"] = queryCount("select count(*) from files")
+		// the size of the root from the stored directory sizes, which leave out the same hidden
+		// and ignored files as the index
+		result["bytes"] = queryCount("select coalesce(sum(size),0) from dir_sizes where path = '/'")
+	}
+	return result
+}
+
+//
+//
+
+// handler for http://andesite/api/stats
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	stats := serverStats()
+	stats["response"] = "good"
+	writeJSON(w, stats)
+}
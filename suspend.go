@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// suspendedMessage tells a suspended user why they can not use Andesite
+func suspendedMessage(user UserRow) string {
+	msg := "Your account has been suspended by an administrator."
+	if len(user.suspendReason) > 0 {
+		msg += " Reason: " + user.suspendReason
+	}
+	return msg
+}
+
+func writeSuspended(r *http.Request, w http.ResponseWriter, user UserRow) {
+	writeStatus(r, w, http.StatusForbidden)
+	writeResponse(r, w, "Account Suspended", suspendedMessage(user), "")
+}
+
+//
+//
+
+// handler for http://andesite/api/users/suspend
+func handleUserSuspend(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128},
+		FormField{Name: "reason", Kind: FieldString, MaxLen: 512, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	user, ok := queryUserBySnowflake(vf.Get("snowflake"))
+	if !ok {
+		writeAPIResponse(r, w, false, "User does not exist")
+		return
+	}
+	if user.id == admin.id {
+		writeAPIResponse(r, w, false, "You can not suspend yourself")
+		return
+	}
+	if user.admin && user.enabled && queryAdminCount() <= 1 {
+		writeAPIResponse(r, w, false, "Can not suspend the last administrator")
+		return
+	}
+	database.QueryPrepared(true, "update users set enabled = 0, suspend_reason = ? where id = ?", vf.Get("reason"), user.id)
+	// every session ends now, not when its cookie expires
+	deleteSessions("user = ?", user.id)
+	auditLog(r, admin.snowflake, "user.suspend", user.snowflake, vf.Get("reason"))
+	writeAPIResponse(r, w, true, F("Suspended %s and logged them out of every session.", user.snowflake))
+}
+
+// handler for http://andesite/api/users/unsuspend
+func handleUserUnsuspend(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128})
+	if !ok {
+		return
+	}
+	user, ok := queryUserBySnowflake(vf.Get("snowflake"))
+	if !ok {
+		writeAPIResponse(r, w, false, "User does not exist")
+		return
+	}
+	if user.enabled {
+		writeAPIResponse(r, w, false, F("%s is not suspended", user.snowflake))
+		return
+	}
+	database.QueryPrepared(true, "update users set enabled = 1, suspend_reason = null where id = ?", user.id)
+	auditLog(r, admin.snowflake, "user.unsuspend", user.snowflake, "")
+	writeAPIResponse(r, w, true, F("%s may log in again.", user.snowflake))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// values of "symlinks"
+const (
+	SymlinksDeny       = "deny"
+	SymlinksWithinRoot = "follow-within-root"
+	SymlinksAll        = "follow-all"
+)
+
+func validateSymlinkPolicy(cfg *Config) error {
+	switch cfg.Symlinks {
+	case "", SymlinksDeny, SymlinksWithinRoot, SymlinksAll:
+		return nil
+	}
+	return E(F("Invalid symlinks '%s', must be one of 'deny', 'follow-within-root', 'follow-all'", cfg.Symlinks))
+}
+
+// symlinkPolicy is "symlinks", links are followed within the root unless it says otherwise
+func symlinkPolicy() string {
+	if len(config.Symlinks) == 0 {
+		return SymlinksWithinRoot
+	}
+	return config.Symlinks
+}
+
+// checkSymlinks returns an error if a symlink in full, a location below base, is not allowed to
+// be followed. The error counts as os.IsNotExist, so that a refused link looks like nothing is
+// there. Links that loop are refused by every policy but "follow-all".
+func checkSymlinks(base string, full string) error {
+	refused := &os.PathError{Op: "symlink", Path: full, Err: os.ErrNotExist}
+	switch symlinkPolicy() {
+	case SymlinksAll:
+		return nil
+	case SymlinksDeny:
+		rel, err := filepath.Rel(base, full)
+		if err != nil || rel == "." {
+			return nil
+		}
+		p := base
+		for _, seg := range strings.Split(rel, string(filepath.Separator)) {
+			p = filepath.Join(p, seg)
+			info, err := os.Lstat(p)
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				return refused
+			}
+		}
+		return nil
+	}
+	real, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return err
+		}
+		return refused
+	}
+	realBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return err
+	}
+	if real != realBase && !strings.HasPrefix(real, realBase+string(filepath.Separator)) {
+		return refused
+	}
+	return nil
+}
+
+// filterSymlinks removes the entries of the directory full that are links the policy does not
+// allow following
+func filterSymlinks(base string, full string, files []os.FileInfo) []os.FileInfo {
+	if symlinkPolicy() == SymlinksAll {
+		return files
+	}
+	return filter(files, func(x os.FileInfo) bool {
+		return x.Mode()&os.ModeSymlink == 0 || checkSymlinks(base, filepath.Join(full, x.Name())) == nil
+	})
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// SyncClient mirrors a remote directory listing into a local directory
+type SyncClient struct {
+	http    *http.Client
+	cookie  string
+	delete  bool
+	limiter *BandwidthLimiter
+	wg      sync.WaitGroup
+	queue   chan syncJob
+	errs    int
+	errLock sync.Mutex
+}
+
+type syncJob struct {
+	url    string
+	local  string
+	size   int64
+	mtime  int64
+	sha256 string
+}
+
+type syncEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Mtime  int64  `json:"mtime"`
+	Type   string `json:"type"`
+	SHA256 string `json:"sha256"`
+}
+
+// syncStateName is the file in DEST that remembers where in the change journal the last sync
+// of a /files/ URL ended, so that the next one only looks at what changed since
+const syncStateName = ".andesite-sync"
+
+type syncState struct {
+	Remote string `json:"remote"`
+	Cursor int64  `json:"cursor"`
+}
+
+type syncChanges struct {
+	Response string       `json:"response"`
+	Message  string       `json:"message"`
+	Reset    bool         `json:"reset"`
+	Cursor   int64        `json:"cursor"`
+	More     bool         `json:"more"`
+	Changes  []FileChange `json:"changes"`
+}
+
+// runSync implements `andesite sync URL DEST`
+func runSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	flagCookie := fs.String("session", os.Getenv("ANDESITE_SESSION"), "Value of the 'session_andesite' cookie to authenticate with, not needed for share links")
+	flagParallel := fs.Int("parallel", 4, "Number of files to download at once")
+	flagLimit := fs.Int("limit", 0, "Total bandwidth cap in KiB/s, 0 for none")
+	flagDelete := fs.Bool("delete", false, "Remove local files that are no longer in the remote directory")
+	fs.Usage = func() {
+		Log("Usage: andesite sync [options] URL DEST")
+		Log("URL is a /files/ or /open/ directory, such as https://example.com/files/music/")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return E("sync requires a URL and a destination")
+	}
+	remote := fs.Arg(0)
+	if !strings.HasSuffix(remote, "/") {
+		remote += "/"
+	}
+	if *flagParallel < 1 {
+		*flagParallel = 1
+	}
+	sc := &SyncClient{
+		http:    &http.Client{},
+		cookie:  *flagCookie,
+		delete:  *flagDelete,
+		limiter: NewBandwidthLimiter(int64(*flagLimit) * 1024),
+		queue:   make(chan syncJob),
+	}
+	for i := 0; i < *flagParallel; i++ {
+		go sc.worker()
+	}
+	local := fs.Arg(1)
+	base, dir, journaled := splitFilesURL(remote)
+	var cursor int64 = -1
+	var err error
+	if journaled {
+		cursor, err = sc.syncChanges(base, dir, remote, local, readSyncState(local, remote))
+	} else {
+		err = sc.syncDir(remote, local, true)
+	}
+	sc.wg.Wait()
+	close(sc.queue)
+	if err != nil {
+		return err
+	}
+	if sc.errs > 0 {
+		return E(F("%d file(s) failed to sync", sc.errs))
+	}
+	if cursor >= 0 {
+		writeSyncState(local, syncState{remote, cursor})
+	}
+	Log("[sync]", "done")
+	return nil
+}
+
+// splitFilesURL splits a /files/ URL into the address of the server and the path of the
+// directory on it, ok is false for any other kind of URL
+func splitFilesURL(remote string) (string, string, bool) {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return "", "", false
+	}
+	p := u.EscapedPath()
+	i := strings.Index(p, "/files/")
+	if i < 0 {
+		return "", "", false
+	}
+	dir, err := url.PathUnescape(p[i+len("/files"):])
+	if err != nil {
+		return "", "", false
+	}
+	return u.Scheme + "://" + u.Host + p[:i], dir, true
+}
+
+// readSyncState returns the cursor the last sync of remote into local ended at, or -1 if
+// there was none
+func readSyncState(local string, remote string) int64 {
+	b, err := ioutil.ReadFile(filepath.Join(local, syncStateName))
+	if err != nil {
+		return -1
+	}
+	var st syncState
+	if json.Unmarshal(b, &st) != nil || st.Remote != remote {
+		return -1
+	}
+	return st.Cursor
+}
+
+func writeSyncState(local string, st syncState) {
+	b, _ := json.Marshal(st)
+	if err := ioutil.WriteFile(filepath.Join(local, syncStateName), b, 0644); err != nil {
+		LogError("[sync]", err)
+	}
+}
+
+// fetchChanges asks the server for the changes in dir since cursor, a cursor of -1 only asks
+// for the current one
+func (sc *SyncClient) fetchChanges(base string, dir string, cursor int64) (syncChanges, error) {
+	var result syncChanges
+	q := url.Values{}
+	q.Set("path", dir)
+	if cursor >= 0 {
+		q.Set("since", strconv.FormatInt(cursor, 10))
+	}
+	res, err := sc.get(base+"/api/changes?"+q.Encode(), nil)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return result, E(F("changes: %s", res.Status))
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return result, E("changes: the server does not keep a change journal")
+	}
+	if result.Response != "good" {
+		return result, E(F("changes: %s", result.Message))
+	}
+	return result, nil
+}
+
+// syncChanges brings local up to date with the changes made to dir since cursor, walking all of
+// it when the server no longer has them. It returns the cursor to start from next time, or -1
+// if the server does not keep a change journal.
+func (sc *SyncClient) syncChanges(base string, dir string, remote string, local string, cursor int64) (int64, error) {
+	for {
+		page, err := sc.fetchChanges(base, dir, cursor)
+		if err != nil {
+			if cursor >= 0 {
+				return -1, err
+			}
+			// an older server, or a URL that needs a session that was not given
+			return -1, sc.syncDir(remote, local, true)
+		}
+		if page.Reset {
+			// the cursor is taken before the walk so that nothing changed during it is missed
+			Log("[sync]", "listing", remote)
+			return page.Cursor, sc.syncDir(remote, local, true)
+		}
+		// folders to list once the page is applied, and whether to list everything in them
+		pending := map[string]bool{}
+		for _, item := range page.Changes {
+			rel := strings.TrimPrefix(item.Path, dir)
+			if len(rel) == 0 || rel == item.Path {
+				continue
+			}
+			switch item.Event {
+			case FileEventRemove:
+				for k := range pending {
+					if k == rel+"/" || strings.HasPrefix(k, rel+"/") {
+						delete(pending, k)
+					}
+				}
+				if sc.delete {
+					lpath := filepath.Join(local, filepath.FromSlash(rel))
+					Log("[sync]", "removing", lpath)
+					os.RemoveAll(lpath)
+				}
+			case FileEventAdd, FileEventModify:
+				if strings.HasSuffix(rel, "/") {
+					pending[rel] = true
+					continue
+				}
+				parent := rel[:strings.LastIndex(rel, "/")+1]
+				if _, ok := pending[parent]; !ok {
+					pending[parent] = false
+				}
+			}
+		}
+		for rel, recurse := range pending {
+			if err := sc.syncDir(remote+escapePath(rel), filepath.Join(local, filepath.FromSlash(rel)), recurse); err != nil {
+				return -1, err
+			}
+		}
+		cursor = page.Cursor
+		if !page.More {
+			return cursor, nil
+		}
+	}
+}
+
+// escapePath escapes every name in the slash separated path p for use in a URL
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, item := range parts {
+		parts[i] = url.PathEscape(item)
+	}
+	return strings.Join(parts, "/")
+}
+
+// fileSHA256 returns the hex SHA-256 of the local file at fpath
+func fileSHA256(fpath string) (string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (sc *SyncClient) get(u string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if len(sc.cookie) > 0 {
+		req.AddCookie(&http.Cookie{Name: sessionName, Value: sc.cookie})
+	}
+	return sc.http.Do(req)
+}
+
+// syncDir walks the remote listing, queueing every file that differs from the local copy, and
+// the folders in it too when recurse is set
+func (sc *SyncClient) syncDir(remote string, local string, recurse bool) error {
+	res, err := sc.get(remote+"?format=json", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return E(F("%s: %s", remote, res.Status))
+	}
+	var listing struct {
+		Response string      `json:"response"`
+		Message  string      `json:"message"`
+		Files    []syncEntry `json:"files"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&listing); err != nil {
+		return E(F("%s: not a directory listing", remote))
+	}
+	if listing.Response != "good" {
+		return E(F("%s: %s", remote, listing.Message))
+	}
+	if err := os.MkdirAll(local, os.ModePerm); err != nil {
+		return err
+	}
+	//
+	seen := map[string]bool{}
+	for _, item := range listing.Files {
+		if strings.ContainsAny(item.Name, "/\\") || item.Name == "." || item.Name == ".." {
+			continue
+		}
+		seen[item.Name] = true
+		u := remote + url.PathEscape(item.Name)
+		lpath := filepath.Join(local, item.Name)
+		if item.Type == "directory" {
+			if !recurse {
+				continue
+			}
+			if err := sc.syncDir(u+"/", lpath, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if info, err := os.Stat(lpath); err == nil && info.Size() == item.Size {
+			if info.ModTime().Unix() == item.Mtime {
+				continue
+			}
+			// the same content with another time, such as after a copy, only needs the time set
+			if len(item.SHA256) > 0 {
+				if sum, err := fileSHA256(lpath); err == nil && sum == item.SHA256 {
+					mtime := time.Unix(item.Mtime, 0)
+					os.Chtimes(lpath, mtime, mtime)
+					continue
+				}
+			}
+		}
+		sc.wg.Add(1)
+		sc.queue <- syncJob{u, lpath, item.Size, item.Mtime, item.SHA256}
+	}
+	if sc.delete {
+		files, _ := ioutil.ReadDir(local)
+		for _, item := range files {
+			if !seen[item.Name()] && !strings.HasSuffix(item.Name(), ".part") && item.Name() != syncStateName {
+				Log("[sync]", "removing", filepath.Join(local, item.Name()))
+				os.RemoveAll(filepath.Join(local, item.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+func (sc *SyncClient) worker() {
+	for job := range sc.queue {
+		if err := sc.download(job); err != nil {
+			LogError("[sync]", job.local, err)
+			sc.errLock.Lock()
+			sc.errs++
+			sc.errLock.Unlock()
+		}
+		sc.wg.Done()
+	}
+}
+
+// download fetches a file into NAME.part, resuming a previous partial download with a Range
+// request, and moves it into place once complete
+func (sc *SyncClient) download(job syncJob) error {
+	part := job.local + ".part"
+	var offset int64
+	if info, err := os.Stat(part); err == nil && info.Size() < job.size {
+		offset = info.Size()
+	}
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	res, err := sc.get(job.url, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		flags = os.O_WRONLY | os.O_APPEND
+	case http.StatusOK:
+		offset = 0
+	default:
+		return E(res.Status)
+	}
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, sc.limiter.Reader(res.Body))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if offset+n != job.size {
+		return E(F("expected %d bytes, got %d", job.size, offset+n))
+	}
+	if len(job.sha256) > 0 {
+		if sum, err := fileSHA256(part); err != nil || sum != job.sha256 {
+			// a resumed download that does not add up has to start over
+			os.Remove(part)
+			return E("the downloaded file does not match its checksum")
+		}
+	}
+	mtime := time.Unix(job.mtime, 0)
+	os.Chtimes(part, mtime, mtime)
+	Log("[sync]", job.local)
+	return os.Rename(part, job.local)
+}
+
+//
+//
+
+// BandwidthLimiter caps the combined read rate of every Reader it hands out
+type BandwidthLimiter struct {
+	sync.Mutex
+	rate int64
+	next time.Time
+}
+
+//
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	return &BandwidthLimiter{rate: bytesPerSecond}
+}
+
+// wait blocks until n more bytes may be transferred
+func (bl *BandwidthLimiter) wait(n int) {
+	if bl.rate <= 0 {
+		return
+	}
+	bl.Lock()
+	now := time.Now()
+	if bl.next.Before(now) {
+		bl.next = now
+	}
+	bl.next = bl.next.Add(time.Duration(int64(n) * int64(time.Second) / bl.rate))
+	until := bl.next
+	bl.Unlock()
+	time.Sleep(time.Until(until))
+}
+
+//
+func (bl *BandwidthLimiter) Reader(r io.Reader) io.Reader {
+	return &limitedReader{r, bl}
+}
+
+type limitedReader struct {
+	r  io.Reader
+	bl *BandwidthLimiter
+}
+
+func (lr *limitedReader) Read(b []byte) (int, error) {
+	if len(b) > 32*1024 {
+		b = b[:32*1024]
+	}
+	n, err := lr.r.Read(b)
+	lr.bl.wait(n)
+	return n, err
+}
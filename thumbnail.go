@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	_ "golang.org/x/image/webp"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// the longest side of a thumbnail
+const thumbSize = 240
+
+// images with more pixels than this are not decoded for a thumbnail, since the whole image has to
+// be held in memory
+const thumbMaxPixels = 50 * 1000 * 1000
+
+// handleThumbnail writes a small JPEG of the image qpath for the previews on share landing pages.
+// Thumbnails are cached in the cache directory by the path, size, and time of the image.
+func handleThumbnail(w http.ResponseWriter, r *http.Request, qpath string, info os.FileInfo) {
+	sum := sha256.Sum256([]byte(F("%s\n%d\n%d", qpath, info.Size(), info.ModTime().UnixNano())))
+	fpath := cacheDir + "/thumbs/" + hex.EncodeToString(sum[:]) + ".jpg"
+	data, err := ioutil.ReadFile(fpath)
+	if err == nil {
+		// the modification time is when it was last used, for pruneImageCache
+		now := time.Now()
+		os.Chtimes(fpath, now, now)
+	} else {
+		data, err = renderThumbnail(qpath)
+		if err != nil {
+			writeStatus(r, w, http.StatusUnsupportedMediaType)
+			writeResponse(r, w, "Unsupported Media Type", F("No thumbnail can be made of %s: %s", qpath, err.Error()), "")
+			return
+		}
+		os.MkdirAll(cacheDir+"/thumbs", os.ModePerm)
+		if err := ioutil.WriteFile(fpath, data, 0644); err != nil {
+			LogError("[thumbnail]", err.Error())
+		}
+		pruneImageCache(cacheDir + "/thumbs")
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(data)
+}
+
+func renderThumbnail(qpath string) ([]byte, error) {
+	file, err := rootDir.ReadFile(qpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.(io.Closer).Close()
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > thumbMaxPixels {
+		return nil, E("the image is too large")
+	}
+	file.Seek(0, io.SeekStart)
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	err = jpeg.Encode(buf, scaleImage(src, thumbSize), &jpeg.Options{Quality: 80})
+	return buf.Bytes(), err
+}
+
+// scaleImage shrinks src to fit in a square of size, averaging the pixels that end up in each
+// one, on the background color of the og images since JPEG has no transparency
+func scaleImage(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	flat := image.NewRGBA(b)
+	draw.Draw(flat, b, image.NewUniform(ogBackground), image.ZP, draw.Src)
+	draw.Draw(flat, b, src, b.Min, draw.Over)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, n uint32
+			for sy := y0; sy < y1 || sy == y0; sy++ {
+				for sx := x0; sx < x1 || sx == x0; sx++ {
+					c := flat.RGBAAt(sx, sy)
+					r, g, bl, n = r+uint32(c.R), g+uint32(c.G), bl+uint32(c.B), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 0xff})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// handleAccessTrace explains the access decision for qpath as JSON. Pass ?as={snowflake} to
+// trace the request as another user instead of the current admin.
+func handleAccessTrace(w http.ResponseWriter, r *http.Request, qpath string, uID string, uAccess []string) {
+	if as := r.URL.Query().Get("as"); len(as) > 0 {
+		u, ok := queryUserBySnowflake(as)
+		if !ok {
+			writeJSON(w, map[string]interface{}{
+				"response": "bad",
+				"message":  "User '" + as + "' does not exist",
+			})
+			return
+		}
+		uID = as
+		uAccess = queryAccess(u)
+	}
+
+	kind := "missing"
+	stat, err := rootDir.Stat(qpath)
+	if err == nil {
+		kind = "file"
+		if stat.IsDir() {
+			kind = "directory"
+		}
+	}
+
+	rules := []map[string]string{}
+	matched := ""
+	partial := false
+	for _, item := range uAccess {
+		result := "no-match"
+		if pathHasPrefix(qpath, item) {
+			result = "grants"
+			if len(matched) == 0 {
+				matched = item
+			}
+		} else if kind == "directory" && strings.HasPrefix(item, qpath) {
+			result = "grants-listing"
+			partial = true
+		}
+		rules = append(rules, map[string]string{
+			"path":   item,
+			"source": "user",
+			"result": result,
+		})
+	}
+
+	decision := "deny"
+	reason := "No access rule covers this path."
+	switch {
+	case isIgnoredPath(qpath) || strings.Contains(r.URL.Path, ".."):
+		reason = "Hidden and ignored files and paths containing '..' are always denied."
+		matched = ""
+	case os.IsNotExist(err):
+		reason = "The path does not exist."
+		matched = ""
+	case len(matched) > 0:
+		decision = "allow"
+		reason = "Access rule '" + matched + "' is a parent of this path."
+	case partial:
+		decision = "partial"
+		reason = "Only the entries leading to the user's access rules will be listed."
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"user":     uID,
+		"path":     qpath,
+		"type":     kind,
+		"decision": decision,
+		"reason":   reason,
+		"matched":  matched,
+		"rules":    rules,
+	})
+}
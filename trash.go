@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+const (
+	// the folder in the root deleted files are moved to, it is hidden from listings and the index
+	trashDirName = ".andesite-trash"
+	// deleted files are kept this long unless "trash" says otherwise
+	trashRetentionDays = 30
+	trashPurgeEvery    = time.Hour
+)
+
+// TrashRow is a file or folder that was deleted, kept in the trash folder under its id
+type TrashRow struct {
+	id      int
+	path    string
+	deleter string
+	deleted string
+	isDir   bool
+}
+
+const trashColumns = "id, path, deleter, deleted, is_dir"
+
+func scanTrash(rows *sql.Rows) TrashRow {
+	var v TrashRow
+	rows.Scan(&v.id, &v.path, &v.deleter, &v.deleted, &v.isDir)
+	return v
+}
+
+func queryTrash() []TrashRow {
+	result := []TrashRow{}
+	rows, err := database.Query(false, "select "+trashColumns+" from trash order by id desc")
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		result = append(result, scanTrash(rows))
+	}
+	rows.Close()
+	return result
+}
+
+func queryTrashByID(id int) (TrashRow, bool) {
+	rows, err := database.QueryPrepared(false, "select "+trashColumns+" from trash where id = ?", id)
+	if err != nil {
+		return TrashRow{}, false
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return TrashRow{}, false
+	}
+	return scanTrash(rows), true
+}
+
+func validateTrashConfig(cfg *Config) error {
+	if cfg.Trash.Days < 0 {
+		return E("trash.days must not be negative")
+	}
+	if cfg.Trash.Days == 0 {
+		cfg.Trash.Days = trashRetentionDays
+	}
+	return nil
+}
+
+func trashEnabled() bool {
+	return !config.Trash.Disabled
+}
+
+// location is where the item is kept on disk
+func (v TrashRow) location() string {
+	return filepath.Join(rootDir.Base(), trashDirName, strconv.Itoa(v.id), path.Base(v.path))
+}
+
+// moveToTrash moves full, which is fpath in the root, into the trash instead of deleting it
+func moveToTrash(full string, fpath string, isDir bool, deleter string) error {
+	item, err := reserveTrashItem(TrashRow{-1, fpath, deleter, timeNow(), isDir})
+	if err != nil {
+		return err
+	}
+	dst := item.location()
+	if err := os.Rename(full, dst); err != nil {
+		os.Remove(filepath.Dir(dst))
+		database.QueryPrepared(true, "delete from trash where id = ?", item.id)
+		return err
+	}
+	releaseStored(fpath, item.id)
+	return nil
+}
+
+// reserveTrashItem gives item an id by inserting its row, which fails if another delete took the
+// same id first, and then creates its empty folder in the trash
+func reserveTrashItem(item TrashRow) (TrashRow, error) {
+	base := filepath.Join(rootDir.Base(), trashDirName)
+	if err := os.MkdirAll(base, 0700); err != nil {
+		return item, err
+	}
+	for attempt := 0; attempt < 10; attempt++ {
+		id, err := database.QueryNextID("trash")
+		if err != nil {
+			return item, err
+		}
+		item.id = id
+		if _, err := database.Exec("insert into trash (id, path, deleter, deleted, is_dir) values (?, ?, ?, ?, ?)", item.id, item.path, item.deleter, item.deleted, boolToString(item.isDir)); err != nil {
+			continue
+		}
+		dir := filepath.Dir(item.location())
+		err = os.Mkdir(dir, 0700)
+		if os.IsExist(err) {
+			// left behind without a row, such as by a crash, keep it but out of the way
+			LogError("[trash]", "moving aside", dir, "which has no trash entry")
+			err = os.Rename(dir, F("%s.orphan-%d", dir, time.Now().UnixNano()))
+			if err == nil {
+				err = os.Mkdir(dir, 0700)
+			}
+		}
+		if err != nil {
+			database.QueryPrepared(true, "delete from trash where id = ?", item.id)
+			return item, err
+		}
+		return item, nil
+	}
+	return item, E("Could not reserve a place in the trash, try again")
+}
+
+// purgeTrashItem deletes an item in the trash for good
+func purgeTrashItem(item TrashRow) error {
+	if err := os.RemoveAll(filepath.Dir(item.location())); err != nil {
+		return err
+	}
+	database.QueryPrepared(true, "delete from trash where id = ?", item.id)
+	purgeStored(item.id)
+	return nil
+}
+
+// initTrashPurger deletes what has been in the trash for longer than trash.days
+func initTrashPurger() {
+	if !trashEnabled() {
+		return
+	}
+	go func() {
+		for {
+			cutoff := time.Now().UTC().AddDate(0, 0, -config.Trash.Days).Format(time.RFC3339)
+			for _, item := range queryTrash() {
+				if item.deleted >= cutoff {
+					continue
+				}
+				if err := purgeTrashItem(item); err != nil {
+					LogError("[trash]", item.path, err.Error())
+					continue
+				}
+				auditLog(nil, "system", "trash.purge", item.path, "")
+			}
+			time.Sleep(trashPurgeEvery)
+		}
+	}()
+}
+
+//
+//
+
+// handler for http://andesite/api/admin/trash
+func handleTrashList(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	result := []map[string]interface{}{}
+	for _, item := range queryTrash() {
+		expires := ""
+		if t, err := time.Parse(time.RFC3339, item.deleted); err == nil {
+			expires = t.AddDate(0, 0, config.Trash.Days).Format(time.RFC3339)
+		}
+		result = append(result, map[string]interface{}{
+			"id":      item.id,
+			"path":    item.path,
+			"deleter": item.deleter,
+			"deleted": item.deleted,
+			"expires": expires,
+			"is_dir":  item.isDir,
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"days":     config.Trash.Days,
+		"trash":    result,
+	})
+}
+
+// handler for http://andesite/api/admin/trash/restore
+func handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "id", Kind: FieldInt})
+	if !ok {
+		return
+	}
+	item, ok := queryTrashByID(vf.Int("id"))
+	if !ok {
+		writeAPIResponse(r, w, false, "Item is not in the trash")
+		return
+	}
+	dst, err := resolveWritable(item.path)
+	if err != nil {
+		writeAPIResponse(r, w, false, F("Can not restore %s: %s", item.path, err.Error()))
+		return
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		writeAPIResponse(r, w, false, F("Can not restore %s, something else is there now", item.path))
+		return
+	}
+	if err := os.Rename(item.location(), dst); err != nil {
+		writeAPIResponse(r, w, false, F("Can not restore %s: %s", item.path, err.Error()))
+		return
+	}
+	os.Remove(filepath.Dir(item.location()))
+	database.QueryPrepared(true, "delete from trash where id = ?", item.id)
+	restoreStored(item.id)
+	auditLog(r, admin.snowflake, "trash.restore", item.path, "")
+	writeAPIResponse(r, w, true, F("Restored %s.", item.path))
+}
+
+// handler for http://andesite/api/admin/trash/delete
+func handleTrashDelete(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "id", Kind: FieldInt})
+	if !ok {
+		return
+	}
+	item, ok := queryTrashByID(vf.Int("id"))
+	if !ok {
+		writeAPIResponse(r, w, false, "Item is not in the trash")
+		return
+	}
+	if !requireConfirmation(r, w, admin, []string{F("Delete %s from the trash for good", item.path)}) {
+		return
+	}
+	if err := purgeTrashItem(item); err != nil {
+		writeAPIResponse(r, w, false, F("Could not delete %s: %s", item.path, err.Error()))
+		return
+	}
+	auditLog(r, admin.snowflake, "trash.purge", item.path, "")
+	writeAPIResponse(r, w, true, F("Deleted %s for good.", item.path))
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/nektro/go.oauth2"
+
+	. "github.com/nektro/go-util/alias"
 )
 
 type Oauth2Provider struct {
@@ -37,3 +41,177 @@ var (
 		},
 	}
 )
+
+// LoginProvider is one identity provider users may log in with. The first one configured is
+// the primary, its users are known by their plain ID and others by "{key}:{ID}".
+type LoginProvider struct {
+	Oauth2Provider
+	key string
+	app *ConfigIDP
+}
+
+// loginProviders returns the providers in use, in the order of "auth"
+func loginProviders() []LoginProvider {
+	return live().providers
+}
+
+// Name is the label of the provider on the login page
+func (lp LoginProvider) Name() string {
+	switch lp.key {
+	case "local":
+		return "Username and Password"
+	case "proxy":
+		return "Single Sign-On"
+	case "passkey":
+		return "a Passkey"
+	}
+	return strings.Title(lp.key)
+}
+
+// findLoginProvider looks up a built-in or custom provider and its client config in cfg
+func findLoginProvider(cfg *Config, auth string) (LoginProvider, error) {
+	if auth == "local" || auth == "proxy" || auth == "passkey" {
+		return LoginProvider{key: auth}, nil
+	}
+	if cfp, ok := Oauth2Providers[auth]; ok {
+		cidp := findStructValueWithTag(cfg, "json", auth).Interface().(*ConfigIDP)
+		if cidp == nil {
+			return LoginProvider{}, E(F("Authorization keys not set for identity prodvider '%s' in config.json!", auth))
+		}
+		if cidp.ID == "" {
+			return LoginProvider{}, E(F("App ID not set for identity prodvider '%s' in config.json!", auth))
+		}
+		if cidp.Secret == "" {
+			return LoginProvider{}, E(F("App Secret not set for identity prodvider '%s' in config.json!", auth))
+		}
+		return LoginProvider{cfp, auth, cidp}, nil
+	}
+	lp := LoginProvider{key: auth}
+	for _, item := range cfg.Providers {
+		if item.ID == auth {
+			lp.Oauth2Provider = Oauth2Provider{item, auth}
+			break
+		}
+	}
+	if lp.dbp == "" {
+		return lp, E(F("Unable to find OAuth2 app type '%s' in config.json", auth))
+	}
+	for i, item := range cfg.CustomIds {
+		if item.Auth == auth {
+			lp.app = &cfg.CustomIds[i]
+			break
+		}
+	}
+	if lp.app == nil {
+		return lp, E(F("Unable to find OAuth2 client config for '%s' config.json", auth))
+	}
+	return lp, nil
+}
+
+// initLoginProviders reads the comma separated list of providers in "auth"
+func initLoginProviders() error {
+	if len(config.Auth) == 0 {
+		config.Auth = "discord"
+	}
+	providers := []LoginProvider{}
+	for _, item := range strings.Split(config.Auth, ",") {
+		lp, err := findLoginProvider(config, strings.TrimSpace(item))
+		if err != nil {
+			return err
+		}
+		providers = append(providers, lp)
+	}
+	updateLive(func(lc *LiveConfig) {
+		lc.providers = providers
+	})
+	return nil
+}
+
+// dbSnowflake splits a user's ID as shown in Andesite into the provider and the snowflake stored
+// in the users table
+func dbSnowflake(snowflake string) (string, string) {
+	lp := loginProviderOf(snowflake)
+	if lp.key != loginProviders()[0].key {
+		snowflake = snowflake[len(lp.key)+1:]
+	}
+	return lp.key, lp.dbp + snowflake
+}
+
+// externalSnowflake is the reverse of dbSnowflake
+func externalSnowflake(provider string, stored string) string {
+	for i, item := range loginProviders() {
+		if item.key != provider || !strings.HasPrefix(stored, item.dbp) {
+			continue
+		}
+		if i == 0 {
+			return stored[len(item.dbp):]
+		}
+		return provider + ":" + stored[len(item.dbp):]
+	}
+	return provider + ":" + stored
+}
+
+// storedProvider guesses the provider of a users row from before the provider column by the
+// prefix of its snowflake
+func storedProvider(stored string) string {
+	for _, item := range loginProviders() {
+		if len(item.dbp) > 0 && strings.HasPrefix(stored, item.dbp) {
+			return item.key
+		}
+	}
+	for k, v := range Oauth2Providers {
+		if len(v.dbp) > 0 && strings.HasPrefix(stored, v.dbp) {
+			return k
+		}
+	}
+	return "discord"
+}
+
+// loginProviderEnabled returns true if key is one of the providers in "auth"
+func loginProviderEnabled(key string) bool {
+	for _, item := range loginProviders() {
+		if item.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// loginProviderOf returns the provider a user logged in with
+func loginProviderOf(snowflake string) LoginProvider {
+	if i := strings.Index(snowflake, ":"); i > 0 {
+		for _, item := range loginProviders()[1:] {
+			if item.key == snowflake[:i] {
+				return item
+			}
+		}
+	}
+	return loginProviders()[0]
+}
+
+// checkSnowflake returns an error unless snowflake is the ID of a user of the first provider, or
+// is prefixed with the key of one of the others, so that it can not be stored under the wrong one
+func checkSnowflake(snowflake string) error {
+	i := strings.Index(snowflake, ":")
+	if i < 0 {
+		if len(snowflake) == 0 {
+			return E("The snowflake can not be empty")
+		}
+		return nil
+	}
+	for _, item := range loginProviders()[1:] {
+		if item.key != snowflake[:i] {
+			continue
+		}
+		if len(snowflake) == i+1 {
+			return E(F("The snowflake %s has no ID after its provider", snowflake))
+		}
+		return nil
+	}
+	return E(F("'%s' is not a login provider of this server", snowflake[:i]))
+}
+
+// displayName prefixes a user's name the way their provider does, eg. "u/" for Reddit
+func displayName(snowflake string, name string) string {
+	return loginProviderOf(snowflake).idp.NamePrefix + name
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"io"
-	"io/ioutil"
 	"os"
 )
 
@@ -21,17 +20,30 @@ type FsRoot struct {
 
 //
 func (rd FsRoot) ReadFile(fpath string) (io.ReadSeeker, error) {
-	return os.Open(rd.base + fpath)
+	full, err := rd.resolve(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(full)
 }
 
 //
 func (rd FsRoot) ReadDir(fpath string) ([]os.FileInfo, error) {
-	return ioutil.ReadDir(rd.base + fpath)
+	full, err := rd.resolve(fpath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := cachedReadDir(full)
+	return filterSymlinks(rd.base, full, files), err
 }
 
 //
 func (rd FsRoot) Stat(fpath string) (os.FileInfo, error) {
-	return os.Stat(rd.base + fpath)
+	full, err := rd.resolve(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(full)
 }
 
 //
@@ -39,6 +51,18 @@ func (rd FsRoot) Base() string {
 	return rd.base
 }
 
+// resolve returns the location of fpath on disk, if the symlink policy allows reaching it
+func (rd FsRoot) resolve(fpath string) (string, error) {
+	full, err := resolvePath(rd.base, fpath)
+	if err != nil {
+		return "", err
+	}
+	if err := checkSymlinks(rd.base, full); err != nil {
+		return "", err
+	}
+	return full, nil
+}
+
 // //
 // type HttpRoot struct {
 // 	base string
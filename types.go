@@ -23,9 +23,10 @@ type PragmaTableInfoRow struct {
 
 //
 type UserAccessRow struct {
-	id   int
-	user int
-	path string
+	id    int
+	user  int
+	path  string
+	perms string
 }
 
 //
@@ -34,13 +35,26 @@ type UserRow struct {
 	snowflake string
 	admin     bool
 	name      string
+	provider  string
+	lastLogin string
+	email     string
+	// quotas in bytes, 0 is unlimited and -1 is the default of the config
+	quotaStorage   int64
+	quotaBandwidth int64
+	quotaSpeed     int64 // bytes per second of each download
+	stored         int64
+	enabled        bool
+	suspendReason  string
 }
 
 //
 type ShareRow struct {
-	id   int
-	hash string
-	path string
+	id      int
+	hash    string
+	path    string
+	perms   string
+	creator string
+	expires string
 }
 
 // Middleware provides a convenient mechanism for augmenting HTTP requests
@@ -60,23 +74,291 @@ const (
 )
 
 type Config struct {
-	Root      string            `json:"root"`
-	Port      int               `json:"port"`
-	Themes    []string          `json:"themes"`
-	HTTPBase  string            `json:"base"`
-	Auth      string            `json:"auth"`
-	Discord   *ConfigIDP        `json:"discord"`
-	Reddit    *ConfigIDP        `json:"reddit"`
-	GitHub    *ConfigIDP        `json:"github"`
-	Google    *ConfigIDP        `json:"google"`
-	Facebook  *ConfigIDP        `json:"facebook"`
-	Microsoft *ConfigIDP        `json:"microsoft"`
-	Providers []oauth2.Provider `json:"providers"`
-	CustomIds []ConfigIDP       `json:"custom"`
+	Root            string                 `json:"root"`
+	Port            int                    `json:"port"`
+	Themes          []string               `json:"themes"`
+	HTTPBase        string                 `json:"base"`
+	Auth            string                 `json:"auth"`
+	Discord         *ConfigIDP             `json:"discord"`
+	Reddit          *ConfigIDP             `json:"reddit"`
+	GitHub          *ConfigIDP             `json:"github"`
+	Google          *ConfigIDP             `json:"google"`
+	Facebook        *ConfigIDP             `json:"facebook"`
+	Microsoft       *ConfigIDP             `json:"microsoft"`
+	Providers       []oauth2.Provider      `json:"providers"`
+	CustomIds       []ConfigIDP            `json:"custom"`
+	Privacy         ConfigPrivacy          `json:"privacy"`
+	ReadOnly        bool                   `json:"read_only"`
+	Webhooks        []ConfigWebhook        `json:"webhooks"`
+	Cluster         ConfigCluster          `json:"cluster"`
+	Redis           *ConfigRedis           `json:"redis"`
+	AccessLog       *ConfigAccessLog       `json:"access_log"`
+	Cert            string                 `json:"cert"`
+	Key             string                 `json:"key"`
+	Redirect        int                    `json:"redirect_port"`
+	LetsEncrypt     *ConfigLetsEncrypt     `json:"letsencrypt"`
+	Listen          string                 `json:"listen"`
+	SocketMode      string                 `json:"socket_mode"`
+	Usage           map[string]ConfigUsage `json:"usage"`
+	RateLimit       *ConfigRateLimit       `json:"rate_limit"`
+	Arr             []ConfigArr            `json:"arr"`
+	SecurityHeaders ConfigSecurityHeaders  `json:"security_headers"`
+	TrustedProxies  []string               `json:"trusted_proxies"`
+	SessionBinding  ConfigSessionBinding   `json:"session_binding"`
+	Lockout         ConfigLockout          `json:"lockout"`
+	Scanners        []ConfigScanner        `json:"scanners"`
+	DataDir         string                 `json:"data_dir"`
+	CacheDir        string                 `json:"cache_dir"`
+	StateDir        string                 `json:"state_dir"`
+	ProxyAuth       *ConfigProxyAuth       `json:"proxy_auth"`
+	Index           ConfigIndex            `json:"index"`
+	Provision       []ConfigProvision      `json:"provision"`
+	AuditSinks      []ConfigAuditSink      `json:"audit_sinks"`
+	WebAuthn        ConfigWebAuthn         `json:"webauthn"`
+	Database        ConfigDatabase         `json:"database"`
+	AccessRequests  ConfigAccessRequests   `json:"access_requests"`
+	SMTP            *ConfigSMTP            `json:"smtp"`
+	DiscordWebhook  *ConfigDiscordWebhook  `json:"discord_webhook"`
+	Quotas          ConfigQuotas           `json:"quotas"`
+	Trash           ConfigTrash            `json:"trash"`
+	Uploads         ConfigUploads          `json:"uploads"`
+	Hooks           []ConfigHook           `json:"hooks"`
+	Symlinks        string                 `json:"symlinks"`
+	Ignore          ConfigIgnore           `json:"ignore"`
+	Compression     ConfigCompression      `json:"compression"`
+	ListingCache    ConfigListingCache     `json:"listing_cache"`
+	Scrub           ConfigScrub            `json:"scrub"`
+	Hotlink         ConfigHotlink          `json:"hotlink"`
+	ContentTypes    []ConfigContentType    `json:"content_types"`
 }
 
 type ConfigIDP struct {
-	Auth   string `json:"auth"`
-	ID     string `json:"id"`
-	Secret string `json:"secret"`
+	Auth     string   `json:"auth"`
+	ID       string   `json:"id"`
+	Secret   string   `json:"secret"`
+	Guild    string   `json:"guild"`
+	Roles    []string `json:"roles"`
+	BotToken string   `json:"bot_token"`
+	Org      string   `json:"org"`
+	Team     string   `json:"team"`
+	Token    string   `json:"token"`
+}
+
+type ConfigPrivacy struct {
+	AnonymizeIP string                     `json:"anonymize_ip"`
+	Retention   map[string]ConfigRetention `json:"retention"`
+}
+
+type ConfigRetention struct {
+	Days  int    `json:"days"`
+	Every string `json:"every"`
+}
+
+type ConfigWebhook struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Path   string   `json:"path"`
+	Secret string   `json:"secret"`
+}
+
+type ConfigCluster struct {
+	Enabled bool   `json:"enabled"`
+	Node    string `json:"node"`
+}
+
+type ConfigRedis struct {
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+}
+
+type ConfigAccessLog struct {
+	Path       string `json:"path"`
+	Format     string `json:"format"`
+	MaxSize    int    `json:"max_size"`
+	MaxBackups int    `json:"max_backups"`
+}
+
+type ConfigLetsEncrypt struct {
+	Domain string `json:"domain"`
+	Email  string `json:"email"`
+}
+
+type ConfigUsage struct {
+	Type    string `json:"type"`
+	Project string `json:"project"`
+	Mount   string `json:"mount"`
+	Dataset string `json:"dataset"`
+}
+
+type ConfigRateLimit struct {
+	Requests   float64  `json:"requests_per_minute"`
+	Burst      int      `json:"burst"`
+	DownloadKB int64    `json:"download_kbps"`
+	Paths      []string `json:"paths"`
+	PerUser    int      `json:"concurrent_per_user"`
+	PerIP      int      `json:"concurrent_per_ip"`
+}
+
+type ConfigArr struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Token string `json:"token"`
+}
+
+type ConfigSecurityHeaders struct {
+	CSP            string            `json:"csp"`
+	ThemeCSP       map[string]string `json:"theme_csp"`
+	ReferrerPolicy string            `json:"referrer_policy"`
+	HSTSMaxAge     int               `json:"hsts_max_age"`
+}
+
+type ConfigSessionBinding struct {
+	IP        string `json:"ip"`
+	UserAgent bool   `json:"user_agent"`
+	Action    string `json:"action"`
+}
+
+type ConfigLockout struct {
+	Threshold int    `json:"threshold"`
+	BaseDelay string `json:"base_delay"`
+	MaxDelay  string `json:"max_delay"`
+	Window    string `json:"window"`
+}
+
+type ConfigScanner struct {
+	Type          string   `json:"type"`
+	Command       []string `json:"command"`
+	InfectedCodes []int    `json:"infected_codes"`
+	URL           string   `json:"url"`
+	Address       string   `json:"address"`
+	Service       string   `json:"service"`
+}
+
+type ConfigProxyAuth struct {
+	Upstream     []string `json:"upstream"`
+	UserHeader   string   `json:"user_header"`
+	NameHeader   string   `json:"name_header"`
+	GroupsHeader string   `json:"groups_header"`
+	EmailHeader  string   `json:"email_header"`
+	AdminGroups  []string `json:"admin_groups"`
+}
+
+type ConfigIndex struct {
+	Concurrency   int                    `json:"concurrency"`
+	BatchSize     int                    `json:"batch_size"`
+	DirsPerSecond int                    `json:"dirs_per_second"`
+	Mounts        map[string]ConfigMount `json:"mounts"`
+}
+
+type ConfigMount struct {
+	Watch    *bool  `json:"watch"`
+	Rescan   string `json:"rescan"`
+	Hash     string `json:"hash"`
+	Priority int    `json:"priority"`
+}
+
+type ConfigProvision struct {
+	Provider    string   `json:"provider"`
+	Group       string   `json:"group"`
+	EmailDomain string   `json:"email_domain"`
+	Paths       []string `json:"paths"`
+}
+
+type ConfigAuditSink struct {
+	Type       string `json:"type"`
+	Address    string `json:"address"`
+	Path       string `json:"path"`
+	MaxSize    int    `json:"max_size"`
+	MaxBackups int    `json:"max_backups"`
+	URL        string `json:"url"`
+	Secret     string `json:"secret"`
+}
+
+type ConfigWebAuthn struct {
+	RPID    string   `json:"rp_id"`
+	Origins []string `json:"origins"`
+}
+
+type ConfigDatabase struct {
+	Type string `json:"type"`
+	DSN  string `json:"dsn"`
+}
+
+type ConfigAccessRequests struct {
+	ListFolders bool `json:"list_folders"`
+}
+
+type ConfigSMTP struct {
+	Host            string   `json:"host"`
+	Port            int      `json:"port"`
+	Username        string   `json:"username"`
+	Password        string   `json:"password"`
+	From            string   `json:"from"`
+	TLS             string   `json:"tls"`
+	URL             string   `json:"url"`
+	Alerts          []string `json:"alerts"`
+	DiskFreePercent int      `json:"disk_free_percent"`
+}
+
+type ConfigDiscordWebhook struct {
+	URL           string   `json:"url"`
+	Events        []string `json:"events"`
+	LargeDownload int64    `json:"large_download"`
+}
+
+type ConfigQuotas struct {
+	Storage   int64 `json:"storage"`
+	Bandwidth int64 `json:"bandwidth"`
+	Speed     int64 `json:"speed"`
+}
+
+type ConfigTrash struct {
+	Days     int  `json:"days"`
+	Disabled bool `json:"disabled"`
+}
+
+type ConfigUploads struct {
+	MaxSize  int64 `json:"max_size"`
+	Disabled bool  `json:"disabled"`
+}
+
+type ConfigHook struct {
+	Event   string   `json:"event"`
+	Command []string `json:"command"`
+	Timeout int      `json:"timeout"`
+}
+
+type ConfigIgnore struct {
+	ShowDotfiles bool     `json:"show_dotfiles"`
+	Patterns     []string `json:"patterns"`
+}
+
+type ConfigCompression struct {
+	MinSize  int  `json:"min_size"`
+	Disabled bool `json:"disabled"`
+}
+
+type ConfigListingCache struct {
+	Size     int  `json:"size"`
+	Disabled bool `json:"disabled"`
+}
+
+type ConfigScrub struct {
+	Every    string `json:"every"`
+	SpeedKB  int64  `json:"speed_kbps"`
+	Disabled bool   `json:"disabled"`
+}
+
+type ConfigHotlink struct {
+	Enabled  bool     `json:"enabled"`
+	Referers []string `json:"referers"`
+	TokenTTL string   `json:"token_ttl"`
+}
+
+type ConfigContentType struct {
+	Extensions  []string `json:"extensions"`
+	Path        string   `json:"path"`
+	Type        string   `json:"type"`
+	Disposition string   `json:"disposition"`
 }
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// uploads follow the tus resumable upload protocol, https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	// the folder in the root unfinished uploads are kept in, on the same filesystem as their
+	// destination so that finishing one is a rename
+	uploadDirName = ".andesite-uploads"
+	// unfinished uploads are deleted this long after they were started
+	uploadExpiry      = time.Hour * 24
+	uploadPurgeEvery  = time.Hour
+	uploadContentType = "application/offset+octet-stream"
+	// uploads.max_size when it is not set
+	defaultUploadMaxSize = 10 << 30
+)
+
+// what has become of an upload, it is receiving chunks until the status is set
+const (
+	UploadProcessing = "processing"
+	UploadDone       = "done"
+	UploadFailed     = "failed"
+)
+
+// uploadsBusy holds the tokens of uploads that are being written to, a client may only send one
+// chunk of an upload at a time
+var uploadsBusy sync.Map
+
+// UploadRow is an upload that has been started but not finished
+type UploadRow struct {
+	id      int
+	token   string
+	user    int
+	path    string
+	length  int64
+	created string
+	status  string
+	message string
+}
+
+const uploadColumns = "id, token, user, path, length, created, coalesce(status, ''), coalesce(message, '')"
+
+func scanUpload(rows *sql.Rows) UploadRow {
+	var v UploadRow
+	rows.Scan(&v.id, &v.token, &v.user, &v.path, &v.length, &v.created, &v.status, &v.message)
+	return v
+}
+
+func queryUploadByToken(token string) (UploadRow, bool) {
+	rows, err := database.QueryPrepared(false, "select "+uploadColumns+" from uploads where token = ?", token)
+	if err != nil {
+		return UploadRow{}, false
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return UploadRow{}, false
+	}
+	return scanUpload(rows), true
+}
+
+// queryUploadsPending is the number of bytes user has reserved with uploads that are not finished
+func queryUploadsPending(uid int) int64 {
+	var total int64
+	rows, err := database.QueryPrepared(false, "select coalesce(sum(length), 0) from uploads where user = ? and coalesce(status, '') in ('', ?)", uid, UploadProcessing)
+	if err != nil {
+		return 0
+	}
+	if rows.Next() {
+		rows.Scan(&total)
+	}
+	rows.Close()
+	return total
+}
+
+func validateUploadConfig(cfg *Config) error {
+	if cfg.Uploads.MaxSize < 0 {
+		return E("uploads.max_size must not be negative")
+	}
+	if cfg.Uploads.MaxSize == 0 {
+		cfg.Uploads.MaxSize = defaultUploadMaxSize
+	}
+	return nil
+}
+
+func uploadsEnabled() bool {
+	return !config.Uploads.Disabled
+}
+
+// location is where the data received so far is kept
+func (v UploadRow) location() string {
+	return filepath.Join(rootDir.Base(), uploadDirName, v.token)
+}
+
+// offset is how many bytes of the upload have been received
+func (v UploadRow) offset() int64 {
+	if len(v.status) > 0 {
+		return v.length
+	}
+	info, err := os.Stat(v.location())
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (v UploadRow) expires() time.Time {
+	t, _ := time.Parse(time.RFC3339, v.created)
+	return t.Add(uploadExpiry)
+}
+
+// discard deletes the upload and what was received of it
+func (v UploadRow) discard() {
+	os.Remove(v.location())
+	database.QueryPrepared(true, "delete from uploads where id = ?", v.id)
+}
+
+// parseUploadMetadata reads the Upload-Metadata header, pairs of a key and a base64 value
+func parseUploadMetadata(v string) map[string]string {
+	result := map[string]string{}
+	for _, item := range strings.Split(v, ",") {
+		parts := strings.Fields(item)
+		if len(parts) == 0 {
+			continue
+		}
+		value := ""
+		if len(parts) > 1 {
+			b, _ := base64.StdEncoding.DecodeString(parts[1])
+			value = string(b)
+		}
+		result[parts[0]] = value
+	}
+	return result
+}
+
+// startFinishUpload finishes a completely received upload in the background, so that scanning a
+// large file does not hold up the request that sent its last chunk. Clients follow it with HEAD
+// until its status is no longer processing.
+func startFinishUpload(r *http.Request, user UserRow, up UploadRow) {
+	res, err := database.Exec("update uploads set status = ? where id = ? and coalesce(status, '') = ''", UploadProcessing, up.id)
+	if err != nil {
+		LogError("[uploads]", err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+	r = r.WithContext(context.Background())
+	go func() {
+		status, message := UploadDone, ""
+		if err := finishUpload(r, user, up); err != nil {
+			status, message = UploadFailed, err.Error()
+		}
+		database.QueryPrepared(true, "update uploads set status = ?, message = ? where id = ?", status, message, up.id)
+	}()
+}
+
+// finishUpload scans a completed upload and moves it into place. What was received is deleted
+// whether or not that works.
+func finishUpload(r *http.Request, user UserRow, up UploadRow) error {
+	defer os.Remove(up.location())
+	res, err := runScanners(up.location())
+	if err != nil {
+		return E("Could not scan the upload: " + err.Error())
+	}
+	if !res.Clean {
+		auditFailure(r, user.snowflake, "file.upload", up.path, res.Reason)
+		return E("The upload was rejected by a scanner: " + res.Reason)
+	}
+	// the length of this upload is already counted as pending
+	if err := checkStorageQuota(user, 0); err != nil {
+		return err
+	}
+	dst, err := resolveWritable(up.path)
+	if err != nil {
+		return err
+	}
+	if err := commitFile(up.location(), dst); err != nil {
+		if os.IsExist(err) {
+			return E(F("%s was created by someone else during the upload", up.path))
+		}
+		return err
+	}
+	recordStored(user.id, up.path, up.length)
+	auditLog(r, user.snowflake, "file.upload", up.path, byteCountIEC(up.length))
+	runHooks(HookUpload, hookUserEnv(map[string]string{"ANDESITE_PATH": up.path, "ANDESITE_FILE": dst}, user))
+	return nil
+}
+
+// commitFile puts src at dst so that dst never exists half written, and fails with an error
+// os.IsExist knows if dst already exists rather than replacing it. When dst is on another
+// filesystem, reached through a symlink, src is copied next to it first.
+func commitFile(src string, dst string) error {
+	err := linkNew(src, dst)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".andesite-part")
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = linkNew(tmp, dst)
+	}
+	os.Remove(tmp)
+	return err
+}
+
+// linkNew gives src the name dst, which must not exist yet. A hard link fails on its own if it
+// does. Filesystems without hard links get dst created empty and exclusively, which src is then
+// renamed over.
+func linkNew(src string, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := os.Rename(src, dst); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// initUploadPurger deletes uploads that were not finished in time
+func initUploadPurger() {
+	go func() {
+		for {
+			cutoff := time.Now().UTC().Add(-uploadExpiry).Format(time.RFC3339)
+			expired := []UploadRow{}
+			rows, err := database.QueryPrepared(false, "select "+uploadColumns+" from uploads where created < ?", cutoff)
+			if err == nil {
+				for rows.Next() {
+					expired = append(expired, scanUpload(rows))
+				}
+				rows.Close()
+			}
+			for _, item := range expired {
+				item.discard()
+			}
+			if len(expired) > 0 {
+				Log("[uploads]", "Deleted", len(expired), "unfinished uploads")
+			}
+			time.Sleep(uploadPurgeEvery)
+		}
+	}()
+}
+
+// writeTusError responds with status, tus clients go by the status and show the body as is
+func writeTusError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	http.Error(w, message, status)
+}
+
+//
+//
+
+// handler for http://andesite/api/upload
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.Uploads.MaxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeTusError(w, http.StatusPreconditionFailed, "Uploads require the tus protocol "+tusVersion)
+		return
+	}
+	_, user, errr := apiBootstrapRequireLogin(r, w, r.Method, false)
+	if errr != nil {
+		return
+	}
+	if !uploadsEnabled() {
+		writeTusError(w, http.StatusForbidden, "Uploads are turned off on this server")
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/upload"), "/")
+	if len(token) == 0 {
+		if r.Method != http.MethodPost {
+			writeTusError(w, http.StatusMethodNotAllowed, "Start an upload with POST")
+			return
+		}
+		handleUploadCreate(w, r, user)
+		return
+	}
+	up, ok := queryUploadByToken(token)
+	if !ok || up.user != user.id {
+		writeTusError(w, http.StatusNotFound, "Upload not found, it may have expired")
+		return
+	}
+	w.Header().Set("Upload-Expires", up.expires().Format(http.TimeFormat))
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(up.offset(), 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(up.length, 10))
+		if len(up.status) > 0 {
+			w.Header().Set("Andesite-Upload-Status", up.status)
+		}
+		if up.status == UploadFailed {
+			w.Header().Set("Andesite-Upload-Error", up.message)
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		handleUploadPatch(w, r, user, up)
+	case http.MethodDelete:
+		if up.status == UploadProcessing {
+			writeTusError(w, http.StatusLocked, "The upload is being checked and moved into place")
+			return
+		}
+		up.discard()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeTusError(w, http.StatusMethodNotAllowed, "Unsupported method "+r.Method)
+	}
+}
+
+func handleUploadCreate(w http.ResponseWriter, r *http.Request, user UserRow) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeTusError(w, http.StatusBadRequest, "Upload-Length is required")
+		return
+	}
+	if length > config.Uploads.MaxSize {
+		writeTusError(w, http.StatusRequestEntityTooLarge, F("Uploads may be at most %s", byteCountIEC(config.Uploads.MaxSize)))
+		return
+	}
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	name := meta["filename"]
+	if len(name) == 0 || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		writeTusError(w, http.StatusBadRequest, "Upload-Metadata requires a valid 'filename'")
+		return
+	}
+	dir := meta["path"]
+	if len(dir) == 0 {
+		dir = "/"
+	}
+	fpath, err := sanitizePath(strings.TrimSuffix(dir, "/") + "/" + name)
+	if err != nil {
+		writeTusError(w, http.StatusBadRequest, F("Invalid path: %s", err.Error()))
+		return
+	}
+	if !hasPathPerm(user, queryAccessGrants(user), fpath, AccessWrite) {
+		writeTusError(w, http.StatusForbidden, F("You are not allowed to write to %s", fpath))
+		return
+	}
+	dst, err := resolveWritable(fpath)
+	if err != nil {
+		writeTusError(w, http.StatusBadRequest, F("Invalid path: %s", err.Error()))
+		return
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		writeTusError(w, http.StatusConflict, F("%s already exists", fpath))
+		return
+	}
+	if err := checkStorageQuota(user, length); err != nil {
+		writeTusError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id, err := database.QueryNextID("uploads")
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	up := UploadRow{id, hex.EncodeToString(b), user.id, fpath, length, timeNow(), "", ""}
+	if err := os.MkdirAll(filepath.Dir(up.location()), 0700); err != nil {
+		writeTusError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	f, err := os.OpenFile(up.location(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	f.Close()
+	database.QueryPrepared(true, "insert into uploads (id, token, user, path, length, created) values (?, ?, ?, ?, ?, ?)", up.id, up.token, up.user, up.path, up.length, up.created)
+	w.Header().Set("Location", fullHost(r)+httpBase+"api/upload/"+up.token)
+	w.Header().Set("Upload-Expires", up.expires().Format(http.TimeFormat))
+	if length == 0 {
+		startFinishUpload(r, user, up)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleUploadPatch(w http.ResponseWriter, r *http.Request, user UserRow, up UploadRow) {
+	if r.Header.Get("Content-Type") != uploadContentType {
+		writeTusError(w, http.StatusUnsupportedMediaType, "Chunks must be sent as "+uploadContentType)
+		return
+	}
+	if _, busy := uploadsBusy.LoadOrStore(up.token, true); busy {
+		writeTusError(w, http.StatusLocked, "Another chunk of this upload is being sent")
+		return
+	}
+	defer uploadsBusy.Delete(up.token)
+	if len(up.status) > 0 {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(up.length, 10))
+		writeTusError(w, http.StatusConflict, "Every chunk of this upload has been received")
+		return
+	}
+	offset := up.offset()
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		writeTusError(w, http.StatusConflict, "Upload-Offset does not match what has been received")
+		return
+	}
+	f, err := os.OpenFile(up.location(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// what arrived before a broken connection is kept, so the client can resume after it
+	n, err := io.Copy(f, io.LimitReader(r.Body, up.length-offset))
+	f.Close()
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		writeTusError(w, http.StatusBadRequest, "The chunk was cut off: "+err.Error())
+		return
+	}
+	if offset == up.length {
+		startFinishUpload(r, user, up)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// UsageBackend reports how many bytes are stored under a directory
+type UsageBackend interface {
+	DirUsage(fpath string) (int64, error)
+}
+
+// WalkUsage sums the size of every file under the directory
+type WalkUsage struct{}
+
+//
+func (WalkUsage) DirUsage(fpath string) (int64, error) {
+	full, err := resolvePath(rootDir.Base(), fpath)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	err = filepath.Walk(full, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// XFSProjectUsage reads the usage of an XFS project quota
+type XFSProjectUsage struct {
+	Project string
+	Mount   string
+}
+
+//
+func (xu XFSProjectUsage) DirUsage(fpath string) (int64, error) {
+	out, err := exec.Command("xfs_quota", "-x", "-c", "quota -p -N -b "+xu.Project, xu.Mount).Output()
+	if err != nil {
+		return 0, err
+	}
+	// {device} {used KiB} {soft} {hard} ...
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return 0, E(F("unexpected xfs_quota output '%s'", string(out)))
+	}
+	kb, err := strconv.ParseInt(fields[1], 10, 64)
+	return kb * 1024, err
+}
+
+// ZFSDatasetUsage reads the space used by a ZFS dataset
+type ZFSDatasetUsage struct {
+	Dataset string
+}
+
+//
+func (zu ZFSDatasetUsage) DirUsage(fpath string) (int64, error) {
+	out, err := exec.Command("zfs", "get", "-Hp", "-o", "value", "used", zu.Dataset).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+//
+//
+
+var usageBackends = map[string]UsageBackend{}
+
+func initUsageBackends() error {
+	for fpath, item := range config.Usage {
+		switch item.Type {
+		case "xfs":
+			if item.Project == "" || item.Mount == "" {
+				return E(F("usage for '%s' requires 'project' and 'mount'", fpath))
+			}
+			usageBackends[fpath] = XFSProjectUsage{item.Project, item.Mount}
+		case "zfs":
+			if item.Dataset == "" {
+				return E(F("usage for '%s' requires 'dataset'", fpath))
+			}
+			usageBackends[fpath] = ZFSDatasetUsage{item.Dataset}
+		case "walk":
+			usageBackends[fpath] = WalkUsage{}
+		default:
+			return E(F("Invalid usage type '%s' for '%s', must be one of 'walk', 'xfs', 'zfs'", item.Type, fpath))
+		}
+	}
+	return nil
+}
+
+// dirUsage returns the bytes stored under fpath, asking the filesystem directly when the
+// directory has a native backend configured and falling back to walking the tree
+func dirUsage(fpath string) (int64, string, error) {
+	if ub, ok := usageBackends[fpath]; ok {
+		n, err := ub.DirUsage(fpath)
+		if err == nil {
+			return n, config.Usage[fpath].Type, nil
+		}
+		LogError("[usage]", fpath, err)
+	}
+	n, err := WalkUsage{}.DirUsage(fpath)
+	return n, "walk", err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+// handler for http://andesite/api/users
+func handleUserList(w http.ResponseWriter, r *http.Request) {
+	_, _, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, true)
+	if errr != nil {
+		return
+	}
+	counts := queryAccessCounts()
+	result := []map[string]interface{}{}
+	for _, item := range queryAllUsers() {
+		result = append(result, map[string]interface{}{
+			"id":         item.id,
+			"snowflake":  item.snowflake,
+			"name":       item.name,
+			"provider":   item.provider,
+			"admin":      item.admin,
+			"last_login": item.lastLogin,
+			"accesses":   counts[item.id],
+			"quotas":     quotaUsage(item),
+			"enabled":    item.enabled,
+			"reason":     item.suspendReason,
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"users":    result,
+	})
+}
+
+// handler for http://andesite/api/users/create
+func handleUserCreate(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128},
+		FormField{Name: "name", Kind: FieldString, MaxLen: 128, Optional: true},
+		FormField{Name: "admin", Kind: FieldBool, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	snowflake := vf.Get("snowflake")
+	if err := checkSnowflake(snowflake); err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	if _, ok := queryUserBySnowflake(snowflake); ok {
+		writeAPIResponse(r, w, false, F("User %s already exists", snowflake))
+		return
+	}
+	uid, err := database.QueryNextID("users")
+	if err != nil {
+		writeAPIResponse(r, w, false, F("User %s could not be created: %s", snowflake, err.Error()))
+		return
+	}
+	queryDoAddUser(uid, snowflake, vf.Bool("admin"), vf.Get("name"))
+	auditLog(r, admin.snowflake, "user.create", snowflake, "admin="+boolToString(vf.Bool("admin")))
+	writeAPIResponse(r, w, true, F("Created user %s.", snowflake))
+}
+
+// handler for http://andesite/api/users/update
+func handleUserUpdate(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128},
+		FormField{Name: "name", Kind: FieldString, MaxLen: 128, Optional: true},
+		FormField{Name: "admin", Kind: FieldBool, Optional: true},
+		FormField{Name: "quota_storage", Kind: FieldString, MaxLen: 32, Optional: true},
+		FormField{Name: "quota_bandwidth", Kind: FieldString, MaxLen: 32, Optional: true},
+		FormField{Name: "quota_speed", Kind: FieldString, MaxLen: 32, Optional: true},
+		FormField{Name: "recount_stored", Kind: FieldBool, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	user, ok := queryUserBySnowflake(vf.Get("snowflake"))
+	if !ok {
+		writeAPIResponse(r, w, false, "User does not exist")
+		return
+	}
+	// every value is checked before any is changed, so that a bad one changes nothing
+	type quotaChange struct {
+		col    string
+		value  interface{}
+		detail string
+	}
+	quotas := []quotaChange{}
+	for _, col := range []string{"quota_storage", "quota_bandwidth", "quota_speed"} {
+		if !vf.Has(col) {
+			continue
+		}
+		// an empty quota goes back to the default of the config
+		q := quotaChange{col, nil, col + "=default"}
+		if v := strings.TrimSpace(vf.Get(col)); len(v) > 0 {
+			n, err := parseByteSize(v)
+			if err != nil {
+				writeAPIResponse(r, w, false, F("Invalid %s: %s", col, err.Error()))
+				return
+			}
+			q.value = n
+			q.detail = col + "=" + strconv.FormatInt(n, 10)
+		}
+		quotas = append(quotas, q)
+	}
+	setAdmin := vf.Has("admin") && vf.Bool("admin") != user.admin
+	if setAdmin && !vf.Bool("admin") && queryAdminCount() <= 1 {
+		writeAPIResponse(r, w, false, "Can not demote the last administrator")
+		return
+	}
+	uid := strconv.Itoa(user.id)
+	if setAdmin {
+		queryDoUpdate("users", "admin", vf.Get("admin"), "id", uid)
+		auditLog(r, admin.snowflake, "user.update", user.snowflake, "admin="+vf.Get("admin"))
+	}
+	if vf.Has("name") && vf.Get("name") != user.name {
+		queryDoUpdate("users", "name", vf.Get("name"), "id", uid)
+		auditLog(r, admin.snowflake, "user.update", user.snowflake, "name="+vf.Get("name"))
+	}
+	for _, q := range quotas {
+		database.QueryPrepared(true, "update users set "+q.col+" = ? where id = ?", q.value, user.id)
+		auditLog(r, admin.snowflake, "user.update", user.snowflake, q.detail)
+	}
+	if vf.Has("recount_stored") && vf.Bool("recount_stored") {
+		recountStored(user.id)
+		auditLog(r, admin.snowflake, "user.update", user.snowflake, "stored=recounted")
+	}
+	writeAPIResponse(r, w, true, F("Updated user %s.", user.snowflake))
+}
+
+// handler for http://andesite/api/users/delete
+func handleUserDelete(w http.ResponseWriter, r *http.Request) {
+	_, admin, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, true)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "snowflake", Kind: FieldString, MaxLen: 128})
+	if !ok {
+		return
+	}
+	user, ok := queryUserBySnowflake(vf.Get("snowflake"))
+	if !ok {
+		writeAPIResponse(r, w, false, "User does not exist")
+		return
+	}
+	if user.id == admin.id {
+		writeAPIResponse(r, w, false, "You can not delete yourself")
+		return
+	}
+	changes := []string{F("Delete user %s (%s)", user.name, user.snowflake)}
+	for _, item := range queryAccess(user) {
+		changes = append(changes, F("Remove their access to '%s'", item))
+	}
+	changes = append(changes, "Delete the share links they created", "Erase them and their IPs from the audit log and access log", "Log them out of every session")
+	if !requireConfirmation(r, w, admin, changes) {
+		return
+	}
+	eraseUser(user)
+	auditLog(r, admin.snowflake, "user.delete", erasedSnowflake, "")
+	writeAPIResponse(r, w, true, F("Deleted user %s.", user.snowflake))
+}
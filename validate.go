@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+//
+type FieldKind int
+
+//
+const (
+	FieldString FieldKind = iota
+	FieldInt
+	FieldBool
+	FieldPath
+	FieldHash
+	FieldSharePerms
+	FieldAccessPerms
+)
+
+// FormField describes one expected value of a POST form
+type FormField struct {
+	Name     string
+	Kind     FieldKind
+	MaxLen   int
+	Optional bool
+}
+
+// ValidForm holds the values of a form that passed validateForm, already normalized
+type ValidForm map[string]string
+
+const defaultMaxLen = 1024
+
+var shareHashRegex = regexp.MustCompile("^[0-9a-f]{32}$")
+
+//
+func (vf ValidForm) Get(name string) string {
+	return vf[name]
+}
+
+//
+func (vf ValidForm) Int(name string) int {
+	i, _ := strconv.Atoi(vf[name])
+	return i
+}
+
+//
+func (vf ValidForm) Bool(name string) bool {
+	return vf[name] == "1"
+}
+
+//
+func (vf ValidForm) Has(name string) bool {
+	_, ok := vf[name]
+	return ok
+}
+
+// validateForm checks r.PostForm against fields. On failure it writes an API error and returns false.
+func validateForm(r *http.Request, w http.ResponseWriter, fields ...FormField) (ValidForm, bool) {
+	result := ValidForm{}
+	for _, item := range fields {
+		vals, ok := r.PostForm[item.Name]
+		if !ok || len(vals) == 0 || (len(vals[0]) == 0 && item.Kind != FieldString) {
+			if item.Optional {
+				continue
+			}
+			writeAPIResponse(r, w, false, F("Missing POST value '%s'", item.Name))
+			return nil, false
+		}
+		v, err := normalizeField(item, vals[0])
+		if err != nil {
+			writeAPIResponse(r, w, false, F("Invalid POST value '%s': %s", item.Name, err.Error()))
+			return nil, false
+		}
+		result[item.Name] = v
+	}
+	return result, true
+}
+
+func normalizeField(item FormField, v string) (string, error) {
+	max := item.MaxLen
+	if max == 0 {
+		max = defaultMaxLen
+	}
+	if !utf8.ValidString(v) || strings.ContainsRune(v, 0) {
+		return "", E("must be valid text")
+	}
+	if len(v) > max {
+		return "", E(F("must be at most %d bytes", max))
+	}
+	switch item.Kind {
+	case FieldInt:
+		if _, err := strconv.Atoi(v); err != nil {
+			return "", E("must be an integer")
+		}
+	case FieldBool:
+		if v != "0" && v != "1" {
+			return "", E("must be '0' or '1'")
+		}
+	case FieldHash:
+		if !shareHashRegex.MatchString(v) {
+			return "", E("must be a 32 character hex string")
+		}
+	case FieldPath:
+		return sanitizePath(v)
+	case FieldSharePerms:
+		return parseSharePerms(v)
+	case FieldAccessPerms:
+		return parseAccessPerms(v)
+	}
+	return v, nil
+}
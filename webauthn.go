@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+// AuthPasskey is the lockout kind of failed passkey logins
+const AuthPasskey = "passkey"
+
+const passkeyChallengeKey = "passkey_challenge"
+
+// COSE algorithms that passkeys may use
+const (
+	coseES256   = -7
+	coseEdDSA   = -8
+	coseRS256   = -257
+	passkeyWait = 60000
+)
+
+// authenticator data flags
+const (
+	flagUserPresent = 0x01
+	flagAttested    = 0x40
+)
+
+// PasskeyRow is a WebAuthn credential of a user
+type PasskeyRow struct {
+	id         int
+	user       int
+	credential string
+	publicKey  string
+	signCount  uint32
+	name       string
+	created    string
+	used       string
+}
+
+// passkeys are added to accounts from the other providers, so they can not be the only one
+func validatePasskeyConfig(cfg *Config) error {
+	if !loginProviderEnabled("passkey") {
+		return nil
+	}
+	if loginProviders()[0].key == "passkey" {
+		return E("'passkey' can not be the first provider in auth, passkeys are added to accounts from the others")
+	}
+	for _, item := range cfg.WebAuthn.Origins {
+		if u, err := url.Parse(item); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return E(F("Invalid webauthn.origins entry '%s', must look like 'https://files.example.com'", item))
+		}
+	}
+	return nil
+}
+
+// passkeyRPID is the domain passkeys are bound to
+func passkeyRPID(r *http.Request) string {
+	if len(config.WebAuthn.RPID) > 0 {
+		return config.WebAuthn.RPID
+	}
+	u, _ := url.Parse(fullHost(r))
+	return u.Hostname()
+}
+
+func passkeyOrigins(r *http.Request) []string {
+	if len(config.WebAuthn.Origins) > 0 {
+		return config.WebAuthn.Origins
+	}
+	return []string{fullHost(r)}
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func unb64url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// newPasskeyChallenge remembers a random challenge in the session for the next finish call
+func newPasskeyChallenge(r *http.Request, w http.ResponseWriter) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	c := b64url(b)
+	sess := getSession(r)
+	sess.Values[passkeyChallengeKey] = c
+	sess.Save(r, w)
+	return c
+}
+
+// takePasskeyChallenge returns the challenge of the session, which may only be used once
+func takePasskeyChallenge(r *http.Request, w http.ResponseWriter) string {
+	sess := getSession(r)
+	c, _ := sess.Values[passkeyChallengeKey].(string)
+	delete(sess.Values, passkeyChallengeKey)
+	sess.Save(r, w)
+	return c
+}
+
+//
+//
+
+func scanPasskey(rows *sql.Rows) PasskeyRow {
+	var v PasskeyRow
+	rows.Scan(&v.id, &v.user, &v.credential, &v.publicKey, &v.signCount, &v.name, &v.created, &v.used)
+	return v
+}
+
+func queryPasskeysOf(uid int) []PasskeyRow {
+	result := []PasskeyRow{}
+	rows, err := database.QueryPrepared(false, "select * from passkeys where user = ?", uid)
+	if err != nil {
+		return result
+	}
+	for rows.Next() {
+		result = append(result, scanPasskey(rows))
+	}
+	rows.Close()
+	return result
+}
+
+func queryPasskeyByCredential(cid string) (PasskeyRow, bool) {
+	rows, err := database.QueryPrepared(false, "select * from passkeys where credential = ?", cid)
+	if err != nil {
+		return PasskeyRow{}, false
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return PasskeyRow{}, false
+	}
+	return scanPasskey(rows), true
+}
+
+//
+//
+
+// verifyClientData checks that the browser signed what we asked for, on one of our origins
+func verifyClientData(r *http.Request, raw []byte, kind string, challenge string) error {
+	cd := struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}{}
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return E("client data is not valid JSON")
+	}
+	if cd.Type != kind {
+		return E(F("client data type must be '%s'", kind))
+	}
+	if len(challenge) == 0 || strings.TrimRight(cd.Challenge, "=") != challenge {
+		return E("challenge does not match, please try again")
+	}
+	if !Contains(passkeyOrigins(r), cd.Origin) {
+		return E(F("origin '%s' is not allowed", cd.Origin))
+	}
+	return nil
+}
+
+// AuthData is the parsed authenticator data of a registration or login
+type AuthData struct {
+	flags      byte
+	signCount  uint32
+	credential []byte
+	publicKey  []byte
+}
+
+func parseAuthData(r *http.Request, b []byte, attested bool) (AuthData, error) {
+	ad := AuthData{}
+	if len(b) < 37 {
+		return ad, E("authenticator data is too short")
+	}
+	rpHash := sha256.Sum256([]byte(passkeyRPID(r)))
+	if !bytes.Equal(b[:32], rpHash[:]) {
+		return ad, E("passkey is for another site")
+	}
+	ad.flags = b[32]
+	if ad.flags&flagUserPresent == 0 {
+		return ad, E("user was not present")
+	}
+	ad.signCount = binary.BigEndian.Uint32(b[33:37])
+	if !attested {
+		return ad, nil
+	}
+	// aaguid, then the length of the credential ID
+	if ad.flags&flagAttested == 0 || len(b) < 55 {
+		return ad, E("authenticator data has no credential")
+	}
+	l := int(binary.BigEndian.Uint16(b[53:55]))
+	if len(b) < 55+l {
+		return ad, E("authenticator data is too short")
+	}
+	ad.credential = b[55 : 55+l]
+	_, rest, err := cborDecode(b[55+l:])
+	if err != nil {
+		return ad, err
+	}
+	ad.publicKey = b[55+l : len(b)-len(rest)]
+	return ad, nil
+}
+
+// parseCOSEKey reads a public key in the algorithms of pubKeyCredParams
+func parseCOSEKey(b []byte) (crypto.PublicKey, int64, error) {
+	v, _, err := cborDecode(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, E("public key is not a COSE key")
+	}
+	alg, _ := m[int64(3)].(int64)
+	switch alg {
+	case coseES256:
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if m[int64(1)] != int64(2) || m[int64(-1)] != int64(1) || len(x) != 32 || len(y) != 32 {
+			return nil, 0, E("invalid ES256 key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, E("invalid ES256 key")
+		}
+		return pub, alg, nil
+	case coseEdDSA:
+		x, _ := m[int64(-2)].([]byte)
+		if m[int64(1)] != int64(1) || m[int64(-1)] != int64(6) || len(x) != ed25519.PublicKeySize {
+			return nil, 0, E("invalid EdDSA key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case coseRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if m[int64(1)] != int64(3) || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, E("invalid RS256 key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+	return nil, 0, E(F("unsupported key algorithm %d", alg))
+}
+
+func verifyPasskeySignature(pub crypto.PublicKey, alg int64, data []byte, sig []byte) bool {
+	h := sha256.Sum256(data)
+	switch alg {
+	case coseES256:
+		esig := struct{ R, S *big.Int }{}
+		if _, err := asn1.Unmarshal(sig, &esig); err != nil {
+			return false
+		}
+		return ecdsa.Verify(pub.(*ecdsa.PublicKey), h[:], esig.R, esig.S)
+	case coseEdDSA:
+		return ed25519.Verify(pub.(ed25519.PublicKey), data, sig)
+	case coseRS256:
+		return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, h[:], sig) == nil
+	}
+	return false
+}
+
+//
+//
+
+// handler for http://andesite/login?with=passkey
+func handlePasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if helperIsLoggedIn(r) {
+		handleLoginDone(w, r)
+		return
+	}
+	writeHandlebarsFile(r, w, "/login_passkey.hbs", map[string]interface{}{
+		"base": httpBase,
+	})
+}
+
+// handler for http://andesite/api/login/passkey/begin
+func handlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !loginProviderEnabled("passkey") {
+		writeAPIResponse(r, w, false, "Passkeys are not enabled")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"publicKey": map[string]interface{}{
+			"challenge":        newPasskeyChallenge(r, w),
+			"rpId":             passkeyRPID(r),
+			"timeout":          passkeyWait,
+			"userVerification": "preferred",
+		},
+	})
+}
+
+// handler for http://andesite/api/login/passkey/finish
+func handlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !loginProviderEnabled("passkey") {
+		writeAPIResponse(r, w, false, "Passkeys are not enabled")
+		return
+	}
+	r.ParseForm()
+	if !checkLockout(r, w, AuthPasskey, "") {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "id", Kind: FieldString, MaxLen: 1024},
+		FormField{Name: "client_data", Kind: FieldString, MaxLen: 4096},
+		FormField{Name: "authenticator_data", Kind: FieldString, MaxLen: 4096},
+		FormField{Name: "signature", Kind: FieldString, MaxLen: 2048},
+	)
+	if !ok {
+		return
+	}
+	challenge := takePasskeyChallenge(r, w)
+	fail := func(msg string) {
+		recordAuthFailure(r, AuthPasskey, "")
+		writeAPIResponse(r, w, false, msg)
+	}
+	pk, found := queryPasskeyByCredential(strings.TrimRight(vf.Get("id"), "="))
+	clientData, err1 := unb64url(vf.Get("client_data"))
+	authData, err2 := unb64url(vf.Get("authenticator_data"))
+	sig, err3 := unb64url(vf.Get("signature"))
+	if !found || err1 != nil || err2 != nil || err3 != nil {
+		fail("Unknown passkey")
+		return
+	}
+	if err := verifyClientData(r, clientData, "webauthn.get", challenge); err != nil {
+		fail(err.Error())
+		return
+	}
+	ad, err := parseAuthData(r, authData, false)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	keyBytes, _ := unb64url(pk.publicKey)
+	pub, alg, err := parseCOSEKey(keyBytes)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	cdHash := sha256.Sum256(clientData)
+	if !verifyPasskeySignature(pub, alg, append(authData, cdHash[:]...), sig) {
+		fail("Invalid passkey signature")
+		return
+	}
+	// authenticators that count always go up, one that goes back may have been cloned
+	if ad.signCount != 0 && pk.signCount != 0 && ad.signCount <= pk.signCount {
+		auditFailure(r, strconv.Itoa(pk.user), "login", "passkey", "signature counter went backwards")
+		fail("This passkey may have been copied, please remove it and add it again")
+		return
+	}
+	user, ok := queryUserByID(pk.user)
+	if !ok || !loginProviderEnabled(user.provider) {
+		fail("The account of this passkey no longer exists")
+		return
+	}
+	clearAuthFailures(AuthPasskey, "")
+	database.QueryPrepared(true, "update passkeys set sign_count = ?, used = ? where id = ?", ad.signCount, timeNow(), pk.id)
+
+	// log in as the provider the account is from, so its gate still applies
+	lp := loginProviderOf(user.snowflake)
+	_, stored := dbSnowflake(user.snowflake)
+	helperOA2SaveInfo(lp)(w, r, "passkey", stored[len(lp.dbp):], user.name)
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"location": httpBase + "login/done",
+	})
+}
+
+// handler for http://andesite/api/account/passkeys
+func handlePasskeyList(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"passkeys": passkeyList(user),
+	})
+}
+
+// passkeyList is what /api/account/passkeys lists of the passkeys of user, which /me includes
+func passkeyList(user UserRow) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, item := range queryPasskeysOf(user.id) {
+		result = append(result, map[string]interface{}{
+			"id":      item.id,
+			"name":    item.name,
+			"created": item.created,
+			"used":    item.used,
+		})
+	}
+	return result
+}
+
+// handler for http://andesite/api/account/passkeys/begin
+func handlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	if !loginProviderEnabled("passkey") || user.provider == "proxy" {
+		writeAPIResponse(r, w, false, "Passkeys are not enabled for your account")
+		return
+	}
+	exclude := []map[string]string{}
+	for _, item := range queryPasskeysOf(user.id) {
+		exclude = append(exclude, map[string]string{"type": "public-key", "id": item.credential})
+	}
+	params := []map[string]interface{}{}
+	for _, alg := range []int{coseES256, coseEdDSA, coseRS256} {
+		params = append(params, map[string]interface{}{"type": "public-key", "alg": alg})
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": "good",
+		"publicKey": map[string]interface{}{
+			"challenge": newPasskeyChallenge(r, w),
+			"rp": map[string]string{
+				"id":   passkeyRPID(r),
+				"name": "Andesite",
+			},
+			"user": map[string]string{
+				"id":          b64url([]byte(strconv.Itoa(user.id))),
+				"name":        user.snowflake,
+				"displayName": displayName(user.snowflake, user.name),
+			},
+			"pubKeyCredParams":   params,
+			"excludeCredentials": exclude,
+			"timeout":            passkeyWait,
+			"attestation":        "none",
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "required",
+				"userVerification": "preferred",
+			},
+		},
+	})
+}
+
+// handler for http://andesite/api/account/passkeys/finish
+func handlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w,
+		FormField{Name: "client_data", Kind: FieldString, MaxLen: 4096},
+		FormField{Name: "attestation", Kind: FieldString, MaxLen: 8192},
+		FormField{Name: "name", Kind: FieldString, MaxLen: 64, Optional: true},
+	)
+	if !ok {
+		return
+	}
+	if !loginProviderEnabled("passkey") || user.provider == "proxy" {
+		writeAPIResponse(r, w, false, "Passkeys are not enabled for your account")
+		return
+	}
+	challenge := takePasskeyChallenge(r, w)
+	clientData, err1 := unb64url(vf.Get("client_data"))
+	attestation, err2 := unb64url(vf.Get("attestation"))
+	if err1 != nil || err2 != nil {
+		writeAPIResponse(r, w, false, "Invalid passkey response")
+		return
+	}
+	if err := verifyClientData(r, clientData, "webauthn.create", challenge); err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	// attestation is "none", so only the authenticator data is looked at
+	v, _, err := cborDecode(attestation)
+	m, ok := v.(map[interface{}]interface{})
+	if err != nil || !ok {
+		writeAPIResponse(r, w, false, "Invalid attestation object")
+		return
+	}
+	authData, _ := m["authData"].([]byte)
+	ad, err := parseAuthData(r, authData, true)
+	if err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	if _, _, err := parseCOSEKey(ad.publicKey); err != nil {
+		writeAPIResponse(r, w, false, err.Error())
+		return
+	}
+	cid := b64url(ad.credential)
+	if _, found := queryPasskeyByCredential(cid); found {
+		writeAPIResponse(r, w, false, "This passkey has already been added")
+		return
+	}
+	name := strings.TrimSpace(vf.Get("name"))
+	if len(name) == 0 {
+		name = "Passkey"
+	}
+	id, err := database.QueryNextID("passkeys")
+	if err != nil {
+		writeAPIResponse(r, w, false, F("The passkey could not be saved: %s", err.Error()))
+		return
+	}
+	database.QueryPrepared(true, "insert into passkeys (id, user, credential, public_key, sign_count, name, created, used) values (?, ?, ?, ?, ?, ?, ?, ?)", id, user.id, cid, b64url(ad.publicKey), ad.signCount, name, timeNow(), "")
+	auditLog(r, user.snowflake, "passkey.create", user.snowflake, name)
+	writeAPIResponse(r, w, true, F("Added passkey '%s'.", name))
+}
+
+// handler for http://andesite/api/account/passkeys/delete
+func handlePasskeyDelete(w http.ResponseWriter, r *http.Request) {
+	_, user, errr := apiBootstrapRequireLogin(r, w, http.MethodPost, false)
+	if errr != nil {
+		return
+	}
+	vf, ok := validateForm(r, w, FormField{Name: "id", Kind: FieldInt})
+	if !ok {
+		return
+	}
+	for _, item := range queryPasskeysOf(user.id) {
+		if item.id == vf.Int("id") {
+			database.QueryPrepared(true, "delete from passkeys where id = ?", item.id)
+			auditLog(r, user.snowflake, "passkey.delete", user.snowflake, item.name)
+			writeAPIResponse(r, w, true, F("Removed passkey '%s'.", item.name))
+			return
+		}
+	}
+	writeAPIResponse(r, w, false, "Passkey does not exist")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+const testRPID = "files.example.com"
+
+// withPasskeyConfig makes passkeys bound to testRPID for the duration of a test
+func withPasskeyConfig(t *testing.T) *http.Request {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config = &Config{WebAuthn: ConfigWebAuthn{RPID: testRPID, Origins: []string{"https://" + testRPID}}}
+	r, _ := http.NewRequest(http.MethodPost, "https://"+testRPID+"/api/login/passkey/finish", nil)
+	return r
+}
+
+// testAuthData builds authenticator data for rpID, with the credential and its COSE key when
+// cose is given
+func testAuthData(rpID string, flags byte, count uint32, credential []byte, cose []byte) []byte {
+	h := sha256.Sum256([]byte(rpID))
+	b := append(h[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], count)
+	if cose == nil {
+		return b
+	}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, byte(len(credential)>>8), byte(len(credential)))
+	b = append(b, credential...)
+	return append(b, cose...)
+}
+
+func testES256Key(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return key, cborEncode(map[interface{}]interface{}{
+		int64(1): int64(2), int64(3): int64(coseES256), int64(-1): int64(1), int64(-2): x, int64(-3): y,
+	})
+}
+
+func testClientData(kind string, challenge string, origin string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": kind, "challenge": challenge, "origin": origin})
+	return b
+}
+
+func TestParseAttestation(t *testing.T) {
+	r := withPasskeyConfig(t)
+	_, cose := testES256Key(t)
+	credential := []byte("credential-id")
+	attestation := cborEncode(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": testAuthData(testRPID, flagUserPresent|flagAttested, 0, credential, cose),
+	})
+
+	// the same steps as handlePasskeyRegisterFinish
+	v, _, err := cborDecode(attestation)
+	m, ok := v.(map[interface{}]interface{})
+	if err != nil || !ok {
+		t.Fatalf("attestation object decoded to %#v, %v", v, err)
+	}
+	authData, _ := m["authData"].([]byte)
+	ad, err := parseAuthData(r, authData, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ad.credential) != string(credential) {
+		t.Errorf("credential is %q, want %q", ad.credential, credential)
+	}
+	if string(ad.publicKey) != string(cose) {
+		t.Errorf("public key is %x, want %x", ad.publicKey, cose)
+	}
+	if _, alg, err := parseCOSEKey(ad.publicKey); err != nil || alg != coseES256 {
+		t.Errorf("parseCOSEKey = %d, %v, want %d", alg, err, coseES256)
+	}
+}
+
+func TestParseAuthDataInvalid(t *testing.T) {
+	r := withPasskeyConfig(t)
+	_, cose := testES256Key(t)
+	good := testAuthData(testRPID, flagUserPresent|flagAttested, 0, []byte("id"), cose)
+	cases := []struct {
+		name     string
+		data     []byte
+		attested bool
+	}{
+		{"empty", nil, false},
+		{"too short", good[:36], false},
+		{"other site", testAuthData("evil.example.com", flagUserPresent, 1, nil, nil), false},
+		{"user not present", testAuthData(testRPID, 0, 1, nil, nil), false},
+		{"no credential", testAuthData(testRPID, flagUserPresent, 0, nil, nil), true},
+		{"not flagged attested", testAuthData(testRPID, flagUserPresent, 0, []byte("id"), cose), true},
+		{"credential length past the end", append(good[:53:53], 0xff, 0xff), true},
+		{"truncated key", good[:len(good)-4], true},
+	}
+	for _, item := range cases {
+		if _, err := parseAuthData(r, item.data, item.attested); err == nil {
+			t.Errorf("%s: parsed, want an error", item.name)
+		}
+	}
+}
+
+func TestParseCOSEKeyInvalid(t *testing.T) {
+	_, cose := testES256Key(t)
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	cases := []struct {
+		name string
+		key  interface{}
+	}{
+		{"not a map", []interface{}{int64(1)}},
+		{"unknown algorithm", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(-36)}},
+		{"ES256 short coordinates", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(coseES256), int64(-1): int64(1), int64(-2): []byte{1}, int64(-3): []byte{2}}},
+		{"ES256 off the curve", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(coseES256), int64(-1): int64(1), int64(-2): make([]byte, 32), int64(-3): make([]byte, 32)}},
+		{"EdDSA wrong curve", map[interface{}]interface{}{int64(1): int64(1), int64(3): int64(coseEdDSA), int64(-1): int64(4), int64(-2): []byte(pub)}},
+		{"RS256 short modulus", map[interface{}]interface{}{int64(1): int64(3), int64(3): int64(coseRS256), int64(-1): make([]byte, 64), int64(-2): []byte{1, 0, 1}}},
+	}
+	for _, item := range cases {
+		if _, _, err := parseCOSEKey(cborEncode(item.key)); err == nil {
+			t.Errorf("%s: parsed, want an error", item.name)
+		}
+	}
+	if _, _, err := parseCOSEKey(cose[:len(cose)-1]); err == nil {
+		t.Error("truncated key parsed, want an error")
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	r := withPasskeyConfig(t)
+	key, cose := testES256Key(t)
+	pub, alg, err := parseCOSEKey(cose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authData := testAuthData(testRPID, flagUserPresent, 7, nil, nil)
+	clientData := testClientData("webauthn.get", "challenge", "https://"+testRPID)
+	if err := verifyClientData(r, clientData, "webauthn.get", "challenge"); err != nil {
+		t.Fatal(err)
+	}
+	ad, err := parseAuthData(r, authData, false)
+	if err != nil || ad.signCount != 7 {
+		t.Fatalf("parseAuthData = %d, %v, want 7", ad.signCount, err)
+	}
+
+	// the same steps as handlePasskeyLoginFinish
+	cdHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), cdHash[:]...)
+	h := sha256.Sum256(signed)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyPasskeySignature(pub, alg, signed, sig) {
+		t.Error("valid signature was refused")
+	}
+	tampered := append([]byte{}, signed...)
+	tampered[32] ^= 0x04
+	if verifyPasskeySignature(pub, alg, tampered, sig) {
+		t.Error("signature over other data was accepted")
+	}
+	if verifyPasskeySignature(pub, alg, signed, sig[:len(sig)-1]) {
+		t.Error("truncated signature was accepted")
+	}
+	other, _ := testES256Key(t)
+	otherSig, _ := ecdsa.SignASN1(rand.Reader, other, h[:])
+	if verifyPasskeySignature(pub, alg, signed, otherSig) {
+		t.Error("signature of another key was accepted")
+	}
+}
+
+func TestVerifyEdDSASignature(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	cose := cborEncode(map[interface{}]interface{}{
+		int64(1): int64(1), int64(3): int64(coseEdDSA), int64(-1): int64(6), int64(-2): []byte(pub),
+	})
+	key, alg, err := parseCOSEKey(cose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("authenticator data and client data hash")
+	if !verifyPasskeySignature(key, alg, data, ed25519.Sign(priv, data)) {
+		t.Error("valid signature was refused")
+	}
+	if verifyPasskeySignature(key, alg, append(data, 0), ed25519.Sign(priv, data)) {
+		t.Error("signature over other data was accepted")
+	}
+}
+
+func TestVerifyClientDataInvalid(t *testing.T) {
+	r := withPasskeyConfig(t)
+	origin := "https://" + testRPID
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"not JSON", []byte("{")},
+		{"wrong type", testClientData("webauthn.create", "challenge", origin)},
+		{"wrong challenge", testClientData("webauthn.get", "other", origin)},
+		{"wrong origin", testClientData("webauthn.get", "challenge", "https://evil.example.com")},
+	}
+	for _, item := range cases {
+		if err := verifyClientData(r, item.data, "webauthn.get", "challenge"); err == nil {
+			t.Errorf("%s: accepted, want an error", item.name)
+		}
+	}
+	if err := verifyClientData(r, testClientData("webauthn.get", "", origin), "webauthn.get", ""); err == nil {
+		t.Error("empty challenge accepted, want an error")
+	}
+}
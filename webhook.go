@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/nektro/go-util/alias"
+	. "github.com/nektro/go-util/util"
+)
+
+const (
+	FileEventAdd    = "add"
+	FileEventRemove = "remove"
+	FileEventModify = "modify"
+	// a file that the scrubber found no longer matches its checksum
+	FileEventCorrupt = "corrupt"
+
+	webhookMaxAttempts = 5
+)
+
+// a receiver that never answers would otherwise hold on to its goroutine forever
+var webhookClient = &http.Client{Timeout: time.Second * 10}
+
+func validateWebhookConfig(cfg *Config) error {
+	for _, item := range cfg.Webhooks {
+		if !strings.HasPrefix(item.URL, "http://") && !strings.HasPrefix(item.URL, "https://") {
+			return E(F("Invalid webhook url '%s'", item.URL))
+		}
+		for _, ev := range item.Events {
+			switch ev {
+			case FileEventAdd, FileEventRemove, FileEventModify, FileEventCorrupt:
+			default:
+				return E(F("Invalid webhook event '%s', must be one of '%s', '%s', '%s', '%s'", ev, FileEventAdd, FileEventRemove, FileEventModify, FileEventCorrupt))
+			}
+		}
+	}
+	return nil
+}
+
+// sends event to every webhook subscribed to it, without blocking the watcher
+func fireFileWebhooks(event string, path string) {
+	for _, item := range config.Webhooks {
+		if len(item.Events) > 0 && !Contains(item.Events, event) {
+			continue
+		}
+		if !strings.HasPrefix(path, item.Path) {
+			continue
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"event": event,
+			"path":  path,
+			"time":  timeNow(),
+		})
+		go sendWebhook(item, body)
+	}
+}
+
+func sendWebhook(hook ConfigWebhook, body []byte) {
+	wait := time.Second
+	for i := 1; i <= webhookMaxAttempts; i++ {
+		req, _ := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "nektro/andesite")
+		if len(hook.Secret) > 0 {
+			mac := hmac.New(sha256.New, []byte(hook.Secret))
+			mac.Write(body)
+			req.Header.Set("X-Andesite-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := webhookClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = E(resp.Status)
+		}
+		LogError("[webhook]", hook.URL, F("attempt %d/%d:", i, webhookMaxAttempts), err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
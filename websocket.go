@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	. "github.com/nektro/go-util/alias"
+)
+
+const (
+	// a client this many events behind is disconnected rather than holding up the watcher, and
+	// has to look again at what it cares about when it reconnects
+	wsQueueSize = 256
+	// how often the session and access of a connected user are checked again
+	wsRecheckEvery = time.Second * 30
+)
+
+// FileEvent is a change to a file as it is sent to WebSocket clients
+type FileEvent struct {
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Path  string `json:"path"`
+	Time  string `json:"time"`
+}
+
+// WSRequest is a message from a WebSocket client
+type WSRequest struct {
+	Type string `json:"type"`
+	ID   int    `json:"id"`
+	Q    string `json:"q"`
+	Path string `json:"path"`
+}
+
+// WSClient is a connection to /ws, the events for it wait in queue
+type WSClient struct {
+	conn  *websocket.Conn
+	queue chan FileEvent
+}
+
+var wsClients = struct {
+	sync.Mutex
+	clients map[*WSClient]bool
+}{clients: map[*WSClient]bool{}}
+
+// hijackThrough hands over the connection of w, the writer a wrapping writer wraps
+func hijackThrough(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, E("the connection can not be taken over")
+}
+
+// fireFileEvent tells webhooks and WebSocket clients that event happened to path, unless path is
+// one that listings leave out
+func fireFileEvent(event string, path string) {
+	if isInternalPath(path) || isIgnoredPath(path) {
+		return
+	}
+	if event != FileEventCorrupt {
+		recordFileChange(event, path)
+	}
+	fireFileWebhooks(event, path)
+	publishFileEvent(event, path)
+}
+
+// publishFileEvent queues event for every WebSocket client, each decides on its own whether its
+// user may see it
+func publishFileEvent(event string, path string) {
+	ev := FileEvent{"event", event, path, timeNow()}
+	wsClients.Lock()
+	defer wsClients.Unlock()
+	for c := range wsClients.clients {
+		select {
+		case c.queue <- ev:
+		default:
+			c.conn.Close()
+			delete(wsClients.clients, c)
+		}
+	}
+}
+
+// checkWSOrigin refuses connections from pages of other sites, which a browser would otherwise
+// open with the session cookie of the user. Clients that are not browsers send no Origin.
+func checkWSOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(cfg, r)
+	if err != nil {
+		return err
+	}
+	if origin != nil && !strings.EqualFold(origin.Scheme+"://"+origin.Host, fullHost(r)) {
+		return E("cross-origin WebSocket refused")
+	}
+	cfg.Origin = origin
+	return nil
+}
+
+// serveWSClient answers the requests of one client and sends it the events its user may see, until
+// either side closes the connection or the session ends. Searches count against the request rate
+// limit of key like those to /api/search do.
+func serveWSClient(conn *websocket.Conn, user UserRow, sid string, key string) {
+	c := &WSClient{conn, make(chan FileEvent, wsQueueSize)}
+	wsClients.Lock()
+	wsClients.clients[c] = true
+	wsClients.Unlock()
+	// closed once this returns, so that the reader below is not left waiting to hand over a request
+	done := make(chan struct{})
+	defer func() {
+		wsClients.Lock()
+		delete(wsClients.clients, c)
+		wsClients.Unlock()
+		close(done)
+		conn.Close()
+	}()
+
+	requests := make(chan WSRequest)
+	go func() {
+		defer close(requests)
+		for {
+			var req WSRequest
+			if err := websocket.JSON.Receive(conn, &req); err != nil {
+				return
+			}
+			select {
+			case requests <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	access := queryAccess(user)
+	prefix := "/"
+	send := func(v interface{}) bool {
+		return websocket.JSON.Send(conn, v) == nil
+	}
+	send(map[string]interface{}{
+		"type":    "hello",
+		"user":    user.snowflake,
+		"warming": indexWarming(),
+	})
+	recheck := time.NewTicker(wsRecheckEvery)
+	defer recheck.Stop()
+	for {
+		ok := true
+		select {
+		case req, open := <-requests:
+			if !open {
+				return
+			}
+			switch req.Type {
+			case "subscribe":
+				p, err := sanitizePath(req.Path)
+				if err != nil {
+					ok = send(map[string]interface{}{"type": "error", "id": req.ID, "message": F("Invalid path: %s", err.Error())})
+					break
+				}
+				prefix = p
+				ok = send(map[string]interface{}{"type": "subscribed", "id": req.ID, "path": prefix})
+			case "search":
+				if limits := rateLimits(); limits.requests != nil && isPathRateLimited(limits, "/api/search") {
+					if allowed, wait := limits.requests.allow(key); !allowed {
+						ok = send(map[string]interface{}{"type": "error", "id": req.ID, "message": F("You are searching too quickly, try again in %d seconds", int(math.Ceil(wait.Seconds())))})
+						break
+					}
+				}
+				results := []WatchedFile{}
+				if len(req.Q) > 0 {
+					results = searchFiles(access, req.Q)
+				}
+				ok = send(map[string]interface{}{"type": "results", "id": req.ID, "q": req.Q, "results": results, "warming": indexWarming()})
+			case "ping":
+				ok = send(map[string]interface{}{"type": "pong", "id": req.ID})
+			default:
+				ok = send(map[string]interface{}{"type": "error", "id": req.ID, "message": F("Unknown request type '%s'", req.Type)})
+			}
+		case ev := <-c.queue:
+			if strings.HasPrefix(ev.Path, prefix) && hasPathAccess(access, ev.Path) {
+				ok = send(ev)
+			}
+		case <-recheck.C:
+			// a revoked session or suspended user is disconnected, and changes to access apply
+			if _, found := querySessionBySID(sid); len(sid) > 0 && !found {
+				return
+			}
+			u, found := queryUserByID(user.id)
+			if !found || !u.enabled {
+				return
+			}
+			access = queryAccess(u)
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+//
+//
+
+// handler for http://andesite/ws
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	sess, user, errr := apiBootstrapRequireLogin(r, w, http.MethodGet, false)
+	if errr != nil {
+		return
+	}
+	if _, ok := w.(http.Hijacker); !ok {
+		writeAPIResponse(r, w, false, "This server can not accept WebSocket connections")
+		return
+	}
+	sid, _ := sess.Values["sid"].(string)
+	key := rateLimitKey(r)
+	websocket.Server{
+		Handshake: checkWSOrigin,
+		Handler: func(conn *websocket.Conn) {
+			serveWSClient(conn, user, sid, key)
+		},
+	}.ServeHTTP(w, r)
+}
@@ -0,0 +1,529 @@
+// Andesite admin dashboard
+// Everything on the page is driven by the JSON admin API, see /api/spec.
+(function() {
+    "use strict";
+
+    const base = Andesite.base;
+
+    function esc(s) {
+        return $("<div>").text(s === undefined || s === null ? "" : String(s)).html();
+    }
+
+    // bad responses are shown to the admin rather than thrown, see andesite.js
+    function api(method, path, data) {
+        return Andesite.api(method, path, data).catch((err) => err.response || { response: "bad", message: err.message });
+    }
+
+    // POSTs to path, walking the user through the confirmation step for destructive actions
+    function post(path, data) {
+        return Andesite.post(path, data)
+            .catch((err) => err.response || { response: "bad", message: err.message })
+            .then((res) => {
+                if (res === null) {
+                    return {};
+                }
+                notify(res);
+                return res;
+            });
+    }
+
+    function notify(res) {
+        const m = $("#messages");
+        const el = $(`<div class="ui ${res.response === "good" ? "positive" : "negative"} message">${esc(res.message)}</div>`);
+        m.prepend(el);
+        setTimeout(() => el.remove(), 5000);
+    }
+
+    function formData(form) {
+        const data = {};
+        $(form).serializeArray().forEach((x) => { data[x.name] = x.value; });
+        return data;
+    }
+
+    function bindForms(el, refresh) {
+        el.find("button[data-action]").on("click", function(e) {
+            e.preventDefault();
+            post($(this).data("action"), formData($(this).closest("tr").find("input"))).then(refresh);
+        });
+    }
+
+    function loadAccess() {
+        api("GET", "/api/access/list").then((res) => {
+            const tb = $("#tab_users tbody").empty();
+            (res.accesses || []).forEach((x) => {
+                tb.append(`<tr>
+                    <td><input type="hidden" name="id" value="${esc(x.id)}"><input type="text" name="snowflake" value="${esc(x.snowflake)}"></td>
+                    <td><input type="text" name="name" value="${esc(x.name)}" readonly></td>
+                    <td><input type="text" name="path" value="${esc(x.path)}"></td>
+                    <td><input type="text" name="perms" value="${esc(x.perms)}" placeholder="read"></td>
+                    <td><button class="ui button" data-action="/api/access/update">Update</button></td>
+                    <td><button class="ui button" data-action="/api/access/delete">Delete</button></td>
+                </tr>`);
+            });
+            tb.append(`<tr>
+                <td><input type="text" name="snowflake" placeholder="User Snowflake"></td>
+                <td colspan="2"><input type="text" name="path" placeholder="Path"></td>
+                <td><input type="text" name="perms" placeholder="write,delete"></td>
+                <td colspan="2"><button class="ui button" data-action="/api/access/create">Add Access</button></td>
+            </tr>`);
+            bindForms(tb, loadAccess);
+        });
+    }
+
+    function loadRequests() {
+        api("GET", "/api/admin/requests").then((res) => {
+            const tb = $("#tab_requests tbody").empty();
+            (res.requests || []).forEach((x) => {
+                tb.append(`<tr>
+                    <td><input type="hidden" name="id" value="${esc(x.id)}">${esc(x.name || x.snowflake)}</td>
+                    <td>${esc(x.path)}</td>
+                    <td>${esc(x.reason)}</td>
+                    <td>${esc(new Date(x.created).toLocaleString())}</td>
+                    <td><input type="text" name="note" placeholder="Optional"></td>
+                    <td><button class="ui positive button" data-action="/api/admin/requests/approve">Approve</button></td>
+                    <td><button class="ui button" data-action="/api/admin/requests/deny">Deny</button></td>
+                </tr>`);
+            });
+            if (!res.requests || res.requests.length === 0) {
+                tb.append(`<tr><td colspan="7">No requests are waiting.</td></tr>`);
+            }
+            bindForms(tb, () => { loadRequests(); loadAccess(); });
+        });
+    }
+
+    function loadInvites() {
+        api("GET", "/api/admin/invites").then((res) => {
+            const tb = $("#tab_invites tbody").empty();
+            (res.invites || []).forEach((x) => {
+                tb.append(`<tr class="${x.usable ? "" : "disabled"}">
+                    <td><input type="hidden" name="code" value="${esc(x.code)}"><input type="text" value="${esc(x.link)}" readonly></td>
+                    <td>${esc(x.paths.join(", "))}</td>
+                    <td>${esc(x.uses)} / ${x.max_uses ? esc(x.max_uses) : "&infin;"}</td>
+                    <td>${x.expires ? esc(new Date(x.expires).toLocaleString()) : "Never"}</td>
+                    <td>${esc(x.note)}</td>
+                    <td><button class="ui button" data-action="/api/admin/invites/delete">Delete</button></td>
+                </tr>`);
+            });
+            bindForms(tb, loadInvites);
+        });
+    }
+
+    // quotaInput shows a user's own quota, or the default as the placeholder
+    function quotaInput(name, q, unit = "") {
+        const limit = q.limit ? q.limit_size + unit : "unlimited";
+        const title = unit ? "" : `${q.used_size} used`;
+        if (q.default) {
+            return `<input type="text" name="${name}" placeholder="${esc(limit)}" title="${esc(title)}" size="10">`;
+        }
+        return `<input type="text" name="${name}" value="${esc(q.limit ? q.limit_size : "0")}" title="${esc(title)}" size="10">`;
+    }
+
+    function loadUsers() {
+        api("GET", "/api/users").then((res) => {
+            const tb = $("#tab_people tbody").empty();
+            (res.users || []).forEach((x) => {
+                const row = $(`<tr class="${x.enabled ? "" : "negative"}" title="${x.enabled ? "" : esc("Suspended " + x.reason)}">
+                    <td><input type="text" name="snowflake" value="${esc(x.snowflake)}" readonly></td>
+                    <td><input type="text" name="name" value="${esc(x.name)}"></td>
+                    <td>${esc(x.provider)}</td>
+                    <td>${x.last_login ? esc(new Date(x.last_login).toLocaleString()) : "Never"}</td>
+                    <td>${esc(x.accesses)}</td>
+                    <td>${quotaInput("quota_storage", x.quotas.storage)}</td>
+                    <td>${quotaInput("quota_bandwidth", x.quotas.bandwidth)}</td>
+                    <td>${quotaInput("quota_speed", x.quotas.speed, "/s")}</td>
+                    <td><button class="ui button" data-do="quota">Set Quotas</button></td>
+                    <td><button class="ui button" data-do="recount">Recount Storage</button></td>
+                    <td><button class="ui button" data-do="rename">Rename</button></td>
+                    <td><button class="ui button" data-do="admin">${x.admin ? "Demote" : "Promote"}</button></td>
+                    <td><button class="ui button" data-do="suspend">${x.enabled ? "Suspend" : "Unsuspend"}</button></td>
+                    <td><button class="ui button" data-do="delete">Delete</button></td>
+                </tr>`);
+                const data = { snowflake: x.snowflake };
+                const refresh = () => { loadUsers(); loadAccess(); };
+                row.find("[data-do=rename]").on("click", () => post("/api/users/update", Object.assign({ name: row.find("[name=name]").val() }, data)).then(refresh));
+                row.find("[data-do=quota]").on("click", () => post("/api/users/update", Object.assign({
+                    quota_storage: row.find("[name=quota_storage]").val(),
+                    quota_bandwidth: row.find("[name=quota_bandwidth]").val(),
+                    quota_speed: row.find("[name=quota_speed]").val(),
+                }, data)).then(refresh));
+                row.find("[data-do=recount]").on("click", () => post("/api/users/update", Object.assign({ recount_stored: "1" }, data)).then(refresh));
+                row.find("[data-do=admin]").on("click", () => post("/api/users/update", Object.assign({ admin: x.admin ? "0" : "1" }, data)).then(refresh));
+                row.find("[data-do=suspend]").on("click", () => {
+                    if (!x.enabled) {
+                        post("/api/users/unsuspend", data).then(refresh);
+                        return;
+                    }
+                    const reason = window.prompt(`Why is ${x.snowflake} being suspended? They will see this.`, "");
+                    if (reason !== null) {
+                        post("/api/users/suspend", Object.assign({ reason: reason }, data)).then(refresh);
+                    }
+                });
+                row.find("[data-do=delete]").on("click", () => post("/api/users/delete", data).then(refresh));
+                tb.append(row);
+            });
+            tb.append(`<tr>
+                <td><input type="text" name="snowflake" placeholder="User Snowflake"></td>
+                <td><input type="text" name="name" placeholder="Name (optional)"></td>
+                <td colspan="11"><button class="ui button" data-action="/api/users/create">Add User</button></td>
+            </tr>`);
+            tb.append(`<tr>
+                <td colspan="2"><input type="text" name="snowflake" placeholder="Snowflake, also of deleted users"></td>
+                <td colspan="11"><button class="ui button" data-action="/api/admin/users/purge">Purge User Data</button></td>
+            </tr>`);
+            bindForms(tb, loadUsers);
+        });
+    }
+
+    function loadShares() {
+        api("GET", "/api/share/list").then((res) => {
+            const tb = $("#tab_shares tbody").empty();
+            (res.shares || []).forEach((x) => {
+                tb.append(`<tr>
+                    <td><input type="hidden" name="id" value="${esc(x.id)}"><input type="text" name="hash" value="${esc(x.hash)}" readonly></td>
+                    <td><input type="text" name="path" value="${esc(x.path)}"></td>
+                    <td><input type="text" name="perms" value="${esc(x.perms || "browse,download,stream")}"></td>
+                    <td>${x.expires ? esc(new Date(x.expires).toLocaleString()) : "Never"}</td>
+                    <td><button class="ui button" data-action="/api/share/update">Update</button></td>
+                    <td><button class="ui button" data-action="/api/share/delete">Delete</button></td>
+                    <td><a href="${base}open/${esc(x.hash)}${esc(x.path)}" target="_blank">Open</a></td>
+                </tr>`);
+            });
+            tb.append(`<tr>
+                <td colspan="2"><input type="text" name="path" placeholder="Path"></td>
+                <td><input type="text" name="perms" placeholder="browse,download,stream"></td>
+                <td><input type="text" name="expires" placeholder="Expires after, eg. 168h"></td>
+                <td colspan="3"><button class="ui button" data-action="/api/share/create">Create Link</button></td>
+            </tr>`);
+            bindForms(tb, loadShares);
+        });
+    }
+
+    function loadLockouts() {
+        api("GET", "/api/admin/lockouts").then((res) => {
+            const tb = $("#tab_lockouts tbody").empty();
+            (res.lockouts || []).forEach((x) => {
+                tb.append(`<tr>
+                    <td><input type="hidden" name="key" value="${esc(x.key)}">${esc(x.kind)}</td>
+                    <td>${esc(x.subject)}</td>
+                    <td>${esc(x.failures)}</td>
+                    <td>${x.locked ? esc(new Date(x.until * 1000).toLocaleString()) : ""}</td>
+                    <td><button class="ui button" data-action="/api/admin/lockouts/clear">Unlock</button></td>
+                </tr>`);
+            });
+            bindForms(tb, loadLockouts);
+        });
+    }
+
+    // only shown when "local" is one of the providers in "auth"
+    function loadLocal() {
+        const tb = $("#tab_local tbody").empty();
+        tb.append(`<tr>
+            <td><input type="text" name="username" placeholder="Username"></td>
+            <td><input type="password" name="password" placeholder="Password (optional, or send them a link)"></td>
+            <td class="collapsing"><button class="ui button" data-action="/api/admin/users/create">Create Account</button></td>
+        </tr>`);
+        tb.append(`<tr>
+            <td colspan="2"><input type="text" name="snowflake" placeholder="User Snowflake"></td>
+            <td class="collapsing"><button class="ui button" data-action="/api/admin/users/reset">Reset Password</button></td>
+        </tr>`);
+        // the result may hold a reset link, so it stays on the page instead of fading out
+        tb.find("button[data-action]").on("click", function(e) {
+            e.preventDefault();
+            post($(this).data("action"), formData($(this).closest("tr").find("input"))).then((res) => {
+                $("#local_result").text(res.response === "good" ? res.message : "");
+                loadLocal();
+                loadAccess();
+            });
+        });
+    }
+
+    function loadSessions() {
+        const snowflake = $("#sessions_user").val();
+        const tb = $("#tab_sessions tbody").empty();
+        if (!snowflake) {
+            return;
+        }
+        api("GET", "/api/admin/sessions", { snowflake: snowflake }).then((res) => {
+            if (res.response !== "good") {
+                notify(res);
+                return;
+            }
+            res.sessions.forEach((x) => {
+                tb.append(`<tr>
+                    <td>${esc(new Date(x.seen).toLocaleString())}</td>
+                    <td>${esc(new Date(x.created).toLocaleString())}</td>
+                    <td>${esc(x.ip)}</td>
+                    <td>${esc(x.agent)}</td>
+                    <td><input type="hidden" name="snowflake" value="${esc(snowflake)}"><input type="hidden" name="sid" value="${esc(x.sid)}"><button class="ui button" data-action="/api/admin/sessions/revoke">Revoke</button></td>
+                </tr>`);
+            });
+            tb.append(`<tr>
+                <td colspan="4">${res.sessions.length} active sessions</td>
+                <td><input type="hidden" name="snowflake" value="${esc(snowflake)}"><button class="ui button" data-action="/api/admin/sessions/revoke">Log Out Everywhere</button></td>
+            </tr>`);
+            bindForms(tb, loadSessions);
+        });
+    }
+
+    function loadTrash() {
+        const tb = $("#trash_table tbody");
+        tb.empty();
+        api("GET", "/api/admin/trash").then((res) => {
+            if (res.response !== "good") {
+                notify(res);
+                return;
+            }
+            $("#trash_days").text(`Deleted files are kept for ${res.days} days.`);
+            res.trash.forEach((x) => {
+                tb.append(`<tr>
+                    <td>${esc(x.path)}</td>
+                    <td>${esc(x.deleter)}</td>
+                    <td>${esc(new Date(x.deleted).toLocaleString())}</td>
+                    <td>${esc(new Date(x.expires).toLocaleString())}</td>
+                    <td><input type="hidden" name="id" value="${x.id}"><button class="ui button" data-action="/api/admin/trash/restore">Restore</button><button class="ui red button" data-action="/api/admin/trash/delete">Delete</button></td>
+                </tr>`);
+            });
+            bindForms(tb, loadTrash);
+        });
+    }
+
+    function loadIntegrity() {
+        const tb = $("#integrity_table tbody");
+        tb.empty();
+        api("GET", "/api/admin/integrity").then((res) => {
+            if (res.response !== "good") {
+                notify(res);
+                return;
+            }
+            const status = `${res.verified} of ${res.total} checksums verified within ${res.every}.`;
+            $("#integrity_status").text(res.enabled ? status : "The scrubber is turned off.");
+            res.corrupt.forEach((x) => {
+                tb.append(`<tr class="negative">
+                    <td>${esc(x.path)}</td>
+                    <td><code>${esc(x.expected)}</code></td>
+                    <td><code>${esc(x.actual)}</code></td>
+                    <td>${esc(new Date(x.detected).toLocaleString())}</td>
+                    <td><input type="hidden" name="path" value="${esc(x.path)}"><button class="ui button" data-action="/api/admin/integrity/accept">Accept</button></td>
+                </tr>`);
+            });
+            if (res.corrupt.length === 0) {
+                tb.append(`<tr><td colspan="5">No damaged files have been found.</td></tr>`);
+            }
+            bindForms(tb, loadIntegrity);
+        });
+    }
+
+    function byteCount(n) {
+        const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+        let i = 0;
+        for (; n >= 1024 && i < units.length - 1; i++) {
+            n /= 1024;
+        }
+        return `${i === 0 ? n : n.toFixed(1)} ${units[i]}`;
+    }
+
+    function loadDownloads() {
+        const snowflake = $("#downloads_user").val();
+        const tb = $("#downloads_user_table tbody").empty();
+        if (!snowflake) {
+            return;
+        }
+        api("GET", "/api/admin/downloads", { snowflake: snowflake }).then((res) => {
+            if (res.response !== "good") {
+                notify(res);
+                return;
+            }
+            res.downloads.forEach((x) => {
+                tb.append(`<tr>
+                    <td>${esc(new Date(x.time).toLocaleString())}</td>
+                    <td>${esc(x.path)}</td>
+                    <td>${esc(byteCount(x.bytes))}</td>
+                    <td>${esc(x.ip)}</td>
+                </tr>`);
+            });
+        });
+    }
+
+    function loadTopDownloads() {
+        const since = new Date(Date.now() - 30 * 24 * 3600 * 1000).toISOString().replace(/\.\d+Z$/, "Z");
+        api("GET", "/api/admin/downloads/top", { since: since, limit: 25 }).then((res) => {
+            const tb = $("#downloads_top_table tbody").empty();
+            (res.files || []).forEach((x) => {
+                tb.append(`<tr>
+                    <td>${esc(x.path)}</td>
+                    <td>${esc(x.downloads)}</td>
+                    <td>${esc(x.users)}</td>
+                    <td>${esc(byteCount(x.bytes))}</td>
+                </tr>`);
+            });
+        });
+    }
+
+    function loadStats() {
+        api("GET", "/api/stats").then((res) => {
+            if (res.response !== "good") {
+                return;
+            }
+            const stat = (label, value) => `<div class="statistic"><div class="value">${esc(value)}</div><div class="label">${esc(label)}</div></div>`;
+            $("#stats_numbers").html([
+                stat("Files Indexed", res.files === undefined ? "-" : res.files),
+                stat("Bytes Indexed", res.bytes === undefined ? "-" : byteCount(res.bytes)),
+                stat("Users", res.users.total),
+                stat("Admins", res.users.admins),
+                stat("Active in 30 Days", res.users.active_30d),
+                stat("Shares", res.shares),
+                stat("Downloads in 24h", res.downloads_24h.count),
+                stat("Sent in 24h", byteCount(res.downloads_24h.bytes)),
+                stat("Watcher Backlog", res.watcher.running ? res.watcher.backlog : "-"),
+            ].join(""));
+            const tb = $("#stats_mounts tbody").empty();
+            res.mounts.forEach((x) => {
+                tb.append(`<tr>
+                    <td>${esc(x.path)}</td>
+                    <td>${x.measured ? esc(byteCount(x.bytes)) : "measuring"}</td>
+                    <td>${x.measured ? esc(new Date(x.measured * 1000).toLocaleString()) : ""}</td>
+                </tr>`);
+            });
+        });
+    }
+
+    const auditPage = 100;
+
+    // loadAudit shows the newest events matching the filter, or the next page after those shown
+    function loadAudit(more) {
+        const tb = $("#tab_audit tbody");
+        if (!more) {
+            tb.empty();
+        }
+        const q = { limit: auditPage, offset: tb.children().length };
+        $("#audit_filter").serializeArray().forEach((x) => {
+            if (!x.value) {
+                return;
+            }
+            // dates are whole days in local time
+            if (x.name === "since" || x.name === "until") {
+                const d = new Date(x.value + "T00:00:00");
+                if (x.name === "until") {
+                    d.setDate(d.getDate() + 1);
+                }
+                q[x.name] = d.toISOString().replace(/\.\d+Z$/, "Z");
+                return;
+            }
+            q[x.name] = x.value;
+        });
+        api("GET", "/api/admin/audit", q).then((res) => {
+            if (res.response !== "good") {
+                notify(res);
+                return;
+            }
+            res.events.forEach((x) => {
+                tb.append(`<tr class="${x.failed ? "negative" : ""}">
+                    <td>${esc(new Date(x.time).toLocaleString())}</td>
+                    <td>${esc(x.actor)}</td>
+                    <td>${esc(x.action)}</td>
+                    <td>${esc(x.target)}</td>
+                    <td>${esc(x.ip)}</td>
+                    <td>${esc(x.detail || "")}</td>
+                </tr>`);
+            });
+            $("#audit_more").toggle(res.events.length === auditPage);
+        });
+    }
+
+    function policyData(dryRun) {
+        const data = formData("#policy_form");
+        data.prune = data.prune ? "1" : "0";
+        data.dry_run = dryRun ? "1" : "0";
+        return data;
+    }
+
+    function previewPolicy() {
+        api("POST", "/api/admin/policy/import", policyData(true)).then((res) => {
+            const ul = $("#policy_changes").empty();
+            if (res.response !== "good") {
+                notify(res);
+                return;
+            }
+            (res.changes || []).forEach((x) => ul.append(`<li>${esc(x)}</li>`));
+            if (res.changes.length === 0) {
+                ul.append("<li>Nothing to change.</li>");
+            }
+        });
+    }
+
+    function indexText(x) {
+        switch (x && x.state) {
+            case "warming":
+                return `warming, ${x.files} files in ${x.dirs} folders scanned so far`;
+            case "ready":
+                return `ready, ${x.files} files scanned in ${x.finished - x.started}s`;
+        }
+        return "not started on this node";
+    }
+
+    function loadSettings() {
+        api("GET", "/api/admin/settings").then((res) => {
+            $("#readonly_warning").toggle(res.read_only);
+            $("#panic_count").text(res.panics);
+            $("#index_status").text(indexText(res.index));
+            $("#readonly_toggle")
+                .text(res.read_only ? "Disable Read-Only Mode" : "Enable Read-Only Mode")
+                .off("click")
+                .on("click", (e) => {
+                    e.preventDefault();
+                    post("/api/admin/read_only", { enabled: res.read_only ? "0" : "1" }).then(loadSettings);
+                });
+        });
+    }
+
+    $(document).ready(function() {
+        loadAccess();
+        loadRequests();
+        loadUsers();
+        loadShares();
+        loadLockouts();
+        loadLocal();
+        loadSettings();
+        loadStats();
+        setInterval(loadStats, 60000);
+        $("#config_reload").on("click", (e) => {
+            e.preventDefault();
+            post("/api/admin/reload", {}).then((res) => {
+                if (res.restart && res.restart.length > 0) {
+                    notify({ response: "good", message: `Reloaded the config. Restart to apply changes to: ${res.restart.join(", ")}` });
+                }
+            });
+        });
+        $("#mail_test").on("click", (e) => { e.preventDefault(); post("/api/admin/mail/test", {}); });
+        $("#sessions_show").on("click", (e) => { e.preventDefault(); loadSessions(); });
+        $("#downloads_show").on("click", (e) => { e.preventDefault(); loadDownloads(); });
+        $("#tab_downloads").one("toggle", loadTopDownloads);
+        $("#tab_trash").one("toggle", loadTrash);
+        $("#tab_integrity").one("toggle", loadIntegrity);
+        $("#audit_filter").on("submit", (e) => { e.preventDefault(); loadAudit(false); });
+        $("#audit_more").on("click", (e) => { e.preventDefault(); loadAudit(true); });
+        $("#tab_audit").one("toggle", () => loadAudit(false));
+        $("#tab_invites").one("toggle", loadInvites);
+        $("#invite_form").on("submit", function(e) {
+            e.preventDefault();
+            post("/api/admin/invites/create", formData(this)).then((res) => {
+                if (res.response === "good") {
+                    this.reset();
+                    loadInvites();
+                }
+            });
+        });
+        $("#policy_preview").on("click", (e) => { e.preventDefault(); previewPolicy(); });
+        $("#policy_import").on("click", (e) => {
+            e.preventDefault();
+            post("/api/admin/policy/import", policyData(false)).then(() => {
+                $("#policy_changes").empty();
+                loadAccess();
+                loadUsers();
+                loadShares();
+            });
+        });
+        // keep the scan progress current while it runs
+        setInterval(() => { if ($("#index_status").text().startsWith("warming")) loadSettings(); }, 5000);
+    });
+})();
@@ -0,0 +1,296 @@
+// Andesite frontend helpers
+// A small client for the JSON API, for the default pages and for themes to build on. Everything
+// on window.Andesite is a stable contract within a major version, check Andesite.version before
+// relying on anything newer. See the "JavaScript API" section of the README.
+(function() {
+    "use strict";
+
+    const script = document.currentScript;
+    // the bundle is always served from the root of httpBase
+    const base = script ? script.src.replace(/andesite\.js(\?.*)?$/, "") : "/";
+
+    // ApiError is thrown for responses with "response": "bad"
+    class ApiError extends Error {
+        constructor(res, status) {
+            super(res.message || ("HTTP " + status));
+            this.name = "ApiError";
+            this.status = status;
+            this.response = res;
+        }
+    }
+
+    // url resolves a site path such as "/api/search" against the base Andesite is served from
+    function url(path) {
+        return new URL(path.replace(/^\//, ""), base).toString();
+    }
+
+    // loginURL is the login page, bringing the user back to the current page afterwards
+    function loginURL() {
+        const u = new URL(location.href);
+        return url("/login") + "?" + new URLSearchParams({ next: u.pathname + u.search });
+    }
+
+    // api sends a request with the session cookie and returns the parsed JSON response. data is
+    // sent as a form for anything but GET, where it is added to the query string instead.
+    function api(method, path, data) {
+        let target = url(path);
+        const init = {
+            method: method,
+            credentials: "same-origin",
+            headers: { "Accept": "application/json" },
+        };
+        if (data !== undefined) {
+            if (method === "GET") {
+                target += (target.indexOf("?") === -1 ? "?" : "&") + new URLSearchParams(data);
+            } else {
+                init.body = data instanceof FormData ? data : new URLSearchParams(data);
+            }
+        }
+        return fetch(target, init).then((res) => {
+            if ((res.status === 401 || res.status === 403) && Andesite.onUnauthorized) {
+                Andesite.onUnauthorized(res);
+            }
+            return res.json().catch(() => ({ response: "bad", message: "HTTP " + res.status })).then((body) => {
+                if (body.response === "bad") {
+                    throw new ApiError(body, res.status);
+                }
+                return body;
+            });
+        });
+    }
+
+    // post is api("POST", ...) that asks the user to confirm destructive actions first. It
+    // resolves to null if they decline.
+    function post(path, data, confirmFn) {
+        const ask = confirmFn || ((changes) => window.confirm("The following changes will be made:\n\n" + changes.join("\n")));
+        return api("POST", path, data).then((res) => {
+            if (res.response !== "confirm") {
+                return res;
+            }
+            return Promise.resolve(ask(res.changes)).then((ok) => {
+                if (!ok) {
+                    return null;
+                }
+                return api("POST", path, Object.assign({}, data, { confirm: res.token }));
+            });
+        });
+    }
+
+    // list returns the entries of a directory, path like "/music/". Pass a share hash to list
+    // a directory of a share link instead.
+    function list(path, share) {
+        const dir = path.endsWith("/") ? path : path + "/";
+        const prefix = share ? "/open/" + share : "/files";
+        return api("GET", prefix + dir, { format: "json" }).then((res) => res.files);
+    }
+
+    // fileURL is the download link of a file or directory
+    function fileURL(path, share) {
+        return url((share ? "/open/" + share : "/files") + path);
+    }
+
+    // archiveURL is the link to download a directory as "zip" or "tar.zst"
+    function archiveURL(path, format, share) {
+        return fileURL(path.endsWith("/") ? path : path + "/", share) + "?archive=" + encodeURIComponent(format || "zip");
+    }
+
+    // capabilities asks the server which optional features it has, and updates supports to match
+    function capabilities() {
+        return api("GET", "/api/capabilities").then((res) => {
+            Andesite.supports.upload = !!res.uploads;
+            return res;
+        });
+    }
+
+    function search(q) {
+        return api("GET", "/api/search", { q: q });
+    }
+
+    function account() {
+        return api("GET", "/account");
+    }
+
+    // uploadChunkSize is how much of a file is sent per request, a failed chunk is all that is resent
+    const uploadChunkSize = 8 << 20;
+
+    // tus sends one request of the resumable upload protocol, failing on any error status
+    function tus(method, target, headers, body) {
+        return fetch(target, {
+            method: method,
+            credentials: "same-origin",
+            headers: Object.assign({ "Tus-Resumable": "1.0.0" }, headers),
+            body: body,
+        }).then((res) => {
+            if (res.status >= 400) {
+                if ((res.status === 401 || res.status === 403) && Andesite.onUnauthorized) {
+                    Andesite.onUnauthorized(res);
+                }
+                return res.text().then((msg) => { throw new ApiError({ response: "bad", message: msg.trim() }, res.status); });
+            }
+            return res;
+        });
+    }
+
+    // upload sends one file to the directory path. onProgress receives a number from 0 to 1.
+    // It is sent in chunks, and calling it again for the same file after a failure resumes
+    // where it stopped. Servers without uploads reject it, see Andesite.supports.
+    function upload(file, path, onProgress) {
+        if (!Andesite.supports.upload) {
+            return Promise.reject(new Error("This server does not accept uploads"));
+        }
+        const key = "andesite-upload:" + [path, file.name, file.size, file.lastModified].join(":");
+        const progress = (n) => { if (onProgress) onProgress(file.size === 0 ? 1 : n / file.size); };
+        const start = () => tus("POST", url("/api/upload"), {
+            "Upload-Length": String(file.size),
+            "Upload-Metadata": "filename " + btoa(unescape(encodeURIComponent(file.name))) + ",path " + btoa(unescape(encodeURIComponent(path))),
+        }).then((res) => {
+            const location = res.headers.get("Location");
+            localStorage.setItem(key, location);
+            return { location: location, offset: 0 };
+        });
+        const resume = () => {
+            const location = localStorage.getItem(key);
+            if (!location) {
+                return start();
+            }
+            return tus("HEAD", location, {})
+                .then((res) => ({ location: location, offset: parseInt(res.headers.get("Upload-Offset"), 10) }))
+                .catch(() => { localStorage.removeItem(key); return start(); });
+        };
+        // the server checks and moves a fully sent upload into place in the background
+        const finish = (location) => tus("HEAD", location, {}).then((res) => {
+            const status = res.headers.get("Andesite-Upload-Status");
+            if (status === "failed") {
+                throw new ApiError({ response: "bad", message: res.headers.get("Andesite-Upload-Error") }, 422);
+            }
+            if (status !== "done") {
+                return new Promise((resolve) => setTimeout(resolve, 1000)).then(() => finish(location));
+            }
+            localStorage.removeItem(key);
+            return { response: "good" };
+        });
+        const send = (location, offset) => {
+            progress(offset);
+            if (offset >= file.size) {
+                return finish(location);
+            }
+            return tus("PATCH", location, {
+                "Content-Type": "application/offset+octet-stream",
+                "Upload-Offset": String(offset),
+            }, file.slice(offset, offset + uploadChunkSize)).then((res) => send(location, parseInt(res.headers.get("Upload-Offset"), 10)));
+        };
+        return resume().then((up) => send(up.location, up.offset)).catch((err) => {
+            // an upload the server finished with an error can not be resumed
+            if (err.status && err.status !== 409 && err.status !== 423) {
+                localStorage.removeItem(key);
+            }
+            throw err;
+        });
+    }
+
+    // uploadWidget turns el into a drop zone and file picker that uploads into the directory path,
+    // calling opts.done after every file and opts.error on failures.
+    function uploadWidget(el, path, opts) {
+        const o = opts || {};
+        const input = document.createElement("input");
+        input.type = "file";
+        input.multiple = true;
+        input.style.display = "none";
+        const status = document.createElement("div");
+        el.appendChild(input);
+        el.appendChild(status);
+        el.classList.add("andesite-upload");
+
+        function send(files) {
+            Array.prototype.forEach.call(files, (f) => {
+                const row = document.createElement("div");
+                row.textContent = f.name;
+                status.appendChild(row);
+                upload(f, path, (p) => { row.textContent = f.name + " " + Math.round(p * 100) + "%"; })
+                    .then((res) => { row.textContent = f.name + " ✓"; if (o.done) o.done(f, res); })
+                    .catch((err) => { row.textContent = f.name + " ✗ " + err.message; if (o.error) o.error(f, err); });
+            });
+        }
+
+        el.addEventListener("click", (e) => { if (e.target === el) input.click(); });
+        input.addEventListener("change", () => { send(input.files); input.value = ""; });
+        el.addEventListener("dragover", (e) => { e.preventDefault(); el.classList.add("dragging"); });
+        el.addEventListener("dragleave", () => el.classList.remove("dragging"));
+        el.addEventListener("drop", (e) => {
+            e.preventDefault();
+            el.classList.remove("dragging");
+            send(e.dataTransfer.files);
+        });
+        return { send: send };
+    }
+
+    // passkeys move binary values as base64url strings
+    function fromB64url(s) {
+        const b = atob(s.replace(/-/g, "+").replace(/_/g, "/"));
+        return Uint8Array.from(b, (c) => c.charCodeAt(0));
+    }
+
+    function toB64url(buf) {
+        return btoa(String.fromCharCode.apply(null, new Uint8Array(buf))).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    }
+
+    // addPasskey creates a passkey on this device and adds it to the current account
+    function addPasskey(name) {
+        return api("POST", "/api/account/passkeys/begin").then((res) => {
+            const opts = res.publicKey;
+            opts.challenge = fromB64url(opts.challenge);
+            opts.user.id = fromB64url(opts.user.id);
+            opts.excludeCredentials.forEach((c) => { c.id = fromB64url(c.id); });
+            return navigator.credentials.create({ publicKey: opts });
+        }).then((cred) => api("POST", "/api/account/passkeys/finish", {
+            client_data: toB64url(cred.response.clientDataJSON),
+            attestation: toB64url(cred.response.attestationObject),
+            name: name || "",
+        }));
+    }
+
+    // loginWithPasskey asks the browser for any passkey of this site and logs in with it,
+    // resolving to the page to go to next
+    function loginWithPasskey() {
+        return api("POST", "/api/login/passkey/begin").then((res) => {
+            const opts = res.publicKey;
+            opts.challenge = fromB64url(opts.challenge);
+            return navigator.credentials.get({ publicKey: opts });
+        }).then((cred) => api("POST", "/api/login/passkey/finish", {
+            id: cred.id,
+            client_data: toB64url(cred.response.clientDataJSON),
+            authenticator_data: toB64url(cred.response.authenticatorData),
+            signature: toB64url(cred.response.signature),
+        })).then((res) => res.location);
+    }
+
+    // not frozen so that onUnauthorized and supports may be set
+    const Andesite = {
+        version: 1,
+        base: base,
+        // features of the server that not every version has, filled in as they are added
+        supports: {
+            upload: false,
+            passkeys: !!window.PublicKeyCredential,
+        },
+        ApiError: ApiError,
+        url: url,
+        loginURL: loginURL,
+        api: api,
+        post: post,
+        list: list,
+        fileURL: fileURL,
+        archiveURL: archiveURL,
+        capabilities: capabilities,
+        search: search,
+        account: account,
+        upload: upload,
+        uploadWidget: uploadWidget,
+        addPasskey: addPasskey,
+        loginWithPasskey: loginWithPasskey,
+        // set to a function to be called with every 401 and 403 response, such as one that sends
+        // the user to loginURL()
+        onUnauthorized: null,
+    };
+    window.Andesite = Andesite;
+})();